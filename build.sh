@@ -26,6 +26,8 @@ echo "Found ${#files[@]} Go file(s): ${files[*]}"
 
 # Build all Go tools and place binaries in bin directory
 for file in "${files[@]}"; do
+    # Tests are built by go test, not into tools
+    [[ "$file" == *_test.go ]] && continue
     name="${file%.go}"
     name="${name##*/}"
     echo "Building $name from $file..."
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ColorReset  = "\033[0m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
+)
+
+// SRVRecord is one domain controller advertised by a SRV lookup
+type SRVRecord struct {
+	Target   string `json:"target"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+type SRVResult struct {
+	Name     string      `json:"name"`
+	Required bool        `json:"required"`
+	Records  []SRVRecord `json:"records"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// PortCheck is one service probed on a domain controller
+type PortCheck struct {
+	Service  string  `json:"service"` // kerberos, ldap, smb or rpc
+	Protocol string  `json:"protocol"`
+	Port     int     `json:"port"`
+	Status   string  `json:"status"` // pass or fail
+	RTTMs    float64 `json:"rttMs"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+type DCResult struct {
+	Name          string      `json:"name"`
+	Address       string      `json:"address,omitempty"`
+	AdvertisedBy  []string    `json:"advertisedBy"`
+	Checks        []PortCheck `json:"checks"`
+	DNSHostName   string      `json:"dnsHostName,omitempty"`
+	NamingContext string      `json:"namingContext,omitempty"`
+	KDCReply      string      `json:"kdcReply,omitempty"`
+	ClockSkewSec  *float64    `json:"clockSkewSec,omitempty"` // DC time minus local time
+	SkewSource    string      `json:"skewSource,omitempty"`   // ldap or kerberos
+	Ready         bool        `json:"ready"`
+	Issues        []string    `json:"issues,omitempty"`
+}
+
+type ADReport struct {
+	Domain            string      `json:"domain"`
+	Realm             string      `json:"realm"`
+	Site              string      `json:"site,omitempty"`
+	DNSServer         string      `json:"dnsServer,omitempty"`
+	Source            string      `json:"source,omitempty"` // Local address used to reach the DCs
+	Subnet            string      `json:"subnet,omitempty"`
+	MaxSkewSec        float64     `json:"maxSkewSec"`
+	SRV               []SRVResult `json:"srv"`
+	DomainControllers []DCResult  `json:"domainControllers"`
+	Verdict           string      `json:"verdict"` // ready, degraded or not-ready
+	Issues            []string    `json:"issues"`
+	Healthy           bool        `json:"healthy"`
+}
+
+// berElement is one decoded BER value; LDAP and Kerberos both only need
+// single byte tags
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berTLV(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, part := range parts {
+		content = append(content, part...)
+	}
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func berInt(tag byte, v int64) []byte {
+	buf := binary.BigEndian.AppendUint64(nil, uint64(v))
+	// Drop leading bytes that only repeat the sign
+	for len(buf) > 1 && ((buf[0] == 0 && buf[1]&0x80 == 0) || (buf[0] == 0xff && buf[1]&0x80 != 0)) {
+		buf = buf[1:]
+	}
+	return berTLV(tag, buf)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func readBER(data []byte) (berElement, []byte, error) {
+	if len(data) < 2 {
+		return berElement{}, nil, errors.New("truncated BER value")
+	}
+	tag, length, data := data[0], int(data[1]), data[2:]
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count == 0 || count > 4 || len(data) < count {
+			return berElement{}, nil, errors.New("unsupported BER length")
+		}
+		length = 0
+		for _, b := range data[:count] {
+			length = length<<8 | int(b)
+		}
+		data = data[count:]
+	}
+	if length > len(data) {
+		return berElement{}, nil, errors.New("truncated BER value")
+	}
+	return berElement{tag: tag, content: data[:length]}, data[length:], nil
+}
+
+func berChildren(content []byte) ([]berElement, error) {
+	var children []berElement
+	for len(content) > 0 {
+		child, rest, err := readBER(content)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		content = rest
+	}
+	return children, nil
+}
+
+func berIntValue(content []byte) int64 {
+	var v int64
+	if len(content) > 0 && content[0]&0x80 != 0 {
+		v = -1
+	}
+	for _, b := range content {
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// readBERMessage reads one complete BER value from a stream
+func readBERMessage(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count == 0 || count > 4 {
+			return nil, errors.New("unsupported BER length")
+		}
+		extra := make([]byte, count)
+		if _, err := io.ReadFull(reader, extra); err != nil {
+			return nil, err
+		}
+		header = append(header, extra...)
+		length = 0
+		for _, b := range extra {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 1<<20 {
+		return nil, fmt.Errorf("BER message of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// parseGeneralizedTime reads the YYYYMMDDHHMMSS[.f]Z form that AD and
+// Kerberos use
+func parseGeneralizedTime(s string) (time.Time, error) {
+	if len(s) < 14 {
+		return time.Time{}, fmt.Errorf("bad time %q", s)
+	}
+	return time.ParseInLocation("20060102150405", s[:14], time.UTC)
+}
+
+// Kerberos error codes a probe for an unknown principal can get back
+var kdcErrors = map[int64]string{
+	6:  "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	12: "KDC_ERR_POLICY",
+	14: "KDC_ERR_ETYPE_NOSUPP",
+	24: "KDC_ERR_PREAUTH_FAILED",
+	25: "KDC_ERR_PREAUTH_REQUIRED",
+	37: "KRB_AP_ERR_SKEW",
+	52: "KRB_ERR_RESPONSE_TOO_BIG",
+	60: "KRB_ERR_GENERIC",
+	68: "KDC_ERR_WRONG_REALM",
+}
+
+func kerberosPrincipal(nameType int64, names ...string) []byte {
+	var parts [][]byte
+	for _, name := range names {
+		parts = append(parts, berString(0x1b, name)) // GeneralString
+	}
+	return berTLV(0x30, berTLV(0xa0, berInt(0x02, nameType)), berTLV(0xa1, berTLV(0x30, parts...)))
+}
+
+// asRequest builds an AS-REQ for a principal that should not exist. Any
+// KRB-ERROR back proves the KDC is serving the realm without needing an
+// account, and carries the KDC's clock.
+func asRequest(realm string) []byte {
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	body := berTLV(0x30,
+		berTLV(0xa0, berTLV(0x03, []byte{0, 0x40, 0, 0, 0})), // forwardable
+		berTLV(0xa1, kerberosPrincipal(1, "cloud-connect-probe")),
+		berTLV(0xa2, berString(0x1b, realm)),
+		berTLV(0xa3, kerberosPrincipal(2, "krbtgt", realm)),
+		berTLV(0xa5, berString(0x18, "20370913024805Z")),
+		berTLV(0xa7, berInt(0x02, int64(binary.BigEndian.Uint32(nonce)&0x7fffffff))),
+		berTLV(0xa8, berTLV(0x30, berInt(0x02, 18), berInt(0x02, 17), berInt(0x02, 23))),
+	)
+	return berTLV(0x6a, berTLV(0x30,
+		berTLV(0xa1, berInt(0x02, 5)),
+		berTLV(0xa2, berInt(0x02, 10)),
+		berTLV(0xa4, body),
+	))
+}
+
+// parseKDCReply returns the KDC's time and error name from a KRB-ERROR
+func parseKDCReply(reply []byte) (time.Time, string, error) {
+	outer, _, err := readBER(reply)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if outer.tag == 0x6b {
+		return time.Time{}, "AS-REP", nil
+	}
+	if outer.tag != 0x7e {
+		return time.Time{}, "", fmt.Errorf("not a Kerberos reply (tag 0x%02x)", outer.tag)
+	}
+	seq, _, err := readBER(outer.content)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	fields, err := berChildren(seq.content)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	var stime time.Time
+	code := int64(-1)
+	for _, field := range fields {
+		inner, _, err := readBER(field.content)
+		if err != nil {
+			continue
+		}
+		switch field.tag {
+		case 0xa4: // stime
+			stime, _ = parseGeneralizedTime(string(inner.content))
+		case 0xa6: // error-code
+			code = berIntValue(inner.content)
+		}
+	}
+	name, ok := kdcErrors[code]
+	if !ok {
+		name = fmt.Sprintf("KRB error %d", code)
+	}
+	return stime, name, nil
+}
+
+// clockSkew estimates the peer clock offset from a reply stamped at
+// whole seconds, assuming the stamp was taken half way through the RTT
+// and, on average, half way through its second
+func clockSkew(remote, sent time.Time, rtt time.Duration) float64 {
+	local := sent.Add(rtt / 2)
+	return math.Round(remote.Add(500*time.Millisecond).Sub(local).Seconds()*10) / 10
+}
+
+type kdcProbe struct {
+	check PortCheck
+	time  time.Time
+	sent  time.Time
+	rtt   time.Duration
+	reply string
+}
+
+func probeKDC(address, network, realm string, timeout time.Duration) kdcProbe {
+	probe := kdcProbe{check: PortCheck{Service: "kerberos", Protocol: network, Port: 88, Status: "fail"}}
+	conn, err := net.DialTimeout(network, net.JoinHostPort(address, "88"), timeout)
+	if err != nil {
+		probe.check.Detail = err.Error()
+		return probe
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := asRequest(realm)
+	if network == "tcp" {
+		request = append(binary.BigEndian.AppendUint32(nil, uint32(len(request))), request...)
+	}
+	probe.sent = time.Now()
+	if _, err := conn.Write(request); err != nil {
+		probe.check.Detail = err.Error()
+		return probe
+	}
+
+	var reply []byte
+	if network == "tcp" {
+		var length [4]byte
+		if _, err = io.ReadFull(conn, length[:]); err == nil {
+			size := binary.BigEndian.Uint32(length[:])
+			if size > 1<<20 {
+				err = fmt.Errorf("reply of %d bytes is too large", size)
+			} else {
+				reply = make([]byte, size)
+				_, err = io.ReadFull(conn, reply)
+			}
+		}
+	} else {
+		buf := make([]byte, 4096)
+		var n int
+		n, err = conn.Read(buf)
+		reply = buf[:n]
+	}
+	probe.rtt = time.Since(probe.sent)
+	if err != nil {
+		probe.check.Detail = "no reply: " + err.Error()
+		return probe
+	}
+
+	probe.check.RTTMs = roundMs(probe.rtt)
+	if probe.time, probe.reply, err = parseKDCReply(reply); err != nil {
+		probe.check.Detail = err.Error()
+		return probe
+	}
+	probe.check.Detail = probe.reply
+	if probe.reply == "KDC_ERR_WRONG_REALM" {
+		probe.check.Detail = fmt.Sprintf("does not serve realm %s", realm)
+		return probe
+	}
+	probe.check.Status = "pass"
+	return probe
+}
+
+type ldapProbe struct {
+	check         PortCheck
+	currentTime   time.Time
+	sent          time.Time
+	rtt           time.Duration
+	dnsHostName   string
+	namingContext string
+}
+
+// probeLDAP reads the rootDSE anonymously, which every DC allows
+func probeLDAP(address string, timeout time.Duration) ldapProbe {
+	probe := ldapProbe{check: PortCheck{Service: "ldap", Protocol: "tcp", Port: 389, Status: "fail"}}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, "389"), timeout)
+	if err != nil {
+		probe.check.Detail = err.Error()
+		return probe
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	search := berTLV(0x30,
+		berInt(0x02, 1),
+		berTLV(0x63,
+			berString(0x04, ""),                    // baseObject: rootDSE
+			berInt(0x0a, 0),                        // scope: baseObject
+			berInt(0x0a, 0),                        // derefAliases: never
+			berInt(0x02, 0),                        // sizeLimit
+			berInt(0x02, int64(timeout.Seconds())), // timeLimit
+			berTLV(0x01, []byte{0}),                // typesOnly
+			berString(0x87, "objectClass"),         // present filter
+			berTLV(0x30,
+				berString(0x04, "currentTime"),
+				berString(0x04, "dnsHostName"),
+				berString(0x04, "defaultNamingContext"),
+			),
+		),
+	)
+	probe.sent = time.Now()
+	if _, err := conn.Write(search); err != nil {
+		probe.check.Detail = err.Error()
+		return probe
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readBERMessage(reader)
+		if probe.rtt == 0 {
+			probe.rtt = time.Since(probe.sent)
+		}
+		if err != nil {
+			probe.check.Detail = "no rootDSE reply: " + err.Error()
+			return probe
+		}
+		envelope, _, err := readBER(msg)
+		if err != nil {
+			probe.check.Detail = err.Error()
+			return probe
+		}
+		parts, err := berChildren(envelope.content)
+		if err != nil || len(parts) < 2 {
+			probe.check.Detail = "malformed LDAP message"
+			return probe
+		}
+
+		switch op := parts[1]; op.tag {
+		case 0x64: // SearchResultEntry
+			fields, _ := berChildren(op.content)
+			if len(fields) < 2 {
+				continue
+			}
+			attributes, _ := berChildren(fields[1].content)
+			for _, attribute := range attributes {
+				pair, _ := berChildren(attribute.content)
+				if len(pair) < 2 {
+					continue
+				}
+				values, _ := berChildren(pair[1].content)
+				if len(values) == 0 {
+					continue
+				}
+				value := string(values[0].content)
+				switch strings.ToLower(string(pair[0].content)) {
+				case "currenttime":
+					probe.currentTime, _ = parseGeneralizedTime(value)
+				case "dnshostname":
+					probe.dnsHostName = value
+				case "defaultnamingcontext":
+					probe.namingContext = value
+				}
+			}
+		case 0x65: // SearchResultDone
+			result, _ := berChildren(op.content)
+			if len(result) > 0 && berIntValue(result[0].content) != 0 {
+				probe.check.Detail = fmt.Sprintf("rootDSE search failed with result code %d", berIntValue(result[0].content))
+				return probe
+			}
+			probe.check.RTTMs = roundMs(probe.rtt)
+			probe.check.Status = "pass"
+			return probe
+		}
+	}
+}
+
+func probeTCP(address, service string, port int, timeout time.Duration) PortCheck {
+	check := PortCheck{Service: service, Protocol: "tcp", Port: port, Status: "fail"}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, fmt.Sprint(port)), timeout)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	conn.Close()
+	check.RTTMs = roundMs(time.Since(start))
+	check.Status = "pass"
+	return check
+}
+
+func roundMs(d time.Duration) float64 {
+	return math.Round(float64(d.Microseconds())/100) / 10
+}
+
+// checkDC probes every service a domain-joined client needs on one DC
+func checkDC(ctx context.Context, resolver *net.Resolver, dc *DCResult, realm string, maxSkew, timeout time.Duration) {
+	lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+	addrs, err := resolver.LookupIPAddr(lookupCtx, dc.Name)
+	cancel()
+	if err != nil || len(addrs) == 0 {
+		dc.Issues = append(dc.Issues, fmt.Sprintf("%s does not resolve: %v", dc.Name, err))
+		return
+	}
+	// Prefer IPv4, which every DC listens on
+	address := addrs[0].IP.String()
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			address = addr.IP.String()
+			break
+		}
+	}
+	dc.Address = address
+
+	var (
+		wg             sync.WaitGroup
+		kdcUDP, kdcTCP kdcProbe
+		ldap           ldapProbe
+		smb, rpc       PortCheck
+	)
+	wg.Add(5)
+	go func() { defer wg.Done(); kdcUDP = probeKDC(address, "udp", realm, timeout) }()
+	go func() { defer wg.Done(); kdcTCP = probeKDC(address, "tcp", realm, timeout) }()
+	go func() { defer wg.Done(); ldap = probeLDAP(address, timeout) }()
+	go func() { defer wg.Done(); smb = probeTCP(address, "smb", 445, timeout) }()
+	go func() { defer wg.Done(); rpc = probeTCP(address, "rpc", 135, timeout) }()
+	wg.Wait()
+
+	dc.Checks = []PortCheck{kdcUDP.check, kdcTCP.check, ldap.check, smb, rpc}
+	dc.DNSHostName, dc.NamingContext = ldap.dnsHostName, ldap.namingContext
+	dc.KDCReply = kdcTCP.reply
+	if dc.KDCReply == "" {
+		dc.KDCReply = kdcUDP.reply
+	}
+
+	// LDAP currentTime is the DC's own clock; the KDC stamp is a fallback
+	var skew float64
+	switch {
+	case !ldap.currentTime.IsZero():
+		skew, dc.SkewSource = clockSkew(ldap.currentTime, ldap.sent, ldap.rtt), "ldap"
+	case !kdcTCP.time.IsZero():
+		skew, dc.SkewSource = clockSkew(kdcTCP.time, kdcTCP.sent, kdcTCP.rtt), "kerberos"
+	case !kdcUDP.time.IsZero():
+		skew, dc.SkewSource = clockSkew(kdcUDP.time, kdcUDP.sent, kdcUDP.rtt), "kerberos"
+	}
+	if dc.SkewSource != "" {
+		dc.ClockSkewSec = &skew
+		if math.Abs(skew) > maxSkew.Seconds() {
+			dc.Issues = append(dc.Issues, fmt.Sprintf("clock skew of %.0fs exceeds the %s Kerberos allows", skew, maxSkew))
+		}
+	} else {
+		dc.Issues = append(dc.Issues, "could not read the DC's clock")
+	}
+
+	for _, check := range dc.Checks {
+		if check.Status != "pass" {
+			dc.Issues = append(dc.Issues, fmt.Sprintf("%s %s/%d: %s", check.Service, check.Protocol, check.Port, check.Detail))
+		}
+	}
+	dc.Ready = len(dc.Issues) == 0
+}
+
+// localSubnet finds the address and interface network this host uses to
+// reach address, which is what the verdict applies to
+func localSubnet(address string) (string, string) {
+	conn, err := net.Dial("udp", net.JoinHostPort(address, "88"))
+	if err != nil {
+		return "", ""
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+			network := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+			return local.String(), network.String()
+		}
+	}
+	return local.String(), ""
+}
+
+func newResolver(server string, timeout time.Duration) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func runADCheck(domain, realm, site, dnsServer string, maxDCs int, maxSkew, timeout time.Duration) ADReport {
+	report := ADReport{
+		Domain:            domain,
+		Realm:             realm,
+		Site:              site,
+		DNSServer:         dnsServer,
+		MaxSkewSec:        maxSkew.Seconds(),
+		DomainControllers: []DCResult{},
+		Issues:            []string{},
+	}
+	resolver := newResolver(dnsServer, timeout)
+	ctx := context.Background()
+
+	type srvQuery struct {
+		service, proto, name string
+		required             bool
+	}
+	queries := []srvQuery{
+		{"ldap", "tcp", domain, true},
+		{"kerberos", "udp", domain, true},
+		{"kerberos", "tcp", domain, false},
+		{"ldap", "tcp", "dc._msdcs." + domain, false},
+	}
+	if site != "" {
+		queries = append(queries,
+			srvQuery{"ldap", "tcp", site + "._sites.dc._msdcs." + domain, true},
+			srvQuery{"kerberos", "tcp", site + "._sites.dc._msdcs." + domain, false})
+	}
+
+	// DCs keyed by name; the site's own DCs take precedence when it has any
+	advertised := map[string][]string{}
+	var order, siteDCs []string
+	for _, q := range queries {
+		result := SRVResult{Name: fmt.Sprintf("_%s._%s.%s", q.service, q.proto, q.name), Required: q.required, Records: []SRVRecord{}}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		_, records, err := resolver.LookupSRV(lookupCtx, q.service, q.proto, q.name)
+		cancel()
+		if err != nil {
+			// The Go resolver names the system server even when -dns is set
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) {
+				err = errors.New(dnsErr.Err)
+			}
+			result.Error = err.Error()
+			severity := "missing"
+			if !q.required {
+				severity = "missing (optional)"
+			}
+			report.Issues = append(report.Issues, fmt.Sprintf("SRV %s %s: %v", result.Name, severity, err))
+		}
+		for _, record := range records {
+			target := strings.ToLower(strings.TrimSuffix(record.Target, "."))
+			result.Records = append(result.Records, SRVRecord{Target: target, Port: record.Port, Priority: record.Priority, Weight: record.Weight})
+			if len(advertised[target]) == 0 {
+				order = append(order, target)
+			}
+			advertised[target] = append(advertised[target], result.Name)
+			if site != "" && strings.Contains(q.name, "._sites.") && !contains(siteDCs, target) {
+				siteDCs = append(siteDCs, target)
+			}
+		}
+		report.SRV = append(report.SRV, result)
+	}
+
+	candidates := order
+	if len(siteDCs) > 0 {
+		candidates = siteDCs
+	}
+	if len(candidates) > maxDCs {
+		report.Issues = append(report.Issues, fmt.Sprintf("testing %d of %d domain controllers (-max-dcs)", maxDCs, len(candidates)))
+		candidates = candidates[:maxDCs]
+	}
+
+	report.DomainControllers = make([]DCResult, len(candidates))
+	var wg sync.WaitGroup
+	for i, name := range candidates {
+		report.DomainControllers[i] = DCResult{Name: name, AdvertisedBy: advertised[name], Checks: []PortCheck{}}
+		wg.Add(1)
+		go func(dc *DCResult) {
+			defer wg.Done()
+			checkDC(ctx, resolver, dc, realm, maxSkew, timeout)
+		}(&report.DomainControllers[i])
+	}
+	wg.Wait()
+
+	ready := 0
+	for _, dc := range report.DomainControllers {
+		if dc.Ready {
+			ready++
+		}
+		if report.Source == "" && dc.Address != "" {
+			report.Source, report.Subnet = localSubnet(dc.Address)
+		}
+	}
+
+	requiredMissing := false
+	for _, srv := range report.SRV {
+		if srv.Required && len(srv.Records) == 0 {
+			requiredMissing = true
+		}
+	}
+	switch {
+	case len(candidates) == 0:
+		report.Verdict = "not-ready"
+		report.Issues = append(report.Issues, "no domain controllers found in DNS")
+	case ready == 0:
+		report.Verdict = "not-ready"
+		report.Issues = append(report.Issues, "no domain controller passed every check")
+	case requiredMissing || ready < len(report.DomainControllers) || len(report.Issues) > 0:
+		report.Verdict = "degraded"
+		if ready < len(report.DomainControllers) {
+			report.Issues = append(report.Issues, fmt.Sprintf("%d of %d domain controllers usable", ready, len(report.DomainControllers)))
+		}
+	default:
+		report.Verdict = "ready"
+	}
+	report.Healthy = report.Verdict == "ready"
+	return report
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func renderADTable(report ADReport) {
+	fmt.Printf("Active Directory readiness for %s (realm %s)", report.Domain, report.Realm)
+	if report.Subnet != "" {
+		fmt.Printf(" from %s (%s)", report.Source, report.Subnet)
+	} else if report.Source != "" {
+		fmt.Printf(" from %s", report.Source)
+	}
+	fmt.Print("\n\n")
+
+	for _, srv := range report.SRV {
+		status := fmt.Sprintf("%s%d record(s)%s", ColorGreen, len(srv.Records), ColorReset)
+		if len(srv.Records) == 0 {
+			color := ColorYellow
+			if srv.Required {
+				color = ColorRed
+			}
+			status = color + "missing" + ColorReset
+		}
+		fmt.Printf("  %-55s %s\n", srv.Name, status)
+	}
+	fmt.Println()
+
+	if len(report.DomainControllers) > 0 {
+		renderDCRows(report.DomainControllers)
+	}
+	for _, issue := range report.Issues {
+		fmt.Printf("  %s\n", issue)
+	}
+
+	color := ColorGreen
+	switch report.Verdict {
+	case "degraded":
+		color = ColorYellow
+	case "not-ready":
+		color = ColorRed
+	}
+	fmt.Printf("\nVerdict: %s%s%s\n", color, strings.ToUpper(report.Verdict), ColorReset)
+}
+
+func renderDCRows(dcs []DCResult) {
+	nameWidth := len("DOMAIN CONTROLLER")
+	for _, dc := range dcs {
+		if len(dc.Name) > nameWidth {
+			nameWidth = len(dc.Name)
+		}
+	}
+	fmt.Printf("%-*s  %-15s  %-9s%-9s%-9s%-9s%-9s%-8s%s\n", nameWidth, "DOMAIN CONTROLLER", "ADDRESS",
+		"KRB/UDP", "KRB/TCP", "LDAP", "SMB", "RPC", "SKEW", "RESULT")
+	for _, dc := range dcs {
+		fmt.Printf("%-*s  %-15s  ", nameWidth, dc.Name, dc.Address)
+		for i := 0; i < 5; i++ {
+			text, color := "-", ""
+			if i < len(dc.Checks) {
+				text, color = dc.Checks[i].Status, ColorGreen
+				if text != "pass" {
+					color = ColorRed
+				}
+			}
+			if color == "" {
+				fmt.Printf("%-9s", text)
+			} else {
+				fmt.Printf("%s%-9s%s", color, text, ColorReset)
+			}
+		}
+		skew := "-"
+		if dc.ClockSkewSec != nil {
+			skew = fmt.Sprintf("%+.0fs", *dc.ClockSkewSec)
+		}
+		fmt.Printf("%-8s", skew)
+		if dc.Ready {
+			fmt.Println(ColorGreen + "READY" + ColorReset)
+		} else {
+			fmt.Println(ColorRed + "FAIL" + ColorReset)
+		}
+	}
+
+	for _, dc := range dcs {
+		for _, issue := range dc.Issues {
+			fmt.Printf("  %s: %s\n", dc.Name, issue)
+		}
+	}
+}
+
+func main() {
+	realm := flag.String("realm", "", "Kerberos realm (default: the domain in upper case)")
+	site := flag.String("site", "", "AD site of this subnet; its site-specific DCs are tested when advertised")
+	dnsServer := flag.String("dns", "", "DNS server for the SRV lookups (default: system resolver)")
+	maxSkew := flag.Duration("max-skew", 5*time.Minute, "Largest clock difference to a DC that Kerberos tolerates")
+	maxDCs := flag.Int("max-dcs", 10, "Most domain controllers to test")
+	timeout := flag.Duration("timeout", 3*time.Second, "Timeout per lookup and probe")
+	table := flag.Bool("table", false, "Render a readiness table instead of JSON")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: adcheck [options] <domain>")
+		fmt.Println("Example: adcheck -table corp.example.com")
+		fmt.Println("         adcheck -site Frankfurt -dns 10.0.0.10 corp.example.com")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *maxDCs < 1 {
+		*maxDCs = 1
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(flag.Arg(0), "."))
+	if *realm == "" {
+		*realm = strings.ToUpper(domain)
+	}
+
+	report := runADCheck(domain, *realm, *site, *dnsServer, *maxDCs, *maxSkew, *timeout)
+	sort.SliceStable(report.DomainControllers, func(i, j int) bool {
+		return report.DomainControllers[i].Ready && !report.DomainControllers[j].Ready
+	})
+
+	if *table {
+		renderADTable(report)
+	} else {
+		json.NewEncoder(os.Stdout).Encode(report)
+	}
+	if report.Verdict == "not-ready" {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The agent protocol is shared by every tool that answers requests from
+// other hosts: this agent, connectivity's mtu-agent and selfcheck -serve.
+// A client opens a TCP connection, writes one JSON request naming its op
+// and reads one JSON response; a response with "error" set failed, and
+// "busy" means the agent turned the request away and another agent should
+// be tried. Requests must arrive within agentReadTimeout. When
+// CLOUD_CONNECT_AGENT_TOKEN (or -token-file here) is set, requests must
+// carry the same token. mtu and selfcheck only ever probe the connecting
+// peer; check reaches any target, so it is refused unless a token is set.
+//
+// Ops: ping (name, labels and load, used as the controller's heartbeat),
+// check (run a one-shot tool), mtu (measure the path MTU back to the
+// peer) and selfcheck (connect back to the peer's ports).
+
+const (
+	agentDefaultListen   = ":7790"
+	agentReadTimeout     = 10 * time.Second
+	agentCheckTimeout    = 2 * time.Minute
+	agentMaxCheckTimeout = 12 * time.Hour // Long enough for a time-boxed net-grab shard
+	agentTokenEnv        = "CLOUD_CONNECT_AGENT_TOKEN"
+	maxAgentPorts        = 4096
+	agentConcurrency     = 100 // Ports probed at once for one selfcheck request
+)
+
+var agentOps = []string{"ping", "check", "mtu", "selfcheck"}
+
+// agentRequest is the envelope every agent op uses; fields an op does not
+// need are left out
+type agentRequest struct {
+	Op        string   `json:"op"`
+	Token     string   `json:"token,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+	Tool      string   `json:"tool,omitempty"`  // check
+	Args      []string `json:"args,omitempty"`  // check
+	Ports     []int    `json:"ports,omitempty"` // selfcheck
+}
+
+// agentResponse answers ping and check; mtu and selfcheck answer with the
+// same documents connectivity and selfcheck's own agents send
+type agentResponse struct {
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Ops      []string          `json:"ops,omitempty"`
+	Running  int               `json:"running"`
+	Capacity int               `json:"capacity"`
+	ExitCode int               `json:"exitCode"`
+	Result   json.RawMessage   `json:"result,omitempty"`
+	Busy     bool              `json:"busy,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type PortProbe struct {
+	Port  int     `json:"port"`
+	State string  `json:"state"` // open, closed or filtered
+	RTTMs float64 `json:"rttMs,omitempty"`
+}
+
+type selfcheckResponse struct {
+	Observed string      `json:"observed"`
+	Probes   []PortProbe `json:"probes"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Tools a check may run: each prints one JSON result and exits
+var agentTools = map[string]bool{
+	"adcheck": true, "connectivity": true, "dns": true, "http-test": true, "interfaces": true, "net-grab": true,
+	"portscan": true, "quicprobe": true, "reputation": true, "traceroute": true, "vpnprobe": true, "webrtc": true,
+}
+
+// hasFlag reports whether args set any of the named flags, in any of the
+// -name, --name or -name=value forms the flag package accepts
+func hasFlag(args []string, names ...string) bool {
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "=")
+		for _, n := range names {
+			if name == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Modes of the check tools that print one result and exit, by the
+// positional argument that selects them, as verify -batch allows them
+var agentToolModes = map[string]struct {
+	index int
+	modes map[string]bool
+}{
+	"connectivity": {1, map[string]bool{"ping": true, "tcp": true, "udp": true, "all": true, "multicast": true, "mtu": true, "dialog": true}},
+}
+
+// checkArgsAllowed rejects tools outside agentTools and the modes of
+// allowed tools that keep running instead of printing one result
+func checkArgsAllowed(tool string, args []string) error {
+	if !agentTools[tool] {
+		return fmt.Errorf("tool %q cannot run as a check", tool)
+	}
+	if mode, ok := agentToolModes[tool]; ok {
+		if len(args) <= mode.index || !mode.modes[args[mode.index]] {
+			return fmt.Errorf("%s: only one-shot modes run as checks", tool)
+		}
+	}
+	switch {
+	case tool == "interfaces" && hasFlag(args, "watch"):
+		return fmt.Errorf("interfaces -watch does not exit")
+	case tool == "http-test" && len(args) >= 3 && args[0] == "scenario":
+		return fmt.Errorf("http-test scenario with an interval does not exit; schedule the scenario instead")
+	case tool == "net-grab" && hasFlag(args, "daemon"):
+		return fmt.Errorf("net-grab -daemon does not exit")
+	}
+	return nil
+}
+
+// runSiblingTool runs a tool binary from the agent's own directory and
+// returns its exit code and the JSON it printed. Tools that print a
+// summary before the JSON (net-grab) are read from their last line.
+func runSiblingTool(tool string, args []string, timeout time.Duration) (int, json.RawMessage, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+	path := filepath.Join(filepath.Dir(self), tool)
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		return exitCode, nil, fmt.Errorf("%s: no result within %s", tool, timeout)
+	}
+
+	output = bytes.TrimSpace(output)
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 && !json.Valid(output) {
+		output = bytes.TrimSpace(output[i+1:])
+	}
+	if len(output) > 0 && json.Valid(output) {
+		return exitCode, output, nil
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return exitCode, nil, fmt.Errorf("%s: %v: %s", tool, err, detail)
+		}
+		return exitCode, nil, fmt.Errorf("%s: %v", tool, err)
+	}
+	return exitCode, nil, fmt.Errorf("%s did not print a JSON result", tool)
+}
+
+// loadAgentToken reads the shared token from a file (first non-empty
+// line) or the environment; tokens never go on the command line
+func loadAgentToken(file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(agentTokenEnv)), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%s holds no token", file)
+}
+
+func probePort(address string, port int, timeout time.Duration) PortProbe {
+	probe := PortProbe{Port: port}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(port)), timeout)
+	if err == nil {
+		conn.Close()
+		probe.State = "open"
+		probe.RTTMs = float64(time.Since(start).Microseconds()) / 1000
+		return probe
+	}
+	if strings.Contains(err.Error(), "refused") {
+		probe.State = "closed"
+	} else {
+		probe.State = "filtered"
+	}
+	return probe
+}
+
+type agentServer struct {
+	name    string
+	labels  map[string]string
+	token   string
+	running chan struct{} // Ops in progress; a full channel turns requests away
+}
+
+func (s *agentServer) serve(listen string) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Agent %s listening on %s (labels: %s)\n", s.name, listener.Addr(), formatLabels(s.labels))
+	if s.token == "" {
+		fmt.Fprintf(os.Stderr, "No %s or -token-file set: only ping, mtu and selfcheck are served\n", agentTokenEnv)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *agentServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	encoder := json.NewEncoder(conn)
+	peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.token)) != 1 {
+		encoder.Encode(agentResponse{Error: "invalid token"})
+		return
+	}
+	if req.Op == "ping" {
+		encoder.Encode(agentResponse{Name: s.name, Labels: s.labels, Ops: agentOps, Running: len(s.running), Capacity: cap(s.running)})
+		return
+	}
+
+	select {
+	case s.running <- struct{}{}:
+		defer func() { <-s.running }()
+	default:
+		encoder.Encode(agentResponse{Busy: true, Running: len(s.running), Capacity: cap(s.running),
+			Error: fmt.Sprintf("agent busy with %d requests", cap(s.running))})
+		return
+	}
+
+	switch req.Op {
+	case "check":
+		encoder.Encode(s.check(req, peer))
+	case "mtu":
+		encoder.Encode(s.mtu(req, conn, peer))
+	case "selfcheck":
+		encoder.Encode(s.selfcheck(req, peer))
+	default:
+		encoder.Encode(agentResponse{Error: fmt.Sprintf("unknown op %q (agent ops: %s)", req.Op, strings.Join(agentOps, ", "))})
+	}
+}
+
+func (s *agentServer) check(req agentRequest, peer string) agentResponse {
+	if s.token == "" {
+		return agentResponse{Error: "checks need a shared token on the agent"}
+	}
+	if err := checkArgsAllowed(req.Tool, req.Args); err != nil {
+		return agentResponse{Error: err.Error()}
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = agentCheckTimeout
+	} else if timeout > agentMaxCheckTimeout {
+		timeout = agentMaxCheckTimeout
+	}
+
+	start := time.Now()
+	code, result, err := runSiblingTool(req.Tool, req.Args, timeout)
+	fmt.Fprintf(os.Stderr, "Ran %s %s for %s in %s\n", req.Tool, strings.Join(req.Args, " "), peer, time.Since(start).Round(time.Millisecond))
+	response := agentResponse{Name: s.name, ExitCode: code, Result: result}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+// mtu measures towards the peer with connectivity and answers with the
+// forward direction, which is the peer's reverse path
+func (s *agentServer) mtu(req agentRequest, conn net.Conn, peer string) interface{} {
+	seconds := req.TimeoutMs / 1000
+	if seconds < 1 || seconds > 10 {
+		seconds = 2
+	}
+	failed := map[string]interface{}{"from": s.name, "to": peer, "probes": []interface{}{}}
+	_, result, err := runSiblingTool("connectivity", []string{peer, "mtu", "0", strconv.Itoa(seconds)}, 5*time.Minute)
+	if err != nil {
+		failed["error"] = err.Error()
+		return failed
+	}
+	var measured struct {
+		MTU *struct {
+			Forward map[string]interface{} `json:"forward"`
+		} `json:"mtu"`
+	}
+	if err := json.Unmarshal(result, &measured); err != nil || measured.MTU == nil || measured.MTU.Forward == nil {
+		failed["error"] = "connectivity returned no MTU measurement"
+		return failed
+	}
+	measured.MTU.Forward["from"] = conn.LocalAddr().(*net.TCPAddr).IP.String()
+	measured.MTU.Forward["to"] = peer
+	return measured.MTU.Forward
+}
+
+func (s *agentServer) selfcheck(req agentRequest, peer string) selfcheckResponse {
+	response := selfcheckResponse{Observed: peer, Probes: []PortProbe{}}
+	if len(req.Ports) > maxAgentPorts {
+		response.Error = fmt.Sprintf("at most %d ports per request", maxAgentPorts)
+		return response
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout < 500*time.Millisecond || timeout > 10*time.Second {
+		timeout = 3 * time.Second
+	}
+
+	probes := make([]PortProbe, len(req.Ports))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, agentConcurrency)
+	for i, port := range req.Ports {
+		if port < 1 || port > 65535 {
+			probes[i] = PortProbe{Port: port, State: "invalid"}
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i, port int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			probes[i] = probePort(peer, port, timeout)
+		}(i, port)
+	}
+	wg.Wait()
+	response.Probes = probes
+	fmt.Fprintf(os.Stderr, "Probed %d ports on %s\n", len(probes), peer)
+	return response
+}
+
+// askAgentOp sends one request to an agent and decodes its response
+func askAgentOp(address string, req agentRequest, deadline time.Duration, response interface{}) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deadline))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	return json.NewDecoder(conn).Decode(response)
+}
+
+// Controller mode assigns scheduled checks to agents. Agents are pinged
+// every heartbeat; one that misses silentAfter heartbeats in a row (or
+// stops answering a check) is silent, and its checks fail over to the
+// next eligible agent until it answers again.
+
+type controllerConfig struct {
+	Heartbeat   string           `json:"heartbeat"`   // Default 10s
+	SilentAfter int              `json:"silentAfter"` // Missed heartbeats, default 3
+	Agents      []agentConfig    `json:"agents"`
+	Checks      []scheduledCheck `json:"checks"`
+}
+
+type agentConfig struct {
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels"` // Override the labels the agent reports
+	Weight  int               `json:"weight"` // For the weighted strategy, default 1
+}
+
+type scheduledCheck struct {
+	Name     string            `json:"name"`
+	Tool     string            `json:"tool"`
+	Args     []string          `json:"args"`
+	Every    string            `json:"every"`   // Default 1m
+	Timeout  string            `json:"timeout"` // Default 2m
+	Select   map[string]string `json:"select"`  // Labels an agent must have, e.g. {"zone": "us-east-1a"}
+	Strategy string            `json:"strategy"`
+	every    time.Duration
+	timeout  time.Duration
+}
+
+// Check strategies: round-robin takes eligible agents in turn, weighted
+// in proportion to their weights, and spread runs the check on every
+// eligible agent at once as a net-grab -agents/-agent shard
+var checkStrategies = map[string]bool{"round-robin": true, "weighted": true, "spread": true}
+
+// CheckRun is one run of a scheduled check, printed as a JSON line
+type CheckRun struct {
+	Time     time.Time       `json:"time"`
+	Check    string          `json:"check"`
+	Agent    string          `json:"agent,omitempty"`
+	Shard    string          `json:"shard,omitempty"`    // "2/3" for a spread check
+	Failover []string        `json:"failover,omitempty"` // Agents tried first that did not answer or were busy
+	ExitCode int             `json:"exitCode"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type agentState struct {
+	agentConfig
+	labels map[string]string // Reported by the agent, overridden by the config
+	missed int
+	silent bool
+}
+
+type controller struct {
+	mu          sync.Mutex
+	agents      []*agentState
+	silentAfter int
+	token       string
+	cursors     map[string]int            // Round-robin position per check
+	weights     map[string]map[string]int // Smooth weighted round-robin state per check
+	output      *json.Encoder
+}
+
+// loadControllerConfig reads the controller config from a file, or stdin
+// for "-"
+func loadControllerConfig(path string) (*controllerConfig, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config controllerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(config.Agents) == 0 || len(config.Checks) == 0 {
+		return nil, fmt.Errorf("%s needs at least one agent and one check", path)
+	}
+	if config.SilentAfter < 1 {
+		config.SilentAfter = 3
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Agents {
+		a := &config.Agents[i]
+		if a.Address == "" {
+			return nil, fmt.Errorf("agent %d has no address", i+1)
+		}
+		if _, _, err := net.SplitHostPort(a.Address); err != nil {
+			a.Address = net.JoinHostPort(a.Address, strings.TrimPrefix(agentDefaultListen, ":"))
+		}
+		if a.Name == "" {
+			a.Name = a.Address
+		}
+		if names[a.Name] {
+			return nil, fmt.Errorf("agent name %q is used twice", a.Name)
+		}
+		names[a.Name] = true
+		if a.Weight < 1 {
+			a.Weight = 1
+		}
+	}
+
+	for i := range config.Checks {
+		c := &config.Checks[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", c.Tool, i+1)
+		}
+		if c.Strategy == "" {
+			c.Strategy = "round-robin"
+		}
+		if !checkStrategies[c.Strategy] {
+			return nil, fmt.Errorf("check %s: unknown strategy %q (use round-robin, weighted or spread)", c.Name, c.Strategy)
+		}
+		if c.Strategy == "spread" && c.Tool != "net-grab" {
+			return nil, fmt.Errorf("check %s: only net-grab scans can be spread across agents", c.Name)
+		}
+		if err := checkArgsAllowed(c.Tool, c.Args); err != nil {
+			return nil, fmt.Errorf("check %s: %v", c.Name, err)
+		}
+		if c.every, err = parseDurationDefault(c.Every, time.Minute); err != nil {
+			return nil, fmt.Errorf("check %s: every: %v", c.Name, err)
+		}
+		if c.timeout, err = parseDurationDefault(c.Timeout, agentCheckTimeout); err != nil {
+			return nil, fmt.Errorf("check %s: timeout: %v", c.Name, err)
+		}
+	}
+	return &config, nil
+}
+
+func parseDurationDefault(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// heartbeat pings every agent once and updates which are silent
+func (c *controller) heartbeat(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, agent := range c.agents {
+		wg.Add(1)
+		go func(agent *agentState) {
+			defer wg.Done()
+			var response agentResponse
+			err := askAgentOp(agent.Address, agentRequest{Op: "ping", Token: c.token}, timeout, &response)
+			if err == nil && response.Error != "" {
+				err = fmt.Errorf("%s", response.Error)
+			}
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if err != nil {
+				c.missLocked(agent, err)
+				return
+			}
+			agent.labels = make(map[string]string)
+			for k, v := range response.Labels {
+				agent.labels[k] = v
+			}
+			for k, v := range agent.Labels {
+				agent.labels[k] = v
+			}
+			agent.missed = 0
+			if agent.silent {
+				agent.silent = false
+				fmt.Fprintf(os.Stderr, "Agent %s is answering again\n", agent.Name)
+			}
+		}(agent)
+	}
+	wg.Wait()
+}
+
+// missLocked counts a missed heartbeat or check; c.mu must be held
+func (c *controller) missLocked(agent *agentState, err error) {
+	agent.missed++
+	if !agent.silent && agent.missed >= c.silentAfter {
+		agent.silent = true
+		fmt.Fprintf(os.Stderr, "Agent %s went silent (%v); its checks fail over to other agents\n", agent.Name, err)
+	}
+}
+
+// eligible lists the live agents whose labels match the check's selector,
+// ordered by the check's strategy: the agent to try first comes first
+func (c *controller) eligible(check *scheduledCheck) []*agentState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var agents []*agentState
+	for _, agent := range c.agents {
+		if agent.silent {
+			continue
+		}
+		matches := true
+		for k, v := range check.Select {
+			if agent.labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			agents = append(agents, agent)
+		}
+	}
+	if len(agents) < 2 {
+		return agents
+	}
+
+	switch check.Strategy {
+	case "round-robin":
+		start := c.cursors[check.Name] % len(agents)
+		c.cursors[check.Name]++
+		return append(agents[start:], agents[:start]...)
+	case "weighted":
+		// Smooth weighted round-robin: every agent gains its weight, the
+		// leader is picked and pays back the total
+		current := c.weights[check.Name]
+		if current == nil {
+			current = make(map[string]int)
+			c.weights[check.Name] = current
+		}
+		total := 0
+		for _, agent := range agents {
+			current[agent.Name] += agent.Weight
+			total += agent.Weight
+		}
+		sort.SliceStable(agents, func(i, j int) bool { return current[agents[i].Name] > current[agents[j].Name] })
+		current[agents[0].Name] -= total
+	}
+	return agents
+}
+
+// runOn sends the check to each candidate in turn until one answers
+func (c *controller) runOn(check *scheduledCheck, args []string, candidates []*agentState) CheckRun {
+	run := CheckRun{Time: time.Now().UTC(), Check: check.Name}
+	for _, agent := range candidates {
+		var response agentResponse
+		req := agentRequest{Op: "check", Token: c.token, Tool: check.Tool, Args: args, TimeoutMs: int(check.timeout.Milliseconds())}
+		err := askAgentOp(agent.Address, req, check.timeout+agentReadTimeout, &response)
+		if err != nil {
+			c.mu.Lock()
+			c.missLocked(agent, err)
+			c.mu.Unlock()
+			run.Failover = append(run.Failover, agent.Name)
+			continue
+		}
+		if response.Busy {
+			run.Failover = append(run.Failover, agent.Name)
+			continue
+		}
+		run.Agent, run.ExitCode, run.Result, run.Error = agent.Name, response.ExitCode, response.Result, response.Error
+		return run
+	}
+	run.Error = "no eligible agent answered"
+	return run
+}
+
+func (c *controller) emit(run CheckRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.output.Encode(run)
+}
+
+// runCheck runs one scheduled check; a spread check runs one shard per
+// eligible agent, each falling back to the agents after it
+func (c *controller) runCheck(check *scheduledCheck) {
+	agents := c.eligible(check)
+	if check.Strategy != "spread" {
+		c.emit(c.runOn(check, check.Args, agents))
+		return
+	}
+	if len(agents) == 0 {
+		c.emit(CheckRun{Time: time.Now().UTC(), Check: check.Name, Error: "no eligible agent answered"})
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range agents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Flags go before the CIDR, which ends net-grab's flag parsing
+			args := append([]string{"-agents", strconv.Itoa(len(agents)), "-agent", strconv.Itoa(i + 1)}, check.Args...)
+			candidates := append(append([]*agentState{}, agents[i:]...), agents[:i]...)
+			run := c.runOn(check, args, candidates)
+			run.Shard = fmt.Sprintf("%d/%d", i+1, len(agents))
+			c.emit(run)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func runController(config *controllerConfig, token string, once bool) error {
+	heartbeat, err := parseDurationDefault(config.Heartbeat, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("heartbeat: %v", err)
+	}
+	c := &controller{
+		silentAfter: config.SilentAfter,
+		token:       token,
+		cursors:     make(map[string]int),
+		weights:     make(map[string]map[string]int),
+		output:      json.NewEncoder(os.Stdout),
+	}
+	for _, agent := range config.Agents {
+		c.agents = append(c.agents, &agentState{agentConfig: agent, labels: agent.Labels})
+	}
+
+	pingTimeout := heartbeat / 2
+	if pingTimeout > 5*time.Second {
+		pingTimeout = 5 * time.Second
+	}
+	c.heartbeat(pingTimeout)
+
+	if once {
+		var wg sync.WaitGroup
+		for i := range config.Checks {
+			wg.Add(1)
+			go func(check *scheduledCheck) {
+				defer wg.Done()
+				c.runCheck(check)
+			}(&config.Checks[i])
+		}
+		wg.Wait()
+		return nil
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	for i := range config.Checks {
+		go func(check *scheduledCheck) {
+			ticker := time.NewTicker(check.every)
+			defer ticker.Stop()
+			for {
+				c.runCheck(check)
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}
+		}(&config.Checks[i])
+	}
+
+	fmt.Fprintf(os.Stderr, "Scheduling %d checks across %d agents (heartbeat %s)\n", len(config.Checks), len(config.Agents), heartbeat)
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.heartbeat(pingTimeout)
+		case <-stop:
+			close(done)
+			return nil
+		}
+	}
+}
+
+func parseLabels(spec string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("label %q should look like key=value", part)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "none"
+	}
+	parts := make([]string, 0, len(labels))
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func main() {
+	listen := flag.String("listen", agentDefaultListen, "Address the agent listens on")
+	name := flag.String("name", "", "Agent name reported to the controller (default: hostname)")
+	labelsArg := flag.String("labels", "", "Agent labels for check selection, e.g. zone=us-east-1a,role=edge")
+	maxOps := flag.Int("max-ops", 8, "Requests the agent runs at once; more are answered busy so the controller fails over")
+	tokenFile := flag.String("token-file", "", "File with the shared token (default: "+agentTokenEnv+")")
+	controllerPath := flag.String("controller", "", "Run as the controller with this JSON config (agents and checks), or - for stdin")
+	once := flag.Bool("once", false, "With -controller, run every check once and exit")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		fmt.Println("Usage: agent [options]")
+		fmt.Println("       agent -controller <config.json> [-once]")
+		fmt.Println("Example: CLOUD_CONNECT_AGENT_TOKEN=... agent -labels zone=us-east-1a -listen :7790")
+		fmt.Println("         CLOUD_CONNECT_AGENT_TOKEN=... agent -controller checks.json > runs.jsonl")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	token, err := loadAgentToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading token file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *controllerPath != "" {
+		config, err := loadControllerConfig(*controllerPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := runController(config, token, *once); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	labels, err := parseLabels(*labelsArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+	if *maxOps < 1 {
+		*maxOps = 1
+	}
+	server := &agentServer{name: *name, labels: labels, token: token, running: make(chan struct{}, *maxOps)}
+	if err := server.serve(*listen); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
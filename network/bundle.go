@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BundleEntry describes one file in the bundle and how it was produced
+type BundleEntry struct {
+	Name       string   `json:"name"`
+	File       string   `json:"file"`
+	Kind       string   `json:"kind"` // tool, command, file or log
+	Command    []string `json:"command,omitempty"`
+	StartedAt  string   `json:"startedAt,omitempty"`
+	DurationMs int64    `json:"durationMs"`
+	ExitCode   int      `json:"exitCode"`
+	Error      string   `json:"error,omitempty"`
+	Bytes      int      `json:"bytes"`
+	SHA256     string   `json:"sha256,omitempty"`
+}
+
+type BundleIndex struct {
+	CreatedAt string        `json:"createdAt"`
+	Hostname  string        `json:"hostname"`
+	Platform  string        `json:"platform"`
+	Arch      string        `json:"arch"`
+	Invoked   []string      `json:"invoked"`
+	Targets   []string      `json:"targets,omitempty"`
+	URLs      []string      `json:"urls,omitempty"`
+	Gateway   string        `json:"gateway,omitempty"`
+	Entries   []BundleEntry `json:"entries"`
+	Failed    []string      `json:"failed"`
+}
+
+type BundleSummary struct {
+	Bundle  string   `json:"bundle"`
+	Bytes   int64    `json:"bytes"`
+	Entries int      `json:"entries"`
+	Failed  []string `json:"failed"`
+}
+
+// bundleStep is a diagnostic whose output becomes one file in the bundle
+type bundleStep struct {
+	name    string
+	file    string
+	kind    string
+	command []string
+	content []byte // captured output or copied file
+	err     error
+}
+
+// bundleLog is the bundle's own log of what ran, shipped as bundle.log
+type bundleLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *bundleLog) printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, "%s ", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&l.buf, format+"\n", args...)
+}
+
+type fileList []string
+
+func (l *fileList) String() string     { return strings.Join(*l, ",") }
+func (l *fileList) Set(v string) error { *l = append(*l, v); return nil }
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findTool locates another cloud-connect binary next to this one, then on PATH
+func findTool(toolsDir, name string) (string, error) {
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	candidate := filepath.Join(toolsDir, name)
+	if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+		return candidate, nil
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	return "", fmt.Errorf("%s not found in %s or PATH (run ./build.sh)", name, toolsDir)
+}
+
+// platformSteps lists the OS commands and files that describe addressing,
+// routing and resolver configuration
+func platformSteps() []bundleStep {
+	switch runtime.GOOS {
+	case "windows":
+		return []bundleStep{
+			{name: "addresses", file: "system/ipconfig.txt", kind: "command", command: []string{"ipconfig", "/all"}},
+			{name: "routes", file: "system/routes.txt", kind: "command", command: []string{"route", "print"}},
+			{name: "dns-servers", file: "system/dns-servers.txt", kind: "command", command: []string{"netsh", "interface", "ip", "show", "dnsservers"}},
+			{name: "dns-cache", file: "system/dns-cache.txt", kind: "command", command: []string{"ipconfig", "/displaydns"}},
+			{name: "hosts", file: "system/hosts", kind: "file", command: []string{filepath.Join(os.Getenv("SystemRoot"), `System32\drivers\etc\hosts`)}},
+		}
+	case "darwin":
+		return []bundleStep{
+			{name: "addresses", file: "system/ifconfig.txt", kind: "command", command: []string{"ifconfig", "-a"}},
+			{name: "routes", file: "system/routes.txt", kind: "command", command: []string{"netstat", "-rn"}},
+			{name: "dns-config", file: "system/scutil-dns.txt", kind: "command", command: []string{"scutil", "--dns"}},
+			{name: "resolv.conf", file: "system/resolv.conf", kind: "file", command: []string{"/etc/resolv.conf"}},
+			{name: "hosts", file: "system/hosts", kind: "file", command: []string{"/etc/hosts"}},
+		}
+	default:
+		return []bundleStep{
+			{name: "addresses", file: "system/ip-addr.txt", kind: "command", command: []string{"ip", "addr", "show"}},
+			{name: "routes", file: "system/routes.txt", kind: "command", command: []string{"ip", "route", "show", "table", "all"}},
+			{name: "routes-v6", file: "system/routes-v6.txt", kind: "command", command: []string{"ip", "-6", "route", "show"}},
+			{name: "rules", file: "system/ip-rule.txt", kind: "command", command: []string{"ip", "rule", "show"}},
+			{name: "neighbours", file: "system/neighbours.txt", kind: "command", command: []string{"ip", "neigh", "show"}},
+			{name: "resolv.conf", file: "system/resolv.conf", kind: "file", command: []string{"/etc/resolv.conf"}},
+			{name: "nsswitch.conf", file: "system/nsswitch.conf", kind: "file", command: []string{"/etc/nsswitch.conf"}},
+			{name: "hosts", file: "system/hosts", kind: "file", command: []string{"/etc/hosts"}},
+		}
+	}
+}
+
+func pingCommand(host string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"ping", "-n", "4", host}
+	}
+	return []string{"ping", "-c", "4", host}
+}
+
+// run executes a step and fills in its entry; command and tool output
+// is kept even when the command fails, since failures are the evidence
+func (s *bundleStep) run(timeout time.Duration, log *bundleLog) BundleEntry {
+	entry := BundleEntry{Name: s.name, File: s.file, Kind: s.kind, Command: s.command}
+	start := time.Now()
+	entry.StartedAt = start.UTC().Format(time.RFC3339)
+
+	switch {
+	case s.err != nil:
+		entry.Error = s.err.Error()
+		entry.ExitCode = -1
+	case s.kind == "file":
+		s.content, s.err = os.ReadFile(s.command[0])
+		if s.err != nil {
+			entry.Error = s.err.Error()
+			entry.ExitCode = -1
+		}
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		s.content = stdout.Bytes()
+		if stderr.Len() > 0 {
+			log.printf("%s stderr:\n%s", s.name, strings.TrimRight(stderr.String(), "\n"))
+		}
+		if err != nil {
+			entry.ExitCode = -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				entry.ExitCode = exitErr.ExitCode()
+			}
+			entry.Error = err.Error()
+			if ctx.Err() == context.DeadlineExceeded {
+				entry.Error = fmt.Sprintf("timed out after %v", timeout)
+			}
+		}
+	}
+
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if entry.Error != "" && len(s.content) == 0 {
+		// Nothing to ship; the index records why
+		s.file, entry.File = "", ""
+	}
+	entry.Bytes = len(s.content)
+	entry.SHA256 = contentHash(s.content)
+	if entry.Error != "" {
+		log.printf("%s failed after %dms: %s", s.name, entry.DurationMs, entry.Error)
+	} else {
+		log.printf("%s done in %dms (%d bytes)", s.name, entry.DurationMs, entry.Bytes)
+	}
+	return entry
+}
+
+func contentHash(content []byte) string {
+	if len(content) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// targetHost extracts the host of a URL or host[:port] target for DNS lookups
+func targetHost(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	if host, _, ok := strings.Cut(target, ":"); ok && !strings.Contains(target, "::") {
+		return host
+	}
+	return target
+}
+
+// writeBundle packages files under a single top-level directory
+func writeBundle(path, root string, files []bundleStep, modTime time.Time) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		if f.file == "" {
+			continue
+		}
+		header := &tar.Header{
+			Name:    root + "/" + f.file,
+			Mode:    0644,
+			Size:    int64(len(f.content)),
+			ModTime: modTime,
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			break
+		}
+		if _, err = tw.Write(f.content); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func main() {
+	output := flag.String("o", "", "Bundle file to write (default: cloud-connect-bundle-<host>-<time>.tar.gz)")
+	tracesArg := flag.String("trace", "", "Comma-separated hosts to traceroute and resolve")
+	urlsArg := flag.String("http", "", "Comma-separated URLs to check")
+	toolsDir := flag.String("tools", "", "Directory holding the other cloud-connect tools (default: this binary's directory)")
+	timeout := flag.Duration("timeout", 2*time.Minute, "Time limit for each diagnostic")
+	var includes fileList
+	flag.Var(&includes, "include", "Extra file or glob to add under logs/, e.g. monitor.ring or alerts.jsonl (repeatable)")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		fmt.Println("Usage: bundle [options]")
+		fmt.Println("Example: bundle -trace 10.20.0.5,example.com -http https://example.com/health")
+		fmt.Println("         bundle -o ticket-4821.tar.gz -include monitor.ring -include /var/log/app/*.log")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	root := fmt.Sprintf("cloud-connect-bundle-%s-%s", hostname, now.UTC().Format("20060102T150405Z"))
+	if *output == "" {
+		*output = root + ".tar.gz"
+	}
+	if *toolsDir == "" {
+		if exe, err := os.Executable(); err == nil {
+			*toolsDir = filepath.Dir(exe)
+		}
+	}
+
+	traces := splitList(*tracesArg)
+	urls := splitList(*urlsArg)
+	log := &bundleLog{}
+	log.printf("bundle started on %s (%s/%s), tools from %s", hostname, runtime.GOOS, runtime.GOARCH, *toolsDir)
+
+	tool := func(name, file string, args ...string) bundleStep {
+		step := bundleStep{name: name, file: file, kind: "tool"}
+		path, err := findTool(*toolsDir, name)
+		step.command = append([]string{path}, args...)
+		step.err = err
+		return step
+	}
+
+	// Interfaces run first: their default gateway is what gets pinged
+	index := BundleIndex{
+		CreatedAt: now.UTC().Format(time.RFC3339),
+		Hostname:  hostname,
+		Platform:  runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Invoked:   os.Args,
+		Targets:   traces,
+		URLs:      urls,
+		Failed:    []string{},
+	}
+	interfaces := tool("interfaces", "diagnostics/interfaces.json")
+	steps := []bundleStep{interfaces}
+	entries := []BundleEntry{steps[0].run(*timeout, log)}
+	var ifaceResult struct {
+		DefaultGateway string `json:"defaultGateway"`
+	}
+	if json.Unmarshal(steps[0].content, &ifaceResult) == nil {
+		index.Gateway = ifaceResult.DefaultGateway
+	}
+
+	steps = append(steps, platformSteps()...)
+	if index.Gateway != "" {
+		steps = append(steps, bundleStep{name: "gateway-ping", file: "diagnostics/gateway-ping.txt", kind: "command", command: pingCommand(index.Gateway)})
+	} else {
+		log.printf("no default gateway found, skipping gateway ping")
+	}
+
+	var lookups []string
+	seen := make(map[string]bool)
+	for _, target := range append(append([]string{}, traces...), urls...) {
+		if host := targetHost(target); host != "" && !seen[host] {
+			seen[host] = true
+			lookups = append(lookups, host)
+		}
+	}
+	if len(lookups) > 0 {
+		steps = append(steps, tool("dns", "diagnostics/dns.json", strings.Join(lookups, ","), "a,aaaa,cname"))
+	}
+	if len(traces) > 0 {
+		steps = append(steps, tool("traceroute", "diagnostics/traceroute.json", strings.Join(traces, ","), "30", "60", "true"))
+	}
+	if len(urls) > 0 {
+		steps = append(steps, tool("http-test", "diagnostics/http.json", strings.Join(urls, ","), "15"))
+	}
+
+	// The remaining diagnostics are independent, so they run side by side
+	entries = append(entries, make([]BundleEntry, len(steps)-1)...)
+	var wg sync.WaitGroup
+	for i := 1; i < len(steps); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entries[i] = steps[i].run(*timeout, log)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, pattern := range includes {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			matches = []string{pattern} // reported as a missing file below
+		}
+		for _, match := range matches {
+			step := bundleStep{name: "include " + match, file: "logs/" + filepath.Base(match), kind: "log", command: []string{match}}
+			step.content, step.err = os.ReadFile(match)
+			entry := BundleEntry{Name: step.name, File: step.file, Kind: step.kind, Command: step.command, Bytes: len(step.content)}
+			entry.SHA256 = contentHash(step.content)
+			if step.err != nil {
+				step.file, entry.File = "", ""
+				entry.Error = step.err.Error()
+				entry.ExitCode = -1
+				log.printf("%s failed: %v", step.name, step.err)
+			}
+			steps = append(steps, step)
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Error != "" {
+			index.Failed = append(index.Failed, entry.Name)
+		}
+	}
+	log.printf("bundle finished: %d entries, %d failed", len(entries), len(index.Failed))
+
+	// bundle.log and index.json describe everything else, so they go last
+	logStep := bundleStep{name: "bundle.log", file: "bundle.log", kind: "log", content: log.buf.Bytes()}
+	entries = append(entries, BundleEntry{Name: logStep.name, File: logStep.file, Kind: logStep.kind, Bytes: len(logStep.content), SHA256: contentHash(logStep.content)})
+	index.Entries = entries
+	indexJSON, _ := json.MarshalIndent(index, "", "  ")
+	files := append(steps, logStep, bundleStep{file: "index.json", content: indexJSON})
+
+	if err := writeBundle(*output, root, files, now); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+
+	summary := BundleSummary{Bundle: *output, Entries: len(entries), Failed: index.Failed}
+	if info, err := os.Stat(*output); err == nil {
+		summary.Bytes = info.Size()
+	}
+	json.NewEncoder(os.Stdout).Encode(summary)
+}
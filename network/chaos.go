@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every rule this tool creates carries this name so leftovers can be found
+const (
+	chaosChain  = "CLOUD_CONNECT_CHAOS"
+	chaosAnchor = "com.apple/cloud-connect-chaos" // Covered by macOS's default anchor "com.apple/*"
+	chaosRule   = "cloud-connect-chaos"
+)
+
+// chaosStep is one command; after runs on success and may add cleanup
+type chaosStep struct {
+	Args  []string
+	Stdin string
+	after func(output string)
+}
+
+type chaosPlan struct {
+	Description string
+	Apply       []chaosStep
+	Cleanup     []chaosStep
+}
+
+type ChaosResult struct {
+	Action          string     `json:"action"`
+	Target          string     `json:"target,omitempty"`
+	Platform        string     `json:"platform"`
+	Description     string     `json:"description"`
+	DryRun          bool       `json:"dryRun"`
+	Commands        []string   `json:"commands"`
+	CleanupCommands []string   `json:"cleanupCommands"`
+	AppliedAt       *time.Time `json:"appliedAt,omitempty"`
+	ClearedAt       *time.Time `json:"clearedAt,omitempty"`
+	ActiveSeconds   float64    `json:"activeSeconds,omitempty"`
+	Interrupted     bool       `json:"interrupted,omitempty"`
+	Errors          []string   `json:"errors,omitempty"`
+}
+
+func isWindows() bool {
+	return runtime.GOOS == "windows"
+}
+
+func isDarwin() bool {
+	return runtime.GOOS == "darwin"
+}
+
+func commandLine(step chaosStep) string {
+	line := strings.Join(step.Args, " ")
+	if step.Stdin != "" {
+		line += " <<< " + strings.TrimSpace(step.Stdin)
+	}
+	return line
+}
+
+// validateTarget accepts an IPv4 address or CIDR; firewall rules need addresses
+func validateTarget(target string) error {
+	if ip := net.ParseIP(target); ip != nil && ip.To4() != nil {
+		return nil
+	}
+	if ip, _, err := net.ParseCIDR(target); err == nil && ip.To4() != nil {
+		return nil
+	}
+	return fmt.Errorf("target %q must be an IPv4 address or CIDR", target)
+}
+
+// iptablesPlan installs rules in a private chain jumped to from OUTPUT,
+// so cleanup never touches rules it did not create
+func iptablesPlan(rules [][]string) ([]chaosStep, []chaosStep) {
+	apply := []chaosStep{
+		{Args: []string{"iptables", "-N", chaosChain}},
+		{Args: []string{"iptables", "-I", "OUTPUT", "1", "-j", chaosChain}},
+	}
+	for _, rule := range rules {
+		apply = append(apply, chaosStep{Args: append([]string{"iptables", "-A", chaosChain}, rule...)})
+	}
+	cleanup := []chaosStep{
+		{Args: []string{"iptables", "-D", "OUTPUT", "-j", chaosChain}},
+		{Args: []string{"iptables", "-F", chaosChain}},
+		{Args: []string{"iptables", "-X", chaosChain}},
+	}
+	return apply, cleanup
+}
+
+var pfTokenRegex = regexp.MustCompile(`Token : (\d+)`)
+
+// pfPlan loads rules into an anchor and takes a pf enable reference,
+// which cleanup releases so pf returns to its previous state
+func pfPlan(plan *chaosPlan, rules []string) {
+	plan.Cleanup = []chaosStep{{Args: []string{"pfctl", "-a", chaosAnchor, "-F", "all"}}}
+	plan.Apply = []chaosStep{
+		{Args: []string{"pfctl", "-a", chaosAnchor, "-f", "-"}, Stdin: strings.Join(rules, "\n") + "\n"},
+		{Args: []string{"pfctl", "-E"}, after: func(output string) {
+			if match := pfTokenRegex.FindStringSubmatch(output); match != nil {
+				plan.Cleanup = append(plan.Cleanup, chaosStep{Args: []string{"pfctl", "-X", match[1]}})
+			}
+		}},
+	}
+}
+
+func netshRule(target, protocol, port string) chaosStep {
+	args := []string{"netsh", "advfirewall", "firewall", "add", "rule", "name=" + chaosRule, "dir=out", "action=block"}
+	if target != "" {
+		args = append(args, "remoteip="+target)
+	}
+	if protocol != "" {
+		args = append(args, "protocol="+protocol, "remoteport="+port)
+	}
+	return chaosStep{Args: args}
+}
+
+var netshCleanup = []chaosStep{{Args: []string{"netsh", "advfirewall", "firewall", "delete", "rule", "name=" + chaosRule}}}
+
+func blackholePlan(target string, port int) (*chaosPlan, error) {
+	if err := validateTarget(target); err != nil {
+		return nil, err
+	}
+	plan := &chaosPlan{Description: fmt.Sprintf("drop all outbound traffic to %s", target)}
+	if port > 0 {
+		plan.Description = fmt.Sprintf("drop outbound TCP and UDP traffic to %s port %d", target, port)
+	}
+	p := fmt.Sprint(port)
+
+	switch {
+	case isWindows():
+		if port > 0 {
+			plan.Apply = []chaosStep{netshRule(target, "TCP", p), netshRule(target, "UDP", p)}
+		} else {
+			plan.Apply = []chaosStep{netshRule(target, "", "")}
+		}
+		plan.Cleanup = netshCleanup
+	case isDarwin():
+		rule := "block drop out quick to " + target
+		if port > 0 {
+			rule = fmt.Sprintf("block drop out quick proto { tcp udp } to %s port %d", target, port)
+		}
+		pfPlan(plan, []string{rule})
+	default:
+		rules := [][]string{{"-d", target, "-j", "DROP"}}
+		if port > 0 {
+			rules = [][]string{
+				{"-d", target, "-p", "tcp", "--dport", p, "-j", "DROP"},
+				{"-d", target, "-p", "udp", "--dport", p, "-j", "DROP"},
+			}
+		}
+		plan.Apply, plan.Cleanup = iptablesPlan(rules)
+	}
+	return plan, nil
+}
+
+// dnsDropPlan drops DNS to one resolver, or to every resolver when target is empty
+func dnsDropPlan(target string) (*chaosPlan, error) {
+	plan := &chaosPlan{Description: "drop all outbound DNS (port 53)"}
+	if target != "" {
+		if err := validateTarget(target); err != nil {
+			return nil, err
+		}
+		plan.Description = fmt.Sprintf("drop outbound DNS to %s", target)
+	}
+
+	switch {
+	case isWindows():
+		plan.Apply = []chaosStep{netshRule(target, "UDP", "53"), netshRule(target, "TCP", "53")}
+		plan.Cleanup = netshCleanup
+	case isDarwin():
+		to := "any"
+		if target != "" {
+			to = target
+		}
+		pfPlan(plan, []string{fmt.Sprintf("block drop out quick proto { tcp udp } to %s port 53", to)})
+	default:
+		var rules [][]string
+		for _, proto := range []string{"udp", "tcp"} {
+			rule := []string{"-p", proto, "--dport", "53", "-j", "DROP"}
+			if target != "" {
+				rule = append([]string{"-d", target}, rule...)
+			}
+			rules = append(rules, rule)
+		}
+		plan.Apply, plan.Cleanup = iptablesPlan(rules)
+	}
+	return plan, nil
+}
+
+var routeDevRegex = regexp.MustCompile(`\bdev (\S+)`)
+
+// routeInterface finds the interface the kernel would use to reach target
+func routeInterface(target string) (string, error) {
+	ip := strings.Split(target, "/")[0]
+	output, err := exec.Command("ip", "route", "get", ip).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip route get %s: %v", ip, strings.TrimSpace(string(output)))
+	}
+	match := routeDevRegex.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", fmt.Errorf("no interface in route to %s", ip)
+	}
+	return match[1], nil
+}
+
+// netemPlan delays or drops only traffic to target: a prio root qdisc with
+// netem on an extra fourth band that the default priomap never uses, and a
+// u32 filter steering the target into it.
+// Adding the root qdisc fails if one is already configured, so existing
+// shaping is never replaced.
+func netemPlan(target, iface string, delay, jitter time.Duration, loss float64) (*chaosPlan, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("latency and loss injection needs tc netem, which is Linux only")
+	}
+	if err := validateTarget(target); err != nil {
+		return nil, err
+	}
+	if delay <= 0 && loss <= 0 {
+		return nil, fmt.Errorf("set -delay and/or -loss")
+	}
+	if iface == "" {
+		var err error
+		if iface, err = routeInterface(target); err != nil {
+			return nil, err
+		}
+	}
+
+	netem := []string{"tc", "qdisc", "add", "dev", iface, "parent", "1:4", "handle", "40:", "netem"}
+	var parts []string
+	if delay > 0 {
+		netem = append(netem, "delay", fmt.Sprintf("%dms", delay.Milliseconds()))
+		if jitter > 0 {
+			netem = append(netem, fmt.Sprintf("%dms", jitter.Milliseconds()))
+		}
+		parts = append(parts, fmt.Sprintf("%s delay", delay))
+	}
+	if loss > 0 {
+		netem = append(netem, "loss", fmt.Sprintf("%g%%", loss))
+		parts = append(parts, fmt.Sprintf("%g%% loss", loss))
+	}
+
+	return &chaosPlan{
+		Description: fmt.Sprintf("add %s to traffic for %s on %s", strings.Join(parts, " and "), target, iface),
+		Apply: []chaosStep{
+			{Args: []string{"tc", "qdisc", "add", "dev", iface, "root", "handle", "1:", "prio", "bands", "4"}},
+			{Args: netem},
+			{Args: []string{"tc", "filter", "add", "dev", iface, "protocol", "ip", "parent", "1:0", "prio", "3", "u32", "match", "ip", "dst", target, "flowid", "1:4"}},
+		},
+		Cleanup: []chaosStep{{Args: []string{"tc", "qdisc", "del", "dev", iface, "root"}}},
+	}, nil
+}
+
+// The root qdisc netemPlan adds: prio with handle 1: and a fourth band
+var chaosQdiscRegex = regexp.MustCompile(`(?m)^qdisc prio 1: root .*\bbands 4\b`)
+
+// ownsRootQdisc reports whether the root qdisc on iface is the one
+// netemPlan adds, so cleanup never deletes shaping configured by others
+func ownsRootQdisc(iface string) (bool, error) {
+	output, err := exec.Command("tc", "qdisc", "show", "dev", iface).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("tc qdisc show dev %s: %v: %s", iface, err, strings.TrimSpace(string(output)))
+	}
+	return chaosQdiscRegex.Match(output), nil
+}
+
+func runStep(step chaosStep) error {
+	cmd := exec.Command(step.Args[0], step.Args[1:]...)
+	if step.Stdin != "" {
+		cmd.Stdin = strings.NewReader(step.Stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", commandLine(step), err, strings.TrimSpace(string(output)))
+	}
+	if step.after != nil {
+		step.after(string(output))
+	}
+	return nil
+}
+
+// runCleanup runs every cleanup step even if earlier ones fail
+func runCleanup(steps []chaosStep, result *ChaosResult) {
+	for _, step := range steps {
+		if err := runStep(step); err != nil {
+			result.Errors = append(result.Errors, "cleanup: "+err.Error())
+		}
+	}
+	now := time.Now()
+	result.ClearedAt = &now
+}
+
+func printChaosResult(result ChaosResult) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
+
+func main() {
+	yes := flag.Bool("yes", false, "Actually apply the fault (otherwise only print the plan)")
+	duration := flag.Duration("duration", time.Minute, "How long the fault stays in place before automatic cleanup")
+	port := flag.Int("port", 0, "Blackhole only this TCP/UDP port")
+	delay := flag.Duration("delay", 0, "Added latency for netem (e.g., 200ms)")
+	jitter := flag.Duration("jitter", 0, "Latency variation for netem")
+	loss := flag.Float64("loss", 0, "Packet loss percentage for netem")
+	iface := flag.String("iface", "", "Interface for netem (default: the route to the target)")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Println("Usage: chaos [options] <blackhole|netem|dns-drop|cleanup> [target]")
+		fmt.Println("Example: chaos -yes -duration 5m blackhole 203.0.113.10")
+		fmt.Println("         chaos -yes -delay 200ms -loss 5 netem 203.0.113.10")
+		fmt.Println("         chaos -yes dns-drop 10.0.0.2")
+		fmt.Println("         chaos -yes -iface eth0 cleanup")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	action := args[0]
+	target := ""
+	if len(args) > 1 {
+		target = args[1]
+	}
+
+	var plan *chaosPlan
+	var err error
+	switch action {
+	case "blackhole":
+		if target == "" {
+			err = fmt.Errorf("blackhole needs a target")
+		} else {
+			plan, err = blackholePlan(target, *port)
+		}
+	case "netem":
+		plan, err = netemPlan(target, *iface, *delay, *jitter, *loss)
+	case "dns-drop":
+		plan, err = dnsDropPlan(target)
+	case "cleanup":
+		// Remove anything a killed run left behind
+		var p *chaosPlan
+		if p, err = blackholePlan("0.0.0.0", 0); err == nil {
+			plan = &chaosPlan{Description: "remove leftover chaos rules", Cleanup: p.Cleanup}
+			if runtime.GOOS == "linux" && *iface != "" {
+				var owned bool
+				if owned, err = ownsRootQdisc(*iface); err == nil && owned {
+					plan.Cleanup = append(plan.Cleanup, chaosStep{Args: []string{"tc", "qdisc", "del", "dev", *iface, "root"}})
+				} else if err == nil {
+					fmt.Fprintf(os.Stderr, "Leaving the root qdisc on %s: it is not the prio 1: qdisc chaos adds\n", *iface)
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	result := ChaosResult{
+		Action:          action,
+		Target:          target,
+		Platform:        runtime.GOOS,
+		Description:     plan.Description,
+		DryRun:          !*yes,
+		Commands:        []string{},
+		CleanupCommands: []string{},
+	}
+	for _, step := range plan.Apply {
+		result.Commands = append(result.Commands, commandLine(step))
+	}
+	for _, step := range plan.Cleanup {
+		result.CleanupCommands = append(result.CleanupCommands, commandLine(step))
+	}
+
+	if !*yes {
+		fmt.Fprintln(os.Stderr, "Dry run: re-run with -yes to apply these changes")
+		printChaosResult(result)
+		return
+	}
+
+	if action == "cleanup" {
+		runCleanup(plan.Cleanup, &result)
+		printChaosResult(result)
+		return
+	}
+	if *duration <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -duration must be positive\n")
+		os.Exit(1)
+	}
+
+	// Catch signals before touching anything so cleanup always runs
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	appliedAt := time.Now()
+	result.AppliedAt = &appliedAt
+	for i, step := range plan.Apply {
+		if err := runStep(step); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			// Nothing exists yet if the very first step failed
+			if i > 0 {
+				runCleanup(plan.Cleanup, &result)
+			}
+			printChaosResult(result)
+			os.Exit(1)
+		}
+	}
+	// pf reports its enable token only after applying, so refresh the list
+	result.CleanupCommands = result.CleanupCommands[:0]
+	for _, step := range plan.Cleanup {
+		result.CleanupCommands = append(result.CleanupCommands, commandLine(step))
+	}
+
+	fmt.Fprintf(os.Stderr, "Fault active: %s. Clearing in %s (Ctrl+C to clear now)\n", plan.Description, *duration)
+	select {
+	case <-time.After(*duration):
+	case <-stop:
+		result.Interrupted = true
+	}
+
+	runCleanup(plan.Cleanup, &result)
+	result.ActiveSeconds = result.ClearedAt.Sub(appliedAt).Seconds()
+	printChaosResult(result)
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
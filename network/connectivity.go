@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +33,21 @@ type ConnectivityResult struct {
 		Avg float64 `json:"avg,omitempty"`
 		Max float64 `json:"max,omitempty"`
 	} `json:"rtt,omitempty"`
+	Multicast *MulticastStats `json:"multicast,omitempty"`
+	MTU       *MTUReport      `json:"mtu,omitempty"`
+	Dialog    *DialogResult   `json:"dialog,omitempty"`
+}
+
+// MulticastStats describes traffic seen after joining a group
+type MulticastStats struct {
+	Group           string   `json:"group"`
+	Interface       string   `json:"interface,omitempty"`
+	IGMPVersion     string   `json:"igmpVersion,omitempty"`
+	WindowSeconds   int      `json:"windowSeconds"`
+	PacketsReceived int      `json:"packetsReceived"`
+	BytesReceived   int      `json:"bytesReceived"`
+	Sources         []string `json:"sources,omitempty"`
+	FirstPacketMs   int64    `json:"firstPacketMs,omitempty"`
 }
 
 // Check both ICMP and TCP connectivity in parallel
@@ -194,10 +216,791 @@ func checkUdpPort(targetIP string, port int, timeout int) ConnectivityResult {
 	}
 }
 
+// checkMulticast joins group on ifaceName (or the default interface) and
+// listens for window seconds. The join itself sends the IGMP/MLD report, so
+// traffic only arrives if the segment's snooping and routing let it through.
+func checkMulticast(group string, port int, window int, ifaceName string) ConnectivityResult {
+	result := ConnectivityResult{TargetIP: group, Port: port, Mode: "multicast"}
+	stats := &MulticastStats{Group: group, Interface: ifaceName, WindowSeconds: window}
+	result.Multicast = stats
+
+	groupIP := net.ParseIP(group)
+	if groupIP == nil || !groupIP.IsMulticast() {
+		result.Message = fmt.Sprintf("%s is not a multicast group address", group)
+		return result
+	}
+
+	var iface *net.Interface
+	if ifaceName != "" {
+		var err error
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			result.Message = fmt.Sprintf("Interface %s: %s", ifaceName, err)
+			return result
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp", iface, &net.UDPAddr{IP: groupIP, Port: port})
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not join %s on port %d - %s", group, port, err)
+		return result
+	}
+	defer conn.Close()
+
+	startTime := time.Now()
+	stats.IGMPVersion, stats.Interface = igmpVersion(groupIP, ifaceName)
+
+	seen := make(map[string]bool)
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(startTime.Add(time.Duration(window) * time.Second))
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if stats.PacketsReceived == 0 {
+			stats.FirstPacketMs = time.Since(startTime).Milliseconds()
+		}
+		stats.PacketsReceived++
+		stats.BytesReceived += n
+		if !seen[addr.IP.String()] {
+			seen[addr.IP.String()] = true
+			stats.Sources = append(stats.Sources, addr.IP.String())
+		}
+	}
+
+	result.ResponseTime = stats.FirstPacketMs
+	result.Success = stats.PacketsReceived > 0
+	if result.Success {
+		result.Message = fmt.Sprintf("Received %d packets from %d sources on %s:%d within %ds", stats.PacketsReceived, len(stats.Sources), group, port, window)
+	} else {
+		result.Message = fmt.Sprintf("Joined %s:%d but received no traffic within %ds", group, port, window)
+	}
+	return result
+}
+
+var ifmcstatVersionRegex = regexp.MustCompile(`\b(igmpv[123]|mldv[12])\b`)
+
+// igmpVersion reports the IGMP (or MLD) version an interface is running,
+// which drops to the oldest querier version heard on the segment. Without
+// an interface name it finds the interface that holds the membership.
+func igmpVersion(group net.IP, ifaceName string) (string, string) {
+	switch runtime.GOOS {
+	case "linux":
+		if group.To4() == nil {
+			if ifaceName == "" {
+				return "", ""
+			}
+			data, err := os.ReadFile("/proc/sys/net/ipv6/conf/" + ifaceName + "/force_mld_version")
+			if err == nil && strings.TrimSpace(string(data)) != "0" {
+				return "MLDv" + strings.TrimSpace(string(data)), ifaceName
+			}
+			return "MLDv2", ifaceName
+		}
+
+		file, err := os.Open("/proc/net/igmp")
+		if err != nil {
+			return "", ifaceName
+		}
+		defer file.Close()
+
+		// Device lines: "2	eth0      :     1      V3"; group lines follow
+		// with the address as little-endian hex
+		ip := group.To4()
+		groupHex := fmt.Sprintf("%02X%02X%02X%02X", ip[3], ip[2], ip[1], ip[0])
+		device, version := "", ""
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 5 && fields[2] == ":" {
+				device, version = fields[1], strings.Replace(fields[4], "V", "IGMPv", 1)
+				continue
+			}
+			if len(fields) > 0 && strings.EqualFold(fields[0], groupHex) && (ifaceName == "" || ifaceName == device) {
+				return version, device
+			}
+		}
+		return "", ifaceName
+	case "darwin", "freebsd":
+		if ifaceName == "" {
+			return "", ""
+		}
+		output, err := exec.Command("ifmcstat", "-i", ifaceName).Output()
+		if err != nil {
+			return "", ifaceName
+		}
+		want := "igmp"
+		if group.To4() == nil {
+			want = "mld"
+		}
+		for _, match := range ifmcstatVersionRegex.FindAllString(string(output), -1) {
+			if strings.HasPrefix(match, want) {
+				return strings.ToUpper(match[:len(match)-2]) + match[len(match)-2:], ifaceName
+			}
+		}
+	}
+	return "", ifaceName
+}
+
+// Packet sizes tried in each direction, as total IPv4 packet length
+var mtuLadder = []int{576, 1280, 1400, 1420, 1450, 1472, 1492, 1500, 1600, 4000, 9000}
+
+const ipv4ICMPOverhead = 28
+
+// Ping outcomes for one probe
+const (
+	probeOK          = "ok"
+	probeFragNeeded  = "frag-needed"   // A router sent ICMP fragmentation needed
+	probeLocalTooBig = "local-too-big" // Larger than our own interface MTU
+	probePathCached  = "path-cached"   // Larger than a path MTU the kernel learned earlier
+	probeNoReply     = "no-reply"
+)
+
+// MTUProbe is one packet size sent with and without the DF bit
+type MTUProbe struct {
+	Size        int    `json:"size"`
+	DF          string `json:"df"`
+	NoDF        string `json:"noDf"`
+	ReportedMTU int    `json:"reportedMtu,omitempty"`
+}
+
+// MTUDirection is the result for one direction of the path
+type MTUDirection struct {
+	From          string     `json:"from"`
+	To            string     `json:"to"`
+	PathMTU       int        `json:"pathMtu"`
+	PMTUDiscovery string     `json:"pmtuDiscovery"` // working, black-hole or not-needed
+	Fragmentation string     `json:"fragmentation"` // works, dropped or not-needed
+	Probes        []MTUProbe `json:"probes"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type MTUReport struct {
+	Forward MTUDirection  `json:"forward"`
+	Reverse *MTUDirection `json:"reverse,omitempty"`
+}
+
+var (
+	fragNeededRegex = regexp.MustCompile(`(?i)frag(mentation)? needed|needs to be fragmented`)
+	tooLongRegex    = regexp.MustCompile(`(?i)message too long`)
+	reportedMTU     = regexp.MustCompile(`(?i)mtu\s*=?\s*(\d+)`)
+	pingReplyRegex  = regexp.MustCompile(`(?i)bytes from|bytes=\d+`)
+)
+
+// mtuPing sends two pings of size bytes (IP header included) with or
+// without DF and classifies the outcome from ping's output
+func mtuPing(target string, size int, df bool, timeout int) (string, int) {
+	payload := strconv.Itoa(size - ipv4ICMPOverhead)
+	var args []string
+	switch runtime.GOOS {
+	case "windows":
+		args = []string{"-n", "2", "-w", strconv.Itoa(timeout * 1000), "-l", payload}
+		if df {
+			args = append(args, "-f")
+		}
+	case "darwin":
+		args = []string{"-c", "2", "-t", strconv.Itoa(timeout + 1), "-s", payload}
+		if df {
+			args = append(args, "-D")
+		}
+	default:
+		pmtu := "dont"
+		if df {
+			pmtu = "do"
+		}
+		args = []string{"-c", "2", "-i", "0.2", "-W", strconv.Itoa(timeout), "-s", payload, "-M", pmtu}
+	}
+
+	output, _ := exec.Command("ping", append(args, target)...).CombinedOutput()
+	text := string(output)
+	mtu := 0
+	if match := reportedMTU.FindStringSubmatch(text); match != nil {
+		mtu, _ = strconv.Atoi(match[1])
+	}
+	switch {
+	case pingReplyRegex.MatchString(text):
+		return probeOK, 0
+	case fragNeededRegex.MatchString(text):
+		return probeFragNeeded, mtu
+	case tooLongRegex.MatchString(text):
+		return probeLocalTooBig, mtu
+	default:
+		return probeNoReply, 0
+	}
+}
+
+// routeMTU is the MTU of the interface the route to target leaves from,
+// or 0 when it cannot be told
+func routeMTU(target string) int {
+	conn, err := net.Dial("udp", net.JoinHostPort(target, "9"))
+	if err != nil {
+		return 0
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
+
+// measureMTUDirection walks the size ladder towards target, then narrows the
+// largest DF size that still gets through. A DF probe that vanishes while
+// the same size without DF arrives is a PMTUD black hole: the path is too
+// small but the ICMP that should say so never comes back.
+func measureMTUDirection(from, target string, timeout int) MTUDirection {
+	direction := MTUDirection{From: from, To: target, Probes: []MTUProbe{}}
+	if ip := net.ParseIP(target); ip == nil || ip.To4() == nil {
+		direction.Error = "MTU testing needs an IPv4 address; IPv6 routers never fragment"
+		return direction
+	}
+
+	// Once a router has reported a smaller MTU, Linux refuses larger DF
+	// packets itself with "message too long, mtu=N"; N below the interface
+	// MTU is that learned path MTU, so PMTUD did its job
+	ifaceMTU := routeMTU(target)
+
+	largestOK, smallestFail := 0, 0
+	blackHole, fragNeeded, pathLimited := false, false, false
+	for _, size := range mtuLadder {
+		probe := MTUProbe{Size: size}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			probe.DF, probe.ReportedMTU = mtuPing(target, size, true, timeout)
+		}()
+		go func() {
+			defer wg.Done()
+			probe.NoDF, _ = mtuPing(target, size, false, timeout)
+		}()
+		wg.Wait()
+		if probe.DF == probeLocalTooBig && probe.ReportedMTU > 0 && ifaceMTU > 0 && probe.ReportedMTU < ifaceMTU {
+			probe.DF = probePathCached
+		}
+		direction.Probes = append(direction.Probes, probe)
+
+		if probe.DF == probeOK {
+			largestOK = size
+			continue
+		}
+		if smallestFail == 0 {
+			smallestFail = size
+		}
+		switch {
+		case probe.DF == probeFragNeeded, probe.DF == probePathCached:
+			fragNeeded = true
+		case probe.DF == probeNoReply && probe.NoDF == probeOK:
+			blackHole = true
+		}
+		pathLimited = pathLimited || probe.DF != probeLocalTooBig
+	}
+
+	if largestOK == 0 {
+		direction.Error = fmt.Sprintf("no probe reached %s; ICMP may be blocked", target)
+		return direction
+	}
+
+	// Binary search between the last size that fit and the first that didn't
+	lo, hi := largestOK, smallestFail
+	for hi > 0 && hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if status, _ := mtuPing(target, mid, true, timeout); status == probeOK {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	direction.PathMTU = lo
+
+	switch {
+	case blackHole:
+		direction.PMTUDiscovery = "black-hole"
+	case fragNeeded:
+		direction.PMTUDiscovery = "working"
+	case !pathLimited:
+		// Only our own interface MTU got in the way
+		direction.PMTUDiscovery = "not-needed"
+	default:
+		direction.PMTUDiscovery = "unknown"
+	}
+
+	// Anything above the path MTU only arrives if it can be fragmented
+	direction.Fragmentation = "not-needed"
+	for _, probe := range direction.Probes {
+		if probe.Size <= direction.PathMTU {
+			continue
+		}
+		if probe.NoDF != probeOK {
+			direction.Fragmentation = "dropped"
+			break
+		}
+		direction.Fragmentation = "works"
+	}
+	return direction
+}
+
+// checkMTU measures towards target and, when an MTU agent is listening on
+// agentPort, asks it to measure the reverse direction back to us
+func checkMTU(targetIP string, agentPort int, timeout int) ConnectivityResult {
+	startTime := time.Now()
+	result := ConnectivityResult{TargetIP: targetIP, Port: agentPort, Mode: "mtu"}
+	report := &MTUReport{}
+	result.MTU = report
+
+	target := targetIP
+	if addrs, err := net.LookupIP(targetIP); err == nil {
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				target = addr.String()
+				break
+			}
+		}
+	}
+
+	// One direction at a time: large probes crossing in both directions
+	// would share the same links and queues and blur each other's losses
+	report.Forward = measureMTUDirection("local", target, timeout)
+	if agentPort > 0 {
+		reverse := requestReverseMTU(target, agentPort, timeout)
+		report.Reverse = &reverse
+	}
+
+	result.ResponseTime = time.Since(startTime).Milliseconds()
+	directions := []MTUDirection{report.Forward}
+	if report.Reverse != nil {
+		directions = append(directions, *report.Reverse)
+	}
+
+	var problems []string
+	for _, d := range directions {
+		name := fmt.Sprintf("%s -> %s", d.From, d.To)
+		switch {
+		case d.Error != "":
+			problems = append(problems, fmt.Sprintf("%s: %s", name, d.Error))
+		case d.PMTUDiscovery == "black-hole":
+			problems = append(problems, fmt.Sprintf("%s: PMTUD black hole above %d bytes", name, d.PathMTU))
+		case d.Fragmentation == "dropped":
+			problems = append(problems, fmt.Sprintf("%s: fragments dropped above %d bytes", name, d.PathMTU))
+		}
+	}
+
+	result.Success = len(problems) == 0
+	if result.Success {
+		summary := fmt.Sprintf("Path MTU to %s is %d", target, report.Forward.PathMTU)
+		if report.Reverse != nil {
+			summary += fmt.Sprintf(", from it %d", report.Reverse.PathMTU)
+		}
+		result.Message = summary
+	} else {
+		result.Message = strings.Join(problems, "; ")
+	}
+	return result
+}
+
+// mtuAgentRequest is the agent protocol envelope (see agent.go) for the
+// mtu op, which bin/agent also answers
+type mtuAgentRequest struct {
+	Op        string `json:"op"`
+	Token     string `json:"token,omitempty"`
+	TimeoutMs int    `json:"timeoutMs"`
+}
+
+// Shared agent token, required by agents that have one set
+const agentTokenEnv = "CLOUD_CONNECT_AGENT_TOKEN"
+
+// requestReverseMTU asks the agent on the target to measure back to us
+func requestReverseMTU(target string, agentPort int, timeout int) MTUDirection {
+	failed := MTUDirection{From: target, To: "local", Probes: []MTUProbe{}}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(target, strconv.Itoa(agentPort)), time.Duration(timeout)*time.Second)
+	if err != nil {
+		failed.Error = fmt.Sprintf("MTU agent unreachable: %s", err)
+		return failed
+	}
+	defer conn.Close()
+
+	// Two pings per probe plus the binary search, with room to spare
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout*(2*len(mtuLadder)+16)+30) * time.Second))
+	if err := json.NewEncoder(conn).Encode(mtuAgentRequest{Op: "mtu", Token: os.Getenv(agentTokenEnv), TimeoutMs: timeout * 1000}); err != nil {
+		failed.Error = err.Error()
+		return failed
+	}
+	var reverse MTUDirection
+	if err := json.NewDecoder(conn).Decode(&reverse); err != nil {
+		failed.Error = fmt.Sprintf("MTU agent: %s", err)
+		return failed
+	}
+	return reverse
+}
+
+// Measurements the MTU agent runs at once; more would skew each other's
+// large probes, so extra requests are turned away rather than queued
+const mtuAgentConcurrency = 4
+
+// runMTUAgent answers MTU requests by measuring back to whoever connected.
+// It only ever pings the connecting peer, so it can't be aimed elsewhere.
+func runMTUAgent(listenIP string, port int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenIP, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "MTU agent listening on %s\n", listener.Addr())
+	token := os.Getenv(agentTokenEnv)
+
+	running := make(chan struct{}, mtuAgentConcurrency)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			var req mtuAgentRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if req.Op != "mtu" {
+				json.NewEncoder(conn).Encode(MTUDirection{From: "agent", To: peer, Probes: []MTUProbe{},
+					Error: fmt.Sprintf("unknown op %q (this agent only answers mtu)", req.Op)})
+				return
+			}
+			if token != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+				json.NewEncoder(conn).Encode(MTUDirection{From: "agent", To: peer, Probes: []MTUProbe{}, Error: "invalid token"})
+				return
+			}
+			timeout := req.TimeoutMs / 1000
+			if timeout < 1 || timeout > 10 {
+				timeout = 2
+			}
+
+			select {
+			case running <- struct{}{}:
+				defer func() { <-running }()
+			default:
+				json.NewEncoder(conn).Encode(MTUDirection{From: "agent", To: peer, Probes: []MTUProbe{},
+					Error: fmt.Sprintf("agent busy with %d measurements, try again shortly", mtuAgentConcurrency)})
+				return
+			}
+			direction := measureMTUDirection(conn.LocalAddr().(*net.TCPAddr).IP.String(), peer, timeout)
+			direction.To = peer
+			json.NewEncoder(conn).Encode(direction)
+		}(conn)
+	}
+}
+
+// DialogScript is an expect-style conversation loaded from a JSON file, for
+// text protocols such as SMTP, POP3 or in-house daemons
+type DialogScript struct {
+	Name      string            `json:"name"`
+	Port      int               `json:"port"`
+	TLS       bool              `json:"tls"` // Implicit TLS from the first byte, e.g. POP3S
+	Insecure  bool              `json:"insecure"`
+	Timeout   int               `json:"timeout"`
+	Variables map[string]string `json:"variables"`
+	Steps     []DialogStep      `json:"steps"`
+}
+
+// DialogStep sends at most one of send, line or hex, then optionally waits
+// for expect to match. Patterns are multi-line so ^ anchors at any line.
+type DialogStep struct {
+	Name     string            `json:"name"`
+	Send     string            `json:"send"`
+	Line     string            `json:"line"` // Sent with a trailing CRLF
+	Hex      string            `json:"hex"`
+	Expect   string            `json:"expect"`
+	Timeout  int               `json:"timeout"`
+	StartTLS bool              `json:"startTls"` // Upgrade to TLS after this step
+	Capture  map[string]string `json:"capture"`  // Variable name to regex group over the reply
+}
+
+type DialogStepResult struct {
+	Name         string `json:"name"`
+	BytesSent    int    `json:"bytesSent,omitempty"`
+	Expect       string `json:"expect,omitempty"`
+	Matched      string `json:"matched,omitempty"`
+	ResponseTime int64  `json:"responseTimeMs"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+}
+
+type DialogResult struct {
+	Name       string             `json:"name,omitempty"`
+	FailedStep string             `json:"failedStep,omitempty"`
+	Steps      []DialogStepResult `json:"steps"`
+}
+
+var dialogVar = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*\}\}`)
+
+// expandDialogVariables substitutes {{name}} from the script and captures,
+// and {{env.NAME}} from the environment so passwords stay out of the file
+func expandDialogVariables(text string, vars map[string]string) string {
+	return dialogVar.ReplaceAllStringFunc(text, func(match string) string {
+		name := dialogVar.FindStringSubmatch(match)[1]
+		if strings.HasPrefix(name, "env.") {
+			return os.Getenv(strings.TrimPrefix(name, "env."))
+		}
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+func loadDialogScript(path string) (DialogScript, error) {
+	var script DialogScript
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return script, err
+	}
+	if err := json.Unmarshal(data, &script); err != nil {
+		return script, fmt.Errorf("invalid dialog script: %v", err)
+	}
+	if script.Port <= 0 || script.Port > 65535 {
+		return script, fmt.Errorf("dialog script needs a port")
+	}
+	if len(script.Steps) == 0 {
+		return script, fmt.Errorf("dialog script has no steps")
+	}
+	for i, step := range script.Steps {
+		sends := 0
+		for _, s := range []string{step.Send, step.Line, step.Hex} {
+			if s != "" {
+				sends++
+			}
+		}
+		if sends > 1 {
+			return script, fmt.Errorf("step %d: use only one of send, line and hex", i+1)
+		}
+		if step.Expect != "" {
+			if _, err := regexp.Compile(step.Expect); err != nil {
+				return script, fmt.Errorf("step %d: invalid expect pattern: %v", i+1, err)
+			}
+		}
+	}
+	return script, nil
+}
+
+// dialogPayload returns the bytes a step sends, after variable expansion
+func dialogPayload(step DialogStep, vars map[string]string) ([]byte, error) {
+	switch {
+	case step.Hex != "":
+		return hex.DecodeString(strings.Join(strings.Fields(step.Hex), ""))
+	case step.Line != "":
+		return []byte(expandDialogVariables(step.Line, vars) + "\r\n"), nil
+	}
+	return []byte(expandDialogVariables(step.Send, vars)), nil
+}
+
+// expectReply reads until the pattern matches unread data, consuming
+// everything up to the end of the line the match ends on
+func expectReply(conn net.Conn, pending *[]byte, pattern *regexp.Regexp, deadline time.Time) ([]byte, error) {
+	return awaitReply(conn, pending, pattern.FindIndex, deadline)
+}
+
+// matchAll finds where the last of several patterns ends, once all match;
+// a step that only captures waits for every value it needs
+func matchAll(patterns []*regexp.Regexp) func([]byte) []int {
+	return func(data []byte) []int {
+		end := 0
+		for _, pattern := range patterns {
+			loc := pattern.FindIndex(data)
+			if loc == nil {
+				return nil
+			}
+			if loc[1] > end {
+				end = loc[1]
+			}
+		}
+		return []int{0, end}
+	}
+}
+
+func awaitReply(conn net.Conn, pending *[]byte, find func([]byte) []int, deadline time.Time) ([]byte, error) {
+	buf := make([]byte, 4096)
+	for {
+		if loc := find(*pending); loc != nil {
+			end := loc[1]
+			if end > 0 && (*pending)[end-1] != '\n' {
+				if newline := bytes.IndexByte((*pending)[end:], '\n'); newline >= 0 {
+					end += newline + 1
+				}
+			}
+			reply := append([]byte(nil), (*pending)[:end]...)
+			*pending = (*pending)[end:]
+			return reply, nil
+		}
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		*pending = append(*pending, buf[:n]...)
+		if err != nil && n == 0 {
+			if find(*pending) != nil {
+				continue
+			}
+			return nil, err
+		}
+	}
+}
+
+// summarizeReply keeps the last lines of a reply short enough for JSON output
+func summarizeReply(reply []byte) string {
+	text := strings.TrimSpace(string(reply))
+	if len(text) > 200 {
+		text = "..." + text[len(text)-200:]
+	}
+	return text
+}
+
+// runDialog connects and walks the script, stopping at the first step
+// whose expectation is not met
+func runDialog(targetIP string, script DialogScript, timeout int) ConnectivityResult {
+	result := ConnectivityResult{TargetIP: targetIP, Port: script.Port, Mode: "dialog"}
+	dialog := &DialogResult{Name: script.Name}
+	result.Dialog = dialog
+
+	if script.Timeout > 0 {
+		timeout = script.Timeout
+	}
+	vars := map[string]string{"target": targetIP}
+	for name, value := range script.Variables {
+		vars[name] = value
+	}
+	tlsConfig := &tls.Config{ServerName: targetIP, InsecureSkipVerify: script.Insecure}
+
+	address := net.JoinHostPort(targetIP, strconv.Itoa(script.Port))
+	startTime := time.Now()
+	conn, err := net.DialTimeout("tcp", address, time.Duration(timeout)*time.Second)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s - %s", address, err)
+		return result
+	}
+	if script.TLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			result.Message = fmt.Sprintf("TLS handshake with %s failed - %s", address, err)
+			return result
+		}
+		conn = tlsConn
+	}
+	defer func() { conn.Close() }()
+
+	var pending []byte
+	for i, step := range script.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		stepResult := DialogStepResult{Name: name, Expect: step.Expect}
+		stepTimeout := timeout
+		if step.Timeout > 0 {
+			stepTimeout = step.Timeout
+		}
+		stepStart := time.Now()
+
+		stepResult.Error = func() string {
+			payload, err := dialogPayload(step, vars)
+			if err != nil {
+				return fmt.Sprintf("invalid hex: %v", err)
+			}
+			if len(payload) > 0 {
+				conn.SetWriteDeadline(time.Now().Add(time.Duration(stepTimeout) * time.Second))
+				if _, err := conn.Write(payload); err != nil {
+					return fmt.Sprintf("send failed: %v", err)
+				}
+				stepResult.BytesSent = len(payload)
+			}
+
+			var reply []byte
+			if step.Expect != "" {
+				pattern := regexp.MustCompile("(?m)" + step.Expect)
+				reply, err = expectReply(conn, &pending, pattern, time.Now().Add(time.Duration(stepTimeout)*time.Second))
+				if err != nil {
+					if len(pending) > 0 {
+						return fmt.Sprintf("expected %q but got %q (%v)", step.Expect, summarizeReply(pending), err)
+					}
+					return fmt.Sprintf("expected %q but got nothing (%v)", step.Expect, err)
+				}
+				stepResult.Matched = summarizeReply(reply)
+			}
+
+			captures := make(map[string]*regexp.Regexp, len(step.Capture))
+			patterns := make([]*regexp.Regexp, 0, len(step.Capture))
+			for variable, expr := range step.Capture {
+				re, err := regexp.Compile("(?m)" + expr)
+				if err != nil {
+					return fmt.Sprintf("capture %s: %v", variable, err)
+				}
+				captures[variable] = re
+				patterns = append(patterns, re)
+			}
+			if step.Expect == "" && len(patterns) > 0 {
+				reply, err = awaitReply(conn, &pending, matchAll(patterns), time.Now().Add(time.Duration(stepTimeout)*time.Second))
+				if err != nil {
+					return fmt.Sprintf("capture: reply %q did not match every capture (%v)", summarizeReply(pending), err)
+				}
+			}
+
+			for variable, re := range captures {
+				expr := step.Capture[variable]
+				matches := re.FindSubmatch(reply)
+				if matches == nil {
+					return fmt.Sprintf("capture %s: %q did not match", variable, expr)
+				}
+				vars[variable] = string(matches[len(matches)-1])
+			}
+
+			if step.StartTLS {
+				tlsConn := tls.Client(conn, tlsConfig)
+				tlsConn.SetDeadline(time.Now().Add(time.Duration(stepTimeout) * time.Second))
+				if err := tlsConn.Handshake(); err != nil {
+					return fmt.Sprintf("STARTTLS handshake failed: %v", err)
+				}
+				tlsConn.SetDeadline(time.Time{})
+				conn = tlsConn
+				pending = nil
+			}
+			return ""
+		}()
+
+		stepResult.ResponseTime = time.Since(stepStart).Milliseconds()
+		stepResult.Success = stepResult.Error == ""
+		dialog.Steps = append(dialog.Steps, stepResult)
+		if !stepResult.Success {
+			dialog.FailedStep = name
+			break
+		}
+	}
+
+	result.ResponseTime = time.Since(startTime).Milliseconds()
+	result.Success = dialog.FailedStep == ""
+	if result.Success {
+		result.Message = fmt.Sprintf("Dialog with %s completed %d steps in %dms", address, len(dialog.Steps), result.ResponseTime)
+	} else {
+		result.Message = fmt.Sprintf("Dialog with %s failed at %s", address, dialog.FailedStep)
+	}
+	return result
+}
+
 func main() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: connectivity <targetIP> <mode> [port|port1,port2,...] [timeout]")
-		fmt.Println("Modes: ping, tcp, udp, all")
+		fmt.Println("       connectivity <group> multicast <port> [window] [interface]")
+		fmt.Println("       connectivity <targetIP> mtu [agentPort] [timeout]")
+		fmt.Println("       connectivity <listenIP> mtu-agent <port>")
+		fmt.Println("       connectivity <targetIP> dialog <script.json> [timeout]")
+		fmt.Println("Modes: ping, tcp, udp, all, multicast, mtu, mtu-agent, dialog")
+		fmt.Println("mtu also works against bin/agent; agents and clients share " + agentTokenEnv)
 		os.Exit(1)
 	}
 
@@ -256,10 +1059,61 @@ func main() {
 			}
 		}
 		result = checkUdpPort(targetIP, port, timeout)
+	} else if mode == "multicast" {
+		port := 5000
+		if len(os.Args) >= 4 {
+			portArg, err := strconv.Atoi(os.Args[3])
+			if err == nil {
+				port = portArg
+			}
+		}
+		ifaceName := ""
+		if len(os.Args) >= 6 {
+			ifaceName = os.Args[5]
+		}
+		result = checkMulticast(targetIP, port, timeout, ifaceName)
+	} else if mode == "mtu" {
+		agentPort := 0
+		if len(os.Args) >= 4 {
+			portArg, err := strconv.Atoi(os.Args[3])
+			if err == nil {
+				agentPort = portArg
+			}
+		}
+		result = checkMTU(targetIP, agentPort, timeout)
+	} else if mode == "mtu-agent" {
+		port := 8799
+		if len(os.Args) >= 4 {
+			portArg, err := strconv.Atoi(os.Args[3])
+			if err == nil {
+				port = portArg
+			}
+		}
+		if err := runMTUAgent(targetIP, port); err != nil {
+			fmt.Printf("{\"error\": \"%s\"}\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	} else if mode == "dialog" {
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: connectivity <targetIP> dialog <script.json> [timeout]")
+			os.Exit(1)
+		}
+		script, err := loadDialogScript(os.Args[3])
+		if err != nil {
+			result = ConnectivityResult{
+				Success:  false,
+				Message:  err.Error(),
+				TargetIP: targetIP,
+				Mode:     mode,
+			}
+		} else {
+			result = runDialog(targetIP, script, timeout)
+		}
 	} else {
 		result = ConnectivityResult{
 			Success:  false,
-			Message:  fmt.Sprintf("Unknown mode: %s. Use 'ping', 'tcp', 'udp', or 'all'", mode),
+			Message:  fmt.Sprintf("Unknown mode: %s. Use 'ping', 'tcp', 'udp', 'all', 'multicast', 'mtu', 'mtu-agent' or 'dialog'", mode),
 			TargetIP: targetIP,
 			Mode:     mode,
 		}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,6 +37,556 @@ type MultipleDNSResult struct {
 	Failed     int         `json:"failed"`
 }
 
+type ResolverAnswer struct {
+	Resolver    string   `json:"resolver"`
+	Label       string   `json:"label,omitempty"`
+	Answers     []string `json:"answers,omitempty"`
+	ResolveTime int64    `json:"resolveTimeMs"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type AnswerGroup struct {
+	Answers   []string `json:"answers"`
+	Resolvers []string `json:"resolvers"`
+}
+
+type GeoDNSResult struct {
+	Domain     string           `json:"domain"`
+	RecordType string           `json:"recordType"`
+	Resolvers  []ResolverAnswer `json:"resolvers"`
+	Groups     []AnswerGroup    `json:"groups"`
+	Consistent bool             `json:"consistent"`
+	TotalTime  int64            `json:"totalTimeMs"`
+}
+
+type SubnetAnswer struct {
+	Subnet      string   `json:"subnet"`
+	Label       string   `json:"label,omitempty"`
+	Answers     []string `json:"answers,omitempty"`
+	Echoed      bool     `json:"ecsEchoed"`
+	ScopePrefix int      `json:"scopePrefix"`
+	Rcode       string   `json:"rcode,omitempty"`
+	ResolveTime int64    `json:"resolveTimeMs"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type SubnetGroup struct {
+	Answers []string `json:"answers"`
+	Subnets []string `json:"subnets"`
+}
+
+type ClientSubnetResult struct {
+	Domain     string         `json:"domain"`
+	RecordType string         `json:"recordType"`
+	Resolver   string         `json:"resolver"`
+	Subnets    []SubnetAnswer `json:"subnets"`
+	Groups     []SubnetGroup  `json:"groups"`
+	Consistent bool           `json:"consistent"`
+	Supported  bool           `json:"ecsSupported"`
+	TotalTime  int64          `json:"totalTimeMs"`
+}
+
+// Resolver used for client subnet probes when none is given. Many public
+// resolvers (Cloudflare among them) strip ECS for privacy; Google forwards it.
+const defaultClientSubnetResolver = "8.8.8.8"
+
+// Public resolvers used when no resolver list is given. Anycast services
+// answer from the PoP nearest this host, so pass regional resolvers
+// (label=ip) to compare what users elsewhere receive.
+var defaultCompareResolvers = []string{
+	"google=8.8.8.8",
+	"cloudflare=1.1.1.1",
+	"quad9=9.9.9.9",
+	"opendns=208.67.222.222",
+}
+
+type FailoverStep struct {
+	Lookup      int    `json:"lookup,omitempty"` // Which rotated lookup the step belongs to
+	Resolver    string `json:"resolver"`
+	Attempt     int    `json:"attempt"`
+	Blackholed  bool   `json:"blackholed"`
+	Success     bool   `json:"success"`
+	ElapsedTime int64  `json:"elapsedTimeMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+type FailoverResult struct {
+	Domain         string   `json:"domain"`
+	Resolvers      []string `json:"resolvers"`
+	FailedResolver string   `json:"failedResolver"`
+	TimeoutSec     int      `json:"timeoutSec"`
+	Attempts       int      `json:"attempts"`
+	Rotate         bool     `json:"rotate"`
+	BaselineTime   int64    `json:"baselineTimeMs"`
+	FailoverTime   int64    `json:"failoverTimeMs"` // Slowest simulated lookup
+	// Estimated extra stall per lookup: the failover time minus the healthy
+	// baseline, not a measurement of a real outage
+	EstimatedOutage int64          `json:"estimatedOutageMs"`
+	StalledLookups  int            `json:"stalledLookups"` // Lookups that tried the failed resolver first
+	Lookups         int            `json:"lookups"`
+	AnsweredBy      string         `json:"answeredBy,omitempty"`
+	Answers         []string       `json:"answers,omitempty"`
+	Steps           []FailoverStep `json:"steps"`
+	Error           string         `json:"error,omitempty"`
+}
+
+// resolverConfig mirrors the parts of resolv.conf that drive client-side failover
+type resolverConfig struct {
+	Servers  []string
+	Timeout  int
+	Attempts int
+	Rotate   bool
+}
+
+// blackholeConn simulates a dead resolver: queries are swallowed and reads
+// block until the deadline passes, exactly like a dropped UDP packet.
+type blackholeConn struct {
+	mu       sync.Mutex
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newBlackholeConn() *blackholeConn {
+	return &blackholeConn{closed: make(chan struct{})}
+}
+
+func (c *blackholeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *blackholeConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *blackholeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+func (c *blackholeConn) LocalAddr() net.Addr  { return &net.UDPAddr{} }
+func (c *blackholeConn) RemoteAddr() net.Addr { return &net.UDPAddr{} }
+func (c *blackholeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+func (c *blackholeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+func (c *blackholeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// resolverAddress appends the default DNS port unless one is already present
+func resolverAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+// readResolverConfig parses nameservers and failover options from resolv.conf
+func readResolverConfig(path string) resolverConfig {
+	// glibc defaults when resolv.conf does not override them
+	config := resolverConfig{Timeout: 5, Attempts: 2}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return config
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			config.Servers = append(config.Servers, fields[1])
+		case "options":
+			for _, option := range fields[1:] {
+				if option == "rotate" {
+					config.Rotate = true
+				} else if strings.HasPrefix(option, "timeout:") {
+					if n, err := strconv.Atoi(strings.TrimPrefix(option, "timeout:")); err == nil && n > 0 {
+						config.Timeout = n
+					}
+				} else if strings.HasPrefix(option, "attempts:") {
+					if n, err := strconv.Atoi(strings.TrimPrefix(option, "attempts:")); err == nil && n > 0 {
+						config.Attempts = n
+					}
+				}
+			}
+		}
+	}
+
+	return config
+}
+
+// serverResolver builds a resolver that sends every query to server
+func serverResolver(server string, timeout time.Duration) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, resolverAddress(server))
+		},
+	}
+}
+
+// queryResolver resolves domain against a single server, or against a
+// blackhole when the server is being treated as failed
+func queryResolver(domain string, server string, timeout time.Duration, blackholed bool) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resolver := serverResolver(server, timeout)
+	if blackholed {
+		resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return newBlackholeConn(), nil
+		}
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		answers = append(answers, addr.IP.String())
+	}
+	return answers, nil
+}
+
+// testResolverFailover blackholes the primary resolver and replays the
+// client's attempt/timeout schedule to measure how long lookups stall
+// before a secondary answers
+func testResolverFailover(domain string, config resolverConfig) FailoverResult {
+	result := FailoverResult{
+		Domain:     domain,
+		Resolvers:  config.Servers,
+		TimeoutSec: config.Timeout,
+		Attempts:   config.Attempts,
+		Rotate:     config.Rotate,
+	}
+
+	if len(config.Servers) < 2 {
+		result.Error = "at least two resolvers are required to test failover"
+		return result
+	}
+
+	primary := config.Servers[0]
+	result.FailedResolver = primary
+	perTry := time.Duration(config.Timeout) * time.Second
+
+	// Baseline: how quickly the primary answers while healthy
+	baselineStart := time.Now()
+	_, baselineErr := queryResolver(domain, primary, perTry, false)
+	result.BaselineTime = time.Since(baselineStart).Milliseconds()
+
+	// Without rotate every lookup starts at the primary. With it the stub
+	// resolver starts each lookup at the next server, so only one lookup in
+	// len(servers) hits the dead primary first; simulate one of each.
+	lookups := 1
+	if config.Rotate {
+		lookups = len(config.Servers)
+	}
+	result.Lookups = lookups
+	for lookup := 0; lookup < lookups; lookup++ {
+		order := append(append([]string(nil), config.Servers[lookup:]...), config.Servers[:lookup]...)
+		elapsed, answered := simulateLookup(domain, order, primary, config, perTry, lookup, &result)
+		if !answered {
+			result.Error = "no secondary resolver answered while the primary was down"
+			if baselineErr != nil {
+				result.Error += fmt.Sprintf(" (primary resolver %s also failed before simulation: %v)", primary, baselineErr)
+			}
+			return result
+		}
+		if order[0] == primary {
+			result.StalledLookups++
+		}
+		if elapsed > result.FailoverTime {
+			result.FailoverTime = elapsed
+		}
+	}
+
+	result.EstimatedOutage = result.FailoverTime - result.BaselineTime
+	if result.EstimatedOutage < 0 {
+		result.EstimatedOutage = 0
+	}
+
+	return result
+}
+
+// simulateLookup walks order for each attempt, as the stub resolver does,
+// with primary blackholed. It records the steps and the first answer.
+func simulateLookup(domain string, order []string, primary string, config resolverConfig, perTry time.Duration, lookup int, result *FailoverResult) (int64, bool) {
+	if config.Rotate {
+		lookup++ // Numbered from one when rotating, omitted otherwise
+	} else {
+		lookup = 0
+	}
+
+	start := time.Now()
+	for attempt := 1; attempt <= config.Attempts; attempt++ {
+		for _, server := range order {
+			stepStart := time.Now()
+			answers, err := queryResolver(domain, server, perTry, server == primary)
+
+			step := FailoverStep{
+				Lookup:      lookup,
+				Resolver:    server,
+				Attempt:     attempt,
+				Blackholed:  server == primary,
+				Success:     err == nil,
+				ElapsedTime: time.Since(stepStart).Milliseconds(),
+			}
+			if err != nil {
+				step.Error = err.Error()
+			}
+			result.Steps = append(result.Steps, step)
+
+			if err == nil {
+				if result.AnsweredBy == "" {
+					result.AnsweredBy = server
+					result.Answers = answers
+				}
+				return time.Since(start).Milliseconds(), true
+			}
+		}
+	}
+	return time.Since(start).Milliseconds(), false
+}
+
+// queryRecords resolves a single record type through one resolver
+func queryRecords(ctx context.Context, resolver *net.Resolver, domain string, recordType string) ([]string, error) {
+	var answers []string
+
+	switch recordType {
+	case "a", "aaaa":
+		network := "ip4"
+		if recordType == "aaaa" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "cname":
+		cname, err := resolver.LookupCNAME(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		answers = []string{cname}
+	default:
+		return nil, fmt.Errorf("unsupported record type for comparison: %s", recordType)
+	}
+
+	sort.Strings(answers)
+	return answers, nil
+}
+
+// compareResolvers asks every resolver the same question and groups
+// resolvers by the answer set they returned
+func compareResolvers(domain string, resolvers []string, recordType string, timeout int) GeoDNSResult {
+	startTime := time.Now()
+	result := GeoDNSResult{
+		Domain:     domain,
+		RecordType: recordType,
+		Resolvers:  make([]ResolverAnswer, len(resolvers)),
+	}
+
+	var wg sync.WaitGroup
+	for i, spec := range resolvers {
+		wg.Add(1)
+		go func(index int, spec string) {
+			defer wg.Done()
+
+			// Resolvers may be labelled, e.g. "eu-west=10.1.0.2"
+			answer := ResolverAnswer{Resolver: spec}
+			if label, server, found := strings.Cut(spec, "="); found {
+				answer.Label = label
+				answer.Resolver = server
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+			defer cancel()
+
+			queryStart := time.Now()
+			answers, err := queryRecords(ctx, serverResolver(answer.Resolver, time.Duration(timeout)*time.Second), domain, recordType)
+			answer.ResolveTime = time.Since(queryStart).Milliseconds()
+			if err != nil {
+				answer.Error = err.Error()
+			}
+			answer.Answers = answers
+
+			result.Resolvers[index] = answer
+		}(i, spec)
+	}
+	wg.Wait()
+
+	// Group resolvers that agree; failed lookups are left out of the groups
+	groupIndex := make(map[string]int)
+	for _, r := range result.Resolvers {
+		if r.Error != "" {
+			continue
+		}
+		name := r.Resolver
+		if r.Label != "" {
+			name = r.Label
+		}
+
+		key := strings.Join(r.Answers, ",")
+		if i, ok := groupIndex[key]; ok {
+			result.Groups[i].Resolvers = append(result.Groups[i].Resolvers, name)
+			continue
+		}
+		groupIndex[key] = len(result.Groups)
+		result.Groups = append(result.Groups, AnswerGroup{Answers: r.Answers, Resolvers: []string{name}})
+	}
+
+	result.Consistent = len(result.Groups) <= 1
+	result.TotalTime = time.Since(startTime).Milliseconds()
+	return result
+}
+
+// parseClientSubnet accepts "label=prefix" or a bare address. Bare addresses
+// become a /24 or /56, the prefixes resolvers forward by default.
+func parseClientSubnet(spec string) (string, *net.IPNet, error) {
+	label, value, found := strings.Cut(spec, "=")
+	if !found {
+		label, value = "", spec
+	}
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", nil, fmt.Errorf("invalid client subnet: %s", value)
+		}
+		if ip.To4() != nil {
+			value += "/24"
+		} else {
+			value += "/56"
+		}
+	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid client subnet: %s", value)
+	}
+	return label, subnet, nil
+}
+
+// compareClientSubnets asks one resolver the same question on behalf of
+// several client subnets and groups the subnets by the answer they got,
+// showing how geo or latency based routing treats users in each prefix
+func compareClientSubnets(domain string, subnets []string, resolver string, recordType string, timeout int) ClientSubnetResult {
+	startTime := time.Now()
+	result := ClientSubnetResult{
+		Domain:     domain,
+		RecordType: recordType,
+		Resolver:   resolver,
+		Subnets:    make([]SubnetAnswer, len(subnets)),
+	}
+
+	qtypes := map[string]uint16{"a": dnsTypeA, "aaaa": dnsTypeAAAA, "cname": dnsTypeCNAME}
+	qtype, ok := qtypes[recordType]
+	server := resolverAddress(resolver)
+
+	var wg sync.WaitGroup
+	for i, spec := range subnets {
+		wg.Add(1)
+		go func(index int, spec string) {
+			defer wg.Done()
+
+			answer := SubnetAnswer{Subnet: spec}
+			defer func() { result.Subnets[index] = answer }()
+			if !ok {
+				answer.Error = fmt.Sprintf("unsupported record type for comparison: %s", recordType)
+				return
+			}
+			label, subnet, err := parseClientSubnet(spec)
+			if err != nil {
+				answer.Error = err.Error()
+				return
+			}
+			answer.Label = label
+			answer.Subnet = subnet.String()
+
+			msg, elapsed, err := exchangeQuery(server, encodeClientSubnetQuery(randomQueryID(), domain, qtype, subnet), time.Duration(timeout)*time.Second)
+			answer.ResolveTime = elapsed.Milliseconds()
+			if err != nil {
+				answer.Error = err.Error()
+				return
+			}
+			answer.Rcode = rcodeNames[msg.Rcode]
+			answer.ScopePrefix, answer.Echoed = msg.clientSubnetScope()
+			if msg.Rcode != 0 {
+				answer.Error = fmt.Sprintf("resolver returned %s", answer.Rcode)
+				return
+			}
+
+			for _, rr := range msg.Answer {
+				if rr.Type != qtype {
+					continue
+				}
+				if qtype == dnsTypeCNAME {
+					answer.Answers = append(answer.Answers, msg.target(rr))
+				} else if addr := msg.address(rr); addr != "" {
+					answer.Answers = append(answer.Answers, addr)
+				}
+			}
+			sort.Strings(answer.Answers)
+		}(i, spec)
+	}
+	wg.Wait()
+
+	groupIndex := make(map[string]int)
+	for _, s := range result.Subnets {
+		if s.Error != "" {
+			continue
+		}
+		// A resolver that forwards ECS echoes the option back; one that never
+		// does is answering from its own location for every subnet
+		if s.Echoed {
+			result.Supported = true
+		}
+		name := s.Subnet
+		if s.Label != "" {
+			name = s.Label
+		}
+
+		key := strings.Join(s.Answers, ",")
+		if i, ok := groupIndex[key]; ok {
+			result.Groups[i].Subnets = append(result.Groups[i].Subnets, name)
+			continue
+		}
+		groupIndex[key] = len(result.Groups)
+		result.Groups = append(result.Groups, SubnetGroup{Answers: s.Answers, Subnets: []string{name}})
+	}
+
+	result.Consistent = len(result.Groups) <= 1
+	result.TotalTime = time.Since(startTime).Milliseconds()
+	return result
+}
+
 func lookupDNS(ctx context.Context, domain string, queryTypes []string, dnsServer string) DNSResult {
 	startTime := time.Now()
 
@@ -40,7 +596,7 @@ func lookupDNS(ctx context.Context, domain string, queryTypes []string, dnsServe
 			PreferGo: true,
 			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 				d := net.Dialer{Timeout: 10 * time.Second}
-				return d.DialContext(ctx, "udp", dnsServer+":53")
+				return d.DialContext(ctx, "udp", resolverAddress(dnsServer))
 			},
 		}
 	} else {
@@ -190,6 +746,620 @@ func lookupMultipleDomains(domains []string, queryTypes []string, dnsServer stri
 	}
 }
 
+// ZoneServerCheck is one authoritative server address queried during an audit
+type ZoneServerCheck struct {
+	NameServer    string   `json:"nameServer"`
+	Address       string   `json:"address"`
+	Authoritative bool     `json:"authoritative"`
+	Rcode         string   `json:"rcode,omitempty"`
+	Serial        uint32   `json:"serial,omitempty"`
+	NS            []string `json:"ns,omitempty"`
+	ResponseTime  int64    `json:"responseTimeMs"`
+	Lame          bool     `json:"lame"`
+	InSync        bool     `json:"inSync"`
+	Skipped       bool     `json:"skipped,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// GlueCheck compares the parent's glue for a name server with what the
+// name server's own address records say
+type GlueCheck struct {
+	NameServer string   `json:"nameServer"`
+	Glue       []string `json:"glue,omitempty"`
+	Resolved   []string `json:"resolved,omitempty"`
+	Required   bool     `json:"required"`
+	Match      bool     `json:"match"`
+}
+
+type ZoneAuditResult struct {
+	Zone            string            `json:"zone"`
+	Parent          string            `json:"parent,omitempty"`
+	ParentServer    string            `json:"parentServer,omitempty"`
+	Delegation      []string          `json:"delegation,omitempty"`
+	DelegationError string            `json:"delegationError,omitempty"`
+	Glue            []GlueCheck       `json:"glue,omitempty"`
+	Servers         []ZoneServerCheck `json:"servers"`
+	LatestSerial    uint32            `json:"latestSerial"`
+	Lame            []string          `json:"lame,omitempty"`
+	OutOfSync       []string          `json:"outOfSync,omitempty"`
+	Issues          []string          `json:"issues,omitempty"`
+	Consistent      bool              `json:"consistent"`
+	TotalTime       int64             `json:"totalTimeMs"`
+}
+
+const (
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+
+	// EDNS Client Subnet option (RFC 7871)
+	ednsOptionClientSubnet = 8
+)
+
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// dnsRR is a resource record whose data still points into the message,
+// since names inside it may be compressed against earlier parts
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	start int
+	end   int
+}
+
+type dnsMessage struct {
+	raw           []byte
+	Authoritative bool
+	Truncated     bool
+	Rcode         int
+	Answer        []dnsRR
+	Authority     []dnsRR
+	Additional    []dnsRR
+}
+
+// encodeQuery builds a non-recursive query; authoritative servers must
+// answer from their own data, which is exactly what an audit wants to see
+func encodeQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1)
+}
+
+// encodeClientSubnetQuery builds a recursive query carrying an OPT record
+// with the EDNS Client Subnet option, so the resolver answers as it would
+// for a client inside subnet
+func encodeClientSubnetQuery(id uint16, name string, qtype uint16, subnet *net.IPNet) []byte {
+	msg := encodeQuery(id, name, qtype)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[10:], 1)
+
+	family, addr := uint16(1), subnet.IP.To4()
+	if addr == nil {
+		family, addr = 2, subnet.IP.To16()
+	}
+	prefix, _ := subnet.Mask.Size()
+	// Only the bytes covered by the prefix are sent
+	addr = addr[:(prefix+7)/8]
+
+	option := binary.BigEndian.AppendUint16(nil, family)
+	option = append(option, byte(prefix), 0)
+	option = append(option, addr...)
+
+	msg = append(msg, 0) // root name
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, 1232) // UDP payload size
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(4+len(option)))
+	msg = binary.BigEndian.AppendUint16(msg, ednsOptionClientSubnet)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(option)))
+	return append(msg, option...)
+}
+
+// readName decodes a possibly compressed name starting at off and returns
+// the offset just past it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name runs past end of message")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".") + "."), next, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errors.New("bad compression pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("label runs past end of message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func parseDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short DNS message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m := &dnsMessage{
+		raw:           msg,
+		Authoritative: flags&0x0400 != 0,
+		Truncated:     flags&0x0200 != 0,
+		Rcode:         int(flags & 0x000F),
+	}
+
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	sections := []*[]dnsRR{&m.Answer, &m.Authority, &m.Additional}
+	for i, section := range sections {
+		count := int(binary.BigEndian.Uint16(msg[6+2*i:]))
+		for j := 0; j < count; j++ {
+			name, next, err := readName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(msg) {
+				return nil, errors.New("record header runs past end of message")
+			}
+			rr := dnsRR{Name: name, Type: binary.BigEndian.Uint16(msg[next:])}
+			rr.start = next + 10
+			rr.end = rr.start + int(binary.BigEndian.Uint16(msg[next+8:]))
+			if rr.end > len(msg) {
+				return nil, errors.New("record data runs past end of message")
+			}
+			*section = append(*section, rr)
+			off = rr.end
+		}
+	}
+	return m, nil
+}
+
+// target returns the name held by an NS record
+func (m *dnsMessage) target(rr dnsRR) string {
+	name, _, err := readName(m.raw, rr.start)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// serial returns the serial of an SOA record
+func (m *dnsMessage) serial(rr dnsRR) (uint32, bool) {
+	_, off, err := readName(m.raw, rr.start) // MNAME
+	if err != nil {
+		return 0, false
+	}
+	if _, off, err = readName(m.raw, off); err != nil || off+4 > rr.end { // RNAME
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(m.raw[off:]), true
+}
+
+// clientSubnetScope returns the scope prefix from an echoed EDNS Client
+// Subnet option, and whether the option was echoed at all. A scope of 0
+// means the answer does not depend on the client's location.
+func (m *dnsMessage) clientSubnetScope() (int, bool) {
+	for _, rr := range m.Additional {
+		if rr.Type != dnsTypeOPT {
+			continue
+		}
+		data := m.raw[rr.start:rr.end]
+		for len(data) >= 4 {
+			code := binary.BigEndian.Uint16(data)
+			length := int(binary.BigEndian.Uint16(data[2:]))
+			if 4+length > len(data) {
+				break
+			}
+			if code == ednsOptionClientSubnet && length >= 4 {
+				return int(data[7]), true
+			}
+			data = data[4+length:]
+		}
+	}
+	return 0, false
+}
+
+// address returns the IP held by an A or AAAA record
+func (m *dnsMessage) address(rr dnsRR) string {
+	data := m.raw[rr.start:rr.end]
+	if (rr.Type == dnsTypeA && len(data) == 4) || (rr.Type == dnsTypeAAAA && len(data) == 16) {
+		return net.IP(data).String()
+	}
+	return ""
+}
+
+// randomQueryID picks an unpredictable DNS message ID so off-path replies
+// cannot be lined up with outstanding queries
+func randomQueryID() uint16 {
+	var b [2]byte
+	cryptorand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// exchange sends one query over UDP, retrying over TCP when the answer is truncated
+func exchange(server string, name string, qtype uint16, timeout time.Duration) (*dnsMessage, time.Duration, error) {
+	return exchangeQuery(server, encodeQuery(randomQueryID(), name, qtype), timeout)
+}
+
+// exchangeQuery sends an already encoded query, matching replies on its ID
+func exchangeQuery(server string, query []byte, timeout time.Duration) (*dnsMessage, time.Duration, error) {
+	id := binary.BigEndian.Uint16(query)
+	start := time.Now()
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, time.Since(start), err
+		}
+		// Ignore stray datagrams that do not answer this query
+		if n < 12 || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		msg, err := parseDNSMessage(append([]byte(nil), buf[:n]...))
+		if err != nil || !msg.Truncated {
+			return msg, time.Since(start), err
+		}
+		break
+	}
+
+	tcp, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(timeout))
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := tcp.Write(append(framed, query...)); err != nil {
+		return nil, time.Since(start), err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(tcp, length[:]); err != nil {
+		return nil, time.Since(start), err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(tcp, reply); err != nil {
+		return nil, time.Since(start), err
+	}
+	if len(reply) < 12 || binary.BigEndian.Uint16(reply) != id {
+		return nil, time.Since(start), fmt.Errorf("TCP reply from %s does not answer the query", server)
+	}
+	msg, err := parseDNSMessage(reply)
+	return msg, time.Since(start), err
+}
+
+// serialNewer compares SOA serials with RFC 1982 arithmetic so a wrapped
+// serial still counts as newer
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".") + ".")
+}
+
+func parentZone(zone string) string {
+	if _, parent, ok := strings.Cut(strings.TrimSuffix(zone, "."), "."); ok {
+		return fqdn(parent)
+	}
+	return "."
+}
+
+func inBailiwick(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func sortedSet(values map[string]bool) []string {
+	list := make([]string, 0, len(values))
+	for value := range values {
+		list = append(list, value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// findDelegation asks the parent's servers which name servers (and glue)
+// they hand out for zone
+func findDelegation(ctx context.Context, zone string, timeout time.Duration) (string, []string, map[string][]string, error) {
+	parentServers, err := net.DefaultResolver.LookupNS(ctx, parentZone(zone))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("cannot find servers for parent zone %s: %v", parentZone(zone), err)
+	}
+
+	var lastErr error
+	for _, parent := range parentServers {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, parent.Host)
+		if err != nil || len(addrs) == 0 {
+			lastErr = fmt.Errorf("cannot resolve %s: %v", parent.Host, err)
+			continue
+		}
+		server := net.JoinHostPort(addrs[0], "53")
+		msg, _, err := exchange(server, zone, dnsTypeNS, timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", parent.Host, err)
+			continue
+		}
+
+		// A referral carries the NS set in the authority section; a parent
+		// that also serves the child answers directly
+		servers := map[string]bool{}
+		for _, rr := range append(msg.Answer, msg.Authority...) {
+			if rr.Type == dnsTypeNS && rr.Name == zone {
+				servers[msg.target(rr)] = true
+			}
+		}
+		if len(servers) == 0 {
+			lastErr = fmt.Errorf("%s returned no delegation for %s (%s)", parent.Host, zone, rcodeNames[msg.Rcode])
+			continue
+		}
+
+		glue := map[string][]string{}
+		for _, rr := range msg.Additional {
+			if addr := msg.address(rr); addr != "" && servers[rr.Name] {
+				glue[rr.Name] = append(glue[rr.Name], addr)
+			}
+		}
+		return fmt.Sprintf("%s (%s)", strings.TrimSuffix(parent.Host, "."), addrs[0]), sortedSet(servers), glue, nil
+	}
+	return "", nil, nil, lastErr
+}
+
+// checkZoneServer asks one server address for the zone's SOA and NS set
+func checkZoneServer(nameServer, address, zone string, timeout time.Duration) ZoneServerCheck {
+	check := ZoneServerCheck{NameServer: nameServer, Address: address}
+
+	msg, elapsed, err := exchange(address, zone, dnsTypeSOA, timeout)
+	check.ResponseTime = elapsed.Milliseconds()
+	if err != nil {
+		check.Error = err.Error()
+		// No route to this address family says more about this host than the server
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			check.Skipped = true
+		} else {
+			check.Lame = true
+		}
+		return check
+	}
+
+	check.Rcode = rcodeNames[msg.Rcode]
+	check.Authoritative = msg.Authoritative
+	haveSOA := false
+	for _, rr := range msg.Answer {
+		if rr.Type == dnsTypeSOA && rr.Name == zone {
+			check.Serial, haveSOA = msg.serial(rr)
+		}
+	}
+	if !msg.Authoritative || msg.Rcode != 0 || !haveSOA {
+		check.Lame = true
+		return check
+	}
+
+	if nsMsg, _, err := exchange(address, zone, dnsTypeNS, timeout); err == nil {
+		servers := map[string]bool{}
+		for _, rr := range nsMsg.Answer {
+			if rr.Type == dnsTypeNS && rr.Name == zone {
+				servers[nsMsg.target(rr)] = true
+			}
+		}
+		check.NS = sortedSet(servers)
+	} else {
+		check.Error = fmt.Sprintf("NS query failed: %v", err)
+	}
+	return check
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, v := range a {
+		seen[v] = true
+	}
+	for _, v := range b {
+		if !seen[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// auditZone queries every authoritative server of zone and reports lame
+// delegations, out-of-sync serials and NS/glue disagreements. servers
+// (name=ip[:port]) replaces delegation discovery for internal zones.
+func auditZone(zone string, servers []string, timeout int) ZoneAuditResult {
+	start := time.Now()
+	zone = fqdn(zone)
+	perQuery := time.Duration(timeout) * time.Second
+	result := ZoneAuditResult{Zone: zone, Parent: parentZone(zone), Servers: []ZoneServerCheck{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*perQuery)
+	defer cancel()
+
+	parentServer, delegation, glue, err := findDelegation(ctx, zone, perQuery)
+	if err != nil {
+		result.DelegationError = err.Error()
+	} else {
+		result.ParentServer = parentServer
+		result.Delegation = delegation
+	}
+
+	// Each name server is checked at every address it has
+	targets := map[string][]string{}
+	if len(servers) > 0 {
+		for _, entry := range servers {
+			name, addr, ok := strings.Cut(entry, "=")
+			if !ok {
+				name, addr = entry, entry
+			}
+			targets[fqdn(name)] = append(targets[fqdn(name)], resolverAddress(addr))
+		}
+	} else {
+		for _, ns := range delegation {
+			addrs := glue[ns]
+			if len(addrs) == 0 {
+				addrs, _ = net.DefaultResolver.LookupHost(ctx, ns)
+			}
+			if len(addrs) == 0 {
+				result.Issues = append(result.Issues, fmt.Sprintf("name server %s does not resolve", ns))
+			}
+			for _, addr := range addrs {
+				targets[ns] = append(targets[ns], net.JoinHostPort(addr, "53"))
+			}
+		}
+	}
+	if len(targets) == 0 && result.DelegationError != "" {
+		result.Issues = append(result.Issues, result.DelegationError)
+	}
+
+	// Glue must exist for in-zone name servers and agree with their A/AAAA records
+	for _, ns := range delegation {
+		resolved, _ := net.DefaultResolver.LookupHost(ctx, ns)
+		sort.Strings(resolved)
+		check := GlueCheck{NameServer: ns, Glue: glue[ns], Resolved: resolved, Required: inBailiwick(ns, zone)}
+		sort.Strings(check.Glue)
+		check.Match = len(check.Glue) == 0 || sameSet(check.Glue, check.Resolved)
+		if check.Required && len(check.Glue) == 0 {
+			check.Match = false
+			result.Issues = append(result.Issues, fmt.Sprintf("in-zone name server %s has no glue at the parent", ns))
+		} else if !check.Match {
+			result.Issues = append(result.Issues, fmt.Sprintf("glue for %s (%s) differs from its address records (%s)",
+				ns, strings.Join(check.Glue, ", "), strings.Join(check.Resolved, ", ")))
+		}
+		result.Glue = append(result.Glue, check)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for ns, addrs := range targets {
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(ns, addr string) {
+				defer wg.Done()
+				check := checkZoneServer(ns, addr, zone, perQuery)
+				mu.Lock()
+				result.Servers = append(result.Servers, check)
+				mu.Unlock()
+			}(ns, addr)
+		}
+	}
+	wg.Wait()
+	sort.Slice(result.Servers, func(i, j int) bool {
+		if result.Servers[i].NameServer != result.Servers[j].NameServer {
+			return result.Servers[i].NameServer < result.Servers[j].NameServer
+		}
+		return result.Servers[i].Address < result.Servers[j].Address
+	})
+
+	answered := false
+	for _, s := range result.Servers {
+		if !s.Lame && !s.Skipped && (!answered || serialNewer(s.Serial, result.LatestSerial)) {
+			result.LatestSerial = s.Serial
+			answered = true
+		}
+	}
+
+	// Without a delegation to check against, servers must at least agree with each other
+	expectedNS, nsSource := result.Delegation, "the parent delegates to"
+	if len(expectedNS) == 0 {
+		nsSource = "other servers list"
+		for _, s := range result.Servers {
+			if !s.Lame && len(s.NS) > 0 {
+				expectedNS = s.NS
+				break
+			}
+		}
+	}
+
+	for i := range result.Servers {
+		s := &result.Servers[i]
+		label := fmt.Sprintf("%s (%s)", strings.TrimSuffix(s.NameServer, "."), s.Address)
+		switch {
+		case s.Skipped:
+			continue
+		case s.Lame:
+			reason := s.Error
+			if reason == "" && !s.Authoritative {
+				reason = "answer is not authoritative"
+			} else if reason == "" {
+				reason = s.Rcode
+			}
+			result.Lame = append(result.Lame, label)
+			result.Issues = append(result.Issues, fmt.Sprintf("lame delegation: %s: %s", label, reason))
+			continue
+		}
+
+		s.InSync = s.Serial == result.LatestSerial
+		if !s.InSync {
+			result.OutOfSync = append(result.OutOfSync, label)
+			result.Issues = append(result.Issues, fmt.Sprintf("%s serves serial %d, latest is %d", label, s.Serial, result.LatestSerial))
+		}
+		if len(expectedNS) > 0 && len(s.NS) > 0 && !sameSet(s.NS, expectedNS) {
+			result.Issues = append(result.Issues, fmt.Sprintf("%s lists NS %s but %s %s",
+				label, strings.Join(s.NS, ", "), nsSource, strings.Join(expectedNS, ", ")))
+		}
+	}
+
+	if !answered {
+		result.Issues = append(result.Issues, "no authoritative server answered for the zone")
+	}
+	result.Consistent = len(result.Issues) == 0
+	result.TotalTime = time.Since(start).Milliseconds()
+	return result
+}
+
 func main() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: dns <domain1[,domain2,...]> <type1[,type2,...]> [server] [timeout]")
@@ -197,9 +1367,104 @@ func main() {
 		fmt.Println("Examples:")
 		fmt.Println("  dns google.com all")
 		fmt.Println("  dns google.com,cloudflare.com a,aaaa 8.8.8.8 5")
+		fmt.Println("  dns failover google.com [resolver1,resolver2,...] [timeout]")
+		fmt.Println("  dns compare google.com [label=resolver1,resolver2,...] [a|aaaa|cname] [timeout]")
+		fmt.Println("  dns ecs google.com label=subnet1,subnet2,... [resolver] [a|aaaa|cname] [timeout]")
+		fmt.Println("  dns audit example.com [timeout] [ns1=ip[:port],ns2=ip[:port],...]")
 		os.Exit(1)
 	}
 
+	if os.Args[1] == "audit" {
+		timeout := 5
+		if len(os.Args) >= 4 {
+			if t, err := strconv.Atoi(os.Args[3]); err == nil && t > 0 {
+				timeout = t
+			}
+		}
+
+		var servers []string
+		if len(os.Args) >= 5 && os.Args[4] != "" {
+			servers = strings.Split(os.Args[4], ",")
+		}
+
+		result := auditZone(os.Args[2], servers, timeout)
+		jsonResult, _ := json.Marshal(result)
+		fmt.Println(string(jsonResult))
+		return
+	}
+
+	if os.Args[1] == "compare" {
+		resolvers := defaultCompareResolvers
+		if len(os.Args) >= 4 && os.Args[3] != "" {
+			resolvers = strings.Split(os.Args[3], ",")
+		}
+
+		recordType := "a"
+		if len(os.Args) >= 5 && os.Args[4] != "" {
+			recordType = strings.ToLower(os.Args[4])
+		}
+
+		timeout := 10
+		if len(os.Args) >= 6 {
+			if t, err := strconv.Atoi(os.Args[5]); err == nil && t > 0 {
+				timeout = t
+			}
+		}
+
+		result := compareResolvers(os.Args[2], resolvers, recordType, timeout)
+		jsonResult, _ := json.Marshal(result)
+		fmt.Println(string(jsonResult))
+		return
+	}
+
+	if os.Args[1] == "ecs" {
+		if len(os.Args) < 4 || os.Args[3] == "" {
+			fmt.Println("Usage: dns ecs <domain> <label=subnet1,subnet2,...> [resolver] [a|aaaa|cname] [timeout]")
+			os.Exit(1)
+		}
+		subnets := strings.Split(os.Args[3], ",")
+
+		resolver := defaultClientSubnetResolver
+		if len(os.Args) >= 5 && os.Args[4] != "" {
+			resolver = os.Args[4]
+		}
+
+		recordType := "a"
+		if len(os.Args) >= 6 && os.Args[5] != "" {
+			recordType = strings.ToLower(os.Args[5])
+		}
+
+		timeout := 5
+		if len(os.Args) >= 7 {
+			if t, err := strconv.Atoi(os.Args[6]); err == nil && t > 0 {
+				timeout = t
+			}
+		}
+
+		result := compareClientSubnets(os.Args[2], subnets, resolver, recordType, timeout)
+		jsonResult, _ := json.Marshal(result)
+		fmt.Println(string(jsonResult))
+		return
+	}
+
+	if os.Args[1] == "failover" {
+		// Default to the host's own resolver configuration
+		config := readResolverConfig("/etc/resolv.conf")
+		if len(os.Args) >= 4 && os.Args[3] != "" && os.Args[3] != "system" {
+			config.Servers = strings.Split(os.Args[3], ",")
+		}
+		if len(os.Args) >= 5 {
+			if t, err := strconv.Atoi(os.Args[4]); err == nil && t > 0 {
+				config.Timeout = t
+			}
+		}
+
+		result := testResolverFailover(os.Args[2], config)
+		jsonResult, _ := json.Marshal(result)
+		fmt.Println(string(jsonResult))
+		return
+	}
+
 	domainsArg := os.Args[1]
 	domains := strings.Split(domainsArg, ",")
 
@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -35,6 +39,8 @@ type NetworkInterface struct {
 	Speed        int64              `json:"speedMbps,omitempty"`
 	Stats        *InterfaceStats    `json:"stats,omitempty"`
 	DefaultRoute bool               `json:"defaultRoute"`
+	Bond         *BondInfo          `json:"bond,omitempty"`       // Set on bond and team devices (Linux)
+	BondMaster   string             `json:"bondMaster,omitempty"` // The bond or team this link belongs to
 }
 
 type InterfaceStats struct {
@@ -50,6 +56,7 @@ type InterfaceResult struct {
 	Interfaces     []NetworkInterface `json:"interfaces"`
 	DefaultGateway string             `json:"defaultGateway,omitempty"`
 	DefaultIface   string             `json:"defaultInterface,omitempty"`
+	DegradedBonds  []string           `json:"degradedBonds,omitempty"`
 	CollectionTime int64              `json:"collectionTimeMs"`
 }
 
@@ -410,17 +417,606 @@ func collectAllInterfaceInfo() InterfaceResult {
 	}
 
 	wg.Wait()
+	attachBonds(&result)
 	result.CollectionTime = time.Since(startTime).Milliseconds()
 
 	return result
 }
 
+// attachBonds adds bond and team health to their interfaces and names the
+// bond each member belongs to. Bridges and VRFs are masters too, so only
+// masters that are known bonds or teams count.
+func attachBonds(result *InterfaceResult) {
+	bonds := collectBonds()
+	for i := range result.Interfaces {
+		if master := bondMaster(result.Interfaces[i].Name); bonds[master] != nil {
+			result.Interfaces[i].BondMaster = master
+		}
+		if bond, ok := bonds[result.Interfaces[i].Name]; ok {
+			result.Interfaces[i].Bond = bond
+			if bond.Status != "healthy" {
+				result.DegradedBonds = append(result.DegradedBonds, result.Interfaces[i].Name)
+			}
+		}
+	}
+	sort.Strings(result.DegradedBonds)
+}
+
+// BondMember is one link of a bond or team
+type BondMember struct {
+	Name         string `json:"name"`
+	LinkUp       bool   `json:"linkUp"`
+	State        string `json:"state"` // active/backup, selected/unselected (LACP) or up/down
+	Speed        int64  `json:"speedMbps,omitempty"`
+	Duplex       string `json:"duplex,omitempty"`
+	LinkFailures int64  `json:"linkFailures"` // Since the bond was created
+	AggregatorID int    `json:"aggregatorId,omitempty"`
+	// LACP port state flags of this side and the switch
+	ActorState   []string `json:"actorState,omitempty"`
+	PartnerState []string `json:"partnerState,omitempty"`
+	PartnerMAC   string   `json:"partnerMac,omitempty"`
+	PartnerKey   int      `json:"partnerKey,omitempty"`
+	PartnerPort  int      `json:"partnerPort,omitempty"`
+	Issues       []string `json:"issues,omitempty"`
+	actorBits    int
+	partnerBits  int
+}
+
+// LACPAggregator is the aggregator the bond is transmitting on
+type LACPAggregator struct {
+	ID         int    `json:"id"`
+	Ports      int    `json:"ports"`
+	ActorKey   int    `json:"actorKey"`
+	PartnerKey int    `json:"partnerKey"`
+	PartnerMAC string `json:"partnerMac"`
+}
+
+type BondInfo struct {
+	Kind         string          `json:"kind"` // bond or team
+	Mode         string          `json:"mode"`
+	LinkUp       bool            `json:"linkUp"`
+	ActiveMember string          `json:"activeMember,omitempty"`
+	LACPRate     string          `json:"lacpRate,omitempty"`
+	Aggregator   *LACPAggregator `json:"aggregator,omitempty"`
+	Members      []BondMember    `json:"members"`
+	Status       string          `json:"status"` // healthy, degraded or down
+	Issues       []string        `json:"issues,omitempty"`
+}
+
+const noPartnerMAC = "00:00:00:00:00:00"
+
+// LACP port state bits (IEEE 802.1AX); a working port is in sync,
+// collecting and distributing
+var lacpStateBits = []string{"activity", "short-timeout", "aggregation", "synchronization", "collecting", "distributing", "defaulted", "expired"}
+
+const lacpWorking = 0x08 | 0x10 | 0x20
+
+func lacpFlags(state int) []string {
+	flags := []string{}
+	for bit, name := range lacpStateBits {
+		if state&(1<<bit) != 0 {
+			flags = append(flags, name)
+		}
+	}
+	return flags
+}
+
+func atoiField(value string) int {
+	n, _ := strconv.Atoi(strings.Fields(value + " 0")[0])
+	return n
+}
+
+// parseProcBonding reads the kernel's /proc/net/bonding/<bond> report
+func parseProcBonding(text string) *BondInfo {
+	bond := &BondInfo{Kind: "bond", Members: []BondMember{}}
+	var member *BondMember
+	section := "bond"
+
+	for _, raw := range strings.Split(text, "\n") {
+		line := strings.TrimSpace(raw)
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		switch key {
+		case "slave interface":
+			bond.Members = append(bond.Members, BondMember{Name: value})
+			member = &bond.Members[len(bond.Members)-1]
+			section = "member"
+			continue
+		case "active aggregator info":
+			bond.Aggregator = &LACPAggregator{}
+			section = "aggregator"
+			continue
+		case "details actor lacp pdu":
+			section = "actor"
+			continue
+		case "details partner lacp pdu":
+			section = "partner"
+			continue
+		}
+		// The aggregator block is indented; the first unindented line ends it
+		if section == "aggregator" && !strings.HasPrefix(raw, "\t") && !strings.HasPrefix(raw, " ") {
+			section = "bond"
+		}
+
+		switch section {
+		case "bond":
+			switch key {
+			case "bonding mode":
+				bond.Mode = value
+			case "mii status":
+				bond.LinkUp = value == "up"
+			case "currently active slave":
+				if value != "None" {
+					bond.ActiveMember = value
+				}
+			case "lacp rate":
+				bond.LACPRate = value
+			}
+		case "aggregator":
+			switch key {
+			case "aggregator id":
+				bond.Aggregator.ID = atoiField(value)
+			case "number of ports":
+				bond.Aggregator.Ports = atoiField(value)
+			case "actor key":
+				bond.Aggregator.ActorKey = atoiField(value)
+			case "partner key":
+				bond.Aggregator.PartnerKey = atoiField(value)
+			case "partner mac address":
+				bond.Aggregator.PartnerMAC = strings.ToLower(value)
+			}
+		case "member":
+			switch key {
+			case "mii status":
+				member.LinkUp = value == "up"
+			case "speed":
+				member.Speed = int64(atoiField(value))
+			case "duplex":
+				member.Duplex = value
+			case "link failure count":
+				member.LinkFailures = int64(atoiField(value))
+			case "aggregator id":
+				member.AggregatorID = atoiField(value)
+			}
+		case "actor":
+			if key == "port state" {
+				member.actorBits = atoiField(value)
+			}
+		case "partner":
+			switch key {
+			case "system mac address":
+				member.PartnerMAC = strings.ToLower(value)
+			case "oper key":
+				member.PartnerKey = atoiField(value)
+			case "port number":
+				member.PartnerPort = atoiField(value)
+			case "port state":
+				member.partnerBits = atoiField(value)
+			}
+		}
+	}
+	return bond
+}
+
+// teamState is the part of `teamdctl <team> state dump` that matters here
+type teamState struct {
+	Setup struct {
+		RunnerName string `json:"runner_name"`
+	} `json:"setup"`
+	Runner struct {
+		ActivePort string `json:"active_port"`
+		FastRate   bool   `json:"fast_rate"`
+	} `json:"runner"`
+	Ports map[string]struct {
+		Link struct {
+			Up     bool   `json:"up"`
+			Speed  int64  `json:"speed"`
+			Duplex string `json:"duplex"`
+		} `json:"link"`
+		LinkWatches struct {
+			List map[string]struct {
+				DownCount int64 `json:"down_count"`
+			} `json:"list"`
+		} `json:"link_watches"`
+		Runner struct {
+			Selected   *bool `json:"selected"`
+			Aggregator struct {
+				ID int `json:"id"`
+			} `json:"aggregator"`
+			Actor struct {
+				State int `json:"state"`
+			} `json:"actor_lacpdu_info"`
+			Partner struct {
+				System string `json:"system"`
+				Key    int    `json:"key"`
+				Port   int    `json:"port"`
+				State  int    `json:"state"`
+			} `json:"partner_lacpdu_info"`
+		} `json:"runner"`
+	} `json:"ports"`
+}
+
+func parseTeamState(data []byte) (*BondInfo, error) {
+	var state teamState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	bond := &BondInfo{Kind: "team", Mode: state.Setup.RunnerName, ActiveMember: state.Runner.ActivePort, Members: []BondMember{}}
+	if bond.Mode == "lacp" {
+		bond.LACPRate = "slow"
+		if state.Runner.FastRate {
+			bond.LACPRate = "fast"
+		}
+	}
+
+	names := make([]string, 0, len(state.Ports))
+	for name := range state.Ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		port := state.Ports[name]
+		member := BondMember{Name: name, LinkUp: port.Link.Up, Speed: port.Link.Speed, Duplex: port.Link.Duplex}
+		for _, watch := range port.LinkWatches.List {
+			member.LinkFailures += watch.DownCount
+		}
+		if bond.Mode == "lacp" {
+			member.AggregatorID = port.Runner.Aggregator.ID
+			member.actorBits = port.Runner.Actor.State
+			member.partnerBits = port.Runner.Partner.State
+			member.PartnerMAC = strings.ToLower(port.Runner.Partner.System)
+			member.PartnerKey = port.Runner.Partner.Key
+			member.PartnerPort = port.Runner.Partner.Port
+			if port.Runner.Selected != nil && *port.Runner.Selected && bond.Aggregator == nil {
+				bond.Aggregator = &LACPAggregator{ID: member.AggregatorID, PartnerKey: member.PartnerKey, PartnerMAC: member.PartnerMAC}
+			}
+		}
+		if member.LinkUp {
+			bond.LinkUp = true
+		}
+		bond.Members = append(bond.Members, member)
+	}
+	if bond.Aggregator != nil {
+		for _, member := range bond.Members {
+			if member.AggregatorID == bond.Aggregator.ID {
+				bond.Aggregator.Ports++
+			}
+		}
+	}
+	return bond, nil
+}
+
+func isLACP(mode string) bool {
+	return strings.Contains(mode, "802.3ad") || mode == "lacp"
+}
+
+func isActiveBackup(mode string) bool {
+	return strings.Contains(mode, "active-backup") || mode == "activebackup"
+}
+
+// assessBond works out member states and what makes the bond degraded
+func assessBond(bond *BondInfo) {
+	lacp, activeBackup := isLACP(bond.Mode), isActiveBackup(bond.Mode)
+	usable := 0
+	for i := range bond.Members {
+		member := &bond.Members[i]
+		member.Issues = nil
+		switch {
+		case !member.LinkUp:
+			member.State = "down"
+			member.Issues = append(member.Issues, "link down")
+		case activeBackup && member.Name == bond.ActiveMember:
+			member.State = "active"
+		case activeBackup:
+			member.State = "backup"
+		case lacp && bond.Aggregator != nil && member.AggregatorID == bond.Aggregator.ID:
+			member.State = "selected"
+		case lacp:
+			member.State = "unselected"
+			if bond.Aggregator != nil {
+				member.Issues = append(member.Issues, fmt.Sprintf("not in the active aggregator (%d, active is %d)", member.AggregatorID, bond.Aggregator.ID))
+			}
+		default:
+			member.State = "up"
+		}
+
+		if lacp && member.LinkUp {
+			member.ActorState, member.PartnerState = lacpFlags(member.actorBits), lacpFlags(member.partnerBits)
+			switch {
+			case member.PartnerMAC == "" || member.PartnerMAC == noPartnerMAC:
+				member.Issues = append(member.Issues, "no LACP partner; is the switch port in a LACP port-channel?")
+			case bond.Aggregator != nil && member.PartnerMAC != bond.Aggregator.PartnerMAC:
+				member.Issues = append(member.Issues, fmt.Sprintf("LACP partner %s differs from the aggregator's %s", member.PartnerMAC, bond.Aggregator.PartnerMAC))
+			}
+			if member.actorBits&lacpWorking != lacpWorking {
+				member.Issues = append(member.Issues, fmt.Sprintf("local port not collecting/distributing (state %d)", member.actorBits))
+			}
+			if member.partnerBits&lacpWorking != lacpWorking && member.PartnerMAC != noPartnerMAC {
+				member.Issues = append(member.Issues, fmt.Sprintf("switch port not collecting/distributing (state %d)", member.partnerBits))
+			}
+		}
+		if len(member.Issues) == 0 {
+			usable++
+		}
+	}
+
+	bond.Issues = nil
+	switch {
+	case len(bond.Members) == 0:
+		bond.Issues = append(bond.Issues, "no members")
+	case activeBackup && bond.ActiveMember == "":
+		bond.Issues = append(bond.Issues, "no active member")
+	}
+	if usable < len(bond.Members) {
+		bond.Issues = append(bond.Issues, fmt.Sprintf("%d of %d members usable", usable, len(bond.Members)))
+	}
+
+	switch {
+	case !bond.LinkUp || usable == 0:
+		bond.Status = "down"
+	case len(bond.Issues) > 0:
+		bond.Status = "degraded"
+	default:
+		bond.Status = "healthy"
+	}
+}
+
+// teamDevices lists teamd devices, which have no /proc report
+func teamDevices() []string {
+	output, err := exec.Command("ip", "-o", "link", "show", "type", "team").Output()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			names = append(names, strings.TrimSuffix(strings.SplitN(fields[1], "@", 2)[0], ":"))
+		}
+	}
+	return names
+}
+
+// collectBonds reads every Linux bond and team, keyed by device name
+func collectBonds() map[string]*BondInfo {
+	bonds := make(map[string]*BondInfo)
+	if paths, _ := filepath.Glob("/proc/net/bonding/*"); len(paths) > 0 {
+		for _, path := range paths {
+			if data, err := os.ReadFile(path); err == nil {
+				bonds[filepath.Base(path)] = parseProcBonding(string(data))
+			}
+		}
+	}
+	for _, name := range teamDevices() {
+		output, err := exec.Command("teamdctl", name, "state", "dump").Output()
+		bond := &BondInfo{Kind: "team", Members: []BondMember{}}
+		if err == nil {
+			if parsed, perr := parseTeamState(output); perr == nil {
+				bond = parsed
+			} else {
+				err = perr
+			}
+		}
+		if err != nil {
+			bond.Issues = []string{"teamdctl state dump failed: " + err.Error()}
+			bond.Status = "unknown"
+			bonds[name] = bond
+			continue
+		}
+		bonds[name] = bond
+	}
+	for _, bond := range bonds {
+		if bond.Status != "unknown" {
+			assessBond(bond)
+		}
+	}
+	return bonds
+}
+
+// bondMaster names the bond or team an interface is enslaved to
+func bondMaster(name string) string {
+	target, err := os.Readlink(filepath.Join("/sys/class/net", name, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// BondEvent is a watch-mode change in a bond
+type BondEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Bond    string    `json:"bond"`
+	Member  string    `json:"member,omitempty"`
+	Status  string    `json:"status"` // Bond status after the change
+	Message string    `json:"message"`
+}
+
+// bondChanges compares two readings of a bond. Link failure counts catch
+// a member that flapped between polls and is back up.
+func bondChanges(name string, prev, cur *BondInfo) []BondEvent {
+	var events []BondEvent
+	add := func(event, member, message string) {
+		events = append(events, BondEvent{Event: event, Bond: name, Member: member, Status: cur.Status, Message: message})
+	}
+
+	before := make(map[string]BondMember)
+	for _, member := range prev.Members {
+		before[member.Name] = member
+	}
+	for _, member := range cur.Members {
+		old, ok := before[member.Name]
+		delete(before, member.Name)
+		if !ok {
+			add("member-added", member.Name, fmt.Sprintf("%s joined %s", member.Name, name))
+			continue
+		}
+		switch {
+		case old.LinkUp && !member.LinkUp:
+			add("member-down", member.Name, fmt.Sprintf("%s link went down", member.Name))
+		case !old.LinkUp && member.LinkUp:
+			add("member-up", member.Name, fmt.Sprintf("%s link came back up", member.Name))
+		case member.LinkUp && member.LinkFailures > old.LinkFailures:
+			add("member-flapped", member.Name, fmt.Sprintf("%s link failed %d time(s) since the last check", member.Name, member.LinkFailures-old.LinkFailures))
+		}
+		if member.LinkUp && old.LinkUp {
+			switch {
+			case old.State == "selected" && member.State == "unselected":
+				add("member-unselected", member.Name, fmt.Sprintf("%s left the active LACP aggregator", member.Name))
+			case old.State == "unselected" && member.State == "selected":
+				add("member-selected", member.Name, fmt.Sprintf("%s joined the active LACP aggregator", member.Name))
+			}
+			if old.PartnerMAC != member.PartnerMAC {
+				if member.PartnerMAC == noPartnerMAC || member.PartnerMAC == "" {
+					add("partner-lost", member.Name, fmt.Sprintf("%s no longer hears LACP from %s", member.Name, old.PartnerMAC))
+				} else {
+					add("partner-changed", member.Name, fmt.Sprintf("%s LACP partner is now %s (was %s)", member.Name, member.PartnerMAC, old.PartnerMAC))
+				}
+			}
+		}
+	}
+	for member := range before {
+		add("member-removed", member, fmt.Sprintf("%s left %s", member, name))
+	}
+
+	if prev.ActiveMember != cur.ActiveMember && prev.ActiveMember != "" {
+		add("failover", cur.ActiveMember, fmt.Sprintf("active member %s -> %s", prev.ActiveMember, orNone(cur.ActiveMember)))
+	}
+	if prev.Status != cur.Status {
+		event := "bond-" + cur.Status
+		if cur.Status == "healthy" {
+			event = "bond-recovered"
+		}
+		add(event, "", bondSummary(name, cur))
+	}
+	return events
+}
+
+func bondSummary(name string, bond *BondInfo) string {
+	summary := fmt.Sprintf("%s (%s, %d members) is %s", name, bond.Mode, len(bond.Members), bond.Status)
+	if len(bond.Issues) > 0 {
+		summary += ": " + strings.Join(bond.Issues, "; ")
+	}
+	return summary
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// watchBonds polls the bonds and prints each change as a JSON line,
+// starting with any bond that is already degraded
+func watchBonds(only string, interval time.Duration, alertFile *os.File) {
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(event BondEvent) {
+		event.Time = time.Now().UTC()
+		encoder.Encode(event)
+		if alertFile != nil {
+			line, _ := json.Marshal(event)
+			alertFile.Write(append(line, '\n'))
+		}
+	}
+	read := func() map[string]*BondInfo {
+		bonds := collectBonds()
+		if only != "" {
+			for name := range bonds {
+				if name != only {
+					delete(bonds, name)
+				}
+			}
+		}
+		return bonds
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous := read()
+	names := make([]string, 0, len(previous))
+	for name := range previous {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bond := previous[name]
+		event := "watching"
+		if bond.Status != "healthy" {
+			event = "bond-" + bond.Status
+		}
+		emit(BondEvent{Event: event, Bond: name, Status: bond.Status, Message: bondSummary(name, bond)})
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "No bonds or teams found yet; watching for them")
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		current := read()
+		for name, bond := range current {
+			if prev, ok := previous[name]; ok {
+				for _, event := range bondChanges(name, prev, bond) {
+					emit(event)
+				}
+			} else {
+				emit(BondEvent{Event: "bond-added", Bond: name, Status: bond.Status, Message: bondSummary(name, bond)})
+			}
+		}
+		for name := range previous {
+			if _, ok := current[name]; !ok {
+				emit(BondEvent{Event: "bond-removed", Bond: name, Status: "down", Message: name + " no longer exists"})
+			}
+		}
+		previous = current
+	}
+}
+
 func main() {
+	watch := flag.Duration("watch", 0, "Watch bonds and teams at this interval, printing member and failover changes as JSON lines (Linux)")
+	alertFile := flag.String("alert-file", "", "With -watch, also append the changes as JSON lines to this file")
+	flag.Usage = func() {
+		fmt.Println("Usage: interfaces [options] [all|<interface>]")
+		fmt.Println("Example: interfaces eth0")
+		fmt.Println("         interfaces -watch 5s -alert-file bonds.jsonl bond0")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	reqIface := flag.Arg(0)
+	if *watch > 0 {
+		if reqIface == "all" {
+			reqIface = ""
+		}
+		var alerts *os.File
+		if *alertFile != "" {
+			var err error
+			if alerts, err = os.OpenFile(*alertFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening alert file: %v\n", err)
+				os.Exit(1)
+			}
+			defer alerts.Close()
+		}
+		watchBonds(reqIface, *watch, alerts)
+		return
+	}
+
 	var result InterfaceResult
 
 	// Check if specific interface was requested
-	if len(os.Args) > 1 && os.Args[1] != "all" {
-		reqIface := os.Args[1]
+	if reqIface != "" && reqIface != "all" {
 		iface, err := net.InterfaceByName(reqIface)
 		if err != nil {
 			fmt.Printf("{\"error\": \"Interface %s not found\"}\n", reqIface)
@@ -434,6 +1030,7 @@ func main() {
 		defaultGateway, defaultIface := getDefaultRoute()
 		result.DefaultGateway = defaultGateway
 		result.DefaultIface = defaultIface
+		attachBonds(&result)
 		result.CollectionTime = time.Since(startTime).Milliseconds()
 	} else {
 		// Get all interfaces
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ColorReset  = "\033[0m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
+)
+
+// A cell is an outlier when it is this many times its column median
+// and at least outlierMinMs slower, so tiny absolute gaps are ignored
+const (
+	outlierFactor = 2.0
+	outlierMinMs  = 10.0
+)
+
+type Measurement struct {
+	Target   string  `json:"target"`
+	Address  string  `json:"address"`
+	MedianMs float64 `json:"medianMs,omitempty"`
+	MinMs    float64 `json:"minMs,omitempty"`
+	LossPct  float64 `json:"lossPct"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// MatrixRow is every measurement taken from one source host
+type MatrixRow struct {
+	Source       string        `json:"source"`
+	Mode         string        `json:"mode"`
+	MeasuredAt   time.Time     `json:"measuredAt"`
+	Measurements []Measurement `json:"measurements"`
+}
+
+type MatrixCell struct {
+	MedianMs float64 `json:"medianMs,omitempty"`
+	LossPct  float64 `json:"lossPct"`
+	Outlier  bool    `json:"outlier,omitempty"`
+	Best     bool    `json:"best,omitempty"`
+	Missing  bool    `json:"missing,omitempty"`
+}
+
+type Matrix struct {
+	Sources  []string                         `json:"sources"`
+	Targets  []string                         `json:"targets"`
+	Cells    map[string]map[string]MatrixCell `json:"cells"` // source -> target -> cell
+	Outliers []string                         `json:"outliers"`
+}
+
+// parseTarget splits "label=host:port" or "host[:port]" into label and address
+func parseTarget(spec string, defaultPort int) (string, string) {
+	label, addr, ok := strings.Cut(spec, "=")
+	if !ok {
+		addr = spec
+		label = spec
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(defaultPort))
+	}
+	return label, addr
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+var pingRTTRegex = regexp.MustCompile(`time[=<]([\d.]+)\s*ms`)
+
+// measureTarget takes count samples of TCP connect time or ICMP round trip
+func measureTarget(label, addr, mode string, count int, timeout time.Duration) Measurement {
+	m := Measurement{Target: label, Address: addr}
+	var samples []float64
+
+	if mode == "icmp" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Address = host
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("ping", "-n", strconv.Itoa(count), "-w", strconv.FormatInt(timeout.Milliseconds(), 10), host)
+		} else {
+			cmd = exec.Command("ping", "-c", strconv.Itoa(count), "-i", "0.2", "-W", strconv.Itoa(int(math.Ceil(timeout.Seconds()))), host)
+		}
+		output, err := cmd.CombinedOutput()
+		for _, match := range pingRTTRegex.FindAllStringSubmatch(string(output), -1) {
+			if ms, err := strconv.ParseFloat(match[1], 64); err == nil {
+				samples = append(samples, ms)
+			}
+		}
+		if len(samples) == 0 && err != nil {
+			m.Error = fmt.Sprintf("ping failed: %v", err)
+		}
+	} else {
+		for i := 0; i < count; i++ {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				m.Error = err.Error()
+				continue
+			}
+			samples = append(samples, float64(time.Since(start).Microseconds())/1000)
+			conn.Close()
+		}
+	}
+
+	if len(samples) > count {
+		samples = samples[:count]
+	}
+	m.LossPct = round2(float64(count-len(samples)) / float64(count) * 100)
+	if len(samples) > 0 {
+		m.Error = ""
+		m.MedianMs = round2(median(samples))
+		m.MinMs = samples[0]
+		for _, s := range samples {
+			if s < m.MinMs {
+				m.MinMs = s
+			}
+		}
+		m.MinMs = round2(m.MinMs)
+	}
+	return m
+}
+
+// measureRow measures every target in parallel from this host
+func measureRow(source string, targets []string, mode string, port, count int, timeout time.Duration) MatrixRow {
+	row := MatrixRow{
+		Source:       source,
+		Mode:         mode,
+		MeasuredAt:   time.Now().UTC(),
+		Measurements: make([]Measurement, len(targets)),
+	}
+
+	var wg sync.WaitGroup
+	for i, spec := range targets {
+		wg.Add(1)
+		go func(i int, spec string) {
+			defer wg.Done()
+			label, addr := parseTarget(spec, port)
+			row.Measurements[i] = measureTarget(label, addr, mode, count, timeout)
+		}(i, spec)
+	}
+	wg.Wait()
+	return row
+}
+
+// buildMatrix lays rows out as sources by targets and flags, per target
+// column, the fastest source and any source far slower than the median
+func buildMatrix(rows []MatrixRow) Matrix {
+	matrix := Matrix{Cells: make(map[string]map[string]MatrixCell), Outliers: []string{}}
+	seenTarget := make(map[string]bool)
+
+	for _, row := range rows {
+		if _, ok := matrix.Cells[row.Source]; !ok {
+			matrix.Sources = append(matrix.Sources, row.Source)
+			matrix.Cells[row.Source] = make(map[string]MatrixCell)
+		}
+		for _, m := range row.Measurements {
+			if !seenTarget[m.Target] {
+				seenTarget[m.Target] = true
+				matrix.Targets = append(matrix.Targets, m.Target)
+			}
+			matrix.Cells[row.Source][m.Target] = MatrixCell{MedianMs: m.MedianMs, LossPct: m.LossPct}
+		}
+	}
+
+	for _, target := range matrix.Targets {
+		var values []float64
+		for _, source := range matrix.Sources {
+			if cell, ok := matrix.Cells[source][target]; ok && cell.MedianMs > 0 {
+				values = append(values, cell.MedianMs)
+			}
+		}
+		columnMedian := median(values)
+		best := math.Inf(1)
+		for _, v := range values {
+			best = math.Min(best, v)
+		}
+
+		for _, source := range matrix.Sources {
+			cell, ok := matrix.Cells[source][target]
+			if !ok {
+				// A host never measures itself, so the diagonal is normally missing
+				matrix.Cells[source][target] = MatrixCell{Missing: true}
+				continue
+			}
+			if cell.MedianMs > 0 && len(values) > 1 && cell.MedianMs == best {
+				cell.Best = true
+			}
+			slow := cell.MedianMs >= columnMedian*outlierFactor && cell.MedianMs-columnMedian >= outlierMinMs
+			if slow || cell.LossPct > 0 {
+				cell.Outlier = true
+				reason := fmt.Sprintf("%.1fms vs %.1fms median", cell.MedianMs, columnMedian)
+				if cell.LossPct > 0 {
+					reason = fmt.Sprintf("%.0f%% loss", cell.LossPct)
+				}
+				matrix.Outliers = append(matrix.Outliers, fmt.Sprintf("%s -> %s: %s", source, target, reason))
+			}
+			matrix.Cells[source][target] = cell
+		}
+	}
+	return matrix
+}
+
+// renderMatrix prints the matrix as a table: outliers red, best per column green
+func renderMatrix(matrix Matrix) {
+	width := 10
+	for _, name := range append(append([]string{}, matrix.Sources...), matrix.Targets...) {
+		if len(name)+2 > width {
+			width = len(name) + 2
+		}
+	}
+
+	fmt.Printf("%-*s", width, "from \\ to")
+	for _, target := range matrix.Targets {
+		fmt.Printf("%*s", width, target)
+	}
+	fmt.Println()
+
+	for _, source := range matrix.Sources {
+		fmt.Printf("%-*s", width, source)
+		for _, target := range matrix.Targets {
+			cell := matrix.Cells[source][target]
+			text := "-"
+			if !cell.Missing {
+				text = fmt.Sprintf("%.1f", cell.MedianMs)
+				if cell.MedianMs == 0 {
+					text = "fail"
+				}
+				if cell.LossPct > 0 && cell.MedianMs > 0 {
+					text += fmt.Sprintf(" %.0f%%", cell.LossPct)
+				}
+			}
+
+			padded := fmt.Sprintf("%*s", width, text)
+			switch {
+			case cell.Outlier:
+				fmt.Print(ColorRed + padded + ColorReset)
+			case cell.Best:
+				fmt.Print(ColorGreen + padded + ColorReset)
+			default:
+				fmt.Print(padded)
+			}
+		}
+		fmt.Println()
+	}
+
+	if len(matrix.Outliers) > 0 {
+		fmt.Printf("\n%sOutliers:%s\n", ColorYellow, ColorReset)
+		for _, outlier := range matrix.Outliers {
+			fmt.Printf("  %s\n", outlier)
+		}
+	}
+}
+
+func loadRows(paths []string) ([]MatrixRow, error) {
+	var rows []MatrixRow
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var row MatrixRow
+		if err := json.Unmarshal(data, &row); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func main() {
+	hostname, _ := os.Hostname()
+	name := flag.String("name", hostname, "Name of this host as a matrix row; use the same label other hosts give it as a target")
+	mode := flag.String("mode", "tcp", "Measurement: tcp (connect time) or icmp")
+	port := flag.Int("port", 443, "Default TCP port for targets without one")
+	count := flag.Int("count", 5, "Samples per target")
+	timeout := flag.Duration("timeout", 2*time.Second, "Timeout per sample")
+	merge := flag.Bool("merge", false, "Combine row files saved on several hosts into one matrix")
+	table := flag.Bool("table", false, "Render a table instead of JSON")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Println("Usage: matrix [options] <label=host[:port],...>")
+		fmt.Println("       matrix -merge [-table] <row.json> [row.json...]")
+		fmt.Println("Example: matrix -name use1 use1=10.0.0.10,usw2=10.1.0.10,euw1=10.2.0.10 > use1.json")
+		fmt.Println("         matrix -merge -table use1.json usw2.json euw1.json")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var matrix Matrix
+	if *merge {
+		rows, err := loadRows(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		matrix = buildMatrix(rows)
+	} else {
+		if *mode != "tcp" && *mode != "icmp" {
+			fmt.Fprintf(os.Stderr, "Error: unknown mode %q (use tcp or icmp)\n", *mode)
+			os.Exit(1)
+		}
+		if *count < 1 {
+			fmt.Fprintf(os.Stderr, "Error: -count must be at least 1\n")
+			os.Exit(1)
+		}
+		row := measureRow(*name, strings.Split(args[0], ","), *mode, *port, *count, *timeout)
+		if !*table {
+			json.NewEncoder(os.Stdout).Encode(row)
+			return
+		}
+		matrix = buildMatrix([]MatrixRow{row})
+	}
+
+	if *table {
+		renderMatrix(matrix)
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(matrix)
+}
@@ -0,0 +1,2022 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Ring file layout: a fixed header followed by capacity fixed-size records.
+// Each record is a unix millisecond timestamp and an RTT in microseconds,
+// with ringFailed marking a failed probe.
+const (
+	ringMagic      = "CCRING01"
+	ringHeaderSize = 128
+	ringRecordSize = 12
+	ringFailed     = math.MaxUint32
+	ringTargetMax  = 84
+	ringModeMax    = 8
+)
+
+// A gap this many intervals long means the monitor was not running
+const gapIntervals = 3
+
+type probeRecord struct {
+	Time time.Time
+	RTT  time.Duration
+	OK   bool
+	// Not stored in the ring; only used by alert rules
+	Status   int
+	CertDays float64
+}
+
+// ringBuffer is an on-disk circular log of probe records
+type ringBuffer struct {
+	mu       sync.Mutex // Reports for tickets are read off the probe loop
+	file     *os.File
+	capacity uint32
+	next     uint64 // Index of the slot the next record goes into
+	count    uint64 // Records stored, at most capacity
+	interval time.Duration
+	mode     string
+	target   string
+}
+
+type Outage struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	FailedProbes    int       `json:"failedProbes"`
+	Ongoing         bool      `json:"ongoing,omitempty"`
+}
+
+type LatencySummary struct {
+	MinMs float64 `json:"minMs"`
+	AvgMs float64 `json:"avgMs"`
+	P95Ms float64 `json:"p95Ms"`
+	MaxMs float64 `json:"maxMs"`
+}
+
+type MonitorReport struct {
+	Target               string            `json:"target"`
+	Mode                 string            `json:"mode"`
+	IntervalMs           int64             `json:"intervalMs"`
+	From                 time.Time         `json:"from"`
+	To                   time.Time         `json:"to"`
+	Samples              int               `json:"samples"`
+	Successes            int               `json:"successes"`
+	Failures             int               `json:"failures"`
+	AvailabilityPct      float64           `json:"availabilityPct"`
+	Flaps                int               `json:"flaps"`
+	Outages              []Outage          `json:"outages"`
+	MTTRSeconds          float64           `json:"mttrSeconds"`
+	LongestOutageSeconds float64           `json:"longestOutageSeconds"`
+	MonitoringGaps       int               `json:"monitoringGaps"`
+	Latency              LatencySummary    `json:"latency"`
+	Connections          *ConnectionReport `json:"connections,omitempty"`
+}
+
+// openRing opens an existing ring file for the same target, or creates one
+func openRing(path string, capacity uint32, interval time.Duration, mode, target string) (*ringBuffer, error) {
+	if len(target) > ringTargetMax {
+		return nil, fmt.Errorf("target too long for ring header (max %d bytes)", ringTargetMax)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		ring := &ringBuffer{file: file, capacity: capacity, interval: interval, mode: mode, target: target}
+		if err := file.Truncate(ringHeaderSize + int64(capacity)*ringRecordSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := ring.writeHeader(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return ring, nil
+	}
+
+	ring, err := readRingHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if ring.target != target || ring.mode != mode {
+		file.Close()
+		return nil, fmt.Errorf("ring file %s belongs to %s %s", path, ring.mode, ring.target)
+	}
+	return ring, nil
+}
+
+func readRingHeader(file *os.File) (*ringBuffer, error) {
+	header := make([]byte, ringHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading ring header: %v", err)
+	}
+	if string(header[:8]) != ringMagic {
+		return nil, errors.New("not a monitor ring file")
+	}
+	if size := binary.LittleEndian.Uint32(header[12:]); size != ringRecordSize {
+		return nil, fmt.Errorf("unsupported record size %d", size)
+	}
+
+	return &ringBuffer{
+		file:     file,
+		capacity: binary.LittleEndian.Uint32(header[8:]),
+		next:     binary.LittleEndian.Uint64(header[16:]),
+		count:    binary.LittleEndian.Uint64(header[24:]),
+		interval: time.Duration(binary.LittleEndian.Uint32(header[32:])) * time.Millisecond,
+		mode:     strings.TrimRight(string(header[36:36+ringModeMax]), "\x00"),
+		target:   strings.TrimRight(string(header[44:44+ringTargetMax]), "\x00"),
+	}, nil
+}
+
+func (r *ringBuffer) writeHeader() error {
+	header := make([]byte, ringHeaderSize)
+	copy(header, ringMagic)
+	binary.LittleEndian.PutUint32(header[8:], r.capacity)
+	binary.LittleEndian.PutUint32(header[12:], ringRecordSize)
+	binary.LittleEndian.PutUint64(header[16:], r.next)
+	binary.LittleEndian.PutUint64(header[24:], r.count)
+	binary.LittleEndian.PutUint32(header[32:], uint32(r.interval.Milliseconds()))
+	copy(header[36:36+ringModeMax], r.mode)
+	copy(header[44:44+ringTargetMax], r.target)
+	_, err := r.file.WriteAt(header, 0)
+	return err
+}
+
+// Append stores a record, overwriting the oldest once the ring is full
+func (r *ringBuffer) Append(rec probeRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf := make([]byte, ringRecordSize)
+	binary.LittleEndian.PutUint64(buf, uint64(rec.Time.UnixMilli()))
+	rtt := uint32(ringFailed)
+	if rec.OK {
+		rtt = uint32(rec.RTT.Microseconds())
+		if rtt == ringFailed {
+			rtt--
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[8:], rtt)
+
+	offset := ringHeaderSize + int64(r.next%uint64(r.capacity))*ringRecordSize
+	if _, err := r.file.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	r.next = (r.next + 1) % uint64(r.capacity)
+	if r.count < uint64(r.capacity) {
+		r.count++
+	}
+	return r.writeHeader()
+}
+
+// Records returns the stored records oldest first
+func (r *ringBuffer) Records() ([]probeRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]byte, int64(r.capacity)*ringRecordSize)
+	if _, err := r.file.ReadAt(data, ringHeaderSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	records := make([]probeRecord, 0, r.count)
+	start := (r.next + uint64(r.capacity) - r.count) % uint64(r.capacity)
+	for i := uint64(0); i < r.count; i++ {
+		slot := data[((start+i)%uint64(r.capacity))*ringRecordSize:]
+		rtt := binary.LittleEndian.Uint32(slot[8:])
+		records = append(records, probeRecord{
+			Time: time.UnixMilli(int64(binary.LittleEndian.Uint64(slot))),
+			RTT:  time.Duration(rtt) * time.Microsecond,
+			OK:   rtt != ringFailed,
+		})
+	}
+	return records, nil
+}
+
+func (r *ringBuffer) Close() error {
+	return r.file.Close()
+}
+
+// probeOnce runs a single check of the target in the given mode
+func probeOnce(mode, target string, timeout time.Duration) probeRecord {
+	rec := probeRecord{Time: time.Now(), CertDays: -1}
+	start := time.Now()
+
+	switch mode {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err == nil {
+			conn.Close()
+			rec.OK = true
+		}
+	case "icmp":
+		rtt, ok := pingOnce(target, timeout)
+		rec.OK = ok
+		if ok && rtt > 0 {
+			rec.RTT = rtt
+			return rec
+		}
+	case "http":
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(target)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			rec.OK = resp.StatusCode < 400
+			rec.Status = resp.StatusCode
+			if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+				rec.CertDays = time.Until(resp.TLS.PeerCertificates[0].NotAfter).Hours() / 24
+			}
+		}
+	}
+
+	rec.RTT = time.Since(start)
+	return rec
+}
+
+var pingTimeRegex = regexp.MustCompile(`time[=<]([\d.]+)\s*ms`)
+
+// pingOnce sends one echo request with the system ping command
+func pingOnce(target string, timeout time.Duration) (time.Duration, bool) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("ping", "-n", "1", "-w", strconv.FormatInt(timeout.Milliseconds(), 10), target)
+	} else {
+		seconds := int(math.Ceil(timeout.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		cmd = exec.Command("ping", "-c", "1", "-W", strconv.Itoa(seconds), target)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, false
+	}
+	if match := pingTimeRegex.FindStringSubmatch(string(output)); match != nil {
+		ms, _ := strconv.ParseFloat(match[1], 64)
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	return 0, true
+}
+
+// analyzeRecords turns raw probe records into availability and outage figures.
+// Stretches where the monitor was not running count as gaps, not downtime.
+func analyzeRecords(records []probeRecord, interval time.Duration) MonitorReport {
+	report := MonitorReport{IntervalMs: interval.Milliseconds(), Outages: []Outage{}}
+	if len(records) == 0 {
+		return report
+	}
+	report.From = records[0].Time
+	report.To = records[len(records)-1].Time
+	report.Samples = len(records)
+
+	var latencies []float64
+	var current *Outage
+	closeOutage := func(end time.Time, ongoing bool) {
+		current.End = end
+		current.DurationSeconds = end.Sub(current.Start).Seconds()
+		current.Ongoing = ongoing
+		report.Outages = append(report.Outages, *current)
+		current = nil
+	}
+
+	for i, rec := range records {
+		if i > 0 && rec.Time.Sub(records[i-1].Time) > gapIntervals*interval {
+			report.MonitoringGaps++
+			if current != nil {
+				// The outage can only be vouched for up to the last probe
+				closeOutage(records[i-1].Time, false)
+			}
+		}
+
+		if rec.OK {
+			report.Successes++
+			latencies = append(latencies, float64(rec.RTT.Microseconds())/1000)
+			if current != nil {
+				closeOutage(rec.Time, false)
+			}
+			continue
+		}
+
+		report.Failures++
+		if current == nil {
+			current = &Outage{Start: rec.Time}
+			// A flap is a transition from up to down
+			if i > 0 && records[i-1].OK {
+				report.Flaps++
+			}
+		}
+		current.FailedProbes++
+	}
+	if current != nil {
+		closeOutage(report.To, true)
+	}
+
+	report.AvailabilityPct = math.Round(float64(report.Successes)/float64(report.Samples)*100000) / 1000
+
+	// MTTR only covers outages that have been repaired
+	var total float64
+	var repaired int
+	for _, outage := range report.Outages {
+		if outage.DurationSeconds > report.LongestOutageSeconds {
+			report.LongestOutageSeconds = outage.DurationSeconds
+		}
+		if !outage.Ongoing {
+			total += outage.DurationSeconds
+			repaired++
+		}
+	}
+	if repaired > 0 {
+		report.MTTRSeconds = math.Round(total/float64(repaired)*1000) / 1000
+	}
+
+	if len(latencies) > 0 {
+		report.Latency = summarizeLatency(latencies)
+	}
+	return report
+}
+
+// summarizeLatency sorts a non-empty slice of latencies in place and summarizes it
+func summarizeLatency(latencies []float64) LatencySummary {
+	sort.Float64s(latencies)
+	var sum float64
+	for _, l := range latencies {
+		sum += l
+	}
+	return LatencySummary{
+		MinMs: latencies[0],
+		AvgMs: sum / float64(len(latencies)),
+		P95Ms: latencies[int(float64(len(latencies)-1)*0.95)],
+		MaxMs: latencies[len(latencies)-1],
+	}
+}
+
+// Alert is a notable monitor event, written as one JSON line
+type Alert struct {
+	Time        time.Time     `json:"time"`
+	Target      string        `json:"target"`
+	Mode        string        `json:"mode"`
+	Kind        string        `json:"kind"` // down, recovered, packet-loss, loss-cleared, rule, rule-cleared or dns-changed
+	Message     string        `json:"message"`
+	LossPct     float64       `json:"lossPct,omitempty"`
+	DownSeconds float64       `json:"downSeconds,omitempty"`
+	Path        *PathAnalysis `json:"path,omitempty"`
+	Rule        string        `json:"rule,omitempty"`
+}
+
+// alerter prints alerts to stderr, appends them to an optional file and
+// hands them to an optional ticketer
+type alerter struct {
+	mu      sync.Mutex
+	file    *os.File
+	tickets *ticketer
+	firing  func() bool // Whether any alert condition is still active
+}
+
+func (a *alerter) Emit(alert Alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s %s %s\n", alert.Time.Format(time.RFC3339), strings.ToUpper(alert.Kind), alert.Message)
+	if a.file != nil {
+		line, _ := json.Marshal(alert)
+		a.file.Write(append(line, '\n'))
+	}
+	if a.tickets != nil {
+		ev := ticketEvent{alert: alert}
+		if alert.Kind == "recovered" || alert.Kind == "loss-cleared" || alert.Kind == "rule-cleared" {
+			ev.resolved = !a.firing()
+		}
+		a.tickets.Submit(ev)
+	}
+}
+
+// Ticketing turns alerts into one ticket per outage in Jira or ServiceNow.
+// The dedup key is stored on the ticket itself (a Jira label, the
+// ServiceNow correlation_id), so a restarted monitor finds the ticket it
+// opened earlier instead of filing another.
+
+// ticketEvent is an alert queued for the ticketing worker
+type ticketEvent struct {
+	alert    Alert
+	resolved bool          // Nothing is failing any more, so the ticket can close
+	report   MonitorReport // Filled in by the worker, off the probe loop
+}
+
+type ticketSystem interface {
+	// find returns the id and display name of the open ticket carrying key,
+	// or "" if there is none
+	find(key string) (string, string, error)
+	// create returns the ticket's id and the name people know it by
+	create(key string, ev ticketEvent) (string, string, error)
+	comment(id string, ev ticketEvent) error
+	attach(id, name, contentType string, data []byte) error
+	resolve(id string, ev ticketEvent) error
+}
+
+// Alert kinds that open a ticket, or update the one already open
+var ticketOpeningKinds = map[string]bool{"down": true, "packet-loss": true, "rule": true}
+
+// ticketer feeds alerts to a ticket system from one goroutine so slow
+// ticket APIs never delay probing and events stay in order. The report
+// attached to tickets is also built there, only when a ticket needs it.
+type ticketer struct {
+	system   ticketSystem
+	key      string
+	report   func() MonitorReport
+	open     string
+	name     string
+	searched bool // find has succeeded once; a failed search is retried on the next event
+	events   chan ticketEvent
+	done     chan struct{}
+}
+
+func newTicketer(system ticketSystem, key string, report func() MonitorReport) *ticketer {
+	t := &ticketer{system: system, key: key, report: report, events: make(chan ticketEvent, 64), done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		for ev := range t.events {
+			if err := t.handle(ev); err != nil {
+				fmt.Fprintf(os.Stderr, "Ticketing error (%s alert): %v\n", ev.alert.Kind, err)
+			}
+		}
+	}()
+	return t
+}
+
+func (t *ticketer) Submit(ev ticketEvent) {
+	select {
+	case t.events <- ev:
+	default:
+		fmt.Fprintf(os.Stderr, "Ticketing queue full, dropping %s alert\n", ev.alert.Kind)
+	}
+}
+
+// Close waits for queued events to reach the ticket system
+func (t *ticketer) Close() {
+	close(t.events)
+	<-t.done
+}
+
+func (t *ticketer) handle(ev ticketEvent) error {
+	// Search once at startup; after that this worker is the only one that
+	// opens or resolves the ticket, so the answer stays valid
+	if t.open == "" && !t.searched {
+		id, name, err := t.system.find(t.key)
+		if err != nil {
+			return fmt.Errorf("searching for an open ticket: %v", err)
+		}
+		t.open, t.name, t.searched = id, name, true
+	}
+
+	if t.open == "" && !ticketOpeningKinds[ev.alert.Kind] {
+		return nil // Recovered before any ticket was filed
+	}
+	ev.report = t.report()
+
+	if t.open == "" {
+		id, name, err := t.system.create(t.key, ev)
+		if err != nil {
+			return fmt.Errorf("creating ticket: %v", err)
+		}
+		t.open, t.name = id, name
+		fmt.Fprintf(os.Stderr, "Opened ticket %s\n", name)
+		return t.attachReports(ev)
+	}
+
+	if err := t.system.comment(t.open, ev); err != nil {
+		return fmt.Errorf("updating ticket %s: %v", t.name, err)
+	}
+	if !ev.resolved {
+		return nil
+	}
+	if err := t.attachReports(ev); err != nil {
+		return err
+	}
+	if err := t.system.resolve(t.open, ev); err != nil {
+		return fmt.Errorf("resolving ticket %s: %v", t.name, err)
+	}
+	fmt.Fprintf(os.Stderr, "Resolved ticket %s\n", t.name)
+	t.open = ""
+	return nil
+}
+
+// attachReports adds the alert and availability report as JSON and HTML
+func (t *ticketer) attachReports(ev ticketEvent) error {
+	stamp := ev.alert.Time.UTC().Format("20060102-150405")
+	attachment := struct {
+		Alert  Alert         `json:"alert"`
+		Report MonitorReport `json:"report"`
+	}{ev.alert, ev.report}
+	data, _ := json.MarshalIndent(attachment, "", "  ")
+	if err := t.system.attach(t.open, "monitor-"+stamp+".json", "application/json", data); err != nil {
+		return fmt.Errorf("attaching JSON report: %v", err)
+	}
+
+	var page bytes.Buffer
+	if err := reportPage.Execute(&page, attachment); err != nil {
+		return err
+	}
+	if err := t.system.attach(t.open, "monitor-"+stamp+".html", "text/html", page.Bytes()); err != nil {
+		return fmt.Errorf("attaching HTML report: %v", err)
+	}
+	return nil
+}
+
+var reportPage = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Alert.Target}} monitor report</title>
+<style>body{font-family:sans-serif}td,th{padding:2px 10px;text-align:left}</style></head><body>
+<h1>{{.Alert.Target}} ({{.Alert.Mode}})</h1>
+<p><b>{{.Alert.Kind}}</b> at {{.Alert.Time.Format "2006-01-02 15:04:05 MST"}}: {{.Alert.Message}}</p>
+{{with .Alert.Path}}<h2>Path analysis</h2><p>{{.Verdict}}</p>
+<table><tr><th>Hop</th><th>Address</th><th>Loss %</th><th>Avg ms</th></tr>
+{{range .Hops}}<tr><td>{{.Hop}}</td><td>{{.Address}}</td><td>{{printf "%.1f" .LossPct}}</td><td>{{printf "%.1f" .AvgMs}}</td></tr>
+{{end}}</table>{{end}}
+{{with .Report}}<h2>Availability {{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}}</h2>
+<table>
+<tr><th>Availability</th><td>{{printf "%.3f" .AvailabilityPct}}%</td></tr>
+<tr><th>Samples</th><td>{{.Samples}} ({{.Failures}} failed)</td></tr>
+<tr><th>Flaps</th><td>{{.Flaps}}</td></tr>
+<tr><th>MTTR</th><td>{{printf "%.0f" .MTTRSeconds}}s</td></tr>
+<tr><th>Latency</th><td>avg {{printf "%.1f" .Latency.AvgMs}}ms, p95 {{printf "%.1f" .Latency.P95Ms}}ms</td></tr>
+</table>
+<h2>Outages</h2><table><tr><th>Start</th><th>Duration</th><th>Failed probes</th></tr>
+{{range .Outages}}<tr><td>{{.Start.Format "2006-01-02 15:04:05"}}</td><td>{{printf "%.0f" .DurationSeconds}}s{{if .Ongoing}} (ongoing){{end}}</td><td>{{.FailedProbes}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
+
+// ticketText describes an alert for a ticket body or comment
+func ticketText(ev ticketEvent) string {
+	var b strings.Builder
+	alert := ev.alert
+	fmt.Fprintf(&b, "%s %s: %s\n", alert.Time.UTC().Format(time.RFC3339), strings.ToUpper(alert.Kind), alert.Message)
+	fmt.Fprintf(&b, "Target: %s (%s)\n", alert.Target, alert.Mode)
+	if alert.Rule != "" {
+		fmt.Fprintf(&b, "Rule: %s\n", alert.Rule)
+	}
+	if alert.LossPct > 0 {
+		fmt.Fprintf(&b, "Loss: %.1f%%\n", alert.LossPct)
+	}
+	if alert.Path != nil {
+		fmt.Fprintf(&b, "Path: %s\n", alert.Path.Verdict)
+	}
+	fmt.Fprintf(&b, "Availability: %.3f%% over %d samples, %d outages\n", ev.report.AvailabilityPct, ev.report.Samples, len(ev.report.Outages))
+	return b.String()
+}
+
+// ticketKey identifies a target's outages across monitor restarts
+func ticketKey(mode, target string) string {
+	sum := sha256.Sum256([]byte(mode + " " + target))
+	return "cloud-connect-" + hex.EncodeToString(sum[:6])
+}
+
+// ticketAPI is the HTTP plumbing shared by both systems
+type ticketAPI struct {
+	base   string
+	client *http.Client
+	auth   func(*http.Request)
+}
+
+func (a *ticketAPI) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return a.send(req, out)
+}
+
+func (a *ticketAPI) send(req *http.Request, out interface{}) error {
+	a.auth(req)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// jiraTickets uses the Jira REST API v2, which takes plain-text bodies
+type jiraTickets struct {
+	api       ticketAPI
+	project   string
+	issueType string
+}
+
+func (j *jiraTickets) find(key string) (string, string, error) {
+	jql := fmt.Sprintf(`labels = "%s" AND statusCategory != Done ORDER BY created DESC`, key)
+	var result struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	err := j.api.do("GET", "/rest/api/2/search?maxResults=1&fields=key&jql="+url.QueryEscape(jql), nil, &result)
+	if err != nil || len(result.Issues) == 0 {
+		return "", "", err
+	}
+	return result.Issues[0].Key, result.Issues[0].Key, nil
+}
+
+func (j *jiraTickets) create(key string, ev ticketEvent) (string, string, error) {
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": j.project},
+		"issuetype":   map[string]string{"name": j.issueType},
+		"summary":     fmt.Sprintf("%s (%s): %s", ev.alert.Target, ev.alert.Mode, ev.alert.Message),
+		"description": ticketText(ev) + "\nOpened by cloud-connect monitor; later alerts for this outage are added as comments.",
+		"labels":      []string{key, "cloud-connect"},
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := j.api.do("POST", "/rest/api/2/issue", map[string]interface{}{"fields": fields}, &created); err != nil {
+		return "", "", err
+	}
+	return created.Key, created.Key, nil
+}
+
+func (j *jiraTickets) comment(id string, ev ticketEvent) error {
+	return j.api.do("POST", "/rest/api/2/issue/"+id+"/comment", map[string]string{"body": ticketText(ev)}, nil)
+}
+
+func (j *jiraTickets) attach(id, name, contentType string, data []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, name))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest("POST", j.api.base+"/rest/api/2/issue/"+id+"/attachments", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Atlassian-Token", "no-check")
+	return j.api.send(req, nil)
+}
+
+// resolve applies the first transition that leads to a done status;
+// workflows name these differently, so the category is what is matched
+func (j *jiraTickets) resolve(id string, ev ticketEvent) error {
+	var result struct {
+		Transitions []struct {
+			ID string `json:"id"`
+			To struct {
+				StatusCategory struct {
+					Key string `json:"key"`
+				} `json:"statusCategory"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	if err := j.api.do("GET", "/rest/api/2/issue/"+id+"/transitions", nil, &result); err != nil {
+		return err
+	}
+	for _, transition := range result.Transitions {
+		if transition.To.StatusCategory.Key == "done" {
+			return j.api.do("POST", "/rest/api/2/issue/"+id+"/transitions",
+				map[string]interface{}{"transition": map[string]string{"id": transition.ID}}, nil)
+		}
+	}
+	return fmt.Errorf("no transition to a done status is available")
+}
+
+// serviceNowTickets files incidents through the Table and Attachment APIs.
+// Tickets are tracked by sys_id; the incident number is only for display.
+type serviceNowTickets struct {
+	api   ticketAPI
+	group string
+}
+
+type serviceNowRecord struct {
+	SysID  string `json:"sys_id"`
+	Number string `json:"number"`
+}
+
+func (s *serviceNowTickets) find(key string) (string, string, error) {
+	query := url.Values{
+		"sysparm_query":  {"correlation_id=" + key + "^active=true"},
+		"sysparm_fields": {"sys_id,number"},
+		"sysparm_limit":  {"1"},
+	}
+	var result struct {
+		Result []serviceNowRecord `json:"result"`
+	}
+	err := s.api.do("GET", "/api/now/table/incident?"+query.Encode(), nil, &result)
+	if err != nil || len(result.Result) == 0 {
+		return "", "", err
+	}
+	return result.Result[0].SysID, result.Result[0].Number, nil
+}
+
+func (s *serviceNowTickets) create(key string, ev ticketEvent) (string, string, error) {
+	incident := map[string]string{
+		"short_description":   fmt.Sprintf("%s (%s): %s", ev.alert.Target, ev.alert.Mode, ev.alert.Message),
+		"description":         ticketText(ev),
+		"correlation_id":      key,
+		"correlation_display": "cloud-connect monitor",
+		"category":            "network",
+	}
+	if s.group != "" {
+		incident["assignment_group"] = s.group
+	}
+	var result struct {
+		Result serviceNowRecord `json:"result"`
+	}
+	if err := s.api.do("POST", "/api/now/table/incident", incident, &result); err != nil {
+		return "", "", err
+	}
+	return result.Result.SysID, result.Result.Number, nil
+}
+
+func (s *serviceNowTickets) comment(id string, ev ticketEvent) error {
+	return s.api.do("PATCH", "/api/now/table/incident/"+id, map[string]string{"work_notes": ticketText(ev)}, nil)
+}
+
+func (s *serviceNowTickets) attach(id, name, contentType string, data []byte) error {
+	query := url.Values{"table_name": {"incident"}, "table_sys_id": {id}, "file_name": {name}}
+	req, err := http.NewRequest("POST", s.api.base+"/api/now/attachment/file?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	return s.api.send(req, nil)
+}
+
+func (s *serviceNowTickets) resolve(id string, ev ticketEvent) error {
+	return s.api.do("PATCH", "/api/now/table/incident/"+id, map[string]string{
+		"state":       "6", // Resolved
+		"close_code":  "Solved (Permanently)",
+		"close_notes": ticketText(ev),
+	}, nil)
+}
+
+// newTicketSystem builds a client from flags; credentials come from the
+// environment so they stay out of process listings
+func newTicketSystem(kind, baseURL, project, issueType, group string) (ticketSystem, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("-ticket-url is required")
+	}
+	api := ticketAPI{base: strings.TrimRight(baseURL, "/"), client: &http.Client{Timeout: 20 * time.Second}}
+
+	switch kind {
+	case "jira":
+		if project == "" {
+			return nil, fmt.Errorf("-ticket-project is required for Jira")
+		}
+		email, token := os.Getenv("JIRA_EMAIL"), os.Getenv("JIRA_API_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("set JIRA_API_TOKEN (and JIRA_EMAIL for Jira Cloud)")
+		}
+		api.auth = func(req *http.Request) {
+			if email != "" {
+				req.SetBasicAuth(email, token)
+			} else {
+				req.Header.Set("Authorization", "Bearer "+token) // Data Center personal access token
+			}
+		}
+		return &jiraTickets{api: api, project: project, issueType: issueType}, nil
+	case "servicenow":
+		user, password := os.Getenv("SERVICENOW_USER"), os.Getenv("SERVICENOW_PASSWORD")
+		if user == "" || password == "" {
+			return nil, fmt.Errorf("set SERVICENOW_USER and SERVICENOW_PASSWORD")
+		}
+		api.auth = func(req *http.Request) { req.SetBasicAuth(user, password) }
+		return &serviceNowTickets{api: api, group: group}, nil
+	}
+	return nil, fmt.Errorf("unknown ticket system %q (use jira or servicenow)", kind)
+}
+
+// hysteresis damps alerting: it fires after fireM failures within the last
+// fireN probes and resolves after resolveM successes within the last resolveN
+type hysteresis struct {
+	fireM, fireN       int
+	resolveM, resolveN int
+	recent             []probeRecord // Newest last, at most max(fireN, resolveN)
+	firing             bool
+	since              time.Time // First failure of the current incident
+}
+
+// parseRatio reads an "M/N" flag value
+func parseRatio(value string) (int, int, error) {
+	mStr, nStr, ok := strings.Cut(value, "/")
+	m, errM := strconv.Atoi(mStr)
+	n, errN := strconv.Atoi(nStr)
+	if !ok || errM != nil || errN != nil || m < 1 || m > n {
+		return 0, 0, fmt.Errorf("%q must look like M/N with 1 <= M <= N", value)
+	}
+	return m, n, nil
+}
+
+// count reports how many of the last n probes had the given outcome
+func (h *hysteresis) count(n int, ok bool) int {
+	matched := 0
+	start := len(h.recent) - n
+	if start < 0 {
+		start = 0
+	}
+	for _, rec := range h.recent[start:] {
+		if rec.OK == ok {
+			matched++
+		}
+	}
+	return matched
+}
+
+// Observe records a probe and reports whether the alert state changed
+func (h *hysteresis) Observe(rec probeRecord) bool {
+	h.recent = append(h.recent, rec)
+	size := h.fireN
+	if h.resolveN > size {
+		size = h.resolveN
+	}
+	if len(h.recent) > size {
+		h.recent = h.recent[len(h.recent)-size:]
+	}
+
+	if !h.firing && h.count(h.fireN, false) >= h.fireM {
+		h.firing = true
+		// Date the incident from its first failure, not from when it was confirmed
+		start := len(h.recent) - h.fireN
+		if start < 0 {
+			start = 0
+		}
+		for _, r := range h.recent[start:] {
+			if !r.OK {
+				h.since = r.Time
+				break
+			}
+		}
+		// Only probes after a transition count towards the next one, or a
+		// single probe could flip the state straight back
+		h.recent = h.recent[:0]
+		return true
+	}
+	if h.firing && h.count(h.resolveN, true) >= h.resolveM {
+		h.firing = false
+		h.recent = h.recent[:0]
+		return true
+	}
+	return false
+}
+
+// lossWindow tracks the most recent probes for loss and latency figures
+type lossWindow struct {
+	results  []probeRecord
+	next     int
+	filled   int
+	failures int
+	streak   int // Consecutive failures up to the latest probe
+	last     probeRecord
+}
+
+func newLossWindow(size int) *lossWindow {
+	return &lossWindow{results: make([]probeRecord, size)}
+}
+
+func (w *lossWindow) Add(rec probeRecord) {
+	if w.filled == len(w.results) {
+		if !w.results[w.next].OK {
+			w.failures--
+		}
+	} else {
+		w.filled++
+	}
+	w.results[w.next] = rec
+	if !rec.OK {
+		w.failures++
+		w.streak++
+	} else {
+		w.streak = 0
+	}
+	w.last = rec
+	w.next = (w.next + 1) % len(w.results)
+}
+
+// Variables returns the values alert rules are evaluated against
+func (w *lossWindow) Variables(mode string) map[string]interface{} {
+	var latencies []float64
+	for _, rec := range w.results[:w.filled] {
+		if rec.OK {
+			latencies = append(latencies, float64(rec.RTT.Microseconds())/1000)
+		}
+	}
+	var avg, p95, maxLatency float64
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		for _, l := range latencies {
+			avg += l
+		}
+		avg /= float64(len(latencies))
+		p95 = latencies[int(float64(len(latencies)-1)*0.95)]
+		maxLatency = latencies[len(latencies)-1]
+	}
+
+	return map[string]interface{}{
+		"ok":                   w.last.OK,
+		"latency":              float64(w.last.RTT.Microseconds()) / 1000,
+		"loss":                 w.LossPct(),
+		"avg_latency":          avg,
+		"p95_latency":          p95,
+		"max_latency":          maxLatency,
+		"consecutive_failures": float64(w.streak),
+		"status":               float64(w.last.Status),
+		"cert_days":            w.last.CertDays,
+		"mode":                 mode,
+	}
+}
+
+func (w *lossWindow) Full() bool {
+	return w.filled == len(w.results)
+}
+
+func (w *lossWindow) LossPct() float64 {
+	if w.filled == 0 {
+		return 0
+	}
+	return float64(w.failures) / float64(w.filled) * 100
+}
+
+// Persistent HTTP probing keeps one client, and so one connection pool, for
+// the whole run the way a long-lived service client would. Cold-start probes
+// never see load balancer idle timeouts or DNS changes that pooled
+// connections keep ignoring; connection reuse statistics surface both.
+
+type TrendBucket struct {
+	Start    time.Time `json:"start"`
+	Probes   int       `json:"probes"`
+	Failures int       `json:"failures"`
+	ReusePct float64   `json:"reusePct"`
+	AvgMs    float64   `json:"avgMs"`
+	P95Ms    float64   `json:"p95Ms"`
+}
+
+type ConnectionReport struct {
+	Probes                int            `json:"probes"`
+	ReusedConnections     int            `json:"reusedConnections"`
+	NewConnections        int            `json:"newConnections"`
+	ReusePct              float64        `json:"reusePct"`
+	Retries               int            `json:"retries"` // Requests resent after a pooled connection turned out dead
+	DNSLookups            int            `json:"dnsLookups"`
+	DNSChanges            int            `json:"dnsChanges"`
+	Addresses             []string       `json:"addresses,omitempty"`       // Most recent resolution
+	RemoteAddresses       []string       `json:"remoteAddresses,omitempty"` // Every server address connected to
+	ReusedLatency         LatencySummary `json:"reusedLatency"`
+	NewLatency            LatencySummary `json:"newConnectionLatency"`
+	LatencyTrendMsPerHour float64        `json:"latencyTrendMsPerHour"`
+	Trend                 []TrendBucket  `json:"trend"`
+}
+
+// persistentProbe probes an HTTP target through one long-lived client
+type persistentProbe struct {
+	mu      sync.Mutex
+	client  *http.Client
+	window  time.Duration
+	start   time.Time
+	report  ConnectionReport
+	reused  []float64
+	fresh   []float64
+	remotes map[string]bool
+
+	bucket          *TrendBucket
+	bucketLatencies []float64
+	bucketReused    int
+
+	// Running sums for a least-squares fit of latency against time
+	n, sx, sy, sxx, sxy float64
+}
+
+func newPersistentProbe(timeout, window time.Duration) *persistentProbe {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return &persistentProbe{
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+		window:  window,
+		start:   time.Now(),
+		remotes: make(map[string]bool),
+	}
+}
+
+// Probe sends one request on the shared client. It returns the record and
+// a message when the client re-resolved the host to different addresses.
+func (p *persistentProbe) Probe(target string) (probeRecord, string) {
+	rec := probeRecord{Time: time.Now(), CertDays: -1}
+
+	var traceMu sync.Mutex
+	var conns, lookups int
+	var reused bool
+	var remote string
+	var addrs []string
+	trace := &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			traceMu.Lock()
+			defer traceMu.Unlock()
+			lookups++
+			for _, addr := range info.Addrs {
+				addrs = append(addrs, addr.IP.String())
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			traceMu.Lock()
+			defer traceMu.Unlock()
+			conns++
+			reused = info.Reused
+			remote = info.Conn.RemoteAddr().String()
+		},
+	}
+
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = p.client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err == nil {
+			// The body must be drained for the connection to go back to the pool
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			rec.OK = resp.StatusCode < 400
+			rec.Status = resp.StatusCode
+			if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+				rec.CertDays = time.Until(resp.TLS.PeerCertificates[0].NotAfter).Hours() / 24
+			}
+		}
+	}
+	rec.RTT = time.Since(start)
+
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := &p.report
+	r.Probes++
+	if conns > 1 {
+		r.Retries++
+	}
+	if conns > 0 {
+		if reused {
+			r.ReusedConnections++
+		} else {
+			r.NewConnections++
+		}
+		if remote != "" && !p.remotes[remote] {
+			p.remotes[remote] = true
+			r.RemoteAddresses = append(r.RemoteAddresses, remote)
+		}
+	}
+
+	var change string
+	if lookups > 0 && len(addrs) > 0 {
+		r.DNSLookups += lookups
+		sort.Strings(addrs)
+		if r.Addresses != nil && strings.Join(addrs, ",") != strings.Join(r.Addresses, ",") {
+			r.DNSChanges++
+			change = fmt.Sprintf("%s re-resolved to %s (was %s)", target, strings.Join(addrs, ", "), strings.Join(r.Addresses, ", "))
+		}
+		r.Addresses = addrs
+	}
+
+	bucketStart := rec.Time.Truncate(p.window)
+	if p.bucket == nil || !p.bucket.Start.Equal(bucketStart) {
+		p.closeBucket()
+		p.bucket = &TrendBucket{Start: bucketStart}
+	}
+	p.bucket.Probes++
+	if conns > 0 && reused {
+		p.bucketReused++
+	}
+	if !rec.OK {
+		p.bucket.Failures++
+		return rec, change
+	}
+
+	ms := float64(rec.RTT.Microseconds()) / 1000
+	p.bucketLatencies = append(p.bucketLatencies, ms)
+	if reused {
+		p.reused = append(p.reused, ms)
+	} else {
+		p.fresh = append(p.fresh, ms)
+	}
+	x := rec.Time.Sub(p.start).Hours()
+	p.n++
+	p.sx += x
+	p.sy += ms
+	p.sxx += x * x
+	p.sxy += x * ms
+	return rec, change
+}
+
+// currentBucket summarizes the trend bucket in progress
+func (p *persistentProbe) currentBucket() TrendBucket {
+	b := *p.bucket
+	b.ReusePct = math.Round(float64(p.bucketReused)/float64(b.Probes)*1000) / 10
+	if len(p.bucketLatencies) > 0 {
+		summary := summarizeLatency(append([]float64(nil), p.bucketLatencies...))
+		b.AvgMs, b.P95Ms = summary.AvgMs, summary.P95Ms
+	}
+	return b
+}
+
+func (p *persistentProbe) closeBucket() {
+	if p.bucket == nil {
+		return
+	}
+	p.report.Trend = append(p.report.Trend, p.currentBucket())
+	p.bucket, p.bucketLatencies, p.bucketReused = nil, nil, 0
+}
+
+// Report returns the statistics so far, including the bucket in progress
+func (p *persistentProbe) Report() *ConnectionReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := p.report
+	report.Trend = append([]TrendBucket{}, p.report.Trend...)
+	if p.bucket != nil {
+		report.Trend = append(report.Trend, p.currentBucket())
+	}
+
+	if total := report.ReusedConnections + report.NewConnections; total > 0 {
+		report.ReusePct = math.Round(float64(report.ReusedConnections)/float64(total)*1000) / 10
+	}
+	if len(p.reused) > 0 {
+		report.ReusedLatency = summarizeLatency(append([]float64(nil), p.reused...))
+	}
+	if len(p.fresh) > 0 {
+		report.NewLatency = summarizeLatency(append([]float64(nil), p.fresh...))
+	}
+	if denom := p.n*p.sxx - p.sx*p.sx; p.n > 1 && denom > 0 {
+		report.LatencyTrendMsPerHour = math.Round((p.n*p.sxy-p.sx*p.sy)/denom*1000) / 1000
+	}
+	return &report
+}
+
+type PathHop struct {
+	Hop      int     `json:"hop"`
+	Address  string  `json:"address,omitempty"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	LossPct  float64 `json:"lossPct"`
+	AvgMs    float64 `json:"avgMs,omitempty"`
+	NoReply  bool    `json:"noReply,omitempty"` // Hop never answered traceroute
+}
+
+// PathAnalysis is an MTR-style per-hop loss measurement of the path
+type PathAnalysis struct {
+	Host               string    `json:"host"`
+	StartedAt          time.Time `json:"startedAt"`
+	Hops               []PathHop `json:"hops"`
+	ReachedDestination bool      `json:"reachedDestination"`
+	DestinationLossPct float64   `json:"destinationLossPct"`
+	CulpritHop         int       `json:"culpritHop,omitempty"`
+	CulpritAddress     string    `json:"culpritAddress,omitempty"`
+	LastCleanAddress   string    `json:"lastCleanAddress,omitempty"`
+	Verdict            string    `json:"verdict"`
+	Error              string    `json:"error,omitempty"`
+}
+
+// traceHost extracts the host to trace from a monitor target
+func traceHost(mode, target string) string {
+	switch mode {
+	case "tcp":
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			return host
+		}
+	case "http":
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname()
+		}
+	}
+	return target
+}
+
+var hopLineRegex = regexp.MustCompile(`^\s*(\d+)\s+(.*)$`)
+
+// discoverPath lists hop addresses with one numeric traceroute probe per hop.
+// Hops that never answered are kept with an empty address.
+func discoverPath(host string) ([]PathHop, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("tracert", "-d", "-h", "30", "-w", "1000", host)
+	} else {
+		cmd = exec.Command("traceroute", "-n", "-q", "1", "-w", "1", "-m", "30", host)
+	}
+	output, err := cmd.CombinedOutput()
+
+	var hops []PathHop
+	for _, line := range strings.Split(string(output), "\n") {
+		match := hopLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		hop := PathHop{}
+		hop.Hop, _ = strconv.Atoi(match[1])
+		for _, field := range strings.Fields(match[2]) {
+			if ip := net.ParseIP(strings.Trim(field, "()[]")); ip != nil {
+				hop.Address = ip.String()
+				break
+			}
+		}
+		hop.NoReply = hop.Address == ""
+		hops = append(hops, hop)
+	}
+	if len(hops) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no hops in traceroute output")
+		}
+		return nil, fmt.Errorf("traceroute to %s: %v", host, err)
+	}
+	return hops, nil
+}
+
+var (
+	pingLossRegex = regexp.MustCompile(`([\d.]+)% (?:packet )?loss`)
+	pingAvgRegex  = regexp.MustCompile(`= [\d.]+/([\d.]+)/|Average = (\d+)ms`)
+)
+
+// measureHop pings one hop count times and fills in its loss and latency
+func measureHop(hop *PathHop, count int) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("ping", "-n", strconv.Itoa(count), "-w", "1000", hop.Address)
+	case "darwin":
+		cmd = exec.Command("ping", "-c", strconv.Itoa(count), "-i", "0.2", "-W", "1000", hop.Address)
+	default:
+		cmd = exec.Command("ping", "-c", strconv.Itoa(count), "-i", "0.2", "-W", "1", hop.Address)
+	}
+	// ping exits non-zero on loss, but its summary is still valid
+	output, _ := cmd.CombinedOutput()
+
+	hop.Sent = count
+	hop.LossPct = 100
+	if match := pingLossRegex.FindStringSubmatch(string(output)); match != nil {
+		hop.LossPct, _ = strconv.ParseFloat(match[1], 64)
+	}
+	hop.Received = count - int(math.Round(hop.LossPct/100*float64(count)))
+	if match := pingAvgRegex.FindStringSubmatch(string(output)); match != nil {
+		avg := match[1]
+		if avg == "" {
+			avg = match[2]
+		}
+		hop.AvgMs, _ = strconv.ParseFloat(avg, 64)
+	}
+}
+
+// analyzePath measures loss at every hop and finds where it begins. Loss
+// only counts against a hop if it carries through to the destination;
+// routers that rate-limit ICMP show loss that later hops do not.
+func analyzePath(host string, pings int, threshold float64) *PathAnalysis {
+	analysis := &PathAnalysis{Host: host, StartedAt: time.Now(), Hops: []PathHop{}}
+
+	hops, err := discoverPath(host)
+	if err != nil {
+		analysis.Error = err.Error()
+		analysis.Verdict = "path could not be traced"
+		return analysis
+	}
+
+	var wg sync.WaitGroup
+	for i := range hops {
+		if hops[i].Address == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(hop *PathHop) {
+			defer wg.Done()
+			measureHop(hop, pings)
+		}(&hops[i])
+	}
+	wg.Wait()
+	analysis.Hops = hops
+
+	var responding []PathHop
+	for _, hop := range hops {
+		if hop.Address != "" {
+			responding = append(responding, hop)
+		}
+	}
+	if len(responding) == 0 {
+		analysis.Verdict = "no hop on the path answered"
+		return analysis
+	}
+
+	last := responding[len(responding)-1]
+	analysis.DestinationLossPct = last.LossPct
+	if addrs, err := net.LookupHost(host); err == nil {
+		for _, addr := range addrs {
+			if addr == last.Address {
+				analysis.ReachedDestination = true
+			}
+		}
+	}
+
+	if last.LossPct < threshold {
+		analysis.Verdict = fmt.Sprintf("loss not reproduced during analysis (%.0f%% at the last hop)", last.LossPct)
+		return analysis
+	}
+
+	// Walk back from the end while hops still show the destination's loss
+	persist := last.LossPct / 2
+	culprit := len(responding) - 1
+	for culprit > 0 && responding[culprit-1].LossPct >= persist {
+		culprit--
+	}
+
+	analysis.CulpritHop = responding[culprit].Hop
+	analysis.CulpritAddress = responding[culprit].Address
+	if culprit == 0 {
+		analysis.Verdict = fmt.Sprintf("loss begins at the first responding hop %d (%s): local network or gateway",
+			analysis.CulpritHop, analysis.CulpritAddress)
+	} else {
+		analysis.LastCleanAddress = responding[culprit-1].Address
+		analysis.Verdict = fmt.Sprintf("loss begins at hop %d (%s), after %s",
+			analysis.CulpritHop, analysis.CulpritAddress, analysis.LastCleanAddress)
+	}
+	if !analysis.ReachedDestination {
+		analysis.Verdict += "; the trace did not reach the destination"
+	}
+	return analysis
+}
+
+// Alert rule expressions: a small language over probe metrics, e.g.
+// "loss > 5 && p95_latency > 200" or "status != 200 || cert_days < 14".
+// Values are numbers, booleans and strings; operators follow the usual
+// precedence: || then && then comparisons then + - then * / then unary ! -.
+
+type exprNode interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+type exprVar struct{ name string }
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+// Variables available to alert rules, with a description for -help
+var exprVariables = map[string]string{
+	"ok":                   "last probe succeeded",
+	"latency":              "last probe round trip in ms",
+	"loss":                 "failed probes over the loss window, percent",
+	"avg_latency":          "mean successful latency over the loss window, ms",
+	"p95_latency":          "95th percentile latency over the loss window, ms",
+	"max_latency":          "highest latency over the loss window, ms",
+	"consecutive_failures": "failed probes in a row",
+	"status":               "HTTP status code of the last probe (0 if none)",
+	"cert_days":            "days until the HTTPS certificate expires (-1 if unknown)",
+	"mode":                 "probe mode: tcp, icmp or http",
+}
+
+func (n exprLiteral) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+func (n exprVar) eval(vars map[string]interface{}) (interface{}, error) {
+	return vars[n.name], nil
+}
+
+func (n exprUnary) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs a boolean, got %v", v)
+		}
+		return !b, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("- needs a number, got %v", v)
+	}
+	return -f, nil
+}
+
+func (n exprBinary) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, left)
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, right)
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %q with %v", l, right)
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		case "+":
+			return l + r, nil
+		}
+		return nil, fmt.Errorf("%s is not defined for strings", n.op)
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s needs numbers, got %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+var exprTokenRegex = regexp.MustCompile(`\s*(?:(\d+(?:\.\d+)?)|([A-Za-z_][A-Za-z0-9_]*)|("[^"]*"|'[^']*')|(&&|\|\||==|!=|<=|>=|[<>!+\-*/()]))`)
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeExpr(src string) ([]string, error) {
+	var tokens []string
+	rest := src
+	for strings.TrimSpace(rest) != "" {
+		loc := exprTokenRegex.FindStringIndex(rest)
+		if loc == nil || loc[0] != 0 {
+			return nil, fmt.Errorf("unexpected input at %q", strings.TrimSpace(rest))
+		}
+		tokens = append(tokens, strings.TrimSpace(rest[:loc[1]]))
+		rest = rest[loc[1]:]
+	}
+	return tokens, nil
+}
+
+// compileExpr parses an alert rule and checks every variable it uses
+func compileExpr(src string) (exprNode, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+// Binary operators from lowest to highest precedence
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, candidate := range exprPrecedence[level] {
+			if op == candidate {
+				matched = true
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	tok := p.peek()
+	if tok == "!" || tok == "-" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op: tok, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case tok == "(":
+		node, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	case tok == "true" || tok == "false":
+		return exprLiteral{value: tok == "true"}, nil
+	case tok[0] == '"' || tok[0] == '\'':
+		return exprLiteral{value: tok[1 : len(tok)-1]}, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, err
+		}
+		return exprLiteral{value: f}, nil
+	}
+	if _, ok := exprVariables[tok]; ok {
+		return exprVar{name: tok}, nil
+	}
+	return nil, fmt.Errorf("unknown variable or token %q", tok)
+}
+
+// alertRule is a compiled -alert-if expression with its own damping
+type alertRule struct {
+	source  string
+	expr    exprNode
+	damping *hysteresis
+}
+
+// parseAlertRule compiles an -alert-if value. A rule may override the
+// -fire and -resolve ratios after a semicolon, e.g.
+// "p95_latency > 200; fire=5/10 resolve=10/10"; otherwise it uses them.
+// "Matched" counts as a failure for the damping.
+func parseAlertRule(src string, defaults *hysteresis) (*alertRule, error) {
+	damping := &hysteresis{
+		fireM: defaults.fireM, fireN: defaults.fireN, resolveM: defaults.resolveM, resolveN: defaults.resolveN,
+	}
+	source := src
+	if i := strings.LastIndex(src, ";"); i >= 0 {
+		source = strings.TrimSpace(src[:i])
+		for _, option := range strings.Fields(src[i+1:]) {
+			name, value, _ := strings.Cut(option, "=")
+			var err error
+			switch name {
+			case "fire":
+				damping.fireM, damping.fireN, err = parseRatio(value)
+			case "resolve":
+				damping.resolveM, damping.resolveN, err = parseRatio(value)
+			default:
+				err = fmt.Errorf("unknown rule option %q (use fire=M/N or resolve=M/N)", option)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	expr, err := compileExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	return &alertRule{source: source, expr: expr, damping: damping}, nil
+}
+
+// stringList collects a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, "; ") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+// ringReport analyzes everything currently in the ring
+func ringReport(ring *ringBuffer) (MonitorReport, error) {
+	records, err := ring.Records()
+	if err != nil {
+		return MonitorReport{}, err
+	}
+	report := analyzeRecords(records, ring.interval)
+	report.Target = ring.target
+	report.Mode = ring.mode
+	return report, nil
+}
+
+// printReport prints the ring report, with connection statistics when the
+// run used a persistent client (they live in memory, not in the ring)
+func printReport(ring *ringBuffer, persistent *persistentProbe) {
+	report, err := ringReport(ring)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading ring file: %v\n", err)
+		os.Exit(1)
+	}
+	if persistent != nil {
+		report.Connections = persistent.Report()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+func main() {
+	mode := flag.String("mode", "tcp", "Probe type: tcp (host:port), icmp (host) or http (URL)")
+	interval := flag.Duration("interval", time.Second, "Time between probes")
+	timeout := flag.Duration("timeout", 0, "Probe timeout (default: the interval)")
+	file := flag.String("file", "monitor.ring", "Ring buffer file")
+	capacity := flag.Uint("capacity", 7*24*3600, "Records kept in the ring buffer (default: 7 days at 1s)")
+	duration := flag.Duration("duration", 0, "Stop after this long and print the report (default: run until interrupted)")
+	reportOnly := flag.Bool("report", false, "Print the report for an existing ring file without probing")
+	alertFile := flag.String("alert-file", "", "Append alerts as JSON lines to this file")
+	lossThreshold := flag.Float64("loss-threshold", 5, "Loss percentage over the loss window that triggers path analysis")
+	lossWindowSize := flag.Int("loss-window", 60, "Number of recent probes the loss percentage covers")
+	tracePings := flag.Int("trace-pings", 20, "Pings sent to each hop during path analysis")
+	traceCooldown := flag.Duration("trace-cooldown", 15*time.Minute, "Minimum time between path analyses")
+	fireRatio := flag.String("fire", "3/5", "Alert when M of the last N probes fail")
+	resolveRatio := flag.String("resolve", "2/3", "Resolve when M of the last N probes succeed")
+	var ruleSources stringList
+	ticketKind := flag.String("ticket", "", "Open one ticket per outage in 'jira' or 'servicenow' (credentials from JIRA_EMAIL/JIRA_API_TOKEN or SERVICENOW_USER/SERVICENOW_PASSWORD)")
+	ticketURL := flag.String("ticket-url", "", "Base URL of the Jira site or ServiceNow instance")
+	ticketProject := flag.String("ticket-project", "", "Jira project key")
+	ticketIssueType := flag.String("ticket-issue-type", "Task", "Jira issue type")
+	ticketGroup := flag.String("ticket-group", "", "ServiceNow assignment group")
+	persistentClient := flag.Bool("persistent", false, "http mode: keep one client and its pooled connections for the whole run, reporting connection reuse, DNS re-resolution and latency trend")
+	trendWindow := flag.Duration("trend-window", 5*time.Minute, "Bucket size for the -persistent latency trend")
+	flag.Var(&ruleSources, "alert-if", "Alert while an expression holds, e.g. 'loss > 5 && p95_latency > 200', optionally with its own ratios: '...; fire=5/10 resolve=3/3' (repeatable)")
+	flag.Parse()
+
+	if *reportOnly {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		ring, err := readRingHeader(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer ring.Close()
+		printReport(ring, nil)
+		return
+	}
+
+	args := flag.Args()
+	if len(args) != 1 {
+		fmt.Println("Usage: monitor [options] <target>")
+		fmt.Println("Example: monitor -mode tcp -file isp.ring 203.0.113.10:443")
+		fmt.Println("         monitor -report -file isp.ring")
+		fmt.Println("         monitor -mode http -alert-if 'status != 200 || cert_days < 14' https://example.com/")
+		fmt.Println("         monitor -mode http -persistent -interval 30s -duration 24h https://api.internal/health")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		fmt.Println("\nAlert rule variables:")
+		names := make([]string, 0, len(exprVariables))
+		for name := range exprVariables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %-22s %s\n", name, exprVariables[name])
+		}
+		os.Exit(1)
+	}
+	target := args[0]
+
+	if *mode != "tcp" && *mode != "icmp" && *mode != "http" {
+		fmt.Fprintf(os.Stderr, "Error: unknown mode %q (use tcp, icmp or http)\n", *mode)
+		os.Exit(1)
+	}
+	if *capacity == 0 || *capacity > math.MaxUint32 {
+		fmt.Fprintf(os.Stderr, "Error: capacity must be between 1 and %d\n", uint32(math.MaxUint32))
+		os.Exit(1)
+	}
+	if *timeout == 0 {
+		*timeout = *interval
+	}
+	if *persistentClient && *mode != "http" {
+		fmt.Fprintf(os.Stderr, "Error: -persistent needs -mode http\n")
+		os.Exit(1)
+	}
+	if *trendWindow <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -trend-window must be positive\n")
+		os.Exit(1)
+	}
+	if *lossWindowSize < 1 || *tracePings < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -loss-window and -trace-pings must be at least 1\n")
+		os.Exit(1)
+	}
+
+	damping := &hysteresis{}
+	var err error
+	if damping.fireM, damping.fireN, err = parseRatio(*fireRatio); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -fire %v\n", err)
+		os.Exit(1)
+	}
+	if damping.resolveM, damping.resolveN, err = parseRatio(*resolveRatio); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -resolve %v\n", err)
+		os.Exit(1)
+	}
+
+	var rules []*alertRule
+	for _, src := range ruleSources {
+		rule, err := parseAlertRule(src, damping)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -alert-if %q: %v\n", src, err)
+			os.Exit(1)
+		}
+		rules = append(rules, rule)
+	}
+
+	alerts := &alerter{}
+	if *alertFile != "" {
+		f, err := os.OpenFile(*alertFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		alerts.file = f
+	}
+
+	ring, err := openRing(*file, uint32(*capacity), *interval, *mode, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer ring.Close()
+
+	var persistent *persistentProbe
+	if *persistentClient {
+		persistent = newPersistentProbe(*timeout, *trendWindow)
+	}
+
+	// Set by a packet-loss alert until the loss window drops below the threshold
+	var lossFiring atomic.Bool
+
+	if *ticketKind != "" {
+		system, err := newTicketSystem(*ticketKind, *ticketURL, *ticketProject, *ticketIssueType, *ticketGroup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		alerts.tickets = newTicketer(system, ticketKey(*mode, target), func() MonitorReport {
+			report, _ := ringReport(ring)
+			if persistent != nil {
+				report.Connections = persistent.Report()
+			}
+			return report
+		})
+		alerts.firing = func() bool {
+			firing := damping.firing || lossFiring.Load()
+			for _, rule := range rules {
+				firing = firing || rule.damping.firing
+			}
+			return firing
+		}
+		// Deferred after ring.Close, so it runs first and can still read the ring
+		defer alerts.tickets.Close()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+
+	fmt.Fprintf(os.Stderr, "Monitoring %s (%s) every %s, recording to %s\n", target, *mode, *interval, *file)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	window := newLossWindow(*lossWindowSize)
+	var tracing atomic.Bool
+	var lastTrace time.Time
+	host := traceHost(*mode, target)
+
+	for {
+		var rec probeRecord
+		var dnsChange string
+		if persistent != nil {
+			rec, dnsChange = persistent.Probe(target)
+		} else {
+			rec = probeOnce(*mode, target, *timeout)
+		}
+		if err := ring.Append(rec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing ring file: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Alerts go to stderr so stdout stays a single JSON report
+		if damping.Observe(rec) {
+			if damping.firing {
+				alerts.Emit(Alert{Time: rec.Time, Target: target, Mode: *mode, Kind: "down",
+					Message: fmt.Sprintf("%s stopped responding (%s probes failed)", target, *fireRatio)})
+			} else {
+				down := rec.Time.Sub(damping.since)
+				alerts.Emit(Alert{Time: rec.Time, Target: target, Mode: *mode, Kind: "recovered",
+					Message: fmt.Sprintf("%s responding again after %s", target, down.Round(time.Second)), DownSeconds: down.Seconds()})
+			}
+		}
+
+		// Pooled connections keep using the old addresses until they close
+		if dnsChange != "" {
+			alerts.Emit(Alert{Time: rec.Time, Target: target, Mode: *mode, Kind: "dns-changed", Message: dnsChange})
+		}
+
+		// Elevated loss triggers a path analysis in the background so
+		// probing carries on; the alert is sent once it completes
+		window.Add(rec)
+		if len(rules) > 0 {
+			vars := window.Variables(*mode)
+			for _, rule := range rules {
+				value, err := rule.expr.eval(vars)
+				matched, isBool := value.(bool)
+				if err != nil || !isBool {
+					if err == nil {
+						err = fmt.Errorf("result %v is not a boolean", value)
+					}
+					fmt.Fprintf(os.Stderr, "Error evaluating %q: %v\n", rule.source, err)
+					continue
+				}
+				if !rule.damping.Observe(probeRecord{Time: rec.Time, OK: !matched}) {
+					continue
+				}
+				kind, message := "rule", "rule matched: "+rule.source
+				if !rule.damping.firing {
+					kind, message = "rule-cleared", "rule cleared: "+rule.source
+				}
+				alerts.Emit(Alert{Time: rec.Time, Target: target, Mode: *mode, Kind: kind, Message: message,
+					LossPct: window.LossPct(), Rule: rule.source})
+			}
+		}
+		if loss := window.LossPct(); window.Full() && loss >= *lossThreshold &&
+			time.Since(lastTrace) >= *traceCooldown && tracing.CompareAndSwap(false, true) {
+			lastTrace = time.Now()
+			fmt.Fprintf(os.Stderr, "%.1f%% loss over the last %d probes, analyzing path to %s\n", loss, *lossWindowSize, host)
+			go func(loss float64) {
+				defer tracing.Store(false)
+				path := analyzePath(host, *tracePings, *lossThreshold)
+				lossFiring.Store(true)
+				alerts.Emit(Alert{
+					Time:    time.Now(),
+					Target:  target,
+					Mode:    *mode,
+					Kind:    "packet-loss",
+					Message: fmt.Sprintf("%.1f%% loss to %s: %s", loss, target, path.Verdict),
+					LossPct: loss,
+					Path:    path,
+				})
+			}(loss)
+		} else if lossFiring.Load() && !tracing.Load() && window.Full() && window.LossPct() < *lossThreshold {
+			lossFiring.Store(false)
+			alerts.Emit(Alert{Time: rec.Time, Target: target, Mode: *mode, Kind: "loss-cleared",
+				Message: fmt.Sprintf("loss to %s back to %.1f%%", target, window.LossPct()), LossPct: window.LossPct()})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			printReport(ring, persistent)
+			return
+		case <-deadline:
+			printReport(ring, persistent)
+			return
+		}
+	}
+}
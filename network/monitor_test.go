@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func evalRule(t *testing.T, src string, vars map[string]interface{}) (interface{}, error) {
+	t.Helper()
+	expr, err := compileExpr(src)
+	if err != nil {
+		t.Fatalf("compileExpr(%q): %v", src, err)
+	}
+	return expr.eval(vars)
+}
+
+func TestExprPrecedence(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0}, // Left associative
+		{"12 / 3 / 2", 2.0},
+		{"-2 * 3", -6.0},
+		{"5 - -3", 8.0},
+		{"1 + 2 * 3 == 7", true},
+		{"1 < 2 == true", true},
+		{"true || false && false", true}, // && binds tighter than ||
+		{"(true || false) && false", false},
+		{"!false && true", true},
+		{"!(1 < 2)", false},
+		{"loss > 5 && p95_latency > 200", true},
+		{"status != 200 || cert_days < 14", false},
+	}
+	vars := map[string]interface{}{"loss": 10.0, "p95_latency": 250.0, "status": 200.0, "cert_days": 30.0}
+	for _, tt := range tests {
+		got, err := evalRule(t, tt.src, vars)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprShortCircuit(t *testing.T) {
+	// The right-hand sides would fail: division by zero, or a string
+	// compared with a number
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"false && 1 / 0 > 1", false},
+		{"true || 1 / 0 > 1", true},
+		{"ok && mode < 5", false},
+		{"!ok || mode < 5", true},
+	}
+	vars := map[string]interface{}{"ok": false, "mode": "tcp"}
+	for _, tt := range tests {
+		got, err := evalRule(t, tt.src, vars)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{"true && 1 / 0 > 1", "false || 1 / 0 > 1"} {
+		if _, err := evalRule(t, src, nil); err == nil {
+			t.Errorf("%q: expected the right-hand side to be evaluated and fail", src)
+		}
+	}
+}
+
+func TestExprStringsAndNumbers(t *testing.T) {
+	vars := map[string]interface{}{"mode": "http", "status": 503.0}
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{`mode == "http"`, true},
+		{`mode == 'http'`, true},
+		{`mode != "tcp"`, true},
+		{`mode < "icmp"`, true},
+		{`"cert" + "_days"`, "cert_days"},
+		{`mode == 5`, false}, // Equality across types is false, not an error
+		{`status == "503"`, false},
+		{`status >= 500`, true},
+		{`"10" < "9"`, true}, // Strings compare as strings
+	}
+	for _, tt := range tests {
+		got, err := evalRule(t, tt.src, vars)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{`mode < 5`, `5 < mode`, `mode - "h"`, `status > "500"`, `-mode`, `!status`, `status && true`, `1 / 0`} {
+		if got, err := evalRule(t, src, vars); err == nil {
+			t.Errorf("%q = %v, expected an error", src, got)
+		}
+	}
+}
+
+func TestExprUnknownIdentifiers(t *testing.T) {
+	for _, src := range []string{"latencyy > 5", "loss > 5 && Loss > 5", "status == OK", "cpu"} {
+		_, err := compileExpr(src)
+		if err == nil || !strings.Contains(err.Error(), "unknown variable") {
+			t.Errorf("compileExpr(%q) = %v, want an unknown variable error", src, err)
+		}
+	}
+
+	// Known variables missing from a probe's values don't compare
+	if _, err := evalRule(t, "cert_days < 14", map[string]interface{}{}); err == nil {
+		t.Errorf("expected an error comparing an unset variable")
+	}
+}
+
+func TestExprMalformed(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"   ",
+		"loss >",
+		"> 5",
+		"loss > 5 &&",
+		"(loss > 5",
+		"loss > 5)",
+		"()",
+		"loss 5",
+		"loss = 5",
+		"loss > 5 & ok",
+		`mode == "http`,
+		"loss > 1.",
+		"latency > 5ms",
+		"status == 200 # comment",
+	} {
+		if expr, err := compileExpr(src); err == nil {
+			t.Errorf("compileExpr(%q) = %#v, expected an error", src, expr)
+		}
+	}
+}
+
+func TestParseAlertRuleOptions(t *testing.T) {
+	defaults := &hysteresis{fireM: 3, fireN: 5, resolveM: 5, resolveN: 5}
+	rule, err := parseAlertRule("p95_latency > 200; fire=5/10 resolve=10/10", defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.source != "p95_latency > 200" {
+		t.Errorf("source = %q", rule.source)
+	}
+	if d := rule.damping; d.fireM != 5 || d.fireN != 10 || d.resolveM != 10 || d.resolveN != 10 {
+		t.Errorf("damping = %d/%d %d/%d, want 5/10 10/10", d.fireM, d.fireN, d.resolveM, d.resolveN)
+	}
+
+	rule, err = parseAlertRule("loss > 5", defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := rule.damping; d.fireM != 3 || d.fireN != 5 || d == defaults {
+		t.Errorf("rule without options should copy the defaults, got %+v", d)
+	}
+
+	for _, src := range []string{"loss > 5; fire=5", "loss > 5; burst=2/3", "loss >; fire=1/2"} {
+		if _, err := parseAlertRule(src, defaults); err == nil {
+			t.Errorf("parseAlertRule(%q): expected an error", src)
+		}
+	}
+}
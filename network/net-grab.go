@@ -1,19 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -51,13 +59,156 @@ type PingOptions struct {
 }
 
 type HostInfo struct {
-	IPAddress   string    `json:"ip_address"`
-	Hostname    string    `json:"hostname,omitempty"`
-	IsReachable bool      `json:"is_reachable"`
-	PingStats   PingStats `json:"ping_stats"`
-	OpenPorts   []int     `json:"open_ports,omitempty"`
-	DNSNames    []string  `json:"dns_names,omitempty"`
-	ScannedAt   time.Time `json:"scanned_at"`
+	IPAddress   string         `json:"ip_address"`
+	Hostname    string         `json:"hostname,omitempty"`
+	MACAddress  string         `json:"mac_address,omitempty"`
+	Vendor      string         `json:"vendor,omitempty"`
+	IsReachable bool           `json:"is_reachable"`
+	PingStats   PingStats      `json:"ping_stats"`
+	OpenPorts   []int          `json:"open_ports,omitempty"`
+	Banners     map[int]string `json:"banners,omitempty"`
+	DNSNames    []string       `json:"dns_names,omitempty"`
+	Roles       []RoleMatch    `json:"roles,omitempty"`
+	ScannedAt   time.Time      `json:"scanned_at"`
+}
+
+// SweepHost is a live host found by a sweep
+type SweepHost struct {
+	IPAddress string  `json:"ip_address"`
+	Method    string  `json:"method"`
+	RTT       float64 `json:"rtt_ms"`
+}
+
+// SweepResult summarises a liveness sweep across a range
+type SweepResult struct {
+	CIDR        string      `json:"cidr"`
+	ICMPMode    string      `json:"icmp_mode"`
+	ProbeModes  ProbeModes  `json:"probe_modes"`
+	TCPPorts    []int       `json:"tcp_ports,omitempty"`
+	HostsProbed int         `json:"hosts_probed"`
+	HostsAlive  int         `json:"hosts_alive"`
+	DurationMs  float64     `json:"duration_ms"`
+	Alive       []SweepHost `json:"alive"`
+}
+
+// NeighborHost is an IPv6 host seen on the local link
+type NeighborHost struct {
+	IPAddress  string   `json:"ip_address"`
+	Scope      string   `json:"scope"`
+	MACAddress string   `json:"mac_address,omitempty"`
+	Vendor     string   `json:"vendor,omitempty"`
+	Router     bool     `json:"router,omitempty"`
+	State      string   `json:"state,omitempty"`
+	Sources    []string `json:"sources"`
+	RTT        float64  `json:"rtt_ms,omitempty"`
+}
+
+// NeighborResult is an IPv6 link enumeration via ND rather than a sweep
+type NeighborResult struct {
+	Interface  string         `json:"interface"`
+	EchoMode   string         `json:"echo_mode"`
+	HostsFound int            `json:"hosts_found"`
+	DurationMs float64        `json:"duration_ms"`
+	Hosts      []NeighborHost `json:"hosts"`
+}
+
+// Sweeps skip per-host enrichment, so they can cover far larger ranges
+const (
+	maxSweepHosts    = 1 << 20
+	maxExecPingProbe = 256 // Concurrency cap when each probe is a ping process
+	sweepAttempts    = 2
+)
+
+// Enrichment runs after the scan so slow lookups never hold a scan slot.
+// Reverse lookups go through the PTR engine; the workers only read the
+// neighbour table for MAC addresses.
+const (
+	enrichWorkers     = 16
+	ptrAttemptTimeout = 2 * time.Second
+	ptrRetries        = 2
+)
+
+// RoleMatch is a probable device role inferred from scan evidence
+type RoleMatch struct {
+	Role     string   `json:"role"`
+	Score    int      `json:"score"`
+	Evidence []string `json:"evidence"`
+}
+
+// roleSignature describes the evidence that points at a device role.
+// Port weights reflect how specific a port is to the role.
+type roleSignature struct {
+	role      string
+	ports     map[int]int
+	hostnames []string
+	vendors   []string
+	banners   []string
+}
+
+// Minimum score before a role is attached to a host
+const roleScoreThreshold = 3
+
+var roleSignatures = []roleSignature{
+	{
+		role:      "router",
+		ports:     map[int]int{23: 1, 53: 1, 161: 2, 179: 3, 1723: 2, 2000: 1, 8291: 3},
+		hostnames: []string{"gw", "gateway", "router", "rtr", "fw", "firewall", "edge", "core", "switch", "sw"},
+		vendors:   []string{"Cisco", "Juniper", "MikroTik", "Ubiquiti", "Aruba"},
+		banners:   []string{"mikrotik", "routeros", "cisco", "juniper", "junos"},
+	},
+	{
+		role:      "printer",
+		ports:     map[int]int{515: 3, 631: 2, 9100: 3},
+		hostnames: []string{"printer", "print", "prn", "mfp", "copier"},
+		vendors:   []string{"HP", "Brother", "Canon", "Epson", "Xerox", "Lexmark"},
+		banners:   []string{"jetdirect", "printer", "laserjet"},
+	},
+	{
+		role:      "hypervisor",
+		ports:     map[int]int{902: 3, 903: 2, 2179: 3, 8006: 3, 16509: 3, 16514: 3},
+		hostnames: []string{"esx", "esxi", "vcenter", "vcsa", "hv", "hyperv", "pve", "proxmox", "kvm", "xen"},
+		vendors:   []string{"Supermicro"},
+		banners:   []string{"vmware authentication daemon", "proxmox", "libvirt"},
+	},
+	{
+		role:      "camera",
+		ports:     map[int]int{554: 3, 8554: 2, 8000: 1, 34567: 3, 37777: 3},
+		hostnames: []string{"cam", "camera", "ipcam", "nvr", "dvr"},
+		vendors:   []string{"Hikvision", "Dahua", "Axis"},
+		banners:   []string{"rtsp/1.0", "hikvision", "dahua"},
+	},
+	{
+		role:      "database server",
+		ports:     map[int]int{1433: 3, 1521: 3, 3306: 3, 5432: 3, 5984: 2, 6379: 3, 9042: 3, 9200: 2, 11211: 2, 27017: 3},
+		hostnames: []string{"db", "sql", "mysql", "mariadb", "pg", "postgres", "mongo", "redis", "oracle", "ora"},
+		banners:   []string{"mysql", "mariadb", "-noauth", "redis"},
+	},
+	{
+		role:      "domain controller",
+		ports:     map[int]int{88: 3, 389: 2, 464: 2, 636: 1, 3268: 3, 3269: 3},
+		hostnames: []string{"dc", "pdc", "bdc", "ad", "addc"},
+	},
+}
+
+// Role-relevant ports scanned by the "roles" port specification
+var rolePorts = []int{
+	22, 23, 53, 80, 88, 161, 179, 389, 443, 445, 464, 515, 554, 631, 636, 902, 903,
+	1433, 1521, 1723, 2000, 2179, 3268, 3269, 3306, 3389, 5432, 5984, 6379, 8000,
+	8006, 8080, 8291, 8554, 9042, 9100, 9200, 11211, 16509, 16514, 27017, 34567, 37777,
+}
+
+// OUI prefixes for vendors whose devices map cleanly onto a role
+var ouiVendors = map[string]string{
+	"00:00:0C": "Cisco", "00:1B:54": "Cisco",
+	"00:05:85": "Juniper", "2C:6B:F5": "Juniper",
+	"4C:5E:0C": "MikroTik", "D4:CA:6D": "MikroTik",
+	"24:A4:3C": "Ubiquiti", "FC:EC:DA": "Ubiquiti",
+	"00:0B:86": "Aruba",
+	"00:1B:78": "HP", "00:80:77": "Brother", "00:1E:8F": "Canon",
+	"00:26:AB": "Epson", "00:00:AA": "Xerox", "00:04:00": "Lexmark",
+	"C0:56:E3": "Hikvision", "44:19:B6": "Hikvision",
+	"3C:EF:8C": "Dahua", "00:40:8C": "Axis", "AC:CC:8E": "Axis",
+	"00:25:90": "Supermicro", "AC:1F:6B": "Supermicro",
 }
 
 type PortScanOptions struct {
@@ -79,8 +230,56 @@ type Scanner struct {
 	totalHosts    int   // Total hosts to be scanned
 	progressMutex sync.Mutex
 	portOptions   PortScanOptions
+	enrichBudget  time.Duration // Total time allowed for the enrichment stage
+	progress      chan ProgressEvent
+
+	// Optional pacing: a probe rate cap, and a target duration that
+	// auto-tunes concurrency instead of the fixed sizes
+	pacer          *probePacer
+	targetDuration time.Duration
+	portLimiter    *probeLimiter // Shared by all hosts while tuning
+	probesDone     int64
+	probesTotal    int64
+
+	// Optional execution windows and a checkpoint of finished hosts
+	windows    *scanWindows
+	checkpoint *checkpointFile
+
+	ptr *ptrEngine // Reverse lookups for enrichment and PTR sweeps
+
+	// Privileged probe implementations, nil when raw sockets are unavailable
+	modes  ProbeModes
+	pinger *icmpPinger
+	syn    *synScanner
+
+	// Probe behaviour, tightened by the polite profile
+	hostLimit   int
+	pingCount   int
+	grabBanners bool
+	shuffle     bool
+	sourcePorts *sourcePortPool
+	probesSent  int64
+	profile     *ScanProfile
 }
 
+// ProgressEvent is a snapshot of a running scan. Phase is "hosts" for a
+// full scan, "sweep" for a sweep and "ports" for one host's large port scan.
+type ProgressEvent struct {
+	Phase       string  `json:"phase"`
+	Host        string  `json:"host,omitempty"`
+	Done        int     `json:"done"`
+	Total       int     `json:"total"`
+	Percent     float64 `json:"percent"`
+	Rate        float64 `json:"rate"` // Items per second so far
+	ETASeconds  float64 `json:"eta_seconds"`
+	ElapsedMs   int64   `json:"elapsed_ms"`
+	Concurrency int     `json:"concurrency,omitempty"`
+	Finished    bool    `json:"finished,omitempty"`
+}
+
+// Interval between progress events for a phase
+const progressInterval = 500 * time.Millisecond
+
 func NewScanner(verbose, liveDisplay bool) *Scanner {
 	return &Scanner{
 		ports:       []int{22, 80, 443, 3389, 8080}, // Common ports
@@ -92,82 +291,2293 @@ func NewScanner(verbose, liveDisplay bool) *Scanner {
 			StartPort: 1,
 			EndPort:   MaxPort,
 		},
+		enrichBudget: 10 * time.Second,
+		hostLimit:    hostConcurrency,
+		pingCount:    4,
+		grabBanners:  true,
 	}
 }
 
-func (s *Scanner) scanNetwork(cidr string) error {
+// expandCIDR lists the addresses in a range, stopping at limit
+func expandCIDR(cidr string, limit int) ([]string, error) {
 	ip, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var hosts []string
 	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
 		hosts = append(hosts, ip.String())
-		if len(hosts) >= s.maxHosts {
+		if len(hosts) >= limit {
 			break
 		}
 	}
+	return hosts, nil
+}
+
+func (s *Scanner) scanNetwork(cidr string) error {
+	hosts, err := expandCIDR(cidr, s.maxHosts)
+	if err != nil {
+		return err
+	}
+
+	if s.checkpoint != nil && len(s.checkpoint.state.Completed) > 0 {
+		finished := make(map[string]bool)
+		for _, info := range s.checkpoint.state.Completed {
+			finished[info.IPAddress] = true
+		}
+		s.results = append(s.results, s.checkpoint.state.Completed...)
+		remaining := hosts[:0]
+		for _, host := range hosts {
+			if !finished[host] {
+				remaining = append(remaining, host)
+			}
+		}
+		if s.verbose {
+			fmt.Printf("Resuming from checkpoint: %d of %d hosts already scanned\n", len(hosts)-len(remaining), len(hosts))
+		}
+		hosts = remaining
+	}
 
 	s.totalHosts = len(hosts)
 	if s.liveDisplay {
 		fmt.Printf("Starting scan of %d hosts in %s\n", s.totalHosts, cidr)
-		// Start a goroutine to display progress
-		go s.displayProgress()
+	}
+	if s.shuffle {
+		rand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
 	}
 
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 20) // Limit concurrent scans
+	portsPerHost := int64(len(s.portList()))
+	s.probesTotal = int64(len(hosts)) * portsPerHost
+	hostLimiter := newProbeLimiter(s.hostLimit)
+	var tunedLimiter *probeLimiter
+	if s.targetDuration > 0 {
+		// One port limiter shared by all hosts is what gets tuned
+		s.portLimiter = newProbeLimiter(portConcurrency)
+		tunedLimiter = s.portLimiter
+		defer s.startTuning(s.portLimiter, s.probesTotal, &s.probesDone, tuneMinConcurrency, tuneMaxConcurrency)()
+	}
+	stopProgress := s.trackProgress("hosts", "", s.totalHosts, &s.hostsScanned, tunedLimiter)
 
+	var wg sync.WaitGroup
 	for _, host := range hosts {
+		s.windows.wait()
 		wg.Add(1)
-		sem <- struct{}{}
+		hostLimiter.acquire()
 
 		go func(ip string) {
 			defer wg.Done()
-			defer func() { <-sem }()
+			defer hostLimiter.release()
 
 			info := s.scanHost(ip)
+			if !info.IsReachable {
+				// Unreachable hosts skip their port scan entirely
+				atomic.AddInt64(&s.probesDone, portsPerHost)
+			}
+
+			s.mu.Lock()
+			s.results = append(s.results, info)
+			s.mu.Unlock()
+
+			if s.checkpoint != nil {
+				if err := s.checkpoint.record(info); err != nil {
+					fmt.Fprintf(os.Stderr, "%sWarning:%s saving checkpoint: %v\n", ColorYellow, ColorReset, err)
+				}
+			}
+
+			if s.liveDisplay {
+				s.displayHostResult(info)
+			}
+
+			// Update progress counter
+			atomic.AddInt32(&s.hostsScanned, 1)
+		}(host)
+	}
+
+	wg.Wait()
+	stopProgress()
+
+	if s.liveDisplay {
+		fmt.Printf("\nScan complete. %d hosts scanned.\n", s.totalHosts)
+	}
+	if s.checkpoint != nil {
+		if err := s.checkpoint.finish(); err != nil {
+			fmt.Fprintf(os.Stderr, "%sWarning:%s removing checkpoint: %v\n", ColorYellow, ColorReset, err)
+		}
+	}
+
+	if skipped := s.enrichResults(s.enrichBudget); skipped > 0 && s.verbose {
+		fmt.Fprintf(os.Stderr, "%sWarning:%s enrichment budget of %s ran out; %d hosts not enriched\n",
+			ColorYellow, ColorReset, s.enrichBudget, skipped)
+	}
+
+	// Live lines went out before names, vendors and roles were known, so
+	// hosts that gained any are shown again
+	if s.liveDisplay {
+		header := false
+		for _, info := range s.results {
+			if info.Hostname == "" && info.Vendor == "" && len(info.Roles) == 0 {
+				continue
+			}
+			if !header {
+				fmt.Printf("\nEnriched hosts:\n")
+				header = true
+			}
+			s.displayHostResult(info)
+		}
+		if header {
+			fmt.Println()
+		}
+	}
+
+	return nil
+}
+
+// enrichResults adds reverse DNS names and hardware vendors to scanned
+// hosts. PTR lookups share the budget; hosts whose lookup had not finished
+// when it ran out are left without names. Roles are classified afterwards
+// so they can use whatever evidence was gathered.
+func (s *Scanner) enrichResults(budget time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	if s.ptr == nil {
+		engine, err := newPTREngine(nil, defaultPTRRate, defaultPTRConns, ptrAttemptTimeout, ptrRetries)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sWarning:%s reverse DNS disabled: %v\n", ColorYellow, ColorReset, err)
+		} else {
+			s.ptr = engine
+			defer func() { engine.Close(); s.ptr = nil }()
+		}
+	}
+
+	var skipped int32
+	if s.ptr != nil {
+		ips := make([]string, len(s.results))
+		for i := range s.results {
+			ips[i] = s.results[i].IPAddress
+		}
+		s.ptr.lookupAll(ctx, ips, nil, func(i int, names []string, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				atomic.AddInt32(&skipped, 1)
+				return
+			}
+			if len(names) > 0 {
+				s.results[i].DNSNames = names
+				s.results[i].Hostname = strings.TrimSuffix(names[0], ".")
+			}
+		})
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < enrichWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				enrichHost(ctx, &s.results[i])
+			}
+		}()
+	}
+
+	for i := range s.results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := range s.results {
+		s.results[i].Roles = classifyHost(s.results[i])
+	}
+	return int(skipped)
+}
+
+// enrichHost fills in the MAC vendor for a single host
+func enrichHost(ctx context.Context, info *HostInfo) {
+	// Hardware address is only known for hosts on the local link
+	if info.MACAddress = lookupMAC(ctx, info.IPAddress); info.MACAddress != "" {
+		info.Vendor = lookupVendor(info.MACAddress)
+	}
+}
+
+// ptrEngine resolves PTR records for many addresses at once. It speaks DNS
+// over UDP directly so thousands of queries can be in flight on a handful
+// of sockets, paces each resolver separately, and spends a shared retry
+// budget so a dead resolver cannot multiply the run time.
+type ptrEngine struct {
+	resolvers   []*ptrResolver
+	concurrency int
+	timeout     time.Duration
+	retries     int
+	retryBudget int64 // Retries left for the current run; shared by all lookups
+	next        uint32
+}
+
+// ptrResolver is one upstream server with its own socket and pacing. The
+// system resolver is used, one query at a time, where none can be read.
+type ptrResolver struct {
+	server string
+	conn   *net.UDPConn // Nil for the system resolver
+	pacer  *probePacer
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingPTR
+
+	queries, answered, nxdomain, failures, timeouts int64
+}
+
+// pendingPTR is an outstanding query. Replies must echo its question name
+// as well as its ID, so a spoofed or stray packet cannot fill in a hostname.
+type pendingPTR struct {
+	name string
+	ch   chan ptrReply
+}
+
+type ptrReply struct {
+	names     []string
+	rcode     int
+	truncated bool
+}
+
+// PTRResolverStats shows how each resolver coped with the load
+type PTRResolverStats struct {
+	Server   string `json:"server"`
+	Queries  int64  `json:"queries"`
+	Answered int64  `json:"answered"`
+	NXDomain int64  `json:"nxdomain"`
+	Failures int64  `json:"failures"`
+	Timeouts int64  `json:"timeouts"`
+}
+
+// PTRRecord is one address with the names pointing back at it
+type PTRRecord struct {
+	IPAddress string   `json:"ip_address"`
+	Names     []string `json:"names"`
+}
+
+// PTRSweepResult is a reverse-DNS-only sweep of a range
+type PTRSweepResult struct {
+	CIDR       string             `json:"cidr"`
+	Queried    int                `json:"queried"`
+	Named      int                `json:"named"`
+	Failed     int                `json:"failed"`
+	DurationMs float64            `json:"duration_ms"`
+	Resolvers  []PTRResolverStats `json:"resolvers"`
+	Hosts      []PTRRecord        `json:"hosts"`
+}
+
+const (
+	dnsTypePTR       = 12
+	dnsRcodeServFail = 2
+	dnsRcodeNXD      = 3
+	ptrRetryShare    = 0.25 // Retries allowed per run, as a share of lookups
+	ptrMinRetries    = 100
+	defaultPTRRate   = 500 // Queries per second per resolver
+	defaultPTRConns  = 2000
+)
+
+// systemResolvers reads nameservers from resolv.conf; elsewhere the
+// engine falls back to the system resolver
+func systemResolvers() []string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+func newPTREngine(servers []string, ratePerResolver float64, concurrency int, timeout time.Duration, retries int) (*ptrEngine, error) {
+	e := &ptrEngine{concurrency: concurrency, timeout: timeout, retries: retries}
+	if len(servers) == 0 {
+		servers = systemResolvers()
+	}
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp", ptrServerAddress(server))
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("resolver %s: %v", server, err)
+		}
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("resolver %s: %v", server, err)
+		}
+		r := &ptrResolver{server: addr.String(), conn: conn, pacer: newProbePacer(ratePerResolver), pending: make(map[uint16]*pendingPTR)}
+		go r.readReplies()
+		e.resolvers = append(e.resolvers, r)
+	}
+	if len(e.resolvers) == 0 {
+		e.resolvers = append(e.resolvers, &ptrResolver{server: "system", pacer: newProbePacer(ratePerResolver)})
+	}
+	return e, nil
+}
+
+func ptrServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+func (e *ptrEngine) Close() {
+	for _, r := range e.resolvers {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+func (e *ptrEngine) Stats() []PTRResolverStats {
+	var stats []PTRResolverStats
+	for _, r := range e.resolvers {
+		stats = append(stats, PTRResolverStats{
+			Server:   r.server,
+			Queries:  atomic.LoadInt64(&r.queries),
+			Answered: atomic.LoadInt64(&r.answered),
+			NXDomain: atomic.LoadInt64(&r.nxdomain),
+			Failures: atomic.LoadInt64(&r.failures),
+			Timeouts: atomic.LoadInt64(&r.timeouts),
+		})
+	}
+	return stats
+}
+
+// reverseName builds the in-addr.arpa or ip6.arpa name for ip
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+func ptrQuery(id uint16, name string) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, dnsTypePTR, 0, 1)
+}
+
+// readDNSName decodes a possibly compressed name starting at off and
+// returns it with the offset just past it in the original position
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 32; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name overflows message")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("truncated pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("label overflows message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", 0, errors.New("too many compression pointers")
+}
+
+// parsePTRReply returns the message ID, the first question name and the
+// PTR answers of a reply
+func parsePTRReply(msg []byte) (uint16, string, ptrReply, error) {
+	if len(msg) < 12 {
+		return 0, "", ptrReply{}, errors.New("short reply")
+	}
+	id := binary.BigEndian.Uint16(msg)
+	reply := ptrReply{rcode: int(msg[3] & 0x0f), truncated: msg[2]&0x02 != 0}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	var question string
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return id, question, reply, err
+		}
+		if i == 0 {
+			question = name
+		}
+		off = next + 4
+	}
+	for i := 0; i < answers; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return id, question, reply, errors.New("malformed answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		rdlength := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlength > len(msg) {
+			return id, question, reply, errors.New("malformed answer")
+		}
+		if rtype == dnsTypePTR {
+			if name, _, err := readDNSName(msg, rdata); err == nil {
+				reply.names = append(reply.names, name)
+			}
+		}
+		off = rdata + rdlength
+	}
+	return id, question, reply, nil
+}
+
+func (r *ptrResolver) readReplies() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // ICMP errors surface here on connected sockets
+		}
+		if n < 12 {
+			continue
+		}
+		id, question, reply, err := parsePTRReply(buf[:n])
+		if err != nil {
+			reply.rcode = dnsRcodeServFail // Retried like a server failure
+		}
+		r.mu.Lock()
+		p, ok := r.pending[id]
+		if ok && !strings.EqualFold(question, p.name) {
+			ok = false // Not the question we asked; keep waiting for the real answer
+		}
+		if ok {
+			delete(r.pending, id)
+		}
+		r.mu.Unlock()
+		if ok {
+			p.ch <- reply
+		}
+	}
+}
+
+// randomQueryID picks an unpredictable DNS message ID so off-path replies
+// cannot be lined up with outstanding queries
+func randomQueryID() uint16 {
+	var b [2]byte
+	cryptorand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// query sends one PTR question and waits up to timeout for its answer
+func (r *ptrResolver) query(ctx context.Context, ip net.IP, timeout time.Duration) (ptrReply, error) {
+	r.pacer.wait()
+	atomic.AddInt64(&r.queries, 1)
+
+	if r.conn == nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(lookupCtx, ip.String())
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ptrReply{rcode: dnsRcodeNXD}, nil
+		}
+		return ptrReply{names: names}, err
+	}
+
+	name := reverseName(ip)
+	ch := make(chan ptrReply, 1)
+	r.mu.Lock()
+	if len(r.pending) >= 0xffff {
+		r.mu.Unlock()
+		return ptrReply{}, errors.New("query IDs exhausted")
+	}
+	id := randomQueryID()
+	for {
+		if _, busy := r.pending[id]; !busy {
+			break
+		}
+		id = randomQueryID()
+	}
+	r.pending[id] = &pendingPTR{name: name, ch: ch}
+	r.mu.Unlock()
+
+	release := func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}
+	if _, err := r.conn.Write(ptrQuery(id, name)); err != nil {
+		release()
+		return ptrReply{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-timer.C:
+		release()
+		atomic.AddInt64(&r.timeouts, 1)
+		return ptrReply{}, errors.New("timeout")
+	case <-ctx.Done():
+		release()
+		return ptrReply{}, ctx.Err()
+	}
+}
+
+// lookup resolves one address, retrying on the next resolver after a
+// timeout or server failure while the retry budget lasts. No PTR record is
+// not an error.
+func (e *ptrEngine) lookup(ctx context.Context, ip net.IP) ([]string, error) {
+	start := int(atomic.AddUint32(&e.next, 1))
+	var lastErr error
+	for attempt := 0; attempt <= e.retries; attempt++ {
+		if attempt > 0 && atomic.AddInt64(&e.retryBudget, -1) < 0 {
+			return nil, fmt.Errorf("%v (retry budget exhausted)", lastErr)
+		}
+		r := e.resolvers[(start+attempt)%len(e.resolvers)]
+		reply, err := r.query(ctx, ip, e.timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if reply.truncated {
+			// PTR sets rarely exceed a datagram; let the system resolver use TCP
+			names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+			if err == nil {
+				atomic.AddInt64(&r.answered, 1)
+			}
+			return names, err
+		}
+		switch reply.rcode {
+		case 0:
+			atomic.AddInt64(&r.answered, 1)
+			return reply.names, nil
+		case dnsRcodeNXD:
+			atomic.AddInt64(&r.nxdomain, 1)
+			return nil, nil
+		}
+		atomic.AddInt64(&r.failures, 1)
+		lastErr = fmt.Errorf("%s answered rcode %d", r.server, reply.rcode)
+	}
+	return nil, lastErr
+}
+
+// lookupAll resolves every address with up to the engine's concurrency,
+// calling found for each as it completes. Addresses not started before
+// ctx ends are reported with ctx's error.
+func (e *ptrEngine) lookupAll(ctx context.Context, ips []string, done *int32, found func(i int, names []string, err error)) {
+	budget := int64(float64(len(ips)) * ptrRetryShare)
+	if budget < ptrMinRetries {
+		budget = ptrMinRetries
+	}
+	atomic.StoreInt64(&e.retryBudget, budget)
+
+	limiter := newProbeLimiter(e.concurrency)
+	var wg sync.WaitGroup
+	for i, address := range ips {
+		if ctx.Err() != nil {
+			found(i, nil, ctx.Err())
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			found(i, nil, fmt.Errorf("invalid address %q", address))
+			continue
+		}
+		wg.Add(1)
+		limiter.acquire()
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			defer limiter.release()
+			names, err := e.lookup(ctx, ip)
+			found(i, names, err)
+			if done != nil {
+				atomic.AddInt32(done, 1)
+			}
+		}(i, ip)
+	}
+	wg.Wait()
+}
+
+// ptrSweep looks up reverse names for a whole range without probing it
+func (s *Scanner) ptrSweep(cidr string) (PTRSweepResult, error) {
+	result := PTRSweepResult{CIDR: cidr, Hosts: []PTRRecord{}}
+	hosts, err := expandCIDR(cidr, maxSweepHosts)
+	if err != nil {
+		return result, err
+	}
+	result.Queried = len(hosts)
+	start := time.Now()
+
+	var done int32
+	stopProgress := s.trackProgress("ptr", "", len(hosts), &done, nil)
+	records := make([][]string, len(hosts))
+	var failed int32
+	s.ptr.lookupAll(context.Background(), hosts, &done, func(i int, names []string, err error) {
+		if err != nil {
+			atomic.AddInt32(&failed, 1)
+			return
+		}
+		records[i] = names
+		if len(names) > 0 && s.liveDisplay {
+			fmt.Printf("%s%-15s%s %s\n", ColorCyan, hosts[i], ColorReset, strings.Join(names, ", "))
+		}
+	})
+	stopProgress()
+
+	for i, names := range records {
+		if len(names) > 0 {
+			result.Hosts = append(result.Hosts, PTRRecord{IPAddress: hosts[i], Names: names})
+		}
+	}
+	result.Named = len(result.Hosts)
+	result.Failed = int(failed)
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	result.Resolvers = s.ptr.Stats()
+	return result, nil
+}
+
+// ProbeModes records which implementation each probing subsystem used.
+// Privileged implementations need raw sockets (root or CAP_NET_RAW on
+// Linux, an elevated prompt on Windows); without them the scan falls back
+// to unprivileged ones and says why, instead of failing. MAC addresses are
+// always read from the ARP cache, so there is no privileged ARP mode.
+type ProbeModes struct {
+	Privileged bool   `json:"privileged"`
+	Reason     string `json:"reason,omitempty"` // Why privileged modes are not in use
+	ICMP       string `json:"icmp"`             // raw (one shared socket) or exec (system ping)
+	PortScan   string `json:"port_scan"`        // syn (half-open, with -syn) or connect
+}
+
+// detectProbeModes checks at startup which privileged probes this process
+// can run, by opening the raw sockets they need. SYN scans are only tried
+// when asked for, since half-open connections trip some IDS rules.
+func detectProbeModes(allowRaw, allowSYN bool) ProbeModes {
+	modes := ProbeModes{ICMP: "exec", PortScan: "connect"}
+	if !allowRaw {
+		modes.Reason = "raw sockets disabled with -no-raw"
+		return modes
+	}
+
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		switch runtime.GOOS {
+		case "linux":
+			modes.Reason = fmt.Sprintf("raw sockets need root or CAP_NET_RAW (sudo setcap cap_net_raw+ep bin/net-grab): %v", err)
+		case "windows":
+			modes.Reason = fmt.Sprintf("raw sockets need an elevated (Administrator) prompt: %v", err)
+		default:
+			modes.Reason = fmt.Sprintf("raw sockets need root: %v", err)
+		}
+		return modes
+	}
+	conn.Close()
+	modes.Privileged = true
+	modes.ICMP = "raw"
+	if !allowSYN {
+		return modes
+	}
+
+	// Only Linux hands incoming TCP segments to raw sockets; BSD kernels
+	// keep them and Windows refuses to send TCP over raw sockets at all
+	if runtime.GOOS != "linux" {
+		modes.Reason = fmt.Sprintf("SYN scans are not supported on %s", runtime.GOOS)
+		return modes
+	}
+	if conn, err := net.ListenPacket("ip4:tcp", "0.0.0.0"); err == nil {
+		conn.Close()
+		modes.PortScan = "syn"
+	}
+	return modes
+}
+
+// internetChecksum is the ones' complement sum used by ICMP and TCP
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// icmpPinger sends echo requests from one shared raw socket and matches
+// replies by source address and sequence number, so a scan costs one
+// socket instead of one ping process per host
+type icmpPinger struct {
+	conn    net.PacketConn
+	id      uint16
+	seq     uint32
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+func newICMPPinger() (*icmpPinger, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	p := &icmpPinger{
+		conn:    conn,
+		id:      uint16(os.Getpid() & 0xffff),
+		waiting: make(map[string]chan struct{}),
+	}
+	go p.readReplies()
+	return p, nil
+}
+
+// echoRequest builds an ICMP echo request with its checksum filled in
+func echoRequest(id, seq uint16) []byte {
+	msg := make([]byte, 16)
+	msg[0] = 8 // Echo request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "netgrab!")
+	binary.BigEndian.PutUint16(msg[2:], internetChecksum(msg))
+	return msg
+}
+
+func (p *icmpPinger) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// Echo replies carrying our identifier; the kernel strips the IP header
+		if n < 8 || buf[0] != 0 || binary.BigEndian.Uint16(buf[4:]) != p.id {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", addr, binary.BigEndian.Uint16(buf[6:]))
+		p.mu.Lock()
+		if ch, ok := p.waiting[key]; ok {
+			delete(p.waiting, key)
+			close(ch)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// echo sends a single echo request and waits up to timeout for the reply
+func (p *icmpPinger) echo(ip string, timeout time.Duration) (time.Duration, bool) {
+	seq := uint16(atomic.AddUint32(&p.seq, 1))
+	key := fmt.Sprintf("%s/%d", ip, seq)
+	ch := make(chan struct{})
+	p.mu.Lock()
+	p.waiting[key] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, key)
+		p.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if _, err := p.conn.WriteTo(echoRequest(p.id, seq), &net.IPAddr{IP: net.ParseIP(ip)}); err != nil {
+		return 0, false
+	}
+	select {
+	case <-ch:
+		return time.Since(start), true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+// probe reports whether ip answered an echo request within timeout
+func (p *icmpPinger) probe(ip string, timeout time.Duration) (time.Duration, bool) {
+	for attempt := 0; attempt < sweepAttempts; attempt++ {
+		if rtt, ok := p.echo(ip, timeout); ok {
+			return rtt, true
+		}
+	}
+	return 0, false
+}
+
+// ping sends options.Count echo requests options.Interval apart and
+// summarizes them the way parsePingOutput does for the system ping
+func (p *icmpPinger) ping(ip string, options PingOptions) PingStats {
+	stats := PingStats{PacketsSent: options.Count, LastPingTime: time.Now()}
+	rtts := make([]time.Duration, options.Count)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Count; i++ {
+		if i > 0 {
+			time.Sleep(options.Interval)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if rtt, ok := p.echo(ip, options.Timeout); ok {
+				rtts[i] = rtt
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, rtt := range rtts {
+		if rtt > 0 {
+			stats.latencies = append(stats.latencies, float64(rtt.Microseconds())/1000)
+		}
+	}
+	stats.PacketsReceived = len(stats.latencies)
+	stats.PacketLoss = float64(stats.PacketsSent-stats.PacketsReceived) / float64(stats.PacketsSent) * 100
+	if stats.PacketsReceived == 0 {
+		stats.ErrorMessage = "Ping failed: no echo replies"
+		return stats
+	}
+	calculateLatencyStats(stats.latencies, &stats)
+	if len(stats.latencies) >= 2 {
+		stats.Jitter = calculateJitter(stats.latencies)
+	}
+	return stats
+}
+
+func (p *icmpPinger) Close() error {
+	return p.conn.Close()
+}
+
+// execPing is the unprivileged fallback: a single ping process per probe
+func execPing(ip string, timeout time.Duration) (time.Duration, bool) {
+	// The reply wait is in milliseconds on Windows and macOS, seconds on Linux
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("ping", "-n", strconv.Itoa(sweepAttempts), "-w", strconv.FormatInt(timeout.Milliseconds(), 10), ip)
+	case "darwin":
+		cmd = exec.Command("ping", "-c", strconv.Itoa(sweepAttempts), "-W", strconv.FormatInt(timeout.Milliseconds(), 10), ip)
+	default:
+		timeoutSec := int(math.Ceil(timeout.Seconds()))
+		if timeoutSec < 1 {
+			timeoutSec = 1
+		}
+		cmd = exec.Command("ping", "-c", strconv.Itoa(sweepAttempts), "-W", strconv.Itoa(timeoutSec), ip)
+	}
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, false
+	}
+
+	var stats PingStats
+	parsePingOutput(string(output), &stats)
+	if stats.AvgLatency > 0 {
+		return time.Duration(stats.AvgLatency * float64(time.Millisecond)), true
+	}
+	return time.Since(start), true
+}
+
+// synScanner sends half-open TCP probes from one raw socket: a SYN-ACK
+// means open, a RST closed and silence filtered. The kernel answers the
+// SYN-ACK with a RST of its own, so no connection is ever completed.
+type synScanner struct {
+	conn    net.PacketConn
+	port    uint16 // Source port when no source port pool is set
+	mu      sync.Mutex
+	waiting map[string]synProbe
+	sources map[string]net.IP // Source address the kernel uses per target
+}
+
+type synProbe struct {
+	seq   uint32
+	reply chan bool
+}
+
+func newSYNScanner() (*synScanner, error) {
+	conn, err := net.ListenPacket("ip4:tcp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	s := &synScanner{
+		conn:    conn,
+		port:    uint16(40000 + rand.Intn(20000)),
+		waiting: make(map[string]synProbe),
+		sources: make(map[string]net.IP),
+	}
+	go s.readReplies()
+	return s, nil
+}
+
+// synSegment builds a SYN with an MSS option; the checksum covers the
+// IPv4 pseudo header, so it needs the source address the kernel will use
+func synSegment(src, dst net.IP, srcPort, dstPort uint16, seq uint32) []byte {
+	seg := make([]byte, 24)
+	binary.BigEndian.PutUint16(seg[0:], srcPort)
+	binary.BigEndian.PutUint16(seg[2:], dstPort)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	seg[12] = 6 << 4 // Header length in 32-bit words
+	seg[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(seg[14:], 1024)
+	seg[20], seg[21] = 2, 4 // MSS
+	binary.BigEndian.PutUint16(seg[22:], 1460)
+
+	pseudo := make([]byte, 0, 12+len(seg))
+	pseudo = append(pseudo, src.To4()...)
+	pseudo = append(pseudo, dst.To4()...)
+	pseudo = append(pseudo, 0, 6, 0, byte(len(seg)))
+	binary.BigEndian.PutUint16(seg[16:], internetChecksum(append(pseudo, seg...)))
+	return seg
+}
+
+// source finds the address the kernel routes towards ip from; connecting
+// a UDP socket only consults the routing table
+func (s *synScanner) source(ip string) (net.IP, error) {
+	s.mu.Lock()
+	src, ok := s.sources[ip]
+	s.mu.Unlock()
+	if ok {
+		return src, nil
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(ip, "9"))
+	if err != nil {
+		return nil, err
+	}
+	src = conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	s.mu.Lock()
+	s.sources[ip] = src
+	s.mu.Unlock()
+	return src, nil
+}
+
+func (s *synScanner) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// The raw socket sees every TCP segment; only answers to our probes matter
+		if n < 20 {
+			continue
+		}
+		flags := buf[13]
+		if flags&0x04 == 0 && flags&0x12 != 0x12 {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d:%d", addr, binary.BigEndian.Uint16(buf[0:]), binary.BigEndian.Uint16(buf[2:]))
+		s.mu.Lock()
+		if probe, ok := s.waiting[key]; ok && binary.BigEndian.Uint32(buf[8:]) == probe.seq+1 {
+			delete(s.waiting, key)
+			probe.reply <- flags&0x12 == 0x12
+		}
+		s.mu.Unlock()
+	}
+}
+
+// probe reports whether port answered a SYN with a SYN-ACK. A RST is a
+// definite answer; silence is retried once, like a sweep.
+func (s *synScanner) probe(ip string, port int, srcPort uint16, timeout time.Duration) bool {
+	src, err := s.source(ip)
+	if err != nil {
+		return false
+	}
+	dst := net.ParseIP(ip)
+	key := fmt.Sprintf("%s:%d:%d", ip, port, srcPort)
+
+	for attempt := 0; attempt < sweepAttempts; attempt++ {
+		probe := synProbe{seq: rand.Uint32(), reply: make(chan bool, 1)}
+		s.mu.Lock()
+		s.waiting[key] = probe
+		s.mu.Unlock()
+
+		_, err := s.conn.WriteTo(synSegment(src, dst, srcPort, uint16(port), probe.seq), &net.IPAddr{IP: dst})
+		if err == nil {
+			select {
+			case open := <-probe.reply:
+				return open
+			case <-time.After(timeout):
+			}
+		}
+		s.mu.Lock()
+		delete(s.waiting, key)
+		s.mu.Unlock()
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func (s *synScanner) Close() error {
+	return s.conn.Close()
+}
+
+// tcpAlive treats both a completed handshake and a reset as proof of life
+func tcpAlive(ip string, port int, timeout time.Duration) (string, time.Duration, bool) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	elapsed := time.Since(start)
+	if err == nil {
+		conn.Close()
+		return fmt.Sprintf("tcp/%d", port), elapsed, true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "refused") {
+		return fmt.Sprintf("tcp-rst/%d", port), elapsed, true
+	}
+	return "", 0, false
+}
+
+// sweepNetwork only answers which hosts are alive: no DNS, port scan or
+// banners. ICMP goes first, then the optional TCP ports in order.
+func (s *Scanner) sweepNetwork(cidr string, tcpPorts []int, concurrency int) (SweepResult, error) {
+	result := SweepResult{CIDR: cidr, TCPPorts: tcpPorts, ProbeModes: s.modes, Alive: []SweepHost{}}
+	if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+		return result, fmt.Errorf("sweep supports IPv4 ranges only")
+	}
+	hosts, err := expandCIDR(cidr, maxSweepHosts)
+	if err != nil {
+		return result, err
+	}
+	result.HostsProbed = len(hosts)
+
+	pinger := s.pinger
+	result.ICMPMode = s.modes.ICMP
+	if pinger == nil {
+		if concurrency > maxExecPingProbe {
+			concurrency = maxExecPingProbe
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	s.totalHosts = len(hosts)
+	if s.liveDisplay {
+		fmt.Printf("Sweeping %d hosts in %s (icmp: %s, concurrency: %d)\n", s.totalHosts, cidr, result.ICMPMode, concurrency)
+	}
+
+	start := time.Now()
+	limiter := newProbeLimiter(concurrency)
+	maxLimit := tuneMaxConcurrency
+	if pinger == nil {
+		maxLimit = maxExecPingProbe
+	}
+	s.probesTotal = int64(len(hosts))
+	defer s.startTuning(limiter, s.probesTotal, &s.probesDone, 1, maxLimit)()
+	var tunedLimiter *probeLimiter
+	if s.targetDuration > 0 {
+		tunedLimiter = limiter
+	}
+	stopProgress := s.trackProgress("sweep", "", s.totalHosts, &s.hostsScanned, tunedLimiter)
+	var wg sync.WaitGroup
+
+	for _, host := range hosts {
+		wg.Add(1)
+		limiter.acquire()
+		s.pacer.wait()
+
+		go func(ip string) {
+			defer wg.Done()
+			defer limiter.release()
+			defer atomic.AddInt64(&s.probesDone, 1)
+			defer atomic.AddInt32(&s.hostsScanned, 1)
+
+			var rtt time.Duration
+			var ok bool
+			method := "icmp"
+			if pinger != nil {
+				rtt, ok = pinger.probe(ip, s.timeout)
+			} else {
+				rtt, ok = execPing(ip, s.timeout)
+			}
+			for _, port := range tcpPorts {
+				if ok {
+					break
+				}
+				s.pacer.wait()
+				method, rtt, ok = tcpAlive(ip, port, s.timeout)
+			}
+			if !ok {
+				return
+			}
+
+			alive := SweepHost{
+				IPAddress: ip,
+				Method:    method,
+				RTT:       float64(rtt.Microseconds()) / 1000,
+			}
+			s.mu.Lock()
+			result.Alive = append(result.Alive, alive)
+			s.mu.Unlock()
+
+			if s.liveDisplay {
+				fmt.Printf("%s%-15s%s alive via %s (%.1fms)\n", ColorGreen, ip, ColorReset, method, alive.RTT)
+			}
+		}(host)
+	}
+
+	wg.Wait()
+	stopProgress()
+
+	sort.Slice(result.Alive, func(i, j int) bool {
+		a, b := net.ParseIP(result.Alive[i].IPAddress).To4(), net.ParseIP(result.Alive[j].IPAddress).To4()
+		return binary.BigEndian.Uint32(a) < binary.BigEndian.Uint32(b)
+	})
+	result.HostsAlive = len(result.Alive)
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return result, nil
+}
+
+// ipv6Scope names the kind of IPv6 address found on the link
+func ipv6Scope(ip net.IP) string {
+	switch {
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	case len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc:
+		return "unique-local"
+	default:
+		return "global"
+	}
+}
+
+// multicastEcho sends echo requests to ff02::1 on iface and collects every
+// unicast source that answers. The kernel fills in the ICMPv6 checksum.
+func multicastEcho(iface string, timeout time.Duration) (map[string]time.Duration, error) {
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid() & 0xffff)
+	group := &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: iface}
+	start := time.Now()
+	for seq := 1; seq <= sweepAttempts; seq++ {
+		msg := make([]byte, 16)
+		msg[0] = 128 // Echo request
+		binary.BigEndian.PutUint16(msg[4:], id)
+		binary.BigEndian.PutUint16(msg[6:], uint16(seq))
+		copy(msg[8:], "netgrab!")
+		if _, err := conn.WriteTo(msg, group); err != nil {
+			return nil, err
+		}
+	}
+
+	replies := make(map[string]time.Duration)
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n < 8 || buf[0] != 129 || binary.BigEndian.Uint16(buf[4:]) != id {
+			continue
+		}
+		ip := addr.(*net.IPAddr).IP.String()
+		if _, seen := replies[ip]; !seen {
+			replies[ip] = time.Since(start)
+		}
+	}
+	return replies, nil
+}
+
+var pingFromRegex = regexp.MustCompile(`from ([0-9a-fA-F:]+)(?:%[^\s:,]+)?[:,\s].*?time[=<]([\d.]+)`)
+
+// execMulticastEcho is the unprivileged fallback using the system ping
+func execMulticastEcho(iface string, timeout time.Duration) (map[string]time.Duration, error) {
+	group := "ff02::1%" + iface
+	waitSec := strconv.Itoa(int(math.Ceil(timeout.Seconds())) + 1)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		return nil, fmt.Errorf("ping cannot collect multicast replies on windows")
+	case "darwin":
+		cmd = exec.Command("ping6", "-c", strconv.Itoa(sweepAttempts), "-i", "1", group)
+	default:
+		cmd = exec.Command("ping", "-6", "-c", strconv.Itoa(sweepAttempts), "-w", waitSec, group)
+	}
+
+	// ping exits non-zero on partial replies, so only the output matters
+	output, _ := cmd.CombinedOutput()
+	replies := make(map[string]time.Duration)
+	for _, match := range pingFromRegex.FindAllStringSubmatch(string(output), -1) {
+		ip := net.ParseIP(strings.TrimRight(match[1], ":"))
+		ms, err := strconv.ParseFloat(match[2], 64)
+		if ip == nil || err != nil {
+			continue
+		}
+		if _, seen := replies[ip.String()]; !seen {
+			replies[ip.String()] = time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	if len(replies) == 0 && len(output) == 0 {
+		return nil, fmt.Errorf("ping produced no output")
+	}
+	return replies, nil
+}
+
+// readNeighborCache dumps the IPv6 neighbor table entries for iface
+func readNeighborCache(iface string) ([]NeighborHost, error) {
+	var neighbors []NeighborHost
+	switch runtime.GOOS {
+	case "windows":
+		output, err := exec.Command("netsh", "interface", "ipv6", "show", "neighbors", "interface="+iface).Output()
+		if err != nil {
+			return nil, err
+		}
+		// fe80::1   00-11-22-33-44-55   Reachable (Router)
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 || net.ParseIP(fields[0]) == nil || !macRegex.MatchString(fields[1]) {
+				continue
+			}
+			state := strings.Join(fields[2:], " ")
+			neighbors = append(neighbors, NeighborHost{
+				IPAddress:  fields[0],
+				MACAddress: normalizeMAC(fields[1]),
+				Router:     strings.Contains(state, "Router"),
+				State:      strings.TrimSpace(strings.Replace(state, "(Router)", "", 1)),
+			})
+		}
+	case "darwin":
+		output, err := exec.Command("ndp", "-an").Output()
+		if err != nil {
+			return nil, err
+		}
+		// fe80::1%en0   a4:83:e7:1:2:3   en0 23h59m58s S R
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 || fields[2] != iface {
+				continue
+			}
+			addr, _, _ := strings.Cut(fields[0], "%")
+			if net.ParseIP(addr) == nil || !macRegex.MatchString(fields[1]) {
+				continue
+			}
+			neighbors = append(neighbors, NeighborHost{
+				IPAddress:  addr,
+				MACAddress: normalizeMAC(fields[1]),
+				Router:     len(fields) > 5 && strings.Contains(fields[5], "R"),
+				State:      fields[4],
+			})
+		}
+	default:
+		output, err := exec.Command("ip", "-6", "neigh", "show", "dev", iface).Output()
+		if err != nil {
+			return nil, err
+		}
+		// fe80::1 lladdr 52:54:00:12:34:56 router REACHABLE
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[1] != "lladdr" || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			neighbors = append(neighbors, NeighborHost{
+				IPAddress:  fields[0],
+				MACAddress: normalizeMAC(fields[2]),
+				Router:     fields[3] == "router",
+				State:      fields[len(fields)-1],
+			})
+		}
+	}
+	return neighbors, nil
+}
+
+// discoverNeighbors enumerates IPv6 hosts on one link. A /64 is far too
+// large to sweep, so hosts are found by an all-nodes multicast echo and
+// then read back, with those that ignore echo, from the neighbor cache.
+func (s *Scanner) discoverNeighbors(ifaceName string) (NeighborResult, error) {
+	result := NeighborResult{Interface: ifaceName, Hosts: []NeighborHost{}}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return result, err
+	}
+
+	// Our own addresses answer the multicast echo too
+	own := make(map[string]bool)
+	if addrs, err := iface.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				own[ipNet.IP.String()] = true
+			}
+		}
+	}
+
+	start := time.Now()
+	replies, err := multicastEcho(iface.Name, s.timeout)
+	result.EchoMode = "raw"
+	if err != nil {
+		replies, err = execMulticastEcho(iface.Name, s.timeout)
+		result.EchoMode = "exec"
+		if err != nil {
+			result.EchoMode = "none"
+			if s.verbose {
+				fmt.Fprintf(os.Stderr, "%sWarning:%s multicast echo unavailable (%v); using the neighbor cache only\n", ColorYellow, ColorReset, err)
+			}
+		}
+	}
+
+	hosts := make(map[string]*NeighborHost)
+	add := func(host NeighborHost, source string) *NeighborHost {
+		ip := net.ParseIP(host.IPAddress)
+		if ip == nil || ip.To4() != nil || ip.IsMulticast() || own[ip.String()] {
+			return nil
+		}
+		existing, ok := hosts[ip.String()]
+		if !ok {
+			host.IPAddress = ip.String()
+			host.Scope = ipv6Scope(ip)
+			host.Sources = nil
+			existing = &host
+			hosts[ip.String()] = existing
+		} else {
+			if existing.MACAddress == "" {
+				existing.MACAddress = host.MACAddress
+			}
+			existing.Router = existing.Router || host.Router
+			if host.State != "" {
+				existing.State = host.State
+			}
+		}
+		existing.Sources = append(existing.Sources, source)
+		return existing
+	}
+
+	for ip, rtt := range replies {
+		if host := add(NeighborHost{IPAddress: ip}, "echo"); host != nil {
+			host.RTT = float64(rtt.Microseconds()) / 1000
+		}
+	}
+
+	// Read the cache after the echo so it includes everyone who just answered
+	neighbors, err := readNeighborCache(iface.Name)
+	if err != nil && len(hosts) == 0 {
+		return result, fmt.Errorf("no echo replies and neighbor cache unreadable: %v", err)
+	}
+	for _, neighbor := range neighbors {
+		if neighbor.State == "FAILED" || neighbor.State == "INCOMPLETE" {
+			continue
+		}
+		add(neighbor, "cache")
+	}
+
+	for _, host := range hosts {
+		host.Vendor = lookupVendor(host.MACAddress)
+		result.Hosts = append(result.Hosts, *host)
+	}
+	sort.Slice(result.Hosts, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(result.Hosts[i].IPAddress), net.ParseIP(result.Hosts[j].IPAddress)) < 0
+	})
+	result.HostsFound = len(result.Hosts)
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return result, nil
+}
+
+// Progress returns a channel of progress events for the scans that follow.
+// The caller must keep receiving until the channel is closed by CloseProgress.
+func (s *Scanner) Progress() <-chan ProgressEvent {
+	if s.progress == nil {
+		s.progress = make(chan ProgressEvent, 16)
+	}
+	return s.progress
+}
+
+// CloseProgress ends the progress stream once scanning is over
+func (s *Scanner) CloseProgress() {
+	if s.progress != nil {
+		close(s.progress)
+	}
+}
+
+// trackProgress emits events for one phase until the returned stop
+// function is called, which sends a final event for the phase. The limiter,
+// if any, is reported so tuning can be followed.
+func (s *Scanner) trackProgress(phase, host string, total int, done *int32, limiter *probeLimiter) func() {
+	if s.progress == nil || total == 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	snapshot := func() ProgressEvent {
+		count := int(atomic.LoadInt32(done))
+		elapsed := time.Since(start)
+		event := ProgressEvent{
+			Phase:     phase,
+			Host:      host,
+			Done:      count,
+			Total:     total,
+			Percent:   roundTenth(float64(count) / float64(total) * 100),
+			ElapsedMs: elapsed.Milliseconds(),
+		}
+		if elapsed > 0 && count > 0 {
+			rate := float64(count) / elapsed.Seconds()
+			event.Rate = roundTenth(rate)
+			event.ETASeconds = roundTenth(float64(total-count) / rate)
+		}
+		// Hosts differ wildly in cost, so a full scan estimates from port probes
+		if probes := atomic.LoadInt64(&s.probesDone); phase == "hosts" && probes > 0 && elapsed > 0 {
+			rate := float64(probes) / elapsed.Seconds()
+			event.ETASeconds = roundTenth(float64(s.probesTotal-probes) / rate)
+		}
+		if limiter != nil {
+			event.Concurrency = limiter.current()
+		}
+		return event
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.progress <- snapshot()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		event := snapshot()
+		event.Finished = true
+		s.progress <- event
+	}
+}
+
+// Fixed concurrency used when no target duration is given
+const (
+	hostConcurrency      = 20
+	portConcurrency      = 500
+	largePortConcurrency = 200 // For scans of more than 10000 ports per host
+)
+
+// Bounds for auto-tuned port concurrency
+const (
+	tuneMinConcurrency = 8
+	tuneMaxConcurrency = 4000
+)
+
+// probeLimiter is a semaphore whose size can change while probes run
+type probeLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newProbeLimiter(limit int) *probeLimiter {
+	l := &probeLimiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *probeLimiter) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+func (l *probeLimiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+func (l *probeLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *probeLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// probePacer spaces probe starts evenly to stay under a maximum rate.
+// A nil pacer does not limit. With jitter each gap is drawn from
+// interval±jitter, which keeps the average rate but no fixed cadence.
+type probePacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	jitter   float64
+	next     time.Time
+}
+
+func newProbePacer(perSecond float64) *probePacer {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &probePacer{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+func (p *probePacer) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	start := p.next
+	gap := p.interval
+	if p.jitter > 0 {
+		gap = time.Duration(float64(gap) * (1 - p.jitter + 2*p.jitter*rand.Float64()))
+	}
+	p.next = p.next.Add(gap)
+	p.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+// Polite profile: conservative limits meant to be pre-approved for
+// production networks. They are caps; options may only lower them.
+const (
+	politeRate        = 10 // Probes per second across the whole scan
+	politeInFlight    = 4  // Connections open at once across all hosts
+	politePings       = 1  // Echo requests per host
+	politeJitter      = 0.5
+	politePTRRate     = 50
+	politeSourcePorts = "47000-47099"
+)
+
+// Most commonly open TCP ports; the only ports a polite scan may probe
+var politePorts = []int{21, 22, 23, 25, 53, 80, 110, 111, 135, 139, 143, 443, 445, 993, 995, 1723, 3306, 3389, 5900, 8080}
+
+// ScanProfile documents the limits a scan ran under, so the results
+// carry their own evidence of how the network was probed
+type ScanProfile struct {
+	Name                string  `json:"name"`
+	MaxProbesPerSecond  float64 `json:"max_probes_per_second"`
+	TimingJitter        float64 `json:"timing_jitter"`
+	MaxInFlight         int     `json:"max_in_flight"`
+	PingsPerHost        int     `json:"pings_per_host"`
+	Ports               []int   `json:"ports"`
+	BannerGrabs         bool    `json:"banner_grabs"`
+	RandomizedOrder     bool    `json:"randomized_order"`
+	SourcePorts         string  `json:"source_ports"`
+	SourcePortFallbacks int64   `json:"source_port_fallbacks"`
+	Identity            string  `json:"identity"` // Recorded in results only; polite probes carry no payload
+	ProbesSent          int64   `json:"probes_sent"`
+}
+
+// sourcePortPool dials from a fixed, documented range of source ports so
+// firewalls and IDS can attribute probes to the scanner. Ports are used
+// round-robin and probe connections are closed with a reset, so a port
+// does not sit in TIME_WAIT and is free again for its next turn; when
+// every port is busy the dial falls back to an ephemeral port and the
+// fallback is counted.
+type sourcePortPool struct {
+	mu          sync.Mutex
+	first, last int
+	next        int
+	fallbacks   int64
+}
+
+func parseSourcePorts(spec string) (*sourcePortPool, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		to = from
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(from))
+	last, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || first < 1024 || last > MaxPort || first > last {
+		return nil, fmt.Errorf("invalid source port range %q (use e.g. 47000-47099, ports 1024-65535)", spec)
+	}
+	return &sourcePortPool{first: first, last: last, next: first}, nil
+}
+
+func (p *sourcePortPool) take() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	port := p.next
+	if p.next++; p.next > p.last {
+		p.next = p.first
+	}
+	return port
+}
+
+func (p *sourcePortPool) dial(address string, timeout time.Duration) (net.Conn, error) {
+	for i := 0; i <= p.last-p.first; i++ {
+		dialer := net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{Port: p.take()}}
+		conn, err := dialer.Dial("tcp", address)
+		var sysErr *os.SyscallError
+		if err != nil && errors.As(err, &sysErr) && sysErr.Syscall == "bind" {
+			continue // Port still held by an earlier connection
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0) // Close with RST: no TIME_WAIT holding the port for ~60s
+		}
+		return conn, err
+	}
+	atomic.AddInt64(&p.fallbacks, 1)
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// dial opens a probe connection, from the source port pool when one is set
+func (s *Scanner) dial(address string) (net.Conn, error) {
+	atomic.AddInt64(&s.probesSent, 1)
+	if s.sourcePorts != nil {
+		return s.sourcePorts.dial(address, s.timeout)
+	}
+	return net.DialTimeout("tcp", address, s.timeout)
+}
+
+// applyPoliteProfile switches the scanner to the polite limits
+func (s *Scanner) applyPoliteProfile(rate float64, ports []int, pool *sourcePortPool, identity string) {
+	s.pacer = &probePacer{interval: time.Duration(float64(time.Second) / rate), jitter: politeJitter}
+	s.portLimiter = newProbeLimiter(politeInFlight)
+	s.hostLimit = politeInFlight
+	s.pingCount = politePings
+	s.grabBanners = false
+	s.shuffle = true
+	s.sourcePorts = pool
+	s.profile = &ScanProfile{
+		Name:               "polite",
+		MaxProbesPerSecond: rate,
+		TimingJitter:       politeJitter,
+		MaxInFlight:        politeInFlight,
+		PingsPerHost:       politePings,
+		Ports:              ports,
+		RandomizedOrder:    true,
+		SourcePorts:        fmt.Sprintf("%d-%d", pool.first, pool.last),
+		Identity:           identity,
+	}
+}
+
+// autoTune resizes limiter once a second so the remaining probes finish by
+// deadline, using the per-slot rate observed over the last second. Each
+// step at most doubles or halves the limit so one noisy second can't swing it.
+func autoTune(limiter *probeLimiter, deadline time.Time, total int64, done *int64, minLimit, maxLimit int, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := atomic.LoadInt64(done)
+	lastTime := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			current := atomic.LoadInt64(done)
+			observed := float64(current-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = current, now
+			remaining := total - current
+			if observed <= 0 || remaining <= 0 {
+				continue
+			}
+
+			limit := limiter.current()
+			next := maxLimit
+			if left := time.Until(deadline).Seconds(); left > 0 {
+				needed := float64(remaining) / left
+				perSlot := observed / float64(limit)
+				next = int(math.Ceil(needed / perSlot * 1.1))
+			}
+			if next > limit*2 {
+				next = limit * 2
+			}
+			if next < limit/2 {
+				next = limit / 2
+			}
+			if next < minLimit {
+				next = minLimit
+			}
+			if next > maxLimit {
+				next = maxLimit
+			}
+			limiter.setLimit(next)
+		}
+	}
+}
+
+// startTuning runs autoTune for a phase when a target duration is set and
+// returns the function that stops it
+func (s *Scanner) startTuning(limiter *probeLimiter, total int64, done *int64, minLimit, maxLimit int) func() {
+	if s.targetDuration <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go autoTune(limiter, time.Now().Add(s.targetDuration), total, done, minLimit, maxLimit, stop)
+	return func() { close(stop) }
+}
+
+// windowRule is one allowed execution window such as "Mon-Fri 01:00-05:00".
+// An end at or before the start runs past midnight into the next day.
+type windowRule struct {
+	days       [7]bool // Indexed by time.Weekday
+	start, end int     // Minutes since midnight; end may be 1440
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (int, error) {
+	hour, minute, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hour)
+	m, err2 := strconv.Atoi(minute)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseWindow reads "[days ]HH:MM-HH:MM" where days is a list such as
+// "Mon-Fri" or "Sat,Sun"; without days the window applies every day
+func parseWindow(spec string) (windowRule, error) {
+	var rule windowRule
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return rule, fmt.Errorf("invalid window %q (use [days ]HH:MM-HH:MM)", spec)
+	}
+
+	if len(fields) == 2 {
+		for _, part := range strings.Split(fields[0], ",") {
+			first, last, isRange := strings.Cut(strings.ToLower(part), "-")
+			from, ok1 := weekdayNames[first]
+			to, ok2 := weekdayNames[last]
+			if !isRange {
+				to, ok2 = from, ok1
+			}
+			if !ok1 || !ok2 {
+				return rule, fmt.Errorf("invalid days %q in window %q", fields[0], spec)
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				rule.days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	} else {
+		for d := range rule.days {
+			rule.days[d] = true
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return rule, fmt.Errorf("invalid window %q (use [days ]HH:MM-HH:MM)", spec)
+	}
+	var err error
+	if rule.start, err = parseClock(from); err != nil {
+		return rule, err
+	}
+	if rule.end, err = parseClock(to); err != nil {
+		return rule, err
+	}
+	if rule.start == rule.end || rule.start == 1440 {
+		return rule, fmt.Errorf("window %q is empty", spec)
+	}
+	return rule, nil
+}
+
+func (r windowRule) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if r.start < r.end {
+		return r.days[t.Weekday()] && minute >= r.start && minute < r.end
+	}
+	// Overnight: the evening belongs to today, the early hours to yesterday
+	yesterday := (t.Weekday() + 6) % 7
+	return (r.days[t.Weekday()] && minute >= r.start) || (r.days[yesterday] && minute < r.end)
+}
+
+// scanWindows pauses probing outside the allowed windows. A nil value
+// allows scanning at any time.
+type scanWindows struct {
+	rules    []windowRule
+	location *time.Location
+	verbose  bool
+
+	mu     sync.Mutex
+	paused bool
+}
+
+func (w *scanWindows) open(t time.Time) bool {
+	t = t.In(w.location)
+	for _, r := range w.rules {
+		if r.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen finds the next minute inside a window, looking a week ahead
+func (w *scanWindows) nextOpen(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for i := 0; i <= 8*24*60; i++ {
+		if w.open(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return t
+}
+
+// wait blocks until scanning is allowed. Probes already in flight finish;
+// new ones wait here, so a scan stops within one probe timeout of the
+// window closing and picks up where it was when the next one opens.
+func (w *scanWindows) wait() {
+	if w == nil {
+		return
+	}
+	for {
+		now := time.Now()
+		if w.open(now) {
+			w.mu.Lock()
+			if w.paused {
+				w.paused = false
+				if w.verbose {
+					fmt.Fprintf(os.Stderr, "%sScan window open; resuming%s\n", ColorGreen, ColorReset)
+				}
+			}
+			w.mu.Unlock()
+			return
+		}
+
+		next := w.nextOpen(now)
+		w.mu.Lock()
+		if !w.paused {
+			w.paused = true
+			if w.verbose {
+				fmt.Fprintf(os.Stderr, "%sOutside scan window; paused until %s%s\n", ColorYellow, next.In(w.location).Format("Mon 2006-01-02 15:04 MST"), ColorReset)
+			}
+		}
+		w.mu.Unlock()
+
+		// Re-check at least every minute in case the clock jumps
+		sleep := time.Until(next)
+		if sleep > time.Minute {
+			sleep = time.Minute
+		}
+		if sleep < time.Second {
+			sleep = time.Second
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// scanCheckpoint records finished hosts so an interrupted scan can
+// continue from where it stopped instead of starting over
+type scanCheckpoint struct {
+	CIDR      string     `json:"cidr"`
+	Ports     string     `json:"ports"`
+	StartedAt time.Time  `json:"started_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Completed []HostInfo `json:"completed"`
+}
+
+type checkpointFile struct {
+	path  string
+	mu    sync.Mutex
+	state scanCheckpoint
+}
+
+// openCheckpoint loads a checkpoint for this scan or starts a new one.
+// A checkpoint from a different range or port list is refused rather
+// than silently mixed in.
+func openCheckpoint(path, cidr, ports string) (*checkpointFile, error) {
+	c := &checkpointFile{path: path, state: scanCheckpoint{CIDR: cidr, Ports: ports, StartedAt: time.Now()}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved scanCheckpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %v", path, err)
+	}
+	if saved.CIDR != cidr || saved.Ports != ports {
+		return nil, fmt.Errorf("checkpoint %s belongs to a scan of %s ports %s; remove it or use another file", path, saved.CIDR, saved.Ports)
+	}
+	c.state = saved
+	return c, nil
+}
+
+// record adds a finished host and rewrites the file atomically
+func (c *checkpointFile) record(info HostInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Completed = append(c.state.Completed, info)
+	c.state.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// finish removes the checkpoint once the whole range has been scanned
+func (c *checkpointFile) finish() error {
+	err := os.Remove(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// A time-boxed scan is planned before it starts: the work is cut into
+// shards of at most planShardHosts addresses and about planShardLength of
+// probing each, spread over the agents, and paced at the rate that
+// finishes inside the open window time with some margin
+const (
+	planShardHosts  = 256
+	planShardLength = 15 * time.Minute
+	planRateMargin  = 1.1
+	maxPlanHosts    = 1 << 20
+)
+
+// PlanShard is one unit of a planned scan, run by a single agent
+type PlanShard struct {
+	ID     int       `json:"id"`
+	Agent  int       `json:"agent"`
+	CIDR   string    `json:"cidr"`
+	Ports  string    `json:"ports"`
+	Probes int64     `json:"probes"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// ScanPlan reports whether a scan fits its time box and how it is split.
+// Rates are per agent; capacity assumes the worst case of every probe
+// waiting for the full timeout.
+type ScanPlan struct {
+	Target        string      `json:"target"`
+	Hosts         int         `json:"hosts"`
+	PortsPerHost  int         `json:"ports_per_host"`
+	Probes        int64       `json:"probes"`
+	Start         time.Time   `json:"start"`
+	Deadline      time.Time   `json:"deadline"`
+	WindowSeconds float64     `json:"window_seconds"`
+	Agents        int         `json:"agents"`
+	RequiredRate  float64     `json:"required_rate"`
+	CapacityRate  float64     `json:"capacity_rate"`
+	Feasible      bool        `json:"feasible"`
+	Problems      []string    `json:"problems,omitempty"`
+	AgentsNeeded  int         `json:"agents_needed,omitempty"`
+	MinimumTime   string      `json:"minimum_time,omitempty"`
+	Shards        []PlanShard `json:"shards"`
+}
+
+// splitCIDR cuts a range into blocks of at most size addresses
+func splitCIDR(cidr string, size int) ([]string, int, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 20 {
+		return nil, 0, fmt.Errorf("%s has more than %d addresses; split it before planning", cidr, maxPlanHosts)
+	}
+	total := 1 << (bits - ones)
+	blockBits := bits - ones
+	for 1<<blockBits > size {
+		blockBits--
+	}
+	blockMask := net.CIDRMask(bits-blockBits, bits)
+
+	var blocks []string
+	ip := append(net.IP(nil), ipnet.IP...)
+	for i := 0; i < total; i += 1 << blockBits {
+		blocks = append(blocks, (&net.IPNet{IP: append(net.IP(nil), ip...), Mask: blockMask}).String())
+		for j := 0; j < 1<<blockBits; j++ {
+			inc(ip)
+		}
+	}
+	return blocks, total, nil
+}
+
+// formatPortList writes ports in a form parsePortSpec reads back: one
+// range when they are consecutive, otherwise a comma-separated list
+func formatPortList(ports []int) string {
+	if len(ports) == 1 {
+		return strconv.Itoa(ports[0])
+	}
+	consecutive := true
+	for i := 1; i < len(ports); i++ {
+		consecutive = consecutive && ports[i] == ports[i-1]+1
+	}
+	if consecutive {
+		return fmt.Sprintf("%d-%d", ports[0], ports[len(ports)-1])
+	}
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// openTime measures the time between from and to that falls inside the
+// scan windows; without windows that is all of it
+func (w *scanWindows) openTime(from, to time.Time) time.Duration {
+	if w == nil {
+		return to.Sub(from)
+	}
+	var open time.Duration
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		if w.open(t) {
+			step := time.Minute
+			if left := to.Sub(t); left < step {
+				step = left
+			}
+			open += step
+		}
+	}
+	return open
+}
+
+// advance returns the wall-clock time at which d of open window time has
+// passed after from
+func (w *scanWindows) advance(from time.Time, d time.Duration) time.Time {
+	if w == nil {
+		return from.Add(d)
+	}
+	t := from
+	for d > 0 {
+		if !w.open(t) {
+			t = w.nextOpen(t.Add(time.Minute))
+			continue
+		}
+		step := time.Minute
+		if d < step {
+			step = d
+		}
+		t, d = t.Add(step), d-step
+	}
+	return t
+}
+
+// planScan checks whether scanning every port in ports on cidr fits in the
+// time box and splits it into shards for the agents
+func planScan(cidr string, portOpts PortScanOptions, within time.Duration, agents int, maxRate float64,
+	timeout time.Duration, windows *scanWindows, start time.Time) (ScanPlan, error) {
+	blocks, hosts, err := splitCIDR(cidr, planShardHosts)
+	if err != nil {
+		return ScanPlan{}, err
+	}
+	ports := (&Scanner{portOptions: portOpts}).portList()
+	plan := ScanPlan{
+		Target:       cidr,
+		Hosts:        hosts,
+		PortsPerHost: len(ports),
+		Start:        start,
+		Deadline:     start.Add(within),
+		Agents:       agents,
+		Shards:       []PlanShard{},
+	}
+	open := windows.openTime(start, plan.Deadline)
+	plan.WindowSeconds = open.Seconds()
+	if open <= 0 {
+		plan.Probes = int64(hosts) * int64(len(ports)+1)
+		plan.Problems = append(plan.Problems, "no scan window opens before the deadline")
+		return plan, nil
+	}
+
+	// Worst case the in-flight limit is reached and every probe waits out the timeout
+	perHost := portConcurrency
+	if len(ports) > 10000 {
+		perHost = largePortConcurrency
+	}
+	inFlight := hostConcurrency
+	if hosts < inFlight {
+		inFlight = hosts
+	}
+	inFlight *= perHost
+	plan.CapacityRate = float64(inFlight) / timeout.Seconds()
+	if maxRate > 0 && maxRate < plan.CapacityRate {
+		plan.CapacityRate = maxRate
+	}
 
-			s.mu.Lock()
-			s.results = append(s.results, info)
-			s.mu.Unlock()
+	// Size shards for the rate they will run at, then balance them over
+	// the agents, each onto the least loaded
+	idealRate := float64(hosts) * float64(len(ports)+1) / float64(agents) / open.Seconds()
+	if idealRate > plan.CapacityRate {
+		idealRate = plan.CapacityRate
+	}
+	shardProbes := int64(idealRate * planShardLength.Seconds())
+	hostsPerBlock := hosts / len(blocks)
+	blockProbes := int64(hostsPerBlock) * int64(len(ports)+1)
+	chunks := 1
+	if shardProbes > 0 && blockProbes > shardProbes {
+		chunks = int((blockProbes + shardProbes - 1) / shardProbes)
+	}
+	if len(blocks)*chunks < agents {
+		chunks = (agents + len(blocks) - 1) / len(blocks)
+	}
+	if chunks > len(ports) {
+		chunks = len(ports)
+	}
 
-			if s.liveDisplay {
-				s.displayHostResult(info)
+	load := make([]int64, agents)
+	for _, block := range blocks {
+		for c := 0; c < chunks; c++ {
+			part := ports[c*len(ports)/chunks : (c+1)*len(ports)/chunks]
+			agent := 0
+			for a := range load {
+				if load[a] < load[agent] {
+					agent = a
+				}
 			}
-
-			// Update progress counter
-			atomic.AddInt32(&s.hostsScanned, 1)
-		}(host)
+			// Every shard pings its hosts before probing their ports
+			probes := int64(hostsPerBlock) * int64(len(part)+1)
+			load[agent] += probes
+			plan.Probes += probes
+			plan.Shards = append(plan.Shards, PlanShard{
+				ID:     len(plan.Shards) + 1,
+				Agent:  agent + 1,
+				CIDR:   block,
+				Ports:  formatPortList(part),
+				Probes: probes,
+			})
+		}
 	}
 
-	wg.Wait()
+	busiest := int64(0)
+	for _, l := range load {
+		if l > busiest {
+			busiest = l
+		}
+	}
+	plan.RequiredRate = math.Ceil(float64(busiest) / open.Seconds() * planRateMargin)
 
-	if s.liveDisplay {
-		fmt.Printf("\nScan complete. %d hosts scanned.\n", s.totalHosts)
+	// Lay each agent's shards end to end at the planned rate
+	rate := plan.RequiredRate
+	if rate > plan.CapacityRate {
+		rate = plan.CapacityRate
+	}
+	elapsed := make([]time.Duration, agents)
+	for i := range plan.Shards {
+		shard := &plan.Shards[i]
+		a := shard.Agent - 1
+		shard.Start = windows.advance(start, elapsed[a])
+		elapsed[a] += time.Duration(float64(shard.Probes) / rate * float64(time.Second))
+		shard.End = windows.advance(start, elapsed[a])
 	}
 
-	return nil
+	plan.Feasible = plan.RequiredRate <= plan.CapacityRate
+	if !plan.Feasible {
+		plan.AgentsNeeded = int(math.Ceil(float64(agents) * plan.RequiredRate / plan.CapacityRate))
+		minimum := time.Duration(float64(plan.Probes) / float64(agents) / plan.CapacityRate * planRateMargin * float64(time.Second))
+		plan.MinimumTime = strings.TrimSuffix(minimum.Round(time.Minute).String(), "0s")
+		limit := "in flight at the probe timeout"
+		if maxRate > 0 && maxRate <= plan.CapacityRate {
+			limit = "under -max-rate"
+		}
+		plan.Problems = append(plan.Problems, fmt.Sprintf(
+			"needs %.0f probes/s per agent but only %.0f are possible %s; use -agents %d or at least %s of window time",
+			plan.RequiredRate, plan.CapacityRate, limit, plan.AgentsNeeded, plan.MinimumTime))
+	}
+	return plan, nil
 }
 
-// Update displayProgress with color
-func (s *Scanner) displayProgress() {
-	for {
-		scanned := atomic.LoadInt32(&s.hostsScanned)
-		if scanned >= int32(s.totalHosts) {
-			break
+// printPlan writes a plan for people; -plan -json prints the ScanPlan itself
+func printPlan(plan ScanPlan) {
+	fmt.Printf("Scan plan for %s: %d hosts x %d ports = %d probes (worst case, every host up)\n",
+		plan.Target, plan.Hosts, plan.PortsPerHost, plan.Probes)
+	fmt.Printf("Time box: until %s, %s inside scan windows\n",
+		plan.Deadline.Format("Mon 2006-01-02 15:04 MST"), (time.Duration(plan.WindowSeconds) * time.Second).String())
+	fmt.Printf("Agents: %d; required %.0f probes/s per agent, capacity %.0f probes/s per agent\n",
+		plan.Agents, plan.RequiredRate, plan.CapacityRate)
+	if plan.Feasible {
+		fmt.Printf("Feasible: %syes%s\n", ColorGreen, ColorReset)
+	} else {
+		fmt.Printf("Feasible: %sno%s\n", ColorRed, ColorReset)
+		for _, problem := range plan.Problems {
+			fmt.Printf("  - %s\n", problem)
+		}
+	}
+	fmt.Printf("Shards (%d):\n", len(plan.Shards))
+	for _, shard := range plan.Shards {
+		ports := shard.Ports
+		if len(ports) > 24 {
+			ports = ports[:21] + "..."
 		}
+		fmt.Printf("  #%-4d agent %-3d %-20s ports %-24s %12d probes  %s - %s\n", shard.ID, shard.Agent, shard.CIDR,
+			ports, shard.Probes, shard.Start.Format("Mon 15:04"), shard.End.Format("Mon 15:04"))
+	}
+}
+
+func roundTenth(v float64) float64 {
+	return math.Round(v*10) / 10
+}
 
-		percentage := float64(scanned) / float64(s.totalHosts) * 100
-		fmt.Printf("\r%sProgress: %s%.1f%% (%d/%d hosts scanned)%s",
+// windowList collects repeatable -window values
+type windowList []string
+
+func (w *windowList) String() string     { return strings.Join(*w, ", ") }
+func (w *windowList) Set(v string) error { *w = append(*w, v); return nil }
+
+// printProgress renders an event as the carriage-return status line
+func printProgress(event ProgressEvent) {
+	switch event.Phase {
+	case "ports":
+		fmt.Printf("\r%sScanning ports: %.1f%% (%d/%d, ETA %s)%s",
+			ColorYellow,
+			event.Percent,
+			event.Done,
+			event.Total,
+			(time.Duration(event.ETASeconds) * time.Second).String(),
+			ColorReset)
+	default:
+		fmt.Printf("\r%sProgress: %s%.1f%% (%d/%d hosts scanned, ETA %s)%s",
 			ColorBlue,
 			ColorYellow,
-			percentage,
-			scanned,
-			s.totalHosts,
+			event.Percent,
+			event.Done,
+			event.Total,
+			(time.Duration(event.ETASeconds) * time.Second).String(),
 			ColorReset)
-		time.Sleep(500 * time.Millisecond)
+	}
+	if event.Finished && event.Phase == "ports" {
+		fmt.Println()
 	}
 }
 
@@ -189,6 +2599,9 @@ func (s *Scanner) displayHostResult(info HostInfo) {
 			fmt.Printf(" (%s%s%s)", ColorYellow, info.Hostname, ColorReset)
 		}
 		fmt.Printf(" - %s%d open ports%s", ColorPurple, len(info.OpenPorts), ColorReset)
+		if len(info.Roles) > 0 {
+			fmt.Printf(" [%s%s%s]", ColorGreen, formatRoles(info.Roles), ColorReset)
+		}
 		s.progressMutex.Unlock()
 		return
 	}
@@ -201,6 +2614,13 @@ func (s *Scanner) displayHostResult(info HostInfo) {
 	if info.Hostname != "" {
 		fmt.Printf("%sHostname:%s %s%s%s\n", ColorGray, ColorReset, ColorYellow, info.Hostname, ColorReset)
 	}
+	if info.MACAddress != "" {
+		fmt.Printf("%sMAC:%s %s", ColorGray, ColorReset, info.MACAddress)
+		if info.Vendor != "" {
+			fmt.Printf(" (%s)", info.Vendor)
+		}
+		fmt.Println()
+	}
 	fmt.Printf("%sStatus:%s %s\n", ColorGray, ColorReset, colorStatus(info.IsReachable))
 
 	fmt.Printf("\n%sPing Statistics:%s\n", ColorBlue, ColorReset)
@@ -230,6 +2650,18 @@ func (s *Scanner) displayHostResult(info HostInfo) {
 			ColorReset)
 	}
 
+	if len(info.Roles) > 0 {
+		fmt.Printf("\n%sProbable Roles:%s\n", ColorBlue, ColorReset)
+		for _, role := range info.Roles {
+			fmt.Printf("  %s%s%s (score %d): %s\n",
+				ColorGreen,
+				role.Role,
+				ColorReset,
+				role.Score,
+				strings.Join(role.Evidence, "; "))
+		}
+	}
+
 	if info.PingStats.ErrorMessage != "" {
 		fmt.Printf("\n%sError:%s %s%s%s\n",
 			ColorRed,
@@ -275,6 +2707,32 @@ func getServiceName(port int) string {
 		return "RDP"
 	case 8080:
 		return "HTTP-Alt"
+	case 53:
+		return "DNS"
+	case 88:
+		return "Kerberos"
+	case 389:
+		return "LDAP"
+	case 445:
+		return "SMB"
+	case 554:
+		return "RTSP"
+	case 631:
+		return "IPP"
+	case 902:
+		return "VMware"
+	case 1433:
+		return "MSSQL"
+	case 3306:
+		return "MySQL"
+	case 5432:
+		return "PostgreSQL"
+	case 6379:
+		return "Redis"
+	case 9100:
+		return "JetDirect"
+	case 27017:
+		return "MongoDB"
 	default:
 		return ""
 	}
@@ -286,29 +2744,182 @@ func (s *Scanner) scanHost(ip string) HostInfo {
 		ScannedAt: time.Now(),
 	}
 
-	// Detailed ping
-	pingStats := s.detailedPing(ip, PingOptions{
-		Count:    4,
+	// Detailed ping; echo requests count against the probe rate too
+	s.pacer.wait()
+	atomic.AddInt64(&s.probesSent, int64(s.pingCount))
+	options := PingOptions{
+		Count:    s.pingCount,
 		Interval: 250 * time.Millisecond,
 		Timeout:  2 * time.Second,
-	})
+	}
+	var pingStats PingStats
+	if s.pinger != nil && net.ParseIP(ip).To4() != nil {
+		pingStats = s.pinger.ping(ip, options)
+	} else {
+		pingStats = s.detailedPing(ip, options)
+	}
 	info.PingStats = pingStats
 	info.IsReachable = pingStats.PacketsReceived > 0
 
-	// DNS lookup
-	if names, err := net.LookupAddr(ip); err == nil {
-		info.DNSNames = names
-		if len(names) > 0 {
-			info.Hostname = strings.TrimSuffix(names[0], ".")
+	// Port scan; names, vendors and roles are added by enrichResults
+	if info.IsReachable {
+		info.OpenPorts, info.Banners = s.scanPorts(ip)
+	}
+
+	return info
+}
+
+// lookupMAC finds the hardware address for ip in the local ARP cache
+func lookupMAC(ctx context.Context, ip string) string {
+	// Linux exposes the neighbour table directly
+	if data, err := os.ReadFile("/proc/net/arp"); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[0] == ip && fields[3] != "00:00:00:00:00:00" {
+				return strings.ToLower(fields[3])
+			}
 		}
+		return ""
 	}
 
-	// Port scan
-	if info.IsReachable {
-		info.OpenPorts = s.scanPorts(ip)
+	args := []string{"-n", ip}
+	if runtime.GOOS == "windows" {
+		args = []string{"-a", ip}
+	}
+	output, err := exec.CommandContext(ctx, "arp", args...).Output()
+	if err != nil {
+		return ""
 	}
 
-	return info
+	return normalizeMAC(macRegex.FindString(string(output)))
+}
+
+var macRegex = regexp.MustCompile(`([0-9a-fA-F]{1,2}[:-]){5}[0-9a-fA-F]{1,2}`)
+
+// normalizeMAC rewrites "0:50:56:c0:0:8" (macOS) and "00-50-56-c0-00-08"
+// (Windows) as "00:50:56:c0:00:08"
+func normalizeMAC(mac string) string {
+	if mac == "" {
+		return ""
+	}
+	octets := strings.FieldsFunc(mac, func(r rune) bool { return r == ':' || r == '-' })
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+	return strings.ToLower(strings.Join(octets, ":"))
+}
+
+// lookupVendor maps a MAC address to a vendor name using its OUI prefix
+func lookupVendor(mac string) string {
+	if len(mac) < 8 {
+		return ""
+	}
+	return ouiVendors[strings.ToUpper(mac[:8])]
+}
+
+// hostnameTokens splits the first DNS label into words with trailing digits
+// removed, so "dc01" and "printer-3" match "dc" and "printer"
+func hostnameTokens(hostname string) []string {
+	label := strings.ToLower(strings.SplitN(hostname, ".", 2)[0])
+	var tokens []string
+	for _, token := range strings.FieldsFunc(label, func(r rune) bool { return r == '-' || r == '_' }) {
+		token = strings.TrimRight(token, "0123456789")
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// classifyHost scores each role signature against the host's open ports,
+// banners, vendor and hostname, returning matching roles best first
+func classifyHost(info HostInfo) []RoleMatch {
+	tokens := hostnameTokens(info.Hostname)
+	var matches []RoleMatch
+
+	for _, sig := range roleSignatures {
+		match := RoleMatch{Role: sig.role}
+
+		for _, port := range info.OpenPorts {
+			if weight, ok := sig.ports[port]; ok {
+				match.Score += weight
+				match.Evidence = append(match.Evidence, fmt.Sprintf("port %d open", port))
+			}
+		}
+
+		for _, keyword := range sig.hostnames {
+			for _, token := range tokens {
+				if token == keyword {
+					match.Score += 2
+					match.Evidence = append(match.Evidence, fmt.Sprintf("hostname %q", info.Hostname))
+				}
+			}
+		}
+
+		for _, vendor := range sig.vendors {
+			if info.Vendor == vendor {
+				match.Score += 3
+				match.Evidence = append(match.Evidence, fmt.Sprintf("vendor %s", vendor))
+			}
+		}
+
+		for port, banner := range info.Banners {
+			lower := strings.ToLower(banner)
+			for _, keyword := range sig.banners {
+				if strings.Contains(lower, keyword) {
+					match.Score += 3
+					match.Evidence = append(match.Evidence, fmt.Sprintf("banner on port %d mentions %q", port, keyword))
+					break
+				}
+			}
+		}
+
+		if match.Score >= roleScoreThreshold {
+			sort.Strings(match.Evidence)
+			matches = append(matches, match)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	return matches
+}
+
+func formatRoles(roles []RoleMatch) string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Role)
+	}
+	return strings.Join(names, ", ")
+}
+
+// grabBanner reads whatever the service volunteers right after connecting
+func grabBanner(conn net.Conn) string {
+	if err := conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond)); err != nil {
+		return ""
+	}
+
+	buf := make([]byte, 512)
+	n, _ := conn.Read(buf)
+	if n == 0 {
+		return ""
+	}
+
+	// Keep printable text only so binary greetings don't garble output
+	banner := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' || (r >= 32 && r < 127) {
+			return r
+		}
+		return -1
+	}, string(buf[:n]))
+	banner = strings.TrimSpace(banner)
+	if len(banner) > 100 {
+		banner = banner[:97] + "..."
+	}
+	return banner
 }
 
 func (s *Scanner) ping(ip string) float64 {
@@ -459,7 +3070,8 @@ func calculateJitter(latencies []float64) float64 {
 	return jitterSum / float64(len(latencies)-1)
 }
 
-func (s *Scanner) scanPorts(ip string) []int {
+// portList expands the port options into the ports scanned on each host
+func (s *Scanner) portList() []int {
 	var portsToScan []int
 
 	if len(s.portOptions.Ports) > 0 {
@@ -475,42 +3087,39 @@ func (s *Scanner) scanPorts(ip string) []int {
 			portsToScan = append(portsToScan, i)
 		}
 	}
+	return portsToScan
+}
+
+func (s *Scanner) scanPorts(ip string) ([]int, map[int]string) {
+	portsToScan := s.portList()
+	if s.shuffle {
+		portsToScan = append([]int(nil), portsToScan...)
+		rand.Shuffle(len(portsToScan), func(i, j int) { portsToScan[i], portsToScan[j] = portsToScan[j], portsToScan[i] })
+	}
 
 	var openPorts []int
+	banners := make(map[int]string)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
-	// Adjust concurrent connections based on port range
-	maxConcurrent := 500
-	if len(portsToScan) > 10000 {
-		maxConcurrent = 200 // Reduce concurrency for large scans
+	// Adjust concurrent connections based on port range, unless a tuned
+	// limiter shared across hosts is in use
+	limiter := s.portLimiter
+	if limiter == nil {
+		maxConcurrent := portConcurrency
+		if len(portsToScan) > 10000 {
+			maxConcurrent = largePortConcurrency // Reduce concurrency for large scans
+		}
+		limiter = newProbeLimiter(maxConcurrent)
 	}
-	sem := make(chan struct{}, maxConcurrent)
 
-	// Add progress tracking for port scanning
+	// Per-host progress is only worth reporting for large port scans
 	var scannedPorts int32
-	totalPorts := len(portsToScan)
-
-	// Start progress display goroutine for large scans
-	if totalPorts > 1000 {
-		go func() {
-			for {
-				current := atomic.LoadInt32(&scannedPorts)
-				if current >= int32(totalPorts) {
-					break
-				}
-				percentage := float64(current) / float64(totalPorts) * 100
-				fmt.Printf("\r%sScanning ports: %.1f%% (%d/%d)%s",
-					ColorYellow,
-					percentage,
-					current,
-					totalPorts,
-					ColorReset)
-				time.Sleep(500 * time.Millisecond)
-			}
-			fmt.Println()
-		}()
+	stopProgress := func() {}
+	if len(portsToScan) > 1000 {
+		stopProgress = s.trackProgress("ports", ip, len(portsToScan), &scannedPorts, limiter)
 	}
+	defer stopProgress()
 
 	// Break ports into chunks for better management
 	chunkSize := 1000
@@ -522,23 +3131,26 @@ func (s *Scanner) scanPorts(ip string) []int {
 		chunk := portsToScan[i:end]
 
 		for _, port := range chunk {
+			s.windows.wait()
 			wg.Add(1)
-			sem <- struct{}{} // Acquire semaphore
+			limiter.acquire()
+			s.pacer.wait()
 
 			go func(p int) {
 				defer wg.Done()
-				defer func() { <-sem }() // Release semaphore
+				defer limiter.release()
 
-				address := fmt.Sprintf("%s:%d", ip, p)
-				conn, err := net.DialTimeout("tcp", address, s.timeout)
-				if err == nil {
-					conn.Close()
+				if open, banner := s.probePort(ip, p); open {
 					mu.Lock()
 					openPorts = append(openPorts, p)
+					if banner != "" {
+						banners[p] = banner
+					}
 					mu.Unlock()
 				}
 
 				atomic.AddInt32(&scannedPorts, 1)
+				atomic.AddInt64(&s.probesDone, 1)
 			}(port)
 		}
 
@@ -548,7 +3160,39 @@ func (s *Scanner) scanPorts(ip string) []int {
 
 	// Sort the open ports before returning
 	sort.Ints(openPorts)
-	return openPorts
+	if len(banners) == 0 {
+		banners = nil
+	}
+	return openPorts, banners
+}
+
+// probePort checks one port, half-open when raw sockets allow it. Banners
+// still need a full connection, so open ports are connected to afterwards.
+func (s *Scanner) probePort(ip string, port int) (bool, string) {
+	syn := s.syn != nil && net.ParseIP(ip).To4() != nil
+	if syn {
+		atomic.AddInt64(&s.probesSent, 1)
+		srcPort := s.syn.port
+		if s.sourcePorts != nil {
+			srcPort = uint16(s.sourcePorts.take())
+		}
+		if !s.syn.probe(ip, port, srcPort, s.timeout) {
+			return false, ""
+		}
+		if !s.grabBanners {
+			return true, ""
+		}
+	}
+
+	conn, err := s.dial(net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return syn, ""
+	}
+	defer conn.Close()
+	if s.grabBanners {
+		return true, grabBanner(conn)
+	}
+	return true, ""
 }
 
 // Helper to increment IP address
@@ -603,6 +3247,15 @@ func formatHostResult(info HostInfo) string {
 			ColorReset)
 	}
 
+	if len(info.Roles) > 0 {
+		fmt.Fprintf(&result, "\n  %sRoles:%s %s%s%s",
+			ColorBlue,
+			ColorReset,
+			ColorGreen,
+			formatRoles(info.Roles),
+			ColorReset)
+	}
+
 	return result.String()
 }
 
@@ -634,6 +3287,12 @@ func parsePortSpec(spec string) (PortScanOptions, error) {
 		return opts, nil
 	}
 
+	// Handle "roles" keyword: ports that feed the device role classifier
+	if strings.ToLower(spec) == "roles" {
+		opts.Ports = rolePorts
+		return opts, nil
+	}
+
 	// Handle comma-separated list
 	if strings.Contains(spec, ",") {
 		ports := []int{}
@@ -687,21 +3346,326 @@ func main() {
 	verbose := flag.Bool("v", true, "Enable verbose output")      // Default to true
 	live := flag.Bool("live", true, "Show live scanning results") // Default to true
 	jsonOutput := flag.Bool("json", false, "Output results as JSON")
-	portSpec := flag.String("p", "22,80,443,3389,8080", "Port specification (e.g., '80', '80,443', '1-1000', 'all')")
+	portSpec := flag.String("p", "22,80,443,3389,8080", "Port specification (e.g., '80', '80,443', '1-1000', 'all', 'roles')")
+	sweep := flag.Bool("sweep", false, "Only find live hosts (ICMP plus optional TCP probes); skips DNS, ports and banners")
+	neighbors := flag.Bool("nd", false, "Enumerate IPv6 hosts on the link of the given interface via multicast echo and the neighbor cache")
+	ptrOnly := flag.Bool("ptr", false, "Only look up reverse DNS names for every address in the range; sends no probes")
+	resolversArg := flag.String("resolvers", "", "Comma-separated DNS servers for PTR lookups (default: from /etc/resolv.conf)")
+	ptrRate := flag.Float64("ptr-rate", defaultPTRRate, "Maximum PTR queries per second to each resolver")
+	ptrConcurrency := flag.Int("ptr-concurrency", defaultPTRConns, "PTR lookups in flight at once")
+	ptrTimeout := flag.Duration("ptr-timeout", ptrAttemptTimeout, "Timeout per PTR query attempt")
+	sweepPorts := flag.String("sweep-ports", "", "TCP ports to probe in sweep mode when ICMP gets no answer (e.g., '22,443')")
+	concurrency := flag.Int("concurrency", 1000, "Concurrent probes in sweep mode (the starting point when -target-duration is set)")
+	timeout := flag.Duration("timeout", 2*time.Second, "Per-probe timeout")
+	enrichTimeout := flag.Duration("enrich-timeout", 10*time.Second, "Total time budget for reverse DNS and vendor enrichment after the scan")
+	progressMode := flag.String("progress", "text", "Progress reporting: 'text' status line, 'json' events on stderr, or 'none'")
+	targetDuration := flag.Duration("target-duration", 0, "Auto-tune concurrency to finish the scan in about this long (e.g. 10m)")
+	maxRate := flag.Float64("max-rate", 0, "Maximum probes started per second across the scan (0 = unlimited)")
+	var windowSpecs windowList
+	flag.Var(&windowSpecs, "window", "Allowed scan window, e.g. '01:00-05:00' or 'Mon-Fri 22:00-06:00'; probing pauses outside (repeatable)")
+	windowTZ := flag.String("window-tz", "Local", "Time zone for -window, e.g. 'UTC' or 'Europe/Berlin'")
+	checkpointPath := flag.String("checkpoint", "", "File recording finished hosts so an interrupted scan resumes where it stopped")
+	daemon := flag.Bool("daemon", false, "Keep running and repeat the scan every -every, within -window if given")
+	every := flag.Duration("every", 24*time.Hour, "Time between scan starts in daemon mode")
+	polite := flag.Bool("polite", false, fmt.Sprintf("Production-safe profile: at most %d probes/s with jittered timing, %d in flight, top-20 ports only, no banner grabs, randomized order, fixed source ports", politeRate, politeInFlight))
+	politeSource := flag.String("polite-source-ports", politeSourcePorts, "Source port range polite probes are sent from, for firewall/IDS allow-listing")
+	politeContact := flag.String("polite-contact", "", "Contact recorded in the polite profile's identity in the results; it is not sent to scanned hosts (e.g. secops@example.com)")
+	within := flag.Duration("within", 0, "Time box for the whole scan (e.g. 2h): plan shards and pace probes to finish in time, counting only -window time")
+	agents := flag.Int("agents", 1, "Hosts sharing a -within scan; each runs the same command with its own -agent number (bin/agent -controller assigns them)")
+	agent := flag.Int("agent", 1, "Which agent of -agents this host is")
+	planOnly := flag.Bool("plan", false, "Print the -within plan and its feasibility without scanning")
+	noRaw := flag.Bool("no-raw", false, "Use the unprivileged probes (system ping, connect scans) even when raw sockets are available")
+	synScan := flag.Bool("syn", false, "Scan ports with half-open SYN probes when raw sockets are available (Linux only)")
 	flag.Parse()
 
 	args := flag.Args()
 	if len(args) != 1 {
 		fmt.Println("Usage: net-grab [options] <cidr>")
+		fmt.Println("       net-grab -nd <interface>")
 		fmt.Println("Example: net-grab 192.168.1.0/24")
+		fmt.Println("         net-grab -sweep -sweep-ports 22,443 10.0.0.0/16")
+		fmt.Println("         net-grab -nd eth0")
+		fmt.Println("         net-grab -json -progress json 10.0.0.0/22 2>progress.jsonl")
+		fmt.Println("         net-grab -sweep -target-duration 5m -max-rate 2000 10.0.0.0/12")
+		fmt.Println("         net-grab -daemon -window 01:00-05:00 -checkpoint prod.ckpt 10.20.0.0/24")
+		fmt.Println("         net-grab -ptr -resolvers 10.0.0.2,10.0.0.3 -ptr-rate 1000 10.0.0.0/16")
+		fmt.Println("         net-grab -polite -polite-contact secops@example.com -json 10.20.0.0/24")
+		fmt.Println("         net-grab -p all -within 2h -agents 3 -plan 10.0.0.0/22")
 		fmt.Println("\nOptions:")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if *progressMode != "text" && *progressMode != "json" && *progressMode != "none" {
+		fmt.Fprintf(os.Stderr, "%sError:%s -progress must be text, json or none\n", ColorRed, ColorReset)
+		os.Exit(1)
+	}
+
+	var windows *scanWindows
+	if len(windowSpecs) > 0 {
+		location, err := time.LoadLocation(*windowTZ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+			os.Exit(1)
+		}
+		windows = &scanWindows{location: location, verbose: *verbose}
+		for _, spec := range windowSpecs {
+			rule, err := parseWindow(spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+				os.Exit(1)
+			}
+			windows.rules = append(windows.rules, rule)
+		}
+	}
+	if (*sweep || *neighbors || *ptrOnly) && (windows != nil || *checkpointPath != "" || *daemon) {
+		fmt.Fprintf(os.Stderr, "%sError:%s -window, -checkpoint and -daemon apply to full scans only\n", ColorRed, ColorReset)
+		os.Exit(1)
+	}
+	if *daemon && *every <= 0 {
+		fmt.Fprintf(os.Stderr, "%sError:%s -every must be positive\n", ColorRed, ColorReset)
+		os.Exit(1)
+	}
+
+	// The polite profile's limits are caps: options may tighten, never loosen them
+	var politePool *sourcePortPool
+	var politeScanPorts []int
+	if *polite {
+		if *sweep || *neighbors || *ptrOnly || *targetDuration > 0 {
+			fmt.Fprintf(os.Stderr, "%sError:%s -polite applies to full scans and cannot be combined with -sweep, -nd, -ptr or -target-duration\n", ColorRed, ColorReset)
+			os.Exit(1)
+		}
+		portGiven := false
+		flag.Visit(func(f *flag.Flag) { portGiven = portGiven || f.Name == "p" })
+		politeScanPorts = politePorts
+		if portGiven {
+			opts, err := parsePortSpec(*portSpec)
+			allowed := make(map[int]bool)
+			for _, port := range politePorts {
+				allowed[port] = true
+			}
+			for _, port := range opts.Ports {
+				if !allowed[port] {
+					err = fmt.Errorf("port %d is not one of the polite profile's ports %v", port, politePorts)
+					break
+				}
+			}
+			if err == nil && len(opts.Ports) == 0 {
+				err = fmt.Errorf("-polite only accepts a list of ports from %v", politePorts)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+				os.Exit(1)
+			}
+			politeScanPorts = opts.Ports
+		}
+		var err error
+		if politePool, err = parseSourcePorts(*politeSource); err != nil {
+			fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+			os.Exit(1)
+		}
+		if *maxRate <= 0 || *maxRate > politeRate {
+			*maxRate = politeRate
+		}
+		if *ptrRate > politePTRRate {
+			*ptrRate = politePTRRate
+		}
+	}
+	if *within > 0 {
+		if *sweep || *neighbors || *ptrOnly || *targetDuration > 0 || *daemon || *checkpointPath != "" || *polite {
+			fmt.Fprintf(os.Stderr, "%sError:%s -within plans full scans and cannot be combined with -sweep, -nd, -ptr, -target-duration, -daemon, -checkpoint or -polite\n", ColorRed, ColorReset)
+			os.Exit(1)
+		}
+		if *agents < 1 || *agent < 1 || *agent > *agents {
+			fmt.Fprintf(os.Stderr, "%sError:%s -agent must be between 1 and -agents\n", ColorRed, ColorReset)
+			os.Exit(1)
+		}
+	} else if *planOnly {
+		fmt.Fprintf(os.Stderr, "%sError:%s -plan needs a time box from -within\n", ColorRed, ColorReset)
+		os.Exit(1)
+	}
+	politeIdentity := "cloud-connect net-grab (polite profile)"
+	if *politeContact != "" {
+		politeIdentity += "; contact " + *politeContact
+	}
+
+	var resolvers []string
+	for _, server := range strings.Split(*resolversArg, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			resolvers = append(resolvers, server)
+		}
+	}
+	if *ptrConcurrency < 1 {
+		*ptrConcurrency = 1
+	}
+	engine, err := newPTREngine(resolvers, *ptrRate, *ptrConcurrency, *ptrTimeout, ptrRetries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+		os.Exit(1)
+	}
+	defer engine.Close()
+
+	// Privileged probes are picked once; scanners created later share them
+	modes := detectProbeModes(!*noRaw && !*ptrOnly && !*neighbors, *synScan)
+	var pinger *icmpPinger
+	var syn *synScanner
+	if modes.ICMP == "raw" {
+		if pinger, err = newICMPPinger(); err != nil {
+			modes.ICMP, modes.Reason = "exec", err.Error()
+		} else {
+			defer pinger.Close()
+		}
+	}
+	if modes.PortScan == "syn" {
+		if syn, err = newSYNScanner(); err != nil {
+			modes.PortScan, modes.Reason = "connect", err.Error()
+		} else {
+			defer syn.Close()
+		}
+	}
+	modes.Privileged = pinger != nil || syn != nil
+	if !*ptrOnly && !*neighbors && modes.Reason != "" && *verbose {
+		fmt.Fprintf(os.Stderr, "%sNote:%s %s; using %s pings and %s port scans\n", ColorYellow, ColorReset, modes.Reason, modes.ICMP, modes.PortScan)
+	}
 
-	fmt.Printf("Starting network scan of %s...\n", args[0])
+	newScanner := func() *Scanner {
+		s := NewScanner(*verbose, *live)
+		s.timeout = *timeout
+		s.enrichBudget = *enrichTimeout
+		s.targetDuration = *targetDuration
+		s.pacer = newProbePacer(*maxRate)
+		s.windows = windows
+		s.ptr = engine
+		s.modes, s.pinger, s.syn = modes, pinger, syn
+		if *polite {
+			s.applyPoliteProfile(*maxRate, politeScanPorts, politePool, politeIdentity)
+		}
+		return s
+	}
+	scanner := newScanner()
+
+	// startProgress consumes progress events until the returned function
+	// is called; JSON events go to stderr so stdout stays a single document
+	startProgress := func(textAllowed bool) func() {
+		var render func(ProgressEvent)
+		switch {
+		case *progressMode == "json":
+			encoder := json.NewEncoder(os.Stderr)
+			render = func(event ProgressEvent) { encoder.Encode(event) }
+		case *progressMode == "text" && textAllowed:
+			render = printProgress
+		default:
+			return func() {}
+		}
+		events := scanner.Progress()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for event := range events {
+				render(event)
+			}
+		}()
+		return func() {
+			scanner.CloseProgress()
+			<-done
+		}
+	}
+
+	if *ptrOnly {
+		// Live lines would corrupt the JSON document
+		scanner.liveDisplay = *live && !*jsonOutput
+		stopProgress := startProgress(false)
+		result, err := scanner.ptrSweep(args[0])
+		stopProgress()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(result)
+			return
+		}
+		fmt.Printf("\nReverse DNS Summary:\n")
+		fmt.Printf("Addresses queried: %d\n", result.Queried)
+		fmt.Printf("Names found: %d\n", result.Named)
+		fmt.Printf("Lookups failed: %d\n", result.Failed)
+		fmt.Printf("Duration: %.1fs\n", result.DurationMs/1000)
+		for _, r := range result.Resolvers {
+			fmt.Printf("  %s: %d queries, %d answered, %d nxdomain, %d timeouts, %d failures\n",
+				r.Server, r.Queries, r.Answered, r.NXDomain, r.Timeouts, r.Failures)
+		}
+		return
+	}
+
+	if *neighbors {
+		result, err := scanner.discoverNeighbors(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(result)
+			return
+		}
+		fmt.Printf("IPv6 neighbors on %s (echo: %s)\n", result.Interface, result.EchoMode)
+		for _, host := range result.Hosts {
+			fmt.Printf("%s%-40s%s %-12s", ColorCyan, host.IPAddress, ColorReset, host.Scope)
+			if host.MACAddress != "" {
+				fmt.Printf(" %s", host.MACAddress)
+				if host.Vendor != "" {
+					fmt.Printf(" (%s)", host.Vendor)
+				}
+			}
+			if host.Router {
+				fmt.Printf(" %srouter%s", ColorYellow, ColorReset)
+			}
+			fmt.Printf(" [%s]", strings.Join(host.Sources, ","))
+			if host.RTT > 0 {
+				fmt.Printf(" %.1fms", host.RTT)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("\nHosts found: %d in %.1fs\n", result.HostsFound, result.DurationMs/1000)
+		return
+	}
+
+	if *sweep {
+		var tcpPorts []int
+		if *sweepPorts != "" {
+			opts, err := parsePortSpec(*sweepPorts)
+			if err != nil || opts.ScanAll || len(opts.Ports) == 0 {
+				fmt.Fprintf(os.Stderr, "%sError:%s sweep ports must be a list such as '22,443'\n", ColorRed, ColorReset)
+				os.Exit(1)
+			}
+			tcpPorts = opts.Ports
+		}
+
+		// Live lines would corrupt the JSON document
+		scanner.liveDisplay = *live && !*jsonOutput
+		stopProgress := startProgress(false)
+		result, err := scanner.sweepNetwork(args[0], tcpPorts, *concurrency)
+		stopProgress()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-	scanner := NewScanner(*verbose, *live)
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(result)
+			return
+		}
+		fmt.Printf("\nSweep Summary:\n")
+		fmt.Printf("Hosts probed: %d\n", result.HostsProbed)
+		fmt.Printf("Hosts alive: %d\n", result.HostsAlive)
+		fmt.Printf("Duration: %.1fs\n", result.DurationMs/1000)
+		if !scanner.liveDisplay {
+			for _, host := range result.Alive {
+				fmt.Printf("%s%-15s%s alive via %s (%.1fms)\n", ColorGreen, host.IPAddress, ColorReset, host.Method, host.RTT)
+			}
+		}
+		return
+	}
 
 	// Parse port specification
 	portOpts, err := parsePortSpec(*portSpec)
@@ -709,13 +3673,101 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
 		os.Exit(1)
 	}
-	scanner.portOptions = portOpts
+	if *polite {
+		portOpts = PortScanOptions{Ports: politeScanPorts}
+		fmt.Printf("Polite profile: %.0f probes/s max (±%.0f%% jitter), %d in flight, %d ports, no banner grabs, source ports %s\n",
+			*maxRate, politeJitter*100, politeInFlight, len(politeScanPorts), *politeSource)
+	}
 
-	if err := scanner.scanNetwork(args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if *within > 0 {
+		plan, err := planScan(args[0], portOpts, *within, *agents, *maxRate, *timeout, windows, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+			os.Exit(1)
+		}
+		if *planOnly && *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(plan)
+		} else {
+			printPlan(plan)
+		}
+		if !plan.Feasible {
+			os.Exit(1)
+		}
+		if *planOnly {
+			return
+		}
+
+		// Run this agent's shards back to back at the planned rate; the
+		// windows pause them like any other scan
+		var results []HostInfo
+		for _, shard := range plan.Shards {
+			if shard.Agent != *agent {
+				continue
+			}
+			shardPorts, _ := parsePortSpec(shard.Ports)
+			scanner = newScanner()
+			scanner.pacer = newProbePacer(plan.RequiredRate)
+			scanner.portOptions = shardPorts
+			fmt.Printf("Starting shard %d: %s ports %s (planned %s - %s)\n", shard.ID, shard.CIDR, shard.Ports,
+				shard.Start.Format("15:04"), shard.End.Format("15:04"))
+
+			stopProgress := startProgress(scanner.liveDisplay)
+			err := scanner.scanNetwork(shard.CIDR)
+			stopProgress()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			results = append(results, scanner.results...)
+			if late := time.Since(shard.End); late > time.Minute {
+				fmt.Fprintf(os.Stderr, "%sWarning:%s shard %d finished %s behind plan\n", ColorYellow, ColorReset, shard.ID, late.Round(time.Second))
+			}
+		}
+		scanner.results = results
+		printScanResults(scanner, *jsonOutput)
+		return
+	}
+
+	// A daemon repeats the scan on a fixed cadence; each run resumes its
+	// checkpoint first, so a run cut short by its window finishes later
+	for {
+		cycleStart := time.Now()
+		fmt.Printf("Starting network scan of %s...\n", args[0])
+
+		scanner.portOptions = portOpts
+		if *checkpointPath != "" {
+			scanner.checkpoint, err = openCheckpoint(*checkpointPath, args[0], *portSpec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%sError:%s %v\n", ColorRed, ColorReset, err)
+				os.Exit(1)
+			}
+		}
+
+		stopProgress := startProgress(scanner.liveDisplay)
+		err = scanner.scanNetwork(args[0])
+		stopProgress()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		printScanResults(scanner, *jsonOutput)
+		if !*daemon {
+			return
+		}
+
+		next := cycleStart.Add(*every)
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "Next scan at %s\n", next.Format(time.RFC3339))
+		}
+		time.Sleep(time.Until(next))
+		scanner = newScanner()
 	}
+}
 
+// printScanResults writes the summary and the per-host results of a full
+// scan; with JSON output each scan is one document on its own line
+func printScanResults(scanner *Scanner, jsonOutput bool) {
 	// Always show a summary
 	fmt.Printf("\nScan Summary:\n")
 	fmt.Printf("Total hosts scanned: %d\n", len(scanner.results))
@@ -728,9 +3780,26 @@ func main() {
 	}
 
 	fmt.Printf("Hosts responding: %d\n", reachable)
+	fmt.Printf("Probe modes: icmp %s, ports %s\n", scanner.modes.ICMP, scanner.modes.PortScan)
+
+	if profile := scanner.profile; profile != nil {
+		profile.ProbesSent = atomic.LoadInt64(&scanner.probesSent)
+		profile.SourcePortFallbacks = atomic.LoadInt64(&scanner.sourcePorts.fallbacks)
+		fmt.Printf("Scan profile: %s, %d probes sent, %d from outside the source port range\n",
+			profile.Name, profile.ProbesSent, profile.SourcePortFallbacks)
+		if profile.SourcePortFallbacks > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d probes were sent from ephemeral ports outside %s; firewall and IDS logs will not attribute them to this scan\n",
+				profile.SourcePortFallbacks, profile.SourcePorts)
+		}
+	}
 
-	// Output detailed results
-	if *jsonOutput {
+	// Output detailed results; a profiled scan wraps them with its profile
+	if jsonOutput && scanner.profile != nil {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Profile *ScanProfile `json:"scan_profile"`
+			Hosts   []HostInfo   `json:"hosts"`
+		}{scanner.profile, scanner.results})
+	} else if jsonOutput {
 		json.NewEncoder(os.Stdout).Encode(scanner.results)
 	} else {
 		fmt.Println("\nDetailed Results:")
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -13,21 +15,53 @@ import (
 )
 
 type PortResult struct {
-	Port      int     `json:"port"`
-	Open      bool    `json:"open"`
-	Service   string  `json:"service,omitempty"`
-	Banner    string  `json:"banner,omitempty"`
-	LatencyMs float64 `json:"latencyMs"`
+	Port        int      `json:"port"`
+	Open        bool     `json:"open"`
+	Service     string   `json:"service,omitempty"`
+	Banner      string   `json:"banner,omitempty"`
+	BannerHex   string   `json:"bannerHex,omitempty"`   // Raw bytes when the banner is binary
+	BannerProbe string   `json:"bannerProbe,omitempty"` // What produced the banner: passive, crlf, http-head, tls
+	TLS         *TLSInfo `json:"tls,omitempty"`
+	LatencyMs   float64  `json:"latencyMs"`
+}
+
+type TLSInfo struct {
+	Version     string   `json:"version"`
+	CipherSuite string   `json:"cipherSuite"`
+	ALPN        string   `json:"alpn,omitempty"`
+	Subject     string   `json:"subject,omitempty"`
+	Issuer      string   `json:"issuer,omitempty"`
+	DNSNames    []string `json:"dnsNames,omitempty"`
 }
 
 type ScanResult struct {
 	TargetIP     string       `json:"targetIp"`
+	Family       string       `json:"family,omitempty"`
 	OpenPorts    []PortResult `json:"openPorts"`
 	ClosedPorts  []PortResult `json:"closedPorts,omitempty"`
 	ScanTime     int64        `json:"scanTimeMs"`
 	PortsScanned int          `json:"portsScanned"`
 }
 
+// DualStackResult holds one scan per address family for a dual-stack host.
+// Only the first address of each family is scanned; hosts behind several
+// A or AAAA records may differ between those records as well.
+type DualStackResult struct {
+	Host       string         `json:"host"`
+	IPv4       ScanResult     `json:"ipv4"`
+	IPv6       ScanResult     `json:"ipv6"`
+	Mismatches []PortMismatch `json:"mismatches"`
+	ScanTime   int64          `json:"scanTimeMs"`
+}
+
+// PortMismatch is a port reachable over one address family but not the other
+type PortMismatch struct {
+	Port     int    `json:"port"`
+	Service  string `json:"service,omitempty"`
+	OpenOn   string `json:"openOn"`
+	ClosedOn string `json:"closedOn"`
+}
+
 // Common service port map
 var commonServices = map[int]string{
 	21: "FTP", 22: "SSH", 23: "Telnet", 25: "SMTP", 53: "DNS",
@@ -36,11 +70,173 @@ var commonServices = map[int]string{
 	3389: "RDP", 5432: "PostgreSQL", 8080: "HTTP-Alt", 8443: "HTTPS-Alt",
 }
 
-func scanPortWithContext(ctx context.Context, ip string, port int, timeout time.Duration) PortResult {
+// Ports where the client must start a TLS handshake before anything else
+var tlsFirstPorts = map[int]bool{
+	443: true, 465: true, 636: true, 853: true, 989: true, 990: true, 993: true,
+	995: true, 3269: true, 5061: true, 5986: true, 6443: true, 8443: true, 9443: true,
+}
+
+// Ports where the server waits for an HTTP request
+var httpPorts = map[int]bool{
+	80: true, 443: true, 3000: true, 5000: true, 5985: true, 5986: true, 6443: true, 8000: true,
+	8008: true, 8080: true, 8081: true, 8443: true, 8888: true, 9090: true, 9200: true, 9443: true,
+}
+
+// Banner prefixes that identify a service regardless of port
+var bannerServices = []struct {
+	prefix  string
+	service string
+}{
+	{"SSH-", "SSH"},
+	{"HTTP/", "HTTP"},
+	{"RFB ", "VNC"},
+	{"+OK", "POP3"},
+	{"* OK", "IMAP"},
+	{"-ERR", "Redis"},
+	{"AMQP", "AMQP"},
+}
+
+const maxBannerLength = 256
+
+// readBanner reads until the deadline, or briefly after data stops arriving
+func readBanner(conn net.Conn, deadline time.Time) []byte {
+	var data []byte
+	buf := make([]byte, 1024)
+	for len(data) < maxBannerLength {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		data = append(data, buf[:n]...)
+		if err != nil {
+			break
+		}
+		// Once something has arrived, only wait a little for the rest
+		if idle := time.Now().Add(150 * time.Millisecond); idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return data
+}
+
+// setBanner stores text banners as text and binary ones as hex as well
+func setBanner(result *PortResult, data []byte, probe string) {
+	if len(data) == 0 {
+		return
+	}
+	if len(data) > maxBannerLength {
+		data = data[:maxBannerLength]
+	}
+
+	printable := 0
+	var text strings.Builder
+	for _, b := range data {
+		switch {
+		case b >= 32 && b < 127:
+			printable++
+			text.WriteByte(b)
+		case b == '\r' || b == '\n' || b == '\t':
+			printable++
+			text.WriteByte(' ')
+		}
+	}
+	if printable < len(data)*9/10 {
+		result.BannerHex = hex.EncodeToString(data)
+	}
+	result.Banner = strings.Join(strings.Fields(text.String()), " ")
+	result.BannerProbe = probe
+
+	for _, known := range bannerServices {
+		if strings.HasPrefix(string(data), known.prefix) {
+			result.Service = known.service
+		}
+	}
+	if probe == "tls" && result.Service == "HTTP" {
+		result.Service = "HTTPS"
+	}
+	// A TLS alert record in reply to plaintext means the port expects TLS
+	if len(data) >= 2 && data[0] == 0x15 && data[1] == 0x03 {
+		result.Service = "TLS"
+	}
+}
+
+func httpHead(host string) []byte {
+	return []byte("HEAD / HTTP/1.0\r\nHost: " + host + "\r\nUser-Agent: cloud-connect\r\n\r\n")
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// grabBanner identifies what is listening within budget. TLS ports get a
+// handshake first, HTTP ports a HEAD request, and everything else a passive
+// read for half the budget followed by a CRLF nudge.
+func grabBanner(conn net.Conn, host string, port int, budget time.Duration, result *PortResult) {
+	deadline := time.Now().Add(budget)
+
+	if tlsFirstPorts[port] {
+		tlsConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true, // Identifying the service, not trusting it
+			NextProtos:         []string{"http/1.1"},
+		})
+		tlsConn.SetDeadline(deadline)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+
+		state := tlsConn.ConnectionState()
+		info := &TLSInfo{
+			Version:     tlsVersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ALPN:        state.NegotiatedProtocol,
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			info.Subject = cert.Subject.CommonName
+			info.Issuer = cert.Issuer.CommonName
+			info.DNSNames = cert.DNSNames
+		}
+		result.TLS = info
+		result.BannerProbe = "tls"
+
+		if httpPorts[port] {
+			tlsConn.Write(httpHead(host))
+		}
+		setBanner(result, readBanner(tlsConn, deadline), "tls")
+		return
+	}
+
+	if httpPorts[port] {
+		conn.SetWriteDeadline(deadline)
+		conn.Write(httpHead(host))
+		setBanner(result, readBanner(conn, deadline), "http-head")
+		return
+	}
+
+	// Server-first protocols (SSH, FTP, SMTP, MySQL...) speak immediately
+	if data := readBanner(conn, time.Now().Add(budget/2)); len(data) > 0 {
+		setBanner(result, data, "passive")
+		return
+	}
+	conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write([]byte("\r\n")); err == nil {
+		setBanner(result, readBanner(conn, deadline), "crlf")
+	}
+}
+
+func scanPortWithContext(ctx context.Context, ip string, port int, timeout, bannerBudget time.Duration) PortResult {
 	var dialer net.Dialer
 	start := time.Now()
 
-	address := fmt.Sprintf("%s:%d", ip, port)
+	address := net.JoinHostPort(ip, strconv.Itoa(port))
 	conn, err := dialer.DialContext(ctx, "tcp", address)
 	latency := time.Since(start).Seconds() * 1000 // milliseconds
 
@@ -59,31 +255,18 @@ func scanPortWithContext(ctx context.Context, ip string, port int, timeout time.
 			result.Service = service
 		}
 
-		// Some protocols return banners upon connection
-		if result.Open {
-			// Set a read deadline instead of using context for the read operation
-			err := conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			if err == nil {
-				banner := make([]byte, 1024)
-				n, _ := conn.Read(banner)
-				if n > 0 {
-					result.Banner = strings.TrimSpace(string(banner[:n]))
-					// Truncate if too long
-					if len(result.Banner) > 100 {
-						result.Banner = result.Banner[:97] + "..."
-					}
-				}
-			}
+		if bannerBudget > 0 {
+			grabBanner(conn, ip, port, bannerBudget, &result)
 		}
 	}
 
 	return result
 }
 
-func scanPortsWithRateLimit(ip string, ports []int, timeout time.Duration, maxConcurrent int) ScanResult {
+func scanPortsWithRateLimit(ip string, ports []int, timeout, bannerBudget time.Duration, maxConcurrent int) ScanResult {
 	startTime := time.Now()
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout+5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+bannerBudget+5*time.Second)
 	defer cancel()
 
 	var wg sync.WaitGroup
@@ -105,7 +288,7 @@ func scanPortsWithRateLimit(ip string, ports []int, timeout time.Duration, maxCo
 			portCtx, portCancel := context.WithTimeout(ctx, timeout)
 			defer portCancel()
 
-			result := scanPortWithContext(portCtx, ip, p, timeout)
+			result := scanPortWithContext(portCtx, ip, p, timeout, bannerBudget)
 			resultChan <- result
 		}(port)
 	}
@@ -138,6 +321,84 @@ func scanPortsWithRateLimit(ip string, ports []int, timeout time.Duration, maxCo
 	}
 }
 
+// resolveFamilies returns the first IPv4 and IPv6 address of a hostname.
+// IP literals come back as the only address of their family.
+func resolveFamilies(host string) (string, string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ip.String(), "", nil
+		}
+		return "", ip.String(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	var v4, v6 string
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if v4 == "" {
+				v4 = addr.IP.String()
+			}
+		} else if v6 == "" {
+			v6 = addr.IP.String()
+		}
+	}
+	return v4, v6, nil
+}
+
+// scanDualStack scans both families in parallel, splitting the concurrency
+// budget, and reports ports whose state differs between them
+func scanDualStack(host, v4, v6 string, ports []int, timeout, bannerBudget time.Duration, maxConcurrent int) DualStackResult {
+	startTime := time.Now()
+	perFamily := maxConcurrent / 2
+	if perFamily < 1 {
+		perFamily = 1
+	}
+
+	result := DualStackResult{Host: host, Mismatches: []PortMismatch{}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.IPv4 = scanPortsWithRateLimit(v4, ports, timeout, bannerBudget, perFamily)
+		result.IPv4.Family = "ipv4"
+	}()
+	go func() {
+		defer wg.Done()
+		result.IPv6 = scanPortsWithRateLimit(v6, ports, timeout, bannerBudget, perFamily)
+		result.IPv6.Family = "ipv6"
+	}()
+	wg.Wait()
+
+	openV4 := make(map[int]bool)
+	for _, p := range result.IPv4.OpenPorts {
+		openV4[p.Port] = true
+	}
+	openV6 := make(map[int]bool)
+	for _, p := range result.IPv6.OpenPorts {
+		openV6[p.Port] = true
+	}
+
+	for _, port := range ports {
+		if openV4[port] == openV6[port] {
+			continue
+		}
+		mismatch := PortMismatch{Port: port, Service: commonServices[port], OpenOn: "ipv4", ClosedOn: "ipv6"}
+		if openV6[port] {
+			mismatch.OpenOn, mismatch.ClosedOn = "ipv6", "ipv4"
+		}
+		result.Mismatches = append(result.Mismatches, mismatch)
+	}
+
+	result.ScanTime = time.Since(startTime).Milliseconds()
+	return result
+}
+
 // parsePortRange parses inputs like "80,443", "1-1000", or "22,80-90,443"
 func parsePortRange(portsArg string) ([]int, error) {
 	var ports []int
@@ -186,11 +447,25 @@ func parsePortRange(portsArg string) ([]int, error) {
 }
 
 func main() {
+	// -dual-stack may appear anywhere; the rest of the arguments are positional
+	dualStack := false
+	args := os.Args[:1]
+	for _, arg := range os.Args[1:] {
+		if arg == "-dual-stack" || arg == "--dual-stack" {
+			dualStack = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	os.Args = args
+
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: portscan <targetIP> <portRange> [timeout] [maxConcurrent]")
+		fmt.Println("Usage: portscan [-dual-stack] <targetIP> <portRange> [timeout] [maxConcurrent] [bannerBudgetMs]")
 		fmt.Println("Examples:")
 		fmt.Println("  portscan 8.8.8.8 80,443")
 		fmt.Println("  portscan 192.168.1.1 1-1000 5 100")
+		fmt.Println("  portscan 192.168.1.1 22,443 2 100 3000   # longer banner budget; 0 skips banners")
+		fmt.Println("  portscan -dual-stack example.com 80,443   # first IPv4 and first IPv6 address, compared")
 		os.Exit(1)
 	}
 
@@ -211,6 +486,14 @@ func main() {
 		}
 	}
 
+	// Time per open port for identifying the service
+	bannerBudget := time.Second
+	if len(os.Args) >= 6 {
+		if ms, err := strconv.Atoi(os.Args[5]); err == nil && ms >= 0 {
+			bannerBudget = time.Duration(ms) * time.Millisecond
+		}
+	}
+
 	ports, err := parsePortRange(portRangeStr)
 	if err != nil {
 		fmt.Printf("{\"error\": \"%s\"}\n", err.Error())
@@ -227,7 +510,22 @@ func main() {
 		maxConcurrent = 500
 	}
 
-	result := scanPortsWithRateLimit(targetIP, ports, timeout, maxConcurrent)
+	// With -dual-stack, hostnames with both A and AAAA records are scanned
+	// over both families
+	if dualStack && net.ParseIP(targetIP) == nil {
+		v4, v6, err := resolveFamilies(targetIP)
+		if err != nil {
+			fmt.Printf("{\"error\": \"%s\"}\n", err.Error())
+			os.Exit(1)
+		}
+		if v4 != "" && v6 != "" {
+			jsonResult, _ := json.Marshal(scanDualStack(targetIP, v4, v6, ports, timeout, bannerBudget, maxConcurrent))
+			fmt.Println(string(jsonResult))
+			return
+		}
+	}
+
+	result := scanPortsWithRateLimit(targetIP, ports, timeout, bannerBudget, maxConcurrent)
 
 	jsonResult, _ := json.Marshal(result)
 	fmt.Println(string(jsonResult))
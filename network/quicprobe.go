@@ -0,0 +1,1379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The probe speaks just enough QUIC v1 (RFC 9000/9001) and TLS 1.3 to
+// complete a handshake, collect a session ticket, try a resumption with
+// early data and move the connection to a new local port. It uses only
+// TLS_AES_128_GCM_SHA256 and X25519, which every QUIC server must support,
+// and does not verify the server's certificate.
+
+const (
+	quicVersion1    = 0x00000001
+	quicGreaseVer   = 0x1a2a3a4a // Reserved version that forces Version Negotiation
+	quicMinDatagram = 1200
+	quicCIDLength   = 8
+	maxEarlyDataAll = 0xffffffff // The only max_early_data_size QUIC allows
+)
+
+var quicV1Salt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+// Packet number spaces, which are also the TLS encryption levels here
+const (
+	epochInitial = iota
+	epochHandshake
+	epochApplication
+)
+
+// TLS handshake message types
+const (
+	tlsClientHello         = 1
+	tlsServerHello         = 2
+	tlsNewSessionTicket    = 4
+	tlsEncryptedExtensions = 8
+	tlsCertificate         = 11
+	tlsCertificateRequest  = 13
+	tlsCertificateVerify   = 15
+	tlsFinished            = 20
+)
+
+// TLS extension numbers
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extPreSharedKey        = 41
+	extEarlyData           = 42
+	extSupportedVersions   = 43
+	extPSKModes            = 45
+	extKeyShare            = 51
+	extQUICTransportParams = 57
+)
+
+var emptyHash = sha256.Sum256(nil)
+
+// A ServerHello with this random is really a HelloRetryRequest
+var helloRetryRandom = sha256.Sum256([]byte("HelloRetryRequest"))
+
+type Reachability struct {
+	Reachable bool    `json:"reachable"`
+	RTTMs     float64 `json:"rttMs,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type TCPCheck struct {
+	Reachability
+	AltSvc       string `json:"altSvc,omitempty"`
+	AdvertisesH3 bool   `json:"advertisesH3"`
+}
+
+type TransportParams struct {
+	MaxIdleTimeoutMs        uint64 `json:"maxIdleTimeoutMs,omitempty"`
+	MaxUDPPayloadSize       uint64 `json:"maxUdpPayloadSize,omitempty"`
+	InitialMaxData          uint64 `json:"initialMaxData,omitempty"`
+	ActiveConnectionIDLimit uint64 `json:"activeConnectionIdLimit,omitempty"`
+	DisableActiveMigration  bool   `json:"disableActiveMigration"`
+	PreferredAddress        bool   `json:"preferredAddress,omitempty"`
+}
+
+type QUICHandshake struct {
+	Completed          bool             `json:"completed"`
+	HandshakeMs        float64          `json:"handshakeMs,omitempty"`
+	RetryRequired      bool             `json:"retryRequired,omitempty"`
+	ALPN               string           `json:"alpn,omitempty"`
+	CertificateSubject string           `json:"certificateSubject,omitempty"`
+	TransportParams    *TransportParams `json:"transportParams,omitempty"`
+	TicketIssued       bool             `json:"ticketIssued"`
+	Error              string           `json:"error,omitempty"`
+}
+
+type ZeroRTTResult struct {
+	Offered  bool    `json:"offered"` // The ticket allows early data
+	Resumed  bool    `json:"resumed"`
+	Accepted bool    `json:"accepted"` // The server accepted early data on resumption
+	Note     string  `json:"note,omitempty"`
+	ResumeMs float64 `json:"resumeMs,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type MigrationResult struct {
+	Allowed bool   `json:"allowed"` // Server did not send disable_active_migration
+	Tested  bool   `json:"tested"`
+	Works   bool   `json:"works"`
+	Note    string `json:"note,omitempty"`
+}
+
+type QUICReport struct {
+	Target    string           `json:"target"`
+	Address   string           `json:"address"`
+	TCP       TCPCheck         `json:"tcp"`
+	UDP       Reachability     `json:"udp"`
+	Versions  []string         `json:"versions,omitempty"`
+	Handshake *QUICHandshake   `json:"handshake,omitempty"`
+	ZeroRTT   *ZeroRTTResult   `json:"zeroRtt,omitempty"`
+	Migration *MigrationResult `json:"migration,omitempty"`
+}
+
+// byteReader parses length-prefixed wire formats; any overrun latches ok=false
+type byteReader struct {
+	b  []byte
+	ok bool
+}
+
+func newByteReader(b []byte) *byteReader { return &byteReader{b: b, ok: true} }
+
+func (r *byteReader) empty() bool { return len(r.b) == 0 }
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *byteReader) uint(n int) uint64 {
+	var v uint64
+	for _, b := range r.bytes(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (r *byteReader) vec(lengthBytes int) []byte { return r.bytes(int(r.uint(lengthBytes))) }
+
+func (r *byteReader) varint() uint64 {
+	if !r.ok || len(r.b) == 0 {
+		r.ok = false
+		return 0
+	}
+	n := 1 << (r.b[0] >> 6)
+	raw := r.bytes(n)
+	if raw == nil {
+		return 0
+	}
+	v := uint64(raw[0] & 0x3f)
+	for _, b := range raw[1:] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	default:
+		return binary.BigEndian.AppendUint64(b, v|0xc0<<56)
+	}
+}
+
+func varintLen(v uint64) int {
+	return len(appendVarint(nil, v))
+}
+
+// appendVec appends data behind a big-endian length of lengthBytes bytes
+func appendVec(b []byte, lengthBytes int, data []byte) []byte {
+	for i := lengthBytes - 1; i >= 0; i-- {
+		b = append(b, byte(len(data)>>(8*i)))
+	}
+	return append(b, data...)
+}
+
+func appendExtension(b []byte, kind uint16, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, kind)
+	return appendVec(b, 2, data)
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpandLabel(secret []byte, label string, context []byte, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = appendVec(info, 1, []byte("tls13 "+label))
+	info = appendVec(info, 1, context)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+func finishedMAC(secret []byte, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, hkdfExpandLabel(secret, "finished", nil, 32))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// packetKeys protect one direction of one packet number space
+type packetKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+func newPacketKeys(secret []byte) *packetKeys {
+	block, _ := aes.NewCipher(hkdfExpandLabel(secret, "quic key", nil, 16))
+	aead, _ := cipher.NewGCM(block)
+	hp, _ := aes.NewCipher(hkdfExpandLabel(secret, "quic hp", nil, 16))
+	return &packetKeys{aead: aead, iv: hkdfExpandLabel(secret, "quic iv", nil, 12), hp: hp}
+}
+
+func (k *packetKeys) nonce(pn uint64) []byte {
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+func (k *packetKeys) mask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+func initialKeys(dcid []byte) (client, server *packetKeys) {
+	secret := hkdfExtract(quicV1Salt, dcid)
+	return newPacketKeys(hkdfExpandLabel(secret, "client in", nil, 32)), newPacketKeys(hkdfExpandLabel(secret, "server in", nil, 32))
+}
+
+// decodePacketNumber expands a truncated packet number (RFC 9000 A.3)
+func decodePacketNumber(largest int64, truncated uint64, length int) uint64 {
+	expected := uint64(largest + 1)
+	window := uint64(1) << (8 * length)
+	half := window / 2
+	candidate := (expected &^ (window - 1)) | truncated
+	switch {
+	case candidate+half <= expected && candidate < 1<<62-window:
+		return candidate + window
+	case candidate > expected+half && candidate >= window:
+		return candidate - window
+	}
+	return candidate
+}
+
+type pnSpace struct {
+	send, recv  *packetKeys
+	nextPN      uint64
+	largest     int64
+	received    map[uint64]bool
+	ackNeeded   bool
+	outgoing    []byte
+	cryptoSent  uint64
+	cryptoRead  uint64
+	cryptoParts map[uint64][]byte
+	tlsBuf      []byte
+}
+
+func newPNSpace() *pnSpace {
+	return &pnSpace{largest: -1, received: make(map[uint64]bool), cryptoParts: make(map[uint64][]byte)}
+}
+
+// ackFrame acknowledges the contiguous run ending at the largest packet seen
+func (s *pnSpace) ackFrame() []byte {
+	first := uint64(0)
+	for pn := s.largest - 1; pn >= 0 && s.received[uint64(pn)]; pn-- {
+		first++
+	}
+	frame := []byte{0x02}
+	frame = appendVarint(frame, uint64(s.largest))
+	frame = append(frame, 0, 0) // ack delay, range count
+	return appendVarint(frame, first)
+}
+
+func (s *pnSpace) queueCrypto(data []byte) {
+	frame := appendVarint([]byte{0x06}, s.cryptoSent)
+	frame = appendVarint(frame, uint64(len(data)))
+	s.outgoing = append(append(s.outgoing, frame...), data...)
+	s.cryptoSent += uint64(len(data))
+}
+
+type sessionTicket struct {
+	lifetime     uint32
+	ageAdd       uint32
+	ticket       []byte
+	psk          []byte
+	maxEarlyData uint32
+	receivedAt   time.Time
+}
+
+// quicProbeConn is a single client connection driven synchronously: every
+// received datagram is processed and answered with whatever ACKs and
+// handshake data it calls for
+type quicProbeConn struct {
+	conn       *net.UDPConn
+	remote     *net.UDPAddr
+	sni        string
+	alpn       string
+	dcid, scid []byte
+	spareCID   []byte
+	token      []byte
+	spaces     [3]*pnSpace
+	buffered   [][]byte
+	started    time.Time
+
+	key          *ecdh.PrivateKey
+	resume       *sessionTicket
+	clientHello  []byte
+	transcript   []byte
+	earlySecret  []byte
+	hsSecret     []byte
+	clientHS     []byte
+	serverHS     []byte
+	resMaster    []byte
+	certRequest  []byte
+	certSubject  string
+	serverParams *TransportParams
+	selectedALPN string
+
+	anyPacket      bool
+	retried        bool
+	resumed        bool
+	earlyAccepted  bool
+	complete       bool
+	handshakeDone  bool
+	completedAfter time.Duration
+	ticket         *sessionTicket
+	newCIDs        [][]byte
+	pathChallenges [][]byte
+	closeErr       error
+	fatal          error
+}
+
+func newQUICProbeConn(remote *net.UDPAddr, sni, alpn string, resume *sessionTicket) (*quicProbeConn, error) {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &quicProbeConn{
+		conn:     conn,
+		remote:   remote,
+		sni:      sni,
+		alpn:     alpn,
+		dcid:     randomBytes(quicCIDLength),
+		scid:     randomBytes(quicCIDLength),
+		spareCID: randomBytes(quicCIDLength),
+		key:      key,
+		resume:   resume,
+	}
+	for i := range c.spaces {
+		c.spaces[i] = newPNSpace()
+	}
+	c.spaces[epochInitial].send, c.spaces[epochInitial].recv = initialKeys(c.dcid)
+	return c, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func (c *quicProbeConn) Close() error {
+	if app := c.spaces[epochApplication]; app.send != nil && c.closeErr == nil {
+		app.outgoing = append(app.outgoing, 0x1c, 0, 0, 0) // CONNECTION_CLOSE, no error
+		c.flush()
+	}
+	return c.conn.Close()
+}
+
+func (c *quicProbeConn) transportParams() []byte {
+	var params []byte
+	param := func(id uint64, value []byte) {
+		params = appendVarint(params, id)
+		params = appendVarint(params, uint64(len(value)))
+		params = append(params, value...)
+	}
+	varintParam := func(id, v uint64) { param(id, appendVarint(nil, v)) }
+
+	varintParam(0x01, 30000) // max_idle_timeout
+	varintParam(0x04, 1<<20) // initial_max_data
+	varintParam(0x05, 1<<16) // initial_max_stream_data_bidi_local
+	varintParam(0x06, 1<<16) // initial_max_stream_data_bidi_remote
+	varintParam(0x07, 1<<16) // initial_max_stream_data_uni
+	varintParam(0x09, 3)     // initial_max_streams_uni, enough for HTTP/3 control streams
+	varintParam(0x0e, 4)     // active_connection_id_limit
+	param(0x0f, c.scid)      // initial_source_connection_id
+	return params
+}
+
+// buildClientHello offers one suite and one group. On resumption it adds
+// early_data and a pre_shared_key whose binder covers the hello itself.
+func (c *quicProbeConn) buildClientHello() []byte {
+	var exts []byte
+	if c.sni != "" && net.ParseIP(c.sni) == nil {
+		name := appendVec([]byte{0}, 2, []byte(c.sni))
+		exts = appendExtension(exts, extServerName, appendVec(nil, 2, name))
+	}
+	exts = appendExtension(exts, extSupportedGroups, []byte{0, 2, 0x00, 0x1d})
+	sigAlgs := []byte{0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03, 0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01, 0x08, 0x07}
+	exts = appendExtension(exts, extSignatureAlgorithms, appendVec(nil, 2, sigAlgs))
+	exts = appendExtension(exts, extALPN, appendVec(nil, 2, appendVec(nil, 1, []byte(c.alpn))))
+	exts = appendExtension(exts, extSupportedVersions, []byte{2, 0x03, 0x04})
+	exts = appendExtension(exts, extPSKModes, []byte{1, 1}) // psk_dhe_ke, so servers issue tickets
+	share := appendVec([]byte{0x00, 0x1d}, 2, c.key.PublicKey().Bytes())
+	exts = appendExtension(exts, extKeyShare, appendVec(nil, 2, share))
+	exts = appendExtension(exts, extQUICTransportParams, c.transportParams())
+
+	psk := make([]byte, 32)
+	if c.resume != nil {
+		psk = c.resume.psk
+		exts = appendExtension(exts, extEarlyData, nil)
+		age := uint32(time.Since(c.resume.receivedAt).Milliseconds()) + c.resume.ageAdd
+		identity := appendVec(nil, 2, c.resume.ticket)
+		identity = binary.BigEndian.AppendUint32(identity, age)
+		offer := appendVec(nil, 2, identity)
+		offer = appendVec(offer, 2, append([]byte{32}, make([]byte, 32)...)) // binder filled below
+		exts = appendExtension(exts, extPreSharedKey, offer)
+	}
+	c.earlySecret = hkdfExtract(make([]byte, 32), psk)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, randomBytes(32)...)
+	body = append(body, 0)                   // legacy_session_id
+	body = append(body, 0, 2, 0x13, 0x01, 1) // TLS_AES_128_GCM_SHA256, null compression
+	body = append(body, 0)
+	body = appendVec(body, 2, exts)
+	hello := appendVec([]byte{tlsClientHello}, 3, body)
+
+	if c.resume != nil {
+		// The binder is a MAC over the hello up to, not including, the binder list
+		binderKey := hkdfExpandLabel(c.earlySecret, "res binder", emptyHash[:], 32)
+		truncated := sha256.Sum256(hello[:len(hello)-35])
+		copy(hello[len(hello)-32:], finishedMAC(binderKey, truncated[:]))
+	}
+	return hello
+}
+
+// longHeader builds an unprotected long header up to the packet number
+func (c *quicProbeConn) longHeader(epoch int, payloadLen int, pn uint64) []byte {
+	kind := byte(0x00)
+	if epoch == epochHandshake {
+		kind = 0x02
+	}
+	header := []byte{0xc0 | kind<<4 | 0x03} // 4-byte packet numbers
+	header = binary.BigEndian.AppendUint32(header, quicVersion1)
+	header = appendVec(header, 1, c.dcid)
+	header = appendVec(header, 1, c.scid)
+	if epoch == epochInitial {
+		header = appendVarint(header, uint64(len(c.token)))
+		header = append(header, c.token...)
+	}
+	length := 4 + payloadLen + 16
+	header = append(header, byte(0x40|length>>8), byte(length))
+	return binary.BigEndian.AppendUint32(header, uint32(pn))
+}
+
+func (c *quicProbeConn) seal(epoch int, header []byte, pnOffset int, frames []byte) []byte {
+	space := c.spaces[epoch]
+	packet := space.send.aead.Seal(header, space.send.nonce(space.nextPN), frames, header)
+	space.nextPN++
+
+	mask := space.send.mask(packet[pnOffset+4 : pnOffset+20])
+	if packet[0]&0x80 != 0 {
+		packet[0] ^= mask[0] & 0x0f
+	} else {
+		packet[0] ^= mask[0] & 0x1f
+	}
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func (c *quicProbeConn) pendingFrames(epoch int) []byte {
+	space := c.spaces[epoch]
+	if space.send == nil || (len(space.outgoing) == 0 && !space.ackNeeded) {
+		return nil
+	}
+	var frames []byte
+	if space.ackNeeded && space.largest >= 0 {
+		frames = space.ackFrame()
+	}
+	frames = append(frames, space.outgoing...)
+	space.outgoing = nil
+	space.ackNeeded = false
+	return frames
+}
+
+// flush sends everything queued as one coalesced datagram. Datagrams that
+// carry an Initial packet are padded to 1200 bytes, as are path probes.
+func (c *quicProbeConn) flush() {
+	c.flushPadded(false)
+}
+
+func (c *quicProbeConn) flushPadded(pad bool) {
+	var handshake, short []byte
+	if frames := c.pendingFrames(epochHandshake); frames != nil {
+		header := c.longHeader(epochHandshake, len(frames), c.spaces[epochHandshake].nextPN)
+		handshake = c.seal(epochHandshake, header, len(header)-4, frames)
+	}
+
+	initialFrames := c.pendingFrames(epochInitial)
+	appFrames := c.pendingFrames(epochApplication)
+	if appFrames != nil {
+		if pad && initialFrames == nil {
+			fill := quicMinDatagram - (1 + len(c.dcid) + 4 + len(appFrames) + 16) - len(handshake)
+			if fill > 0 {
+				appFrames = append(appFrames, make([]byte, fill)...)
+			}
+		}
+		header := append([]byte{0x43}, c.dcid...)
+		header = binary.BigEndian.AppendUint32(header, uint32(c.spaces[epochApplication].nextPN))
+		short = c.seal(epochApplication, header, len(header)-4, appFrames)
+	}
+
+	var initial []byte
+	if initialFrames != nil {
+		overhead := len(c.longHeader(epochInitial, 0, 0)) + 16
+		if fill := quicMinDatagram - overhead - len(initialFrames) - len(handshake) - len(short); fill > 0 {
+			initialFrames = append(initialFrames, make([]byte, fill)...)
+		}
+		header := c.longHeader(epochInitial, len(initialFrames), c.spaces[epochInitial].nextPN)
+		initial = c.seal(epochInitial, header, len(header)-4, initialFrames)
+	}
+
+	datagram := append(append(initial, handshake...), short...)
+	if len(datagram) > 0 {
+		c.conn.Write(datagram)
+	}
+	// A client drops Initial keys once it has sent a Handshake packet
+	if handshake != nil {
+		c.spaces[epochInitial].send, c.spaces[epochInitial].recv = nil, nil
+	}
+}
+
+// handleDatagram opens every packet coalesced into one datagram
+func (c *quicProbeConn) handleDatagram(data []byte) {
+	for len(data) > 0 {
+		if data[0]&0x80 == 0 {
+			c.openPacket(epochApplication, data, 1+quicCIDLength)
+			return
+		}
+
+		r := newByteReader(data)
+		first := byte(r.uint(1))
+		version := uint32(r.uint(4))
+		r.vec(1) // our connection id
+		scid := r.vec(1)
+		if !r.ok {
+			return
+		}
+		if version == 0 {
+			c.fatal = errors.New("server answered with Version Negotiation: QUIC v1 not supported")
+			return
+		}
+		kind := (first >> 4) & 0x03
+		if kind == 0x03 {
+			c.handleRetry(r.b, scid)
+			return
+		}
+		if kind == 0x00 {
+			r.bytes(int(r.varint())) // token
+		}
+		length := r.varint()
+		if !r.ok || uint64(len(r.b)) < length {
+			return
+		}
+		pnOffset := len(data) - len(r.b)
+		end := pnOffset + int(length)
+		packet := data[:end]
+		data = data[end:]
+
+		switch kind {
+		case 0x00:
+			if !c.anyPacket {
+				// The server picks its own connection id in its first Initial
+				c.dcid = append([]byte(nil), scid...)
+			}
+			c.openPacket(epochInitial, packet, pnOffset)
+		case 0x02:
+			c.openPacket(epochHandshake, packet, pnOffset)
+		}
+	}
+}
+
+// handleRetry restarts the handshake with the server's token and new
+// connection id; the retry integrity tag is not checked
+func (c *quicProbeConn) handleRetry(rest []byte, scid []byte) {
+	if c.retried || c.anyPacket || len(rest) < 16 {
+		return
+	}
+	c.retried = true
+	c.token = append([]byte(nil), rest[:len(rest)-16]...)
+	c.dcid = append([]byte(nil), scid...)
+
+	space := c.spaces[epochInitial]
+	space.send, space.recv = initialKeys(c.dcid)
+	space.outgoing = nil
+	space.cryptoSent = 0
+	space.queueCrypto(c.clientHello)
+	c.flush()
+}
+
+func (c *quicProbeConn) openPacket(epoch int, packet []byte, pnOffset int) {
+	space := c.spaces[epoch]
+	if space.recv == nil {
+		// Keys for this level arrive with a message still in flight
+		if epoch != epochInitial && !c.complete {
+			c.buffered = append(c.buffered, append([]byte(nil), packet...))
+		}
+		return
+	}
+	if len(packet) < pnOffset+20 {
+		return
+	}
+
+	mask := space.recv.mask(packet[pnOffset+4 : pnOffset+20])
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	if header[0]&0x80 != 0 {
+		header[0] ^= mask[0] & 0x0f
+	} else {
+		header[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(header[0]&0x03) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	pn := decodePacketNumber(space.largest, truncated, pnLen)
+
+	payload, err := space.recv.aead.Open(nil, space.recv.nonce(pn), packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return
+	}
+	c.anyPacket = true
+	space.received[pn] = true
+	if int64(pn) > space.largest {
+		space.largest = int64(pn)
+	}
+	c.handleFrames(epoch, payload)
+}
+
+func (c *quicProbeConn) handleFrames(epoch int, payload []byte) {
+	space := c.spaces[epoch]
+	r := newByteReader(payload)
+	for !r.empty() && r.ok {
+		kind := r.varint()
+		if kind != 0x00 && kind != 0x02 && kind != 0x03 && kind != 0x1c && kind != 0x1d {
+			space.ackNeeded = true
+		}
+		switch {
+		case kind == 0x00 || kind == 0x01 || kind == 0x1e: // PADDING, PING, HANDSHAKE_DONE
+			if kind == 0x1e {
+				c.handshakeDone = true
+				c.spaces[epochHandshake].send, c.spaces[epochHandshake].recv = nil, nil
+			}
+		case kind == 0x02 || kind == 0x03: // ACK
+			r.varint()
+			r.varint()
+			ranges := r.varint()
+			r.varint()
+			for i := uint64(0); i < ranges && r.ok; i++ {
+				r.varint()
+				r.varint()
+			}
+			if kind == 0x03 {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case kind == 0x04: // RESET_STREAM
+			r.varint()
+			r.varint()
+			r.varint()
+		case kind == 0x05 || kind == 0x11 || kind == 0x15: // STOP_SENDING, MAX_STREAM_DATA, STREAM_DATA_BLOCKED
+			r.varint()
+			r.varint()
+		case kind == 0x06: // CRYPTO
+			offset := r.varint()
+			data := r.bytes(int(r.varint()))
+			if r.ok {
+				c.addCrypto(epoch, offset, data)
+			}
+		case kind == 0x07: // NEW_TOKEN
+			r.bytes(int(r.varint()))
+		case kind >= 0x08 && kind <= 0x0f: // STREAM
+			r.varint()
+			if kind&0x04 != 0 {
+				r.varint()
+			}
+			if kind&0x02 != 0 {
+				r.bytes(int(r.varint()))
+			} else {
+				r.b = nil
+			}
+		case kind == 0x10 || kind == 0x12 || kind == 0x13 || kind == 0x14 || kind == 0x16 || kind == 0x17 || kind == 0x19:
+			r.varint()
+		case kind == 0x18: // NEW_CONNECTION_ID
+			seq := r.varint()
+			r.varint()
+			cid := r.vec(1)
+			r.bytes(16)
+			if r.ok && seq > 0 {
+				c.newCIDs = append(c.newCIDs, append([]byte(nil), cid...))
+			}
+		case kind == 0x1a: // PATH_CHALLENGE
+			data := r.bytes(8)
+			if r.ok {
+				c.pathChallenges = append(c.pathChallenges, append([]byte(nil), data...))
+				space.outgoing = append(append(space.outgoing, 0x1b), data...)
+			}
+		case kind == 0x1b:
+			r.bytes(8)
+		case kind == 0x1c || kind == 0x1d: // CONNECTION_CLOSE
+			code := r.varint()
+			if kind == 0x1c {
+				r.varint()
+			}
+			reason := r.bytes(int(r.varint()))
+			c.closeErr = fmt.Errorf("server closed the connection: error 0x%x %s", code, strings.TrimSpace(string(reason)))
+			return
+		case kind == 0x30:
+			r.b = nil
+		case kind == 0x31:
+			r.bytes(int(r.varint()))
+		default:
+			return
+		}
+	}
+}
+
+// addCrypto reassembles the CRYPTO stream of one level and hands complete
+// handshake messages to the TLS state machine
+func (c *quicProbeConn) addCrypto(epoch int, offset uint64, data []byte) {
+	space := c.spaces[epoch]
+	if offset+uint64(len(data)) <= space.cryptoRead {
+		return
+	}
+	space.cryptoParts[offset] = append([]byte(nil), data...)
+
+	for progressed := true; progressed; {
+		progressed = false
+		for start, part := range space.cryptoParts {
+			end := start + uint64(len(part))
+			if start <= space.cryptoRead && end > space.cryptoRead {
+				space.tlsBuf = append(space.tlsBuf, part[space.cryptoRead-start:]...)
+				space.cryptoRead = end
+				progressed = true
+			}
+			if end <= space.cryptoRead {
+				delete(space.cryptoParts, start)
+			}
+		}
+	}
+
+	for len(space.tlsBuf) >= 4 {
+		length := int(space.tlsBuf[1])<<16 | int(space.tlsBuf[2])<<8 | int(space.tlsBuf[3])
+		if len(space.tlsBuf) < 4+length {
+			return
+		}
+		message := space.tlsBuf[:4+length]
+		space.tlsBuf = space.tlsBuf[4+length:]
+		if err := c.handleTLS(epoch, message); err != nil {
+			c.fatal = err
+			return
+		}
+	}
+}
+
+func (c *quicProbeConn) transcriptHash() []byte {
+	sum := sha256.Sum256(c.transcript)
+	return sum[:]
+}
+
+func (c *quicProbeConn) handleTLS(epoch int, message []byte) error {
+	kind := message[0]
+	body := newByteReader(message[4:])
+
+	switch {
+	case epoch == epochInitial && kind == tlsServerHello:
+		body.bytes(2)
+		random := body.bytes(32)
+		body.vec(1)
+		suite := body.uint(2)
+		body.bytes(1)
+		exts := newByteReader(body.vec(2))
+		if !body.ok {
+			return errors.New("malformed ServerHello")
+		}
+		if bytes.Equal(random, helloRetryRandom[:]) {
+			return errors.New("server sent HelloRetryRequest; X25519 is not acceptable to it")
+		}
+		if suite != 0x1301 {
+			return fmt.Errorf("server chose cipher suite 0x%04x", suite)
+		}
+
+		var serverShare []byte
+		for !exts.empty() && exts.ok {
+			extType := exts.uint(2)
+			data := newByteReader(exts.vec(2))
+			switch extType {
+			case extKeyShare:
+				data.uint(2)
+				serverShare = data.vec(2)
+			case extPreSharedKey:
+				c.resumed = true
+			}
+		}
+		peer, err := ecdh.X25519().NewPublicKey(serverShare)
+		if err != nil {
+			return fmt.Errorf("bad server key share: %v", err)
+		}
+		shared, err := c.key.ECDH(peer)
+		if err != nil {
+			return err
+		}
+
+		c.transcript = append(c.transcript, message...)
+		derived := hkdfExpandLabel(c.earlySecret, "derived", emptyHash[:], 32)
+		c.hsSecret = hkdfExtract(derived, shared)
+		c.clientHS = hkdfExpandLabel(c.hsSecret, "c hs traffic", c.transcriptHash(), 32)
+		c.serverHS = hkdfExpandLabel(c.hsSecret, "s hs traffic", c.transcriptHash(), 32)
+		c.spaces[epochHandshake].send = newPacketKeys(c.clientHS)
+		c.spaces[epochHandshake].recv = newPacketKeys(c.serverHS)
+
+		buffered := c.buffered
+		c.buffered = nil
+		for _, packet := range buffered {
+			c.handleDatagram(packet)
+		}
+
+	case epoch == epochHandshake && kind == tlsEncryptedExtensions:
+		exts := newByteReader(body.vec(2))
+		for !exts.empty() && exts.ok {
+			extType := exts.uint(2)
+			data := exts.vec(2)
+			switch extType {
+			case extALPN:
+				c.selectedALPN = string(newByteReader(newByteReader(data).vec(2)).vec(1))
+			case extQUICTransportParams:
+				c.serverParams = parseTransportParams(data)
+			case extEarlyData:
+				c.earlyAccepted = true
+			}
+		}
+		c.transcript = append(c.transcript, message...)
+
+	case epoch == epochHandshake && kind == tlsCertificateRequest:
+		c.certRequest = body.vec(1)
+		if c.certRequest == nil {
+			c.certRequest = []byte{}
+		}
+		c.transcript = append(c.transcript, message...)
+
+	case epoch == epochHandshake && kind == tlsCertificate:
+		body.vec(1)
+		list := newByteReader(body.vec(3))
+		if leaf := list.vec(3); list.ok {
+			if cert, err := x509.ParseCertificate(leaf); err == nil {
+				c.certSubject = cert.Subject.String()
+			}
+		}
+		c.transcript = append(c.transcript, message...)
+
+	case epoch == epochHandshake && kind == tlsCertificateVerify:
+		c.transcript = append(c.transcript, message...)
+
+	case epoch == epochHandshake && kind == tlsFinished:
+		if !hmac.Equal(message[4:], finishedMAC(c.serverHS, c.transcriptHash())) {
+			return errors.New("server Finished does not verify")
+		}
+		c.transcript = append(c.transcript, message...)
+
+		derived := hkdfExpandLabel(c.hsSecret, "derived", emptyHash[:], 32)
+		master := hkdfExtract(derived, make([]byte, 32))
+		clientAP := hkdfExpandLabel(master, "c ap traffic", c.transcriptHash(), 32)
+		serverAP := hkdfExpandLabel(master, "s ap traffic", c.transcriptHash(), 32)
+
+		var flight []byte
+		if c.certRequest != nil {
+			// No client certificate: an empty list lets the server decide
+			empty := appendVec(appendVec(nil, 1, c.certRequest), 3, nil)
+			certMsg := appendVec([]byte{tlsCertificate}, 3, empty)
+			c.transcript = append(c.transcript, certMsg...)
+			flight = append(flight, certMsg...)
+		}
+		finished := appendVec([]byte{tlsFinished}, 3, finishedMAC(c.clientHS, c.transcriptHash()))
+		c.transcript = append(c.transcript, finished...)
+		flight = append(flight, finished...)
+		c.resMaster = hkdfExpandLabel(master, "res master", c.transcriptHash(), 32)
+
+		c.spaces[epochHandshake].queueCrypto(flight)
+		c.spaces[epochApplication].send = newPacketKeys(clientAP)
+		c.spaces[epochApplication].recv = newPacketKeys(serverAP)
+
+		// Give the server a spare connection id so it can follow a migration
+		newCID := append([]byte{0x18, 1, 0}, appendVec(nil, 1, c.spareCID)...)
+		c.spaces[epochApplication].outgoing = append(newCID, randomBytes(16)...)
+		c.complete = true
+		c.completedAfter = time.Since(c.started)
+
+	case epoch == epochApplication && kind == tlsNewSessionTicket:
+		ticket := &sessionTicket{receivedAt: time.Now()}
+		ticket.lifetime = uint32(body.uint(4))
+		ticket.ageAdd = uint32(body.uint(4))
+		nonce := body.vec(1)
+		ticket.ticket = append([]byte(nil), body.vec(2)...)
+		exts := newByteReader(body.vec(2))
+		for !exts.empty() && exts.ok {
+			extType := exts.uint(2)
+			data := newByteReader(exts.vec(2))
+			if extType == extEarlyData {
+				ticket.maxEarlyData = uint32(data.uint(4))
+			}
+		}
+		if body.ok && c.ticket == nil {
+			ticket.psk = hkdfExpandLabel(c.resMaster, "resumption", nonce, 32)
+			c.ticket = ticket
+		}
+	}
+	return nil
+}
+
+func parseTransportParams(data []byte) *TransportParams {
+	params := &TransportParams{}
+	r := newByteReader(data)
+	for !r.empty() && r.ok {
+		id := r.varint()
+		value := newByteReader(r.bytes(int(r.varint())))
+		switch id {
+		case 0x01:
+			params.MaxIdleTimeoutMs = value.varint()
+		case 0x03:
+			params.MaxUDPPayloadSize = value.varint()
+		case 0x04:
+			params.InitialMaxData = value.varint()
+		case 0x0c:
+			params.DisableActiveMigration = true
+		case 0x0d:
+			params.PreferredAddress = true
+		case 0x0e:
+			params.ActiveConnectionIDLimit = value.varint()
+		}
+	}
+	return params
+}
+
+// readUntil processes datagrams until done reports true or the deadline passes
+func (c *quicProbeConn) readUntil(deadline time.Time, done func() bool) error {
+	buf := make([]byte, 65535)
+	for !done() {
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		c.handleDatagram(buf[:n])
+		c.flush()
+		if c.fatal != nil {
+			return c.fatal
+		}
+		if c.closeErr != nil {
+			return c.closeErr
+		}
+	}
+	return nil
+}
+
+// handshake sends the ClientHello, resending it until the server answers
+func (c *quicProbeConn) handshake(timeout time.Duration) error {
+	c.started = time.Now()
+	c.clientHello = c.buildClientHello()
+	c.transcript = append([]byte(nil), c.clientHello...)
+	c.spaces[epochInitial].queueCrypto(c.clientHello)
+	c.flush()
+
+	deadline := c.started.Add(timeout)
+	resend := time.Now().Add(timeout / 3)
+	for {
+		wait := deadline
+		if !c.anyPacket && resend.Before(deadline) {
+			wait = resend
+		}
+		err := c.readUntil(wait, func() bool { return c.complete })
+		if err == nil {
+			return nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			if !c.anyPacket {
+				return errors.New("no QUIC response")
+			}
+			return errors.New("handshake did not complete in time")
+		}
+		if !c.anyPacket {
+			// Probably lost: send the same hello again as a fresh Initial
+			space := c.spaces[epochInitial]
+			space.cryptoSent = 0
+			space.queueCrypto(c.clientHello)
+			c.flush()
+			resend = time.Now().Add(timeout / 3)
+		}
+	}
+}
+
+// probeVersions sends a long header with a reserved version, which any
+// QUIC server must answer with the list of versions it supports
+func probeVersions(remote *net.UDPAddr, timeout time.Duration) ([]string, Reachability) {
+	result := Reachability{}
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		result.Error = err.Error()
+		return nil, result
+	}
+	defer conn.Close()
+
+	packet := []byte{0xc0}
+	packet = binary.BigEndian.AppendUint32(packet, quicGreaseVer)
+	packet = appendVec(packet, 1, randomBytes(quicCIDLength))
+	packet = appendVec(packet, 1, randomBytes(quicCIDLength))
+	packet = append(packet, make([]byte, quicMinDatagram-len(packet))...)
+
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt < 2; attempt++ {
+		start := time.Now()
+		conn.Write(packet)
+		conn.SetReadDeadline(start.Add(timeout / 2))
+		n, err := conn.Read(buf)
+		if err != nil {
+			result.Error = describeUDPError(err)
+			if strings.Contains(err.Error(), "refused") {
+				return nil, result
+			}
+			continue
+		}
+
+		r := newByteReader(buf[:n])
+		first := r.uint(1)
+		version := r.uint(4)
+		r.vec(1)
+		r.vec(1)
+		if !r.ok || first&0x80 == 0 || version != 0 {
+			result.Error = "unexpected reply to version probe"
+			continue
+		}
+		result = Reachability{Reachable: true, RTTMs: float64(time.Since(start).Microseconds()) / 1000}
+
+		var versions []string
+		for len(r.b) >= 4 {
+			if name := versionName(uint32(r.uint(4))); name != "" {
+				versions = append(versions, name)
+			}
+		}
+		return versions, result
+	}
+	if result.Error == "" || strings.Contains(result.Error, "timeout") {
+		result.Error = "no Version Negotiation reply"
+	}
+	return nil, result
+}
+
+// describeUDPError turns an ICMP port unreachable into something readable
+func describeUDPError(err error) string {
+	if strings.Contains(err.Error(), "refused") {
+		return "UDP port unreachable (ICMP port unreachable received)"
+	}
+	return err.Error()
+}
+
+func versionName(v uint32) string {
+	switch {
+	case v == quicVersion1:
+		return "v1"
+	case v == 0x6b3343cf:
+		return "v2"
+	case v&0x0f0f0f0f == 0x0a0a0a0a:
+		return "" // Greased versions are noise by design
+	case v>>8 == 0xff0000:
+		return fmt.Sprintf("draft-%d", v&0xff)
+	}
+	raw := binary.BigEndian.AppendUint32(nil, v)
+	for _, b := range raw {
+		if b < 0x20 || b > 0x7e {
+			return fmt.Sprintf("0x%08x", v)
+		}
+	}
+	return string(raw) // Google QUIC versions such as Q050
+}
+
+// probeTCP checks TCP reachability and whether HTTPS advertises HTTP/3
+func probeTCP(host string, port int, sni string, timeout time.Duration) TCPCheck {
+	result := TCPCheck{}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	conn.Close()
+	result.Reachable = true
+	result.RTTMs = float64(time.Since(start).Microseconds()) / 1000
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: sni, InsecureSkipVerify: true},
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Head("https://" + net.JoinHostPort(sni, strconv.Itoa(port)) + "/")
+	if err != nil {
+		result.Error = fmt.Sprintf("HTTPS over TCP: %v", err)
+		return result
+	}
+	resp.Body.Close()
+	result.AltSvc = resp.Header.Get("Alt-Svc")
+	result.AdvertisesH3 = strings.Contains(result.AltSvc, "h3=") || strings.Contains(result.AltSvc, "h3-")
+	return result
+}
+
+// testMigration moves the connection to a new local port using a spare
+// connection id. Any authenticated reply on the new path means the server
+// followed; a PATH_CHALLENGE shows it validated the path first.
+func (c *quicProbeConn) testMigration(timeout time.Duration) *MigrationResult {
+	result := &MigrationResult{Allowed: c.serverParams == nil || !c.serverParams.DisableActiveMigration}
+	if !result.Allowed {
+		result.Note = "server sent disable_active_migration"
+		return result
+	}
+	if len(c.newCIDs) == 0 {
+		result.Note = "server issued no spare connection ids, so a client cannot migrate"
+		return result
+	}
+
+	conn, err := net.DialUDP("udp", nil, c.remote)
+	if err != nil {
+		result.Note = err.Error()
+		return result
+	}
+	result.Tested = true
+	c.conn.Close()
+	c.conn = conn
+	c.dcid = c.newCIDs[0]
+	c.pathChallenges = nil
+
+	before := c.spaces[epochApplication].largest
+	c.spaces[epochApplication].outgoing = append(c.spaces[epochApplication].outgoing, 0x01) // PING
+	c.flushPadded(true)
+
+	buf := make([]byte, 65535)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		c.handleDatagram(buf[:n])
+		// A PATH_RESPONSE must also be padded to validate the path
+		c.flushPadded(len(c.pathChallenges) > 0)
+		if c.spaces[epochApplication].largest > before {
+			result.Works = true
+			break
+		}
+	}
+
+	switch {
+	case result.Works && len(c.pathChallenges) > 0:
+		result.Note = "server validated the new path and continued the connection"
+	case result.Works:
+		result.Note = "server continued the connection on the new path"
+	default:
+		result.Note = "no reply on the new path"
+	}
+	return result
+}
+
+func probeQUIC(host string, port int, sni, alpn string, timeout time.Duration, try0RTT, tryMigration bool) QUICReport {
+	report := QUICReport{Target: net.JoinHostPort(host, strconv.Itoa(port))}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		report.UDP.Error = fmt.Sprintf("resolve %s: %v", host, err)
+		return report
+	}
+	remote := &net.UDPAddr{IP: ips[0], Port: port}
+	report.Address = remote.String()
+
+	report.TCP = probeTCP(ips[0].String(), port, sni, timeout)
+	report.Versions, report.UDP = probeVersions(remote, timeout)
+
+	handshake := &QUICHandshake{}
+	report.Handshake = handshake
+	conn, err := newQUICProbeConn(remote, sni, alpn, nil)
+	if err != nil {
+		handshake.Error = err.Error()
+		return report
+	}
+	defer conn.Close()
+
+	err = conn.handshake(timeout)
+	handshake.RetryRequired = conn.retried
+	if conn.anyPacket && !report.UDP.Reachable {
+		report.UDP = Reachability{Reachable: true}
+	}
+	if err != nil {
+		handshake.Error = describeUDPError(err)
+		return report
+	}
+	handshake.Completed = true
+	handshake.HandshakeMs = float64(conn.completedAfter.Microseconds()) / 1000
+	handshake.ALPN = conn.selectedALPN
+	handshake.CertificateSubject = conn.certSubject
+	handshake.TransportParams = conn.serverParams
+
+	// Tickets and HANDSHAKE_DONE follow the handshake in 1-RTT packets
+	conn.readUntil(time.Now().Add(timeout/2), func() bool { return conn.handshakeDone && conn.ticket != nil })
+	handshake.TicketIssued = conn.ticket != nil
+
+	if tryMigration {
+		report.Migration = conn.testMigration(timeout / 2)
+	}
+	ticket := conn.ticket
+
+	if try0RTT {
+		zeroRTT := &ZeroRTTResult{}
+		report.ZeroRTT = zeroRTT
+		switch {
+		case ticket == nil:
+			zeroRTT.Note = "no session ticket, so no resumption or 0-RTT"
+		case ticket.maxEarlyData != maxEarlyDataAll:
+			zeroRTT.Note = "ticket does not allow early data"
+		default:
+			zeroRTT.Offered = true
+			resumed, err := newQUICProbeConn(remote, sni, alpn, ticket)
+			if err != nil {
+				zeroRTT.Error = err.Error()
+				break
+			}
+			err = resumed.handshake(timeout)
+			resumed.Close()
+			if err != nil {
+				zeroRTT.Error = err.Error()
+				break
+			}
+			zeroRTT.Resumed = resumed.resumed
+			zeroRTT.Accepted = resumed.earlyAccepted
+			zeroRTT.ResumeMs = float64(resumed.completedAfter.Microseconds()) / 1000
+			// Only the acceptance is tested; no application data is sent early
+			if !zeroRTT.Accepted {
+				zeroRTT.Note = "server resumed but rejected early data"
+				if !zeroRTT.Resumed {
+					zeroRTT.Note = "server declined the ticket and ran a full handshake"
+				}
+			}
+		}
+	}
+	return report
+}
+
+// parseQUICTarget accepts host, host:port or an https URL
+func parseQUICTarget(target string) (string, int, error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", 0, err
+		}
+		port := 443
+		if u.Port() != "" {
+			port, _ = strconv.Atoi(u.Port())
+		}
+		return u.Hostname(), port, nil
+	}
+	if host, portStr, err := net.SplitHostPort(target); err == nil {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port %q", portStr)
+		}
+		return host, port, nil
+	}
+	return strings.Trim(target, "[]"), 443, nil
+}
+
+func main() {
+	timeout := flag.Duration("timeout", 5*time.Second, "Timeout for each stage")
+	sni := flag.String("sni", "", "Server name to send (defaults to the target host)")
+	alpn := flag.String("alpn", "h3", "ALPN protocol to offer")
+	zeroRTT := flag.Bool("0rtt", true, "Resume with the session ticket and check whether early data is accepted")
+	migration := flag.Bool("migration", true, "Move the connection to a new local port and check the server follows")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 1 {
+		fmt.Println("Usage: quicprobe [options] <host[:port]|https://url>")
+		fmt.Println("Example: quicprobe www.example.com")
+		fmt.Println("         quicprobe -sni edge.example.com 203.0.113.10:443")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	host, port, err := parseQUICTarget(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *sni == "" {
+		*sni = host
+	}
+
+	report := probeQUIC(host, port, *sni, *alpn, *timeout, *zeroRTT, *migration)
+	json.NewEncoder(os.Stdout).Encode(report)
+	if report.Handshake == nil || !report.Handshake.Completed {
+		os.Exit(1)
+	}
+}
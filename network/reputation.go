@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSBLListing is the answer of one DNS blocklist for one address
+type DNSBLListing struct {
+	Zone    string   `json:"zone"`
+	Listed  bool     `json:"listed"`
+	Codes   []string `json:"codes,omitempty"`
+	Lists   []string `json:"lists,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	QueryMs int64    `json:"queryMs"`
+}
+
+// FeedMatch is a reputation feed entry covering an address
+type FeedMatch struct {
+	Feed  string `json:"feed"`
+	Entry string `json:"entry"`
+}
+
+type IPReputation struct {
+	Address string         `json:"address"`
+	Source  string         `json:"source,omitempty"` // hostname or egress when not given directly
+	DNSBL   []DNSBLListing `json:"dnsbl"`
+	Feeds   []FeedMatch    `json:"feeds,omitempty"`
+	Listed  bool           `json:"listed"`
+}
+
+type FeedStatus struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Entries   int    `json:"entries"`
+	FetchedAt string `json:"fetchedAt,omitempty"`
+	Cached    bool   `json:"cached"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ReputationReport struct {
+	Results []IPReputation `json:"results"`
+	Feeds   []FeedStatus   `json:"feeds"`
+	Listed  []string       `json:"listed"`
+	Errors  int            `json:"errors"`
+	Healthy bool           `json:"healthy"`
+}
+
+var defaultDNSBLs = []string{"zen.spamhaus.org"}
+
+// abuse.ch publishes plain-text IP lists; they ask for at most one
+// download every few minutes, so feeds are cached between runs
+var defaultFeeds = []string{
+	"feodo=https://feodotracker.abuse.ch/downloads/ipblocklist.txt",
+	"sslbl=https://sslbl.abuse.ch/blacklist/sslipblacklist.txt",
+}
+
+// Spamhaus return codes; see https://www.spamhaus.org/faqs/dnsbl-usage/
+var spamhausCodes = map[string]string{
+	"127.0.0.2":  "SBL",
+	"127.0.0.3":  "SBL CSS",
+	"127.0.0.4":  "XBL",
+	"127.0.0.5":  "XBL",
+	"127.0.0.6":  "XBL",
+	"127.0.0.7":  "XBL",
+	"127.0.0.9":  "DROP",
+	"127.0.0.10": "PBL (ISP)",
+	"127.0.0.11": "PBL (Spamhaus)",
+}
+
+// Answers in 127.255.255.0/24 are errors from the list operator, not
+// listings. Spamhaus refuses queries relayed through public resolvers.
+var dnsblErrorCodes = map[string]string{
+	"127.255.255.252": "typing error in DNSBL name",
+	"127.255.255.254": "query refused: public/open resolver, use your own resolver or a DQS key",
+	"127.255.255.255": "query refused: excessive number of queries",
+}
+
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// dnsblName builds the query name for addr under zone: reversed octets for
+// IPv4, reversed nibbles for IPv6
+func dnsblName(addr net.IP, zone string) string {
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	const hexDigits = "0123456789abcdef"
+	v6 := addr.To16()
+	var b strings.Builder
+	for i := len(v6) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[v6[i]&0x0F])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[v6[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString(zone)
+	return b.String()
+}
+
+func newResolver(server string, timeout time.Duration) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// checkDNSBL looks addr up in one blocklist zone
+func checkDNSBL(resolver *net.Resolver, addr net.IP, zone string, timeout time.Duration) DNSBLListing {
+	listing := DNSBLListing{Zone: zone}
+	name := dnsblName(addr, zone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	answers, err := resolver.LookupHost(ctx, name)
+	listing.QueryMs = time.Since(start).Milliseconds()
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return listing // NXDOMAIN: not listed
+		}
+		listing.Error = err.Error()
+		return listing
+	}
+
+	sort.Strings(answers)
+	lists := make(map[string]bool)
+	for _, answer := range answers {
+		if reason, ok := dnsblErrorCodes[answer]; ok {
+			listing.Error = fmt.Sprintf("%s (%s)", reason, answer)
+			return listing
+		}
+		listing.Codes = append(listing.Codes, answer)
+		if strings.Contains(zone, "spamhaus") {
+			if list, ok := spamhausCodes[answer]; ok && !lists[list] {
+				lists[list] = true
+				listing.Lists = append(listing.Lists, list)
+			}
+		}
+	}
+	listing.Listed = len(listing.Codes) > 0
+
+	// Most lists publish a human-readable reason as TXT next to the A record
+	if listing.Listed {
+		if txt, err := resolver.LookupTXT(ctx, name); err == nil && len(txt) > 0 {
+			listing.Reason = strings.Join(txt, "; ")
+		}
+	}
+	return listing
+}
+
+// feed is a downloaded reputation list of addresses and prefixes
+type feed struct {
+	name     string
+	url      string
+	addrs    map[string]bool
+	prefixes []*net.IPNet
+}
+
+func (f *feed) match(addr net.IP) (string, bool) {
+	if f.addrs[addr.String()] {
+		return addr.String(), true
+	}
+	for _, prefix := range f.prefixes {
+		if prefix.Contains(addr) {
+			return prefix.String(), true
+		}
+	}
+	return "", false
+}
+
+// parseFeed accepts one address or prefix per line; comments and extra
+// columns (CSV exports, "ip port" pairs) are ignored
+func parseFeed(r io.Reader, f *feed) int {
+	f.addrs = make(map[string]bool)
+	entries := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		field := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '"'
+		})
+		if len(field) == 0 {
+			continue
+		}
+		if _, prefix, err := net.ParseCIDR(field[0]); err == nil {
+			f.prefixes = append(f.prefixes, prefix)
+			entries++
+		} else if ip := net.ParseIP(field[0]); ip != nil {
+			f.addrs[ip.String()] = true
+			entries++
+		}
+	}
+	return entries
+}
+
+func feedCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "cloud-connect", "feeds")
+}
+
+// loadFeed reads a feed from a local file, or downloads it unless a cached
+// copy is younger than maxAge
+func loadFeed(spec string, maxAge time.Duration, client *http.Client) (*feed, FeedStatus) {
+	name, location, ok := strings.Cut(spec, "=")
+	if !ok {
+		location = spec
+		name = strings.TrimSuffix(filepath.Base(spec), filepath.Ext(spec))
+	}
+	f := &feed{name: name, url: location}
+	status := FeedStatus{Name: name, URL: location}
+
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		file, err := os.Open(location)
+		if err != nil {
+			status.Error = err.Error()
+			return nil, status
+		}
+		defer file.Close()
+		status.Entries = parseFeed(file, f)
+		return f, status
+	}
+
+	cache := filepath.Join(feedCacheDir(), name+".txt")
+	if info, err := os.Stat(cache); err == nil && time.Since(info.ModTime()) < maxAge {
+		if file, err := os.Open(cache); err == nil {
+			defer file.Close()
+			status.Entries = parseFeed(file, f)
+			status.Cached = true
+			status.FetchedAt = info.ModTime().UTC().Format(time.RFC3339)
+			return f, status
+		}
+	}
+
+	body, err := fetchFeed(client, location)
+	if err != nil {
+		// A stale copy is better than no feed at all
+		if file, openErr := os.Open(cache); openErr == nil {
+			defer file.Close()
+			info, _ := file.Stat()
+			status.Entries = parseFeed(file, f)
+			status.Cached = true
+			status.FetchedAt = info.ModTime().UTC().Format(time.RFC3339)
+			status.Error = fmt.Sprintf("download failed, using stale cache: %v", err)
+			return f, status
+		}
+		status.Error = err.Error()
+		return nil, status
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err == nil {
+		tmp := cache + ".tmp"
+		if os.WriteFile(tmp, body, 0644) == nil {
+			os.Rename(tmp, cache)
+		}
+	}
+	status.Entries = parseFeed(strings.NewReader(string(body)), f)
+	status.FetchedAt = time.Now().UTC().Format(time.RFC3339)
+	return f, status
+}
+
+func fetchFeed(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d from %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
+
+// egressAddress asks an echo service which address our traffic leaves from
+func egressAddress(client *http.Client, url string) (net.IP, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s did not return an address", url)
+	}
+	return ip, nil
+}
+
+type target struct {
+	addr   net.IP
+	source string
+}
+
+// expandTargets turns addresses, prefixes and hostnames into addresses
+func expandTargets(args []string, maxHosts int, resolver *net.Resolver, timeout time.Duration) ([]target, error) {
+	var targets []target
+	seen := make(map[string]bool)
+	add := func(ip net.IP, source string) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			targets = append(targets, target{addr: ip, source: source})
+		}
+	}
+
+	for _, arg := range args {
+		if ip := net.ParseIP(arg); ip != nil {
+			add(ip, "")
+			continue
+		}
+		if _, prefix, err := net.ParseCIDR(arg); err == nil {
+			ones, bits := prefix.Mask.Size()
+			if bits-ones > 20 || 1<<(bits-ones) > maxHosts {
+				return nil, fmt.Errorf("%s has more than %d addresses (raise -max-hosts)", arg, maxHosts)
+			}
+			ip := append(net.IP(nil), prefix.IP...)
+			for prefix.Contains(ip) {
+				add(append(net.IP(nil), ip...), arg)
+				for i := len(ip) - 1; i >= 0; i-- {
+					ip[i]++
+					if ip[i] != 0 {
+						break
+					}
+				}
+			}
+			continue
+		}
+
+		// Hostnames are checked at every address, e.g. all MX addresses of a relay
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := resolver.LookupHost(ctx, arg)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %v", arg, err)
+		}
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				add(ip, arg)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Carrier-grade NAT space (RFC 6598) is as unlisted as RFC 1918 space
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isBogon(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+func main() {
+	var dnsbls, feeds stringList
+	flag.Var(&dnsbls, "dnsbl", "DNS blocklist zone to query (repeatable; default zen.spamhaus.org)")
+	flag.Var(&feeds, "feed", "Reputation feed as name=url or a local file (repeatable; default abuse.ch Feodo Tracker and SSLBL)")
+	noFeeds := flag.Bool("no-feeds", false, "Skip reputation feeds, query DNSBLs only")
+	resolverArg := flag.String("resolver", "", "DNS server for blocklist queries (default: system resolver)")
+	egress := flag.Bool("egress", false, "Also check this host's public egress address")
+	egressURL := flag.String("egress-url", "https://checkip.amazonaws.com", "Service that echoes the caller's address, used by -egress")
+	feedMaxAge := flag.Duration("feed-max-age", time.Hour, "Re-download feeds older than this")
+	maxHosts := flag.Int("max-hosts", 256, "Largest prefix (in addresses) that is expanded")
+	timeout := flag.Duration("timeout", 5*time.Second, "Timeout per DNS query or feed download")
+	concurrency := flag.Int("concurrency", 20, "Concurrent blocklist queries")
+	flag.Parse()
+
+	if flag.NArg() == 0 && !*egress {
+		fmt.Println("Usage: reputation [options] <ip|cidr|hostname>...")
+		fmt.Println("Example: reputation 203.0.113.25 mail.example.com")
+		fmt.Println("         reputation -egress -no-feeds")
+		fmt.Println("         reputation -dnsbl <key>.zen.dq.spamhaus.net -feed blocked=./blocked.txt 198.51.100.0/28")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if len(dnsbls) == 0 {
+		dnsbls = defaultDNSBLs
+	}
+	if len(feeds) == 0 && !*noFeeds {
+		feeds = defaultFeeds
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	resolver := newResolver(*resolverArg, *timeout)
+	client := &http.Client{Timeout: 4 * *timeout}
+
+	targets, err := expandTargets(flag.Args(), *maxHosts, resolver, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *egress {
+		ip, err := egressAddress(client, *egressURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: finding egress address: %v\n", err)
+			os.Exit(1)
+		}
+		targets = append(targets, target{addr: ip, source: "egress"})
+	}
+
+	report := ReputationReport{Feeds: []FeedStatus{}, Listed: []string{}}
+	var loaded []*feed
+	if !*noFeeds {
+		for _, spec := range feeds {
+			f, status := loadFeed(spec, *feedMaxAge, client)
+			report.Feeds = append(report.Feeds, status)
+			if status.Error != "" {
+				report.Errors++
+			}
+			if f != nil {
+				loaded = append(loaded, f)
+			}
+		}
+	}
+
+	report.Results = make([]IPReputation, len(targets))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		result := &report.Results[i]
+		result.Address = t.addr.String()
+		result.Source = t.source
+		result.DNSBL = make([]DNSBLListing, len(dnsbls))
+
+		// Private addresses are never listed; querying them only leaks internal ranges
+		if isBogon(t.addr) {
+			for j, zone := range dnsbls {
+				result.DNSBL[j] = DNSBLListing{Zone: zone, Error: "not a public address, not queried"}
+			}
+		} else {
+			for j, zone := range dnsbls {
+				wg.Add(1)
+				go func(listing *DNSBLListing, addr net.IP, zone string) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+					*listing = checkDNSBL(resolver, addr, zone, *timeout)
+				}(&result.DNSBL[j], t.addr, zone)
+			}
+		}
+
+		for _, f := range loaded {
+			if entry, ok := f.match(t.addr); ok {
+				result.Feeds = append(result.Feeds, FeedMatch{Feed: f.name, Entry: entry})
+			}
+		}
+	}
+	wg.Wait()
+
+	for i := range report.Results {
+		result := &report.Results[i]
+		var reasons []string
+		for _, listing := range result.DNSBL {
+			if listing.Listed {
+				reasons = append(reasons, listing.Zone)
+			} else if listing.Error != "" && !isBogon(net.ParseIP(result.Address)) {
+				report.Errors++
+			}
+		}
+		for _, match := range result.Feeds {
+			reasons = append(reasons, match.Feed)
+		}
+		if len(reasons) > 0 {
+			result.Listed = true
+			report.Listed = append(report.Listed, fmt.Sprintf("%s (%s)", result.Address, strings.Join(reasons, ", ")))
+		}
+	}
+	report.Healthy = len(report.Listed) == 0
+
+	json.NewEncoder(os.Stdout).Encode(report)
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listener is one listening socket on this host and what the vantage
+// could reach of it
+type Listener struct {
+	Protocol   string  `json:"protocol"`
+	Family     string  `json:"family"`
+	Address    string  `json:"address"`
+	Port       int     `json:"port"`
+	Scope      string  `json:"scope"` // loopback, all or address
+	PID        int     `json:"pid,omitempty"`
+	Process    string  `json:"process,omitempty"`
+	Intended   bool    `json:"intended"`
+	Exposure   string  `json:"exposure"` // local-only, reachable, blocked, untested or untestable
+	ProbeState string  `json:"probeState,omitempty"`
+	RTTMs      float64 `json:"rttMs,omitempty"`
+	inode      string
+}
+
+type SelfCheckSummary struct {
+	Listeners   int `json:"listeners"`
+	LocalOnly   int `json:"localOnly"`
+	NonLoopback int `json:"nonLoopback"`
+	Reachable   int `json:"reachable"`
+	Unintended  int `json:"unintended"`
+}
+
+type SelfCheckReport struct {
+	Hostname        string           `json:"hostname"`
+	Platform        string           `json:"platform"`
+	Vantage         string           `json:"vantage,omitempty"`
+	ObservedAddress string           `json:"observedAddress,omitempty"`
+	Listeners       []Listener       `json:"listeners"`
+	Summary         SelfCheckSummary `json:"summary"`
+	Unintended      []string         `json:"unintended"`
+	AtRisk          []string         `json:"atRisk,omitempty"`
+	Notes           []string         `json:"notes,omitempty"`
+	Healthy         bool             `json:"healthy"`
+}
+
+// selfcheckRequest is the agent protocol envelope (see agent.go) for the
+// selfcheck op, which asks an agent to connect back to the requester
+type selfcheckRequest struct {
+	Op        string `json:"op"`
+	Token     string `json:"token,omitempty"`
+	Ports     []int  `json:"ports"`
+	TimeoutMs int    `json:"timeoutMs"`
+}
+
+// Shared agent token, required by agents that have one set
+const agentTokenEnv = "CLOUD_CONNECT_AGENT_TOKEN"
+
+type PortProbe struct {
+	Port  int     `json:"port"`
+	State string  `json:"state"` // open, closed or filtered
+	RTTMs float64 `json:"rttMs,omitempty"`
+}
+
+type selfcheckResponse struct {
+	Observed string      `json:"observed"`
+	Probes   []PortProbe `json:"probes"`
+	Error    string      `json:"error,omitempty"`
+}
+
+const (
+	maxAgentPorts    = 4096
+	agentConcurrency = 100
+)
+
+func (l Listener) String() string {
+	s := fmt.Sprintf("%s %s", l.Protocol, net.JoinHostPort(l.Address, strconv.Itoa(l.Port)))
+	if l.Process != "" {
+		s += fmt.Sprintf(" (%s)", l.Process)
+	}
+	return s
+}
+
+func classifyScope(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsUnspecified():
+		return "all"
+	}
+	return "address"
+}
+
+func newListener(protocol string, ip net.IP, port int) Listener {
+	family := "IPv4"
+	if ip.To4() == nil {
+		family = "IPv6"
+	}
+	return Listener{Protocol: protocol, Family: family, Address: ip.String(), Port: port, Scope: classifyScope(ip)}
+}
+
+// decodeProcAddress converts /proc/net notation ("0100007F:1F90") into an
+// address and port. Addresses are 32-bit words in host (little-endian) order.
+func decodeProcAddress(s string) (net.IP, int, error) {
+	addrHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed port %q", portHex)
+	}
+	return net.IP(raw), int(port), nil
+}
+
+// readProcNet lists listening TCP sockets, or bound unconnected UDP sockets
+func readProcNet(path, protocol string) ([]Listener, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var listeners []Listener
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		// 0A is TCP_LISTEN; UDP sockets sit in 07 (TCP_CLOSE) when unconnected
+		if protocol == "tcp" && fields[3] != "0A" {
+			continue
+		}
+		if protocol == "udp" && (fields[3] != "07" || !strings.HasSuffix(fields[2], ":0000")) {
+			continue
+		}
+		ip, port, err := decodeProcAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		l := newListener(protocol, ip, port)
+		l.inode = fields[9]
+		listeners = append(listeners, l)
+	}
+	return listeners, scanner.Err()
+}
+
+// socketOwners maps socket inodes to processes by walking /proc/*/fd.
+// Without root only our own processes are visible.
+func socketOwners() map[string][2]string {
+	owners := make(map[string][2]string)
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+		if _, seen := owners[inode]; seen {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		comm, _ := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+		owners[inode] = [2]string{pid, strings.TrimSpace(string(comm))}
+	}
+	return owners
+}
+
+func linuxListeners(includeUDP bool) ([]Listener, error) {
+	sources := []struct{ path, protocol string }{
+		{"/proc/net/tcp", "tcp"}, {"/proc/net/tcp6", "tcp"},
+	}
+	if includeUDP {
+		sources = append(sources, struct{ path, protocol string }{"/proc/net/udp", "udp"}, struct{ path, protocol string }{"/proc/net/udp6", "udp"})
+	}
+
+	var listeners []Listener
+	for _, source := range sources {
+		found, err := readProcNet(source.path, source.protocol)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // No IPv6 in this kernel
+			}
+			return nil, err
+		}
+		listeners = append(listeners, found...)
+	}
+
+	owners := socketOwners()
+	for i := range listeners {
+		if owner, ok := owners[listeners[i].inode]; ok {
+			listeners[i].PID, _ = strconv.Atoi(owner[0])
+			listeners[i].Process = owner[1]
+		}
+	}
+	return listeners, nil
+}
+
+// splitNetstatAddress handles "127.0.0.1.631", "*.22" (macOS) and
+// "0.0.0.0:135", "[::]:445", "*:*" (Windows)
+func splitNetstatAddress(s, family string) (net.IP, int, bool) {
+	sep := strings.LastIndexAny(s, ".:")
+	if sep < 0 {
+		return nil, 0, false
+	}
+	host, portText := strings.Trim(s[:sep], "[]"), s[sep+1:]
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, 0, false
+	}
+	host, _, _ = strings.Cut(host, "%")
+	if host == "*" {
+		if family == "6" {
+			return net.IPv6unspecified, port, true
+		}
+		return net.IPv4zero, port, true
+	}
+	ip := net.ParseIP(host)
+	return ip, port, ip != nil
+}
+
+func netstatListeners(includeUDP bool) ([]Listener, error) {
+	var output []byte
+	var err error
+	if runtime.GOOS == "windows" {
+		output, err = exec.Command("netstat", "-ano").Output()
+	} else {
+		output, err = exec.Command("netstat", "-an").Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("netstat: %v", err)
+	}
+
+	var listeners []Listener
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		proto := strings.ToLower(fields[0])
+		isUDP := strings.HasPrefix(proto, "udp")
+		if !strings.HasPrefix(proto, "tcp") && !isUDP || (isUDP && !includeUDP) {
+			continue
+		}
+
+		var local string
+		pid := 0
+		if runtime.GOOS == "windows" {
+			// TCP 0.0.0.0:135 0.0.0.0:0 LISTENING 1032 / UDP 0.0.0.0:5353 *:* 4840
+			local = fields[1]
+			if !isUDP && (len(fields) < 5 || fields[3] != "LISTENING") {
+				continue
+			}
+			pid, _ = strconv.Atoi(fields[len(fields)-1])
+		} else {
+			// tcp4 0 0 127.0.0.1.631 *.* LISTEN / udp4 0 0 *.5353 *.*
+			if len(fields) < 5 || (!isUDP && fields[len(fields)-1] != "LISTEN") || (isUDP && fields[4] != "*.*") {
+				continue
+			}
+			local = fields[3]
+		}
+
+		family := "4"
+		if strings.HasSuffix(proto, "6") || strings.Contains(local, "[") {
+			family = "6"
+		}
+		ip, port, ok := splitNetstatAddress(local, family)
+		if !ok {
+			continue
+		}
+		protocol := "tcp"
+		if isUDP {
+			protocol = "udp"
+		}
+		l := newListener(protocol, ip, port)
+		l.PID = pid
+		listeners = append(listeners, l)
+	}
+
+	if runtime.GOOS == "windows" {
+		names := windowsProcessNames()
+		for i := range listeners {
+			listeners[i].Process = names[listeners[i].PID]
+		}
+	}
+	return listeners, nil
+}
+
+func windowsProcessNames() map[int]string {
+	names := make(map[int]string)
+	output, err := exec.Command("tasklist", "/FO", "CSV", "/NH").Output()
+	if err != nil {
+		return names
+	}
+	// "svchost.exe","1032","Services","0","12,345 K"
+	records, _ := csv.NewReader(strings.NewReader(string(output))).ReadAll()
+	for _, record := range records {
+		if len(record) >= 2 {
+			if pid, err := strconv.Atoi(record[1]); err == nil {
+				names[pid] = record[0]
+			}
+		}
+	}
+	return names
+}
+
+func localListeners(includeUDP bool) ([]Listener, error) {
+	var listeners []Listener
+	var err error
+	if runtime.GOOS == "linux" {
+		listeners, err = linuxListeners(includeUDP)
+	} else {
+		listeners, err = netstatListeners(includeUDP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// SO_REUSEPORT and forked workers list the same socket several times
+	seen := make(map[string]bool)
+	unique := listeners[:0]
+	for _, l := range listeners {
+		key := l.String()
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, l)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].Protocol != unique[j].Protocol {
+			return unique[i].Protocol > unique[j].Protocol // tcp first
+		}
+		if unique[i].Port != unique[j].Port {
+			return unique[i].Port < unique[j].Port
+		}
+		return unique[i].Address < unique[j].Address
+	})
+	return unique, nil
+}
+
+func probePort(address string, port int, timeout time.Duration) PortProbe {
+	probe := PortProbe{Port: port}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(port)), timeout)
+	if err == nil {
+		conn.Close()
+		probe.State = "open"
+		probe.RTTMs = float64(time.Since(start).Microseconds()) / 1000
+		return probe
+	}
+	if strings.Contains(err.Error(), "refused") {
+		probe.State = "closed"
+	} else {
+		probe.State = "filtered"
+	}
+	return probe
+}
+
+// askAgent has an agent outside this host connect back to every port
+func askAgent(agent string, ports []int, timeout time.Duration) (selfcheckResponse, error) {
+	var response selfcheckResponse
+	conn, err := net.DialTimeout("tcp", agent, timeout)
+	if err != nil {
+		return response, fmt.Errorf("agent unreachable: %v", err)
+	}
+	defer conn.Close()
+
+	batches := (len(ports) + agentConcurrency - 1) / agentConcurrency
+	conn.SetDeadline(time.Now().Add(time.Duration(batches+1)*timeout + 10*time.Second))
+	if err := json.NewEncoder(conn).Encode(selfcheckRequest{Op: "selfcheck", Token: os.Getenv(agentTokenEnv), Ports: ports, TimeoutMs: int(timeout.Milliseconds())}); err != nil {
+		return response, err
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, fmt.Errorf("agent: %v", err)
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("agent: %s", response.Error)
+	}
+	return response, nil
+}
+
+// runAgent probes ports on whoever connects. Like the MTU agent it only
+// ever targets the connecting peer, so it can't be used to scan others.
+func runAgent(listen string) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Selfcheck agent listening on %s\n", listener.Addr())
+	token := os.Getenv(agentTokenEnv)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			var req selfcheckRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+
+			peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			response := selfcheckResponse{Observed: peer, Probes: []PortProbe{}}
+			if req.Op != "selfcheck" {
+				response.Error = fmt.Sprintf("unknown op %q (this agent only answers selfcheck)", req.Op)
+				json.NewEncoder(conn).Encode(response)
+				return
+			}
+			if token != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+				response.Error = "invalid token"
+				json.NewEncoder(conn).Encode(response)
+				return
+			}
+			if len(req.Ports) > maxAgentPorts {
+				response.Error = fmt.Sprintf("at most %d ports per request", maxAgentPorts)
+				json.NewEncoder(conn).Encode(response)
+				return
+			}
+			timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+			if timeout < 500*time.Millisecond || timeout > 10*time.Second {
+				timeout = 3 * time.Second
+			}
+
+			probes := make([]PortProbe, len(req.Ports))
+			var wg sync.WaitGroup
+			semaphore := make(chan struct{}, agentConcurrency)
+			for i, port := range req.Ports {
+				if port < 1 || port > 65535 {
+					probes[i] = PortProbe{Port: port, State: "invalid"}
+					continue
+				}
+				wg.Add(1)
+				semaphore <- struct{}{}
+				go func(i, port int) {
+					defer wg.Done()
+					defer func() { <-semaphore }()
+					probes[i] = probePort(peer, port, timeout)
+				}(i, port)
+			}
+			wg.Wait()
+			response.Probes = probes
+			fmt.Fprintf(os.Stderr, "Probed %d ports on %s\n", len(probes), peer)
+			json.NewEncoder(conn).Encode(response)
+		}(conn)
+	}
+}
+
+// localAddresses lists the addresses assigned to this host's interfaces
+func localAddresses() map[string]bool {
+	addresses := make(map[string]bool)
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			addresses[ipnet.IP.String()] = true
+		}
+	}
+	return addresses
+}
+
+func main() {
+	agent := flag.String("agent", "", "Selfcheck agent outside this host (host:port) that probes the listeners back")
+	serve := flag.String("serve", "", "Run as an agent on this address (e.g. :7790) for other hosts to audit against")
+	intendedArg := flag.String("intended", "", "Ports meant to be reachable from the vantage (e.g. '22,443')")
+	includeUDP := flag.Bool("udp", true, "List UDP sockets too (they are inventoried, not probed)")
+	timeout := flag.Duration("timeout", 3*time.Second, "Connect timeout per probe")
+	flag.Parse()
+
+	if *serve != "" {
+		if err := runAgent(*serve); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() != 0 {
+		fmt.Println("Usage: selfcheck [options]")
+		fmt.Println("Example: selfcheck -intended 22,443")
+		fmt.Println("         selfcheck -agent vantage.example.com:7790 -intended 22,443")
+		fmt.Println("         selfcheck -serve :7790   (on the vantage host; bin/agent answers too)")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	intended := make(map[int]bool)
+	for _, part := range strings.Split(*intendedArg, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		port, err := strconv.Atoi(part)
+		if err != nil || port < 1 || port > 65535 {
+			fmt.Fprintf(os.Stderr, "Error: invalid port %q in -intended\n", part)
+			os.Exit(1)
+		}
+		intended[port] = true
+	}
+
+	listeners, err := localListeners(*includeUDP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: listing sockets: %v\n", err)
+		os.Exit(1)
+	}
+
+	report := SelfCheckReport{Platform: runtime.GOOS, Vantage: *agent, Unintended: []string{}}
+	report.Hostname, _ = os.Hostname()
+
+	// Only TCP listeners reachable beyond loopback are worth probing
+	var ports []int
+	queued := make(map[int]bool)
+	for i := range listeners {
+		l := &listeners[i]
+		l.Intended = intended[l.Port]
+		if l.Scope == "loopback" {
+			l.Exposure = "local-only"
+			continue
+		}
+		l.Exposure = "untested"
+		if l.Protocol == "tcp" && !queued[l.Port] {
+			queued[l.Port] = true
+			ports = append(ports, l.Port)
+		}
+	}
+	sort.Ints(ports)
+
+	if *agent != "" && len(ports) > 0 {
+		if len(ports) > maxAgentPorts {
+			report.Notes = append(report.Notes, fmt.Sprintf("only the first %d of %d ports were probed", maxAgentPorts, len(ports)))
+			ports = ports[:maxAgentPorts]
+		}
+		response, err := askAgent(*agent, ports, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		report.ObservedAddress = response.Observed
+
+		probes := make(map[int]PortProbe)
+		for _, probe := range response.Probes {
+			probes[probe.Port] = probe
+		}
+		observed := net.ParseIP(response.Observed)
+		local := localAddresses()
+		if observed != nil && !local[observed.String()] {
+			report.Notes = append(report.Notes, fmt.Sprintf("the agent sees us as %s, which is not a local address (NAT); only forwarded ports can be reached", response.Observed))
+		}
+
+		for i := range listeners {
+			l := &listeners[i]
+			probe, ok := probes[l.Port]
+			if l.Scope == "loopback" || l.Protocol != "tcp" || !ok {
+				continue
+			}
+			// The agent connects to the address it saw; a socket bound to
+			// a different local address or family can't be told apart
+			if observed != nil && local[observed.String()] &&
+				((l.Scope == "address" && l.Address != observed.String()) ||
+					(l.Scope == "all" && l.Family == "IPv4" && observed.To4() == nil)) {
+				l.Exposure = "untestable"
+				continue
+			}
+			l.ProbeState = probe.State
+			l.RTTMs = probe.RTTMs
+			if probe.State == "open" {
+				l.Exposure = "reachable"
+			} else {
+				l.Exposure = "blocked"
+			}
+		}
+	} else if *agent == "" {
+		report.Notes = append(report.Notes, "no -agent given; listeners are classified by bind address only")
+	}
+
+	for _, l := range listeners {
+		report.Summary.Listeners++
+		if l.Scope == "loopback" {
+			report.Summary.LocalOnly++
+			continue
+		}
+		report.Summary.NonLoopback++
+		switch {
+		case l.Exposure == "reachable":
+			report.Summary.Reachable++
+			if !l.Intended {
+				report.Summary.Unintended++
+				report.Unintended = append(report.Unintended, l.String())
+			}
+		case l.Exposure != "blocked" && !l.Intended:
+			report.AtRisk = append(report.AtRisk, l.String())
+		}
+	}
+	if len(listeners) == 0 {
+		listeners = []Listener{}
+	}
+	report.Listeners = listeners
+	report.Healthy = len(report.Unintended) == 0
+
+	json.NewEncoder(os.Stdout).Encode(report)
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDriftPorts = "21,22,23,25,53,80,110,135,139,143,443,445,993,995,1433,1521,2049,2375,3306,3389,5432,5900,6379,8080,8443,9200,11211,27017"
+
+// tfResource is one managed resource, whichever JSON format it came from
+type tfResource struct {
+	Address string
+	Type    string
+	Values  map[string]interface{}
+}
+
+// ingressRule is a single declared port range. AWS rules are all allows;
+// GCP firewalls add deny rules and priorities.
+type ingressRule struct {
+	Set      string
+	Protocol string
+	From, To int
+	Sources  []string
+	Deny     bool
+	Priority int
+}
+
+func (r ingressRule) covers(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r ingressRule) String() string {
+	ports := strconv.Itoa(r.From)
+	if r.From == 1 && r.To == 65535 {
+		ports = "all"
+	} else if r.To != r.From {
+		ports = fmt.Sprintf("%d-%d", r.From, r.To)
+	}
+	action := ""
+	if r.Deny {
+		action = "deny "
+	}
+	return fmt.Sprintf("%s: %s%s/%s from %s", r.Set, action, r.Protocol, ports, strings.Join(r.Sources, ","))
+}
+
+// ruleSet is a security group or firewall resource
+type ruleSet struct {
+	Address string
+	ID      string
+	Name    string
+	Rules   []ingressRule
+
+	// GCP firewalls apply by network and target tags/service accounts
+	gcp            bool
+	Network        string
+	TargetTags     []string
+	TargetAccounts []string
+}
+
+type declaredHost struct {
+	IP        string
+	Resources []string
+	Sets      []*ruleSet
+}
+
+type PortFinding struct {
+	Port  int    `json:"port"`
+	State string `json:"state"`
+	Rule  string `json:"rule,omitempty"`
+}
+
+type HostDrift struct {
+	Address         string        `json:"address"`
+	Resources       []string      `json:"resources"`
+	RuleSets        []string      `json:"ruleSets"`
+	PortsScanned    int           `json:"portsScanned"`
+	Open            []int         `json:"open"`
+	OpenNotDeclared []PortFinding `json:"openNotDeclared"`
+	DeclaredNotOpen []PortFinding `json:"declaredNotOpen"`
+	WideRules       []string      `json:"wideRules,omitempty"`
+	NotVerified     []string      `json:"notVerified,omitempty"`
+	Drift           bool          `json:"drift"`
+}
+
+type DriftReport struct {
+	State          string      `json:"state"`
+	Source         string      `json:"source"`
+	RuleSets       int         `json:"ruleSets"`
+	UnmappedSets   []string    `json:"unmappedRuleSets,omitempty"`
+	UnresolvedRefs []string    `json:"unresolved,omitempty"`
+	Hosts          []HostDrift `json:"hosts"`
+	Drift          bool        `json:"drift"`
+	ScanTime       int64       `json:"scanTimeMs"`
+}
+
+// loadResources accepts a raw terraform.tfstate (format version 4), the
+// output of "terraform show -json", or a plan from "terraform show -json plan.out"
+func loadResources(data []byte) ([]tfResource, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %v", err)
+	}
+
+	var resources []tfResource
+	if raw, ok := doc["resources"].([]interface{}); ok {
+		for _, item := range raw {
+			r, _ := item.(map[string]interface{})
+			if r == nil || jsonString(r, "mode") != "managed" {
+				continue
+			}
+			base := jsonString(r, "type") + "." + jsonString(r, "name")
+			if module := jsonString(r, "module"); module != "" {
+				base = module + "." + base
+			}
+			for _, inst := range jsonObjects(r, "instances") {
+				address := base
+				switch key := inst["index_key"].(type) {
+				case float64:
+					address += fmt.Sprintf("[%d]", int(key))
+				case string:
+					address += fmt.Sprintf("[%q]", key)
+				}
+				attrs, _ := inst["attributes"].(map[string]interface{})
+				resources = append(resources, tfResource{Address: address, Type: jsonString(r, "type"), Values: attrs})
+			}
+		}
+		return resources, nil
+	}
+
+	// Plans carry the declared end state in planned_values
+	for _, key := range []string{"planned_values", "values"} {
+		if values, ok := doc[key].(map[string]interface{}); ok {
+			root, _ := values["root_module"].(map[string]interface{})
+			walkModule(root, &resources)
+			return resources, nil
+		}
+	}
+	return nil, fmt.Errorf("no resources found (expected a tfstate file or 'terraform show -json' output)")
+}
+
+func walkModule(module map[string]interface{}, out *[]tfResource) {
+	if module == nil {
+		return
+	}
+	for _, r := range jsonObjects(module, "resources") {
+		if jsonString(r, "mode") == "data" {
+			continue
+		}
+		values, _ := r["values"].(map[string]interface{})
+		*out = append(*out, tfResource{Address: jsonString(r, "address"), Type: jsonString(r, "type"), Values: values})
+	}
+	for _, child := range jsonObjects(module, "child_modules") {
+		walkModule(child, out)
+	}
+}
+
+func jsonString(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func jsonInt(m map[string]interface{}, key string) (int, bool) {
+	switch v := m[key].(type) {
+	case float64:
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func jsonStrings(m map[string]interface{}, key string) []string {
+	var out []string
+	switch v := m[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+	case string:
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func jsonObjects(m map[string]interface{}, key string) []map[string]interface{} {
+	var out []map[string]interface{}
+	items, _ := m[key].([]interface{})
+	for _, item := range items {
+		if obj, ok := item.(map[string]interface{}); ok {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+// lastSegment reduces GCP self links to the bare resource name
+func lastSegment(s string) string {
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+func normalizeProtocol(p string) string {
+	switch p = strings.ToLower(p); p {
+	case "-1", "all", "":
+		return "all"
+	case "6":
+		return "tcp"
+	case "17":
+		return "udp"
+	case "1":
+		return "icmp"
+	case "58":
+		return "icmpv6"
+	}
+	return p
+}
+
+// awsRule converts an inline ingress block or a standalone rule resource
+func awsRule(set string, v map[string]interface{}, protocolKey string) ingressRule {
+	rule := ingressRule{Set: set, Protocol: normalizeProtocol(jsonString(v, protocolKey)), Priority: 1000}
+	rule.From, _ = jsonInt(v, "from_port")
+	rule.To, _ = jsonInt(v, "to_port")
+	if rule.Protocol == "all" || (rule.From <= 0 && rule.To <= 0) || (rule.From == 0 && rule.To == 65535) {
+		rule.From, rule.To = 1, 65535
+	}
+	for _, key := range []string{"cidr_blocks", "ipv6_cidr_blocks", "cidr_ipv4", "cidr_ipv6"} {
+		rule.Sources = append(rule.Sources, jsonStrings(v, key)...)
+	}
+	// Group and prefix list references carry no addresses we can check
+	for _, key := range []string{"security_groups", "source_security_group_id", "referenced_security_group_id", "prefix_list_ids", "prefix_list_id"} {
+		rule.Sources = append(rule.Sources, jsonStrings(v, key)...)
+	}
+	if self, _ := v["self"].(bool); self {
+		rule.Sources = append(rule.Sources, "self")
+	}
+	return rule
+}
+
+// gcpRules expands allow/deny blocks; no ports means every port
+func gcpRules(set string, v map[string]interface{}) []ingressRule {
+	priority, ok := jsonInt(v, "priority")
+	if !ok {
+		priority = 1000
+	}
+	sources := jsonStrings(v, "source_ranges")
+	for _, tag := range jsonStrings(v, "source_tags") {
+		sources = append(sources, "tag:"+tag)
+	}
+	sources = append(sources, jsonStrings(v, "source_service_accounts")...)
+
+	var rules []ingressRule
+	for _, action := range []string{"allow", "deny"} {
+		for _, block := range jsonObjects(v, action) {
+			base := ingressRule{Set: set, Protocol: normalizeProtocol(jsonString(block, "protocol")), Sources: sources, Deny: action == "deny", Priority: priority}
+			ports := jsonStrings(block, "ports")
+			if len(ports) == 0 {
+				base.From, base.To = 1, 65535
+				rules = append(rules, base)
+				continue
+			}
+			for _, p := range ports {
+				rule := base
+				from, to, found := strings.Cut(p, "-")
+				rule.From, _ = strconv.Atoi(from)
+				rule.To = rule.From
+				if found {
+					rule.To, _ = strconv.Atoi(to)
+				}
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// buildInventory links rule sets to the addresses they protect
+func buildInventory(resources []tfResource, addressKind string) (map[string]*declaredHost, []*ruleSet, []string) {
+	var sets []*ruleSet
+	byID := map[string]*ruleSet{}
+	var unresolved []string
+
+	setFor := func(id string) *ruleSet {
+		if s, ok := byID[id]; ok {
+			return s
+		}
+		// Rule resource whose group is not managed in this state
+		s := &ruleSet{Address: id, ID: id}
+		byID[id] = s
+		sets = append(sets, s)
+		return s
+	}
+
+	for _, r := range resources {
+		if r.Values == nil {
+			continue
+		}
+		switch r.Type {
+		case "aws_security_group":
+			s := &ruleSet{Address: r.Address, ID: jsonString(r.Values, "id"), Name: jsonString(r.Values, "name")}
+			for _, block := range jsonObjects(r.Values, "ingress") {
+				s.Rules = append(s.Rules, awsRule(r.Address, block, "protocol"))
+			}
+			if s.ID != "" {
+				byID[s.ID] = s
+			}
+			sets = append(sets, s)
+		case "google_compute_firewall":
+			direction := jsonString(r.Values, "direction")
+			if disabled, _ := r.Values["disabled"].(bool); disabled || (direction != "" && direction != "INGRESS") {
+				continue
+			}
+			sets = append(sets, &ruleSet{
+				Address:        r.Address,
+				ID:             jsonString(r.Values, "id"),
+				Name:           jsonString(r.Values, "name"),
+				Rules:          gcpRules(r.Address, r.Values),
+				gcp:            true,
+				Network:        lastSegment(jsonString(r.Values, "network")),
+				TargetTags:     jsonStrings(r.Values, "target_tags"),
+				TargetAccounts: jsonStrings(r.Values, "target_service_accounts"),
+			})
+		}
+	}
+
+	// Standalone rule resources attach to their group by id
+	for _, r := range resources {
+		if r.Values == nil {
+			continue
+		}
+		switch r.Type {
+		case "aws_security_group_rule":
+			if jsonString(r.Values, "type") != "ingress" {
+				continue
+			}
+			s := setFor(jsonString(r.Values, "security_group_id"))
+			s.Rules = append(s.Rules, awsRule(r.Address, r.Values, "protocol"))
+		case "aws_vpc_security_group_ingress_rule":
+			s := setFor(jsonString(r.Values, "security_group_id"))
+			s.Rules = append(s.Rules, awsRule(r.Address, r.Values, "ip_protocol"))
+		}
+	}
+
+	hosts := map[string]*declaredHost{}
+	addHost := func(ip, resource string, attached []*ruleSet) {
+		if ip == "" {
+			return
+		}
+		h, ok := hosts[ip]
+		if !ok {
+			h = &declaredHost{IP: ip}
+			hosts[ip] = h
+		}
+		h.Resources = appendUnique(h.Resources, resource)
+	next:
+		for _, s := range attached {
+			for _, existing := range h.Sets {
+				if existing == s {
+					continue next
+				}
+			}
+			h.Sets = append(h.Sets, s)
+		}
+	}
+	wantPublic := addressKind == "public" || addressKind == "all"
+	wantPrivate := addressKind == "private" || addressKind == "all"
+
+	instanceSets := map[string][]*ruleSet{}
+	for _, r := range resources {
+		if r.Values == nil {
+			continue
+		}
+		switch r.Type {
+		case "aws_instance":
+			var attached []*ruleSet
+			for _, id := range jsonStrings(r.Values, "vpc_security_group_ids") {
+				if s, ok := byID[id]; ok {
+					attached = append(attached, s)
+				} else {
+					unresolved = append(unresolved, fmt.Sprintf("%s: security group %s not in state", r.Address, id))
+				}
+			}
+			for _, name := range jsonStrings(r.Values, "security_groups") {
+				for _, s := range sets {
+					if !s.gcp && s.Name == name {
+						attached = append(attached, s)
+					}
+				}
+			}
+			instanceSets[jsonString(r.Values, "id")] = attached
+			if wantPublic {
+				addHost(jsonString(r.Values, "public_ip"), r.Address, attached)
+				for _, ip := range jsonStrings(r.Values, "ipv6_addresses") {
+					addHost(ip, r.Address, attached)
+				}
+			}
+			if wantPrivate {
+				addHost(jsonString(r.Values, "private_ip"), r.Address, attached)
+			}
+		case "google_compute_instance":
+			tags := jsonStrings(r.Values, "tags")
+			var accounts []string
+			for _, sa := range jsonObjects(r.Values, "service_account") {
+				accounts = append(accounts, jsonString(sa, "email"))
+			}
+			for _, nic := range jsonObjects(r.Values, "network_interface") {
+				network := lastSegment(jsonString(nic, "network"))
+				var attached []*ruleSet
+				for _, s := range sets {
+					if s.gcp && s.Network == network && firewallTargets(s, tags, accounts) {
+						attached = append(attached, s)
+					}
+				}
+				if wantPublic {
+					for _, ac := range jsonObjects(nic, "access_config") {
+						addHost(jsonString(ac, "nat_ip"), r.Address, attached)
+					}
+				}
+				if wantPrivate {
+					addHost(jsonString(nic, "network_ip"), r.Address, attached)
+				}
+			}
+		}
+	}
+
+	// Elastic IPs inherit the groups of the instance they are bound to
+	if wantPublic {
+		for _, r := range resources {
+			if r.Values == nil || (r.Type != "aws_eip" && r.Type != "aws_eip_association") {
+				continue
+			}
+			instance := jsonString(r.Values, "instance")
+			if instance == "" {
+				instance = jsonString(r.Values, "instance_id")
+			}
+			if attached, ok := instanceSets[instance]; ok {
+				addHost(jsonString(r.Values, "public_ip"), r.Address, attached)
+			}
+		}
+	}
+	return hosts, sets, unresolved
+}
+
+func firewallTargets(s *ruleSet, tags, accounts []string) bool {
+	if len(s.TargetTags) == 0 && len(s.TargetAccounts) == 0 {
+		return true
+	}
+	for _, want := range s.TargetTags {
+		for _, tag := range tags {
+			if want == tag {
+				return true
+			}
+		}
+	}
+	for _, want := range s.TargetAccounts {
+		for _, account := range accounts {
+			if want == account {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// sourceMatches reports whether a rule admits the scanning host. With no
+// -source, only rules open to the whole internet count.
+func sourceMatches(sources []string, source net.IP, targetV6 bool) bool {
+	for _, s := range sources {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				continue
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		if source == nil {
+			ones, _ := network.Mask.Size()
+			if ones == 0 && (network.IP.To4() == nil) == targetV6 {
+				return true
+			}
+		} else if network.Contains(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// verdict applies the lowest-priority-number rule covering the port;
+// at equal priority a deny wins, as it does in GCP
+func verdict(rules []ingressRule, port int) (bool, *ingressRule) {
+	var best *ingressRule
+	for i := range rules {
+		r := &rules[i]
+		if !r.covers(port) {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority || (r.Priority == best.Priority && r.Deny && !best.Deny) {
+			best = r
+		}
+	}
+	return best != nil && !best.Deny, best
+}
+
+func probeTCP(ip string, port int, timeout time.Duration) string {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	if err == nil {
+		conn.Close()
+		return "open"
+	}
+	if strings.Contains(err.Error(), "refused") {
+		return "closed"
+	}
+	return "filtered"
+}
+
+type hostPlan struct {
+	drift    *HostDrift
+	rules    []ingressRule
+	ports    []int
+	narrow   map[int]bool // ports named by a rule small enough to enumerate
+	observed map[int]string
+}
+
+func planHost(h *declaredHost, source net.IP, baseline []int, maxRange int) *hostPlan {
+	targetV6 := net.ParseIP(h.IP).To4() == nil
+	plan := &hostPlan{
+		drift:    &HostDrift{Address: h.IP, Resources: h.Resources, Open: []int{}, OpenNotDeclared: []PortFinding{}, DeclaredNotOpen: []PortFinding{}},
+		narrow:   map[int]bool{},
+		observed: map[int]string{},
+	}
+	for _, s := range h.Sets {
+		plan.drift.RuleSets = append(plan.drift.RuleSets, s.Address)
+		for _, r := range s.Rules {
+			if !sourceMatches(r.Sources, source, targetV6) {
+				continue
+			}
+			if r.Protocol != "tcp" && r.Protocol != "all" {
+				plan.drift.NotVerified = append(plan.drift.NotVerified, r.String())
+				continue
+			}
+			plan.rules = append(plan.rules, r)
+			if r.Deny {
+				continue
+			}
+			if r.To-r.From+1 > maxRange {
+				plan.drift.WideRules = append(plan.drift.WideRules, r.String())
+				continue
+			}
+			for port := r.From; port <= r.To; port++ {
+				plan.narrow[port] = true
+			}
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, port := range baseline {
+		seen[port] = true
+	}
+	for port := range plan.narrow {
+		seen[port] = true
+	}
+	for port := range seen {
+		plan.ports = append(plan.ports, port)
+	}
+	sort.Ints(plan.ports)
+	plan.drift.PortsScanned = len(plan.ports)
+	return plan
+}
+
+func (p *hostPlan) compare() {
+	d := p.drift
+	for _, port := range p.ports {
+		state := p.observed[port]
+		allowed, rule := verdict(p.rules, port)
+		if state == "open" {
+			d.Open = append(d.Open, port)
+			if !allowed {
+				finding := PortFinding{Port: port, State: state}
+				if rule != nil {
+					finding.Rule = rule.String()
+				}
+				d.OpenNotDeclared = append(d.OpenNotDeclared, finding)
+			}
+			continue
+		}
+		if allowed && p.narrow[port] {
+			d.DeclaredNotOpen = append(d.DeclaredNotOpen, PortFinding{Port: port, State: state, Rule: rule.String()})
+		}
+	}
+	d.Drift = len(d.OpenNotDeclared) > 0 || len(d.DeclaredNotOpen) > 0
+}
+
+// targetList collects repeatable -target key=ip[,ip] mappings
+type targetList []string
+
+func (t *targetList) String() string     { return strings.Join(*t, "; ") }
+func (t *targetList) Set(v string) error { *t = append(*t, v); return nil }
+
+// parsePortRange parses inputs like "80,443", "1-1000", or "22,80-90,443"
+func parsePortRange(portsArg string) ([]int, error) {
+	var ports []int
+	for _, rs := range strings.Split(portsArg, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+		start, end := rs, rs
+		if strings.Contains(rs, "-") {
+			parts := strings.Split(rs, "-")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid port range: %s", rs)
+			}
+			start, end = parts[0], parts[1]
+		}
+		from, err := strconv.Atoi(start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", start)
+		}
+		to, err := strconv.Atoi(end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", end)
+		}
+		if from > to || from < 1 || to > 65535 {
+			return nil, fmt.Errorf("invalid port range: %s (must be 1-65535)", rs)
+		}
+		for port := from; port <= to; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func main() {
+	portsArg := flag.String("ports", defaultDriftPorts, "Ports always scanned in addition to declared ones")
+	addressKind := flag.String("address", "public", "Addresses to scan: public, private or all")
+	sourceArg := flag.String("source", "", "Address the scan comes from; rules are matched against it (default: only rules open to the internet)")
+	maxRange := flag.Int("max-range", 1024, "Declared ranges wider than this are not enumerated for declared-but-not-open checks")
+	timeout := flag.Duration("timeout", 2*time.Second, "Connect timeout per port")
+	concurrency := flag.Int("concurrency", 200, "Concurrent connection attempts")
+	var targets targetList
+	flag.Var(&targets, "target", "Scan addresses for a rule set the state cannot link, as <group id, name or address>=<ip>[,<ip>] (repeatable)")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 1 {
+		fmt.Println("Usage: tfdrift [options] <terraform.tfstate | show.json | plan.json | ->")
+		fmt.Println("Example: tfdrift terraform.tfstate")
+		fmt.Println("         terraform show -json | tfdrift -")
+		fmt.Println("         tfdrift -source 198.51.100.7 -target sg-0abc123=203.0.113.10 plan.json")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	switch *addressKind {
+	case "public", "private", "all":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown address kind %q (use public, private or all)\n", *addressKind)
+		os.Exit(1)
+	}
+	var source net.IP
+	if *sourceArg != "" {
+		if source = net.ParseIP(*sourceArg); source == nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid source address %q\n", *sourceArg)
+			os.Exit(1)
+		}
+	}
+	baseline, err := parsePortRange(*portsArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	var data []byte
+	if args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	resources, err := loadResources(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	hosts, sets, unresolved := buildInventory(resources, *addressKind)
+	for _, t := range targets {
+		key, ips, ok := strings.Cut(t, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: -target %q must be <group>=<ip>[,<ip>]\n", t)
+			os.Exit(1)
+		}
+		var matched *ruleSet
+		for _, s := range sets {
+			if key == s.Address || key == s.ID || key == s.Name {
+				matched = s
+				break
+			}
+		}
+		if matched == nil {
+			fmt.Fprintf(os.Stderr, "Error: no security group or firewall %q in state\n", key)
+			os.Exit(1)
+		}
+		for _, ip := range strings.Split(ips, ",") {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid address %q in -target\n", ip)
+				os.Exit(1)
+			}
+			h, ok := hosts[ip]
+			if !ok {
+				h = &declaredHost{IP: ip}
+				hosts[ip] = h
+			}
+			h.Resources = appendUnique(h.Resources, "-target "+key)
+			h.Sets = append(h.Sets, matched)
+		}
+	}
+
+	report := DriftReport{State: args[0], Source: "anywhere", RuleSets: len(sets), UnresolvedRefs: unresolved, Hosts: []HostDrift{}}
+	if source != nil {
+		report.Source = source.String()
+	}
+	used := map[*ruleSet]bool{}
+	var ips []string
+	for ip, h := range hosts {
+		ips = append(ips, ip)
+		for _, s := range h.Sets {
+			used[s] = true
+		}
+	}
+	sort.Strings(ips)
+	for _, s := range sets {
+		if !used[s] {
+			report.UnmappedSets = append(report.UnmappedSets, s.Address)
+		}
+	}
+	if len(ips) == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: no addresses found in state; use -target to map rule sets to addresses")
+	}
+
+	plans := make([]*hostPlan, len(ips))
+	for i, ip := range ips {
+		plans[i] = planHost(hosts[ip], source, baseline, *maxRange)
+	}
+
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	semaphore := make(chan struct{}, *concurrency)
+	for _, plan := range plans {
+		for _, port := range plan.ports {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(plan *hostPlan, port int) {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+				state := probeTCP(plan.drift.Address, port, *timeout)
+				mu.Lock()
+				plan.observed[port] = state
+				mu.Unlock()
+			}(plan, port)
+		}
+	}
+	wg.Wait()
+	report.ScanTime = time.Since(startTime).Milliseconds()
+
+	for _, plan := range plans {
+		plan.compare()
+		report.Hosts = append(report.Hosts, *plan.drift)
+		report.Drift = report.Drift || plan.drift.Drift
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Drift {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Check statuses, from the tunnel's point of view
+const (
+	statusHealthy       = "healthy"
+	statusNoListener    = "no-listener"     // Nothing on the forward port: the ssh process is gone
+	statusFarSideClosed = "far-side-closed" // ssh accepted, then closed: the far service is unreachable
+	statusUnexpected    = "unexpected-response"
+	statusTimeout       = "timeout"
+	statusError         = "error"
+)
+
+// TunnelCheck is one end-to-end probe through a forward
+type TunnelCheck struct {
+	Addr       string    `json:"addr"`
+	Status     string    `json:"status"`
+	Healthy    bool      `json:"healthy"`
+	Verified   bool      `json:"verified"` // The far service sent data, not just held the connection
+	ConnectMs  float64   `json:"connectMs,omitempty"`
+	ResponseMs float64   `json:"responseMs,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// ReestablishRound records one kill-and-restart of the tunnel process
+type ReestablishRound struct {
+	Round        int          `json:"round"`
+	DownDetected bool         `json:"downDetected"`
+	DownStatus   string       `json:"downStatus"`
+	Recovered    bool         `json:"recovered"`
+	RecoveryMs   float64      `json:"recoveryMs,omitempty"`
+	Check        *TunnelCheck `json:"check,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+type ReestablishReport struct {
+	Addr    string             `json:"addr"`
+	Command string             `json:"command"`
+	Initial TunnelCheck        `json:"initial"`
+	Rounds  []ReestablishRound `json:"rounds"`
+	Passed  bool               `json:"passed"`
+}
+
+// TunnelEvent is a watch-mode state change
+type TunnelEvent struct {
+	Time  time.Time   `json:"time"`
+	Event string      `json:"event"`
+	Check TunnelCheck `json:"check"`
+	Note  string      `json:"note,omitempty"`
+}
+
+type prober struct {
+	addr    string
+	send    string
+	expect  *regexp.Regexp
+	grace   time.Duration
+	timeout time.Duration
+}
+
+// check connects to the forward and decides whether the far side answered.
+// ssh accepts on the forward port before it has reached the far service, so
+// a successful connect proves nothing: a dead far side shows up as an EOF
+// right after connecting, while a live but silent service keeps the
+// connection open.
+func (p *prober) check() TunnelCheck {
+	result := TunnelCheck{Addr: p.addr, CheckedAt: time.Now().UTC()}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		result.Status = statusError
+		if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "refused") {
+			result.Status = statusNoListener
+		}
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.ConnectMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if p.send != "" {
+		conn.SetWriteDeadline(time.Now().Add(p.timeout))
+		if _, err := conn.Write([]byte(p.send)); err != nil {
+			result.Status = statusFarSideClosed
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	// Without an expectation, any data (or a connection that stays open)
+	// is enough; with one, keep reading until it matches or time runs out
+	wait := p.timeout
+	if p.expect == nil && p.send == "" {
+		wait = p.grace
+	}
+	deadline := time.Now().Add(wait)
+	conn.SetReadDeadline(deadline)
+
+	var received bytes.Buffer
+	buf := make([]byte, 1024)
+	for received.Len() < 4096 {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if result.ResponseMs == 0 {
+				result.ResponseMs = float64(time.Since(start).Microseconds()) / 1000
+			}
+			received.Write(buf[:n])
+			if p.expect == nil || p.expect.Match(received.Bytes()) {
+				break
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || !isTimeout(err) {
+				if received.Len() == 0 {
+					result.Status = statusFarSideClosed
+					result.Error = "connection closed by tunnel before any data"
+					return result
+				}
+			} else if received.Len() == 0 && p.expect == nil && p.send == "" {
+				// Silent service that held the connection open past the grace period
+				result.Status = statusHealthy
+				result.Healthy = true
+				return result
+			}
+			break
+		}
+	}
+
+	result.Response = printable(received.Bytes())
+	switch {
+	case received.Len() == 0:
+		result.Status = statusTimeout
+		result.Error = "no response through tunnel"
+	case p.expect != nil && !p.expect.Match(received.Bytes()):
+		result.Status = statusUnexpected
+		result.Error = fmt.Sprintf("response does not match %q", p.expect.String())
+	default:
+		result.Status = statusHealthy
+		result.Healthy = true
+		result.Verified = true
+	}
+	return result
+}
+
+// waitHealthy polls until the forward passes a check or the deadline passes
+func (p *prober) waitHealthy(limit time.Duration, exited chan error) (TunnelCheck, error) {
+	deadline := time.Now().Add(limit)
+	for {
+		check := p.check()
+		if check.Healthy {
+			return check, nil
+		}
+		if time.Now().After(deadline) {
+			return check, fmt.Errorf("not healthy after %v (last status %s)", limit, check.Status)
+		}
+		select {
+		case err := <-exited:
+			exited <- err
+			return check, fmt.Errorf("tunnel command exited: %v", err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func printable(data []byte) string {
+	if len(data) > 128 {
+		data = data[:128]
+	}
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || (r >= 32 && r < 127) {
+			return r
+		}
+		return '.'
+	}, string(data)))
+}
+
+// lockedBuffer collects a child's stderr; exec copies into it from its own
+// goroutine while probes read the tail
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// tunnelProcess runs the command that holds the forward open
+type tunnelProcess struct {
+	command string
+	cmd     *exec.Cmd
+	stderr  lockedBuffer
+	exited  chan error
+}
+
+func (t *tunnelProcess) Start() error {
+	// exec replaces the shell so killing the process kills ssh itself
+	if runtime.GOOS == "windows" {
+		fields := strings.Fields(t.command)
+		t.cmd = exec.Command(fields[0], fields[1:]...)
+	} else {
+		t.cmd = exec.Command("sh", "-c", "exec "+t.command)
+	}
+	t.stderr.Reset()
+	t.cmd.Stderr = &t.stderr
+	if err := t.cmd.Start(); err != nil {
+		return err
+	}
+
+	t.exited = make(chan error, 1)
+	go func(cmd *exec.Cmd, exited chan error) {
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("exit status 0")
+		}
+		exited <- err
+	}(t.cmd, t.exited)
+	return nil
+}
+
+func (t *tunnelProcess) Stop() {
+	if t.cmd == nil || t.cmd.Process == nil {
+		return
+	}
+	t.cmd.Process.Kill()
+	select {
+	case <-t.exited:
+	case <-time.After(5 * time.Second):
+	}
+	t.cmd = nil
+}
+
+func (t *tunnelProcess) Running() bool {
+	if t.cmd == nil {
+		return false
+	}
+	select {
+	case err := <-t.exited:
+		t.exited <- err
+		return false
+	default:
+		return true
+	}
+}
+
+// lastError is the tail of ssh's stderr, which usually names the cause
+func (t *tunnelProcess) lastError() string {
+	lines := strings.Split(strings.TrimSpace(t.stderr.String()), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// reestablish kills the tunnel, confirms the probe notices, then restarts it
+// and measures how long the forward takes to carry traffic again
+func reestablish(p *prober, tunnel *tunnelProcess, rounds int, readyTimeout time.Duration) ReestablishReport {
+	report := ReestablishReport{Addr: p.addr, Command: tunnel.command, Rounds: []ReestablishRound{}}
+
+	check, err := p.waitHealthy(readyTimeout, tunnel.exited)
+	report.Initial = check
+	if err != nil {
+		report.Initial.Error = joinError(err.Error(), tunnel.lastError())
+		return report
+	}
+
+	report.Passed = true
+	for i := 1; i <= rounds; i++ {
+		round := ReestablishRound{Round: i}
+
+		tunnel.Stop()
+		down := p.check()
+		round.DownStatus = down.Status
+		round.DownDetected = !down.Healthy
+
+		start := time.Now()
+		if err := tunnel.Start(); err != nil {
+			round.Error = err.Error()
+			report.Rounds = append(report.Rounds, round)
+			report.Passed = false
+			break
+		}
+		check, err := p.waitHealthy(readyTimeout, tunnel.exited)
+		round.Check = &check
+		if err != nil {
+			round.Error = joinError(err.Error(), tunnel.lastError())
+		} else {
+			round.Recovered = true
+			round.RecoveryMs = float64(time.Since(start).Microseconds()) / 1000
+		}
+		report.Passed = report.Passed && round.DownDetected && round.Recovered
+		report.Rounds = append(report.Rounds, round)
+		if !round.Recovered {
+			break
+		}
+	}
+	return report
+}
+
+func joinError(err, detail string) string {
+	if detail == "" {
+		return err
+	}
+	return err + ": " + detail
+}
+
+// watch probes on an interval and prints an event on every state change.
+// With a tunnel command it also restarts the tunnel after consecutive failures.
+func watch(p *prober, tunnel *tunnelProcess, interval time.Duration, failLimit int, readyTimeout time.Duration) {
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(event string, check TunnelCheck, note string) {
+		encoder.Encode(TunnelEvent{Time: time.Now().UTC(), Event: event, Check: check, Note: note})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Give a freshly started tunnel time to come up before judging it
+	if tunnel != nil {
+		p.waitHealthy(readyTimeout, tunnel.exited)
+	}
+
+	lastStatus := ""
+	failures := 0
+	for {
+		check := p.check()
+		if check.Status != lastStatus {
+			event := "up"
+			if !check.Healthy {
+				event = "down"
+			}
+			emit(event, check, "")
+			lastStatus = check.Status
+		}
+
+		if check.Healthy {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		if tunnel != nil && failures >= failLimit {
+			cause := "tunnel process was running"
+			if !tunnel.Running() {
+				cause = joinError("tunnel process exited", tunnel.lastError())
+			}
+			tunnel.Stop()
+			start := time.Now()
+			if err := tunnel.Start(); err != nil {
+				emit("restart-failed", check, err.Error())
+			} else if check, err := p.waitHealthy(readyTimeout, tunnel.exited); err != nil {
+				emit("restart-failed", check, joinError(err.Error(), tunnel.lastError()))
+			} else {
+				emit("reestablished", check, fmt.Sprintf("recovered in %dms; %s", time.Since(start).Milliseconds(), cause))
+				lastStatus = check.Status
+			}
+			failures = 0
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "", "Forward listener to probe: the local side of -L, or the bastion side of -R")
+	send := flag.String("send", "", "Payload to send through the tunnel (\\r and \\n are unescaped)")
+	expect := flag.String("expect", "", "Regular expression the far-side response must match")
+	grace := flag.Duration("grace", time.Second, "How long a silent service must hold the connection open to count as healthy")
+	timeout := flag.Duration("timeout", 5*time.Second, "Connect and response timeout")
+	sshCommand := flag.String("ssh", "", "Command that establishes the forward (e.g. 'ssh -N -o ExitOnForwardFailure=yes -L 15432:db:5432 bastion'); started and managed by this tool")
+	reestablishTest := flag.Bool("reestablish", false, "Kill and restart the -ssh command, checking the outage is detected and the forward recovers")
+	rounds := flag.Int("rounds", 1, "Kill/restart rounds for -reestablish")
+	readyTimeout := flag.Duration("ready-timeout", 20*time.Second, "How long the forward may take to carry traffic after the command starts")
+	interval := flag.Duration("watch", 0, "Probe continuously at this interval, printing state changes as JSON lines")
+	failLimit := flag.Int("fail", 2, "Consecutive failures before watch mode restarts the -ssh command")
+	flag.Parse()
+
+	if *addr == "" {
+		fmt.Println("Usage: tunnel -addr <host:port> [options]")
+		fmt.Println("Example: tunnel -addr 127.0.0.1:15432 -grace 2s")
+		fmt.Println("         tunnel -addr 127.0.0.1:8080 -send 'HEAD / HTTP/1.0\\r\\n\\r\\n' -expect '^HTTP/'")
+		fmt.Println("         tunnel -addr 127.0.0.1:15432 -ssh 'ssh -N -L 15432:db:5432 bastion' -reestablish -rounds 3")
+		fmt.Println("         tunnel -addr 127.0.0.1:15432 -ssh 'ssh -N -L 15432:db:5432 bastion' -watch 30s")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *reestablishTest && *sshCommand == "" {
+		fmt.Fprintln(os.Stderr, "Error: -reestablish needs the -ssh command so the tunnel can be restarted")
+		os.Exit(1)
+	}
+
+	p := &prober{
+		addr:    *addr,
+		send:    strings.NewReplacer(`\r`, "\r", `\n`, "\n").Replace(*send),
+		grace:   *grace,
+		timeout: *timeout,
+	}
+	if *expect != "" {
+		re, err := regexp.Compile(*expect)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -expect: %v\n", err)
+			os.Exit(1)
+		}
+		p.expect = re
+	}
+
+	var tunnel *tunnelProcess
+	if *sshCommand != "" {
+		tunnel = &tunnelProcess{command: *sshCommand}
+		if err := tunnel.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: starting tunnel: %v\n", err)
+			os.Exit(1)
+		}
+		defer tunnel.Stop()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	switch {
+	case *reestablishTest:
+		report := reestablish(p, tunnel, *rounds, *readyTimeout)
+		encoder.Encode(report)
+		if !report.Passed {
+			tunnel.Stop()
+			os.Exit(1)
+		}
+	case *interval > 0:
+		watch(p, tunnel, *interval, *failLimit, *readyTimeout)
+	default:
+		var check TunnelCheck
+		if tunnel != nil {
+			var err error
+			if check, err = p.waitHealthy(*readyTimeout, tunnel.exited); err != nil {
+				check.Error = joinError(err.Error(), tunnel.lastError())
+			}
+		} else {
+			check = p.check()
+		}
+		encoder.Encode(check)
+		if !check.Healthy {
+			if tunnel != nil {
+				tunnel.Stop()
+			}
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,994 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ColorReset  = "\033[0m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
+)
+
+// Dependency is one entry of a service's dependency manifest. The type is
+// inferred when omitted: url means http, a port means tcp, otherwise dns.
+type Dependency struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"` // dns, tcp, tls or http
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	URL          string   `json:"url"`
+	ResolvesTo   []string `json:"resolvesTo"`   // addresses or CIDRs the name must resolve into
+	ExpectStatus int      `json:"expectStatus"` // default: any status below 400
+	Timeout      string   `json:"timeout"`
+	Optional     bool     `json:"optional"` // reported, but does not fail the run
+}
+
+type Manifest struct {
+	Service      string       `json:"service"`
+	Timeout      string       `json:"timeout"`
+	Dependencies []Dependency `json:"dependencies"`
+}
+
+// StageResult is one cell of the matrix; stages that do not apply to a
+// dependency type are left out
+type StageResult struct {
+	Status     string `json:"status"` // pass, fail or skip (an earlier stage failed)
+	DurationMs int64  `json:"durationMs"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+type DependencyResult struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Target   string       `json:"target"`
+	Optional bool         `json:"optional,omitempty"`
+	DNS      *StageResult `json:"dns,omitempty"`
+	Connect  *StageResult `json:"connect,omitempty"`
+	TLS      *StageResult `json:"tls,omitempty"`
+	HTTP     *StageResult `json:"http,omitempty"`
+	Passed   bool         `json:"passed"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type VerifyReport struct {
+	Service  string             `json:"service,omitempty"`
+	Manifest string             `json:"manifest"`
+	Host     string             `json:"host"`
+	Results  []DependencyResult `json:"results"`
+	Passed   int                `json:"passed"`
+	Failed   int                `json:"failed"`
+	Warnings int                `json:"warnings"` // optional dependencies that failed
+	Healthy  bool               `json:"healthy"`
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAML reads the block-style YAML subset manifests are written in:
+// nested mappings and sequences, flow sequences of scalars, quoted or plain
+// scalars and comments. Anchors, multi-line strings and flow mappings are
+// not supported.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if leading := raw[:len(raw)-len(strings.TrimLeft(raw, " \t"))]; strings.Contains(leading, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty manifest")
+	}
+	value, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[next].number)
+	}
+	return value, nil
+}
+
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func isYAMLSequenceItem(text string) bool { return text == "-" || strings.HasPrefix(text, "- ") }
+
+func parseYAMLBlock(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	if isYAMLSequenceItem(lines[i].text) {
+		return parseYAMLSequence(lines, i, indent)
+	}
+	return parseYAMLMapping(lines, i, indent)
+}
+
+func parseYAMLSequence(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	items := []interface{}{}
+	for i < len(lines) && lines[i].indent == indent && isYAMLSequenceItem(lines[i].text) {
+		rest := strings.TrimPrefix(lines[i].text, "-")
+		item := strings.TrimLeft(rest, " ")
+		switch {
+		case item == "":
+			if i+1 >= len(lines) || lines[i+1].indent <= indent {
+				items = append(items, nil)
+				i++
+				continue
+			}
+			value, next, err := parseYAMLBlock(lines, i+1, lines[i+1].indent)
+			if err != nil {
+				return nil, 0, err
+			}
+			items, i = append(items, value), next
+		case yamlKeyValue(item) != "":
+			// "- key: value" opens a mapping indented to where the key starts
+			lines[i] = yamlLine{number: lines[i].number, indent: indent + 1 + len(rest) - len(item), text: item}
+			value, next, err := parseYAMLMapping(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, 0, err
+			}
+			items, i = append(items, value), next
+		default:
+			value, err := parseYAMLValue(item, lines[i].number)
+			if err != nil {
+				return nil, 0, err
+			}
+			items, i = append(items, value), i+1
+		}
+	}
+	return items, i, nil
+}
+
+// yamlKeyValue returns the key when text is a "key: value" or "key:" line
+func yamlKeyValue(text string) string {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") || strings.HasPrefix(text, "[") {
+		return ""
+	}
+	if key, _, ok := strings.Cut(text, ": "); ok {
+		return key
+	}
+	if strings.HasSuffix(text, ":") {
+		return strings.TrimSuffix(text, ":")
+	}
+	return ""
+}
+
+func parseYAMLMapping(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	mapping := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		key := yamlKeyValue(line.text)
+		if key == "" {
+			return nil, 0, fmt.Errorf("line %d: expected \"key: value\"", line.number)
+		}
+		if _, dup := mapping[key]; dup {
+			return nil, 0, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(line.text, key+":"))
+		i++
+		if value != "" {
+			parsed, err := parseYAMLValue(value, line.number)
+			if err != nil {
+				return nil, 0, err
+			}
+			mapping[key] = parsed
+			continue
+		}
+		// A nested block, or a sequence written at the same indentation as its key
+		if i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && isYAMLSequenceItem(lines[i].text))) {
+			nested, next, err := parseYAMLBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, 0, err
+			}
+			mapping[key], i = nested, next
+			continue
+		}
+		mapping[key] = nil
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, 0, fmt.Errorf("line %d: unexpected indentation", lines[i].number)
+	}
+	return mapping, i, nil
+}
+
+func parseYAMLValue(text string, number int) (interface{}, error) {
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d: unterminated list", number)
+		}
+		items := []interface{}{}
+		parts, err := splitYAMLFlow(text[1:len(text)-1], number)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range parts {
+			value, err := parseYAMLValue(item, number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	}
+	if strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("line %d: flow mappings are not supported", number)
+	}
+	if len(text) >= 2 && (text[0] == '"' || text[0] == '\'') {
+		if text[len(text)-1] != text[0] {
+			return nil, fmt.Errorf("line %d: unterminated string", number)
+		}
+		if text[0] == '"' {
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			return s, nil
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	// YAML 1.2 core schema: yes, no, on and off are plain strings
+	switch text {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	return text, nil
+}
+
+// splitYAMLFlow splits the inside of a flow sequence at the commas that
+// are not inside quotes. A trailing comma is allowed, as in YAML.
+func splitYAMLFlow(inner string, number int) ([]string, error) {
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range inner {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '[' || r == '{':
+			return nil, fmt.Errorf("line %d: nested flow collections are not supported", number)
+		case r == ',':
+			items = append(items, strings.TrimSpace(inner[start:i]))
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("line %d: unterminated string", number)
+	}
+	if last := strings.TrimSpace(inner[start:]); last != "" {
+		items = append(items, last)
+	}
+	for _, item := range items {
+		if item == "" {
+			return nil, fmt.Errorf("line %d: empty list item", number)
+		}
+	}
+	return items, nil
+}
+
+// loadManifest reads a YAML or JSON manifest and checks every dependency
+func loadManifest(path string) (Manifest, error) {
+	var manifest Manifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" && !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return manifest, fmt.Errorf("%s: %v", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return manifest, err
+		}
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(manifest.Dependencies) == 0 {
+		return manifest, fmt.Errorf("%s: no dependencies listed", path)
+	}
+
+	for i := range manifest.Dependencies {
+		dep := &manifest.Dependencies[i]
+		if err := normalizeDependency(dep); err != nil {
+			label := dep.Name
+			if label == "" {
+				label = fmt.Sprintf("#%d", i+1)
+			}
+			return manifest, fmt.Errorf("%s: dependency %s: %v", path, label, err)
+		}
+	}
+	return manifest, nil
+}
+
+func normalizeDependency(dep *Dependency) error {
+	// Allow host: db.internal:5432 as a shorthand for host and port
+	if dep.Port == 0 && strings.Count(dep.Host, ":") == 1 {
+		host, port, _ := net.SplitHostPort(dep.Host)
+		if p, err := strconv.Atoi(port); err == nil {
+			dep.Host, dep.Port = host, p
+		}
+	}
+	if dep.Type == "" {
+		switch {
+		case dep.URL != "":
+			dep.Type = "http"
+		case dep.Port != 0:
+			dep.Type = "tcp"
+		default:
+			dep.Type = "dns"
+		}
+	}
+
+	switch dep.Type {
+	case "http":
+		u, err := url.Parse(dep.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return fmt.Errorf("http dependencies need an http(s) url")
+		}
+		dep.Host = u.Hostname()
+		dep.Port = 80
+		if u.Scheme == "https" {
+			dep.Port = 443
+		}
+		if p := u.Port(); p != "" {
+			dep.Port, _ = strconv.Atoi(p)
+		}
+	case "tcp", "tls":
+		if dep.Host == "" || dep.Port < 1 || dep.Port > 65535 {
+			return fmt.Errorf("%s dependencies need a host and a port", dep.Type)
+		}
+	case "dns":
+		if dep.Host == "" {
+			return fmt.Errorf("dns dependencies need a host")
+		}
+	default:
+		return fmt.Errorf("unknown type %q (use dns, tcp, tls or http)", dep.Type)
+	}
+
+	for _, expected := range dep.ResolvesTo {
+		if net.ParseIP(expected) == nil {
+			if _, _, err := net.ParseCIDR(expected); err != nil {
+				return fmt.Errorf("resolvesTo: %q is not an address or CIDR", expected)
+			}
+		}
+	}
+	if dep.Timeout != "" {
+		if _, err := time.ParseDuration(dep.Timeout); err != nil {
+			return fmt.Errorf("timeout: %v", err)
+		}
+	}
+	if dep.Name == "" {
+		dep.Name = dep.target()
+	}
+	return nil
+}
+
+func (dep Dependency) target() string {
+	switch {
+	case dep.Type == "http":
+		return dep.URL
+	case dep.Port != 0:
+		return net.JoinHostPort(dep.Host, strconv.Itoa(dep.Port))
+	}
+	return dep.Host
+}
+
+func stage(start time.Time, err error, detail string) *StageResult {
+	result := &StageResult{Status: "pass", DurationMs: time.Since(start).Milliseconds(), Detail: detail}
+	if err != nil {
+		result.Status = "fail"
+		result.Detail = err.Error()
+	}
+	return result
+}
+
+func skipped() *StageResult { return &StageResult{Status: "skip"} }
+
+// resolvesInto reports whether every address is covered by one of the expected entries
+func resolvesInto(addrs []net.IP, expected []string) error {
+	for _, addr := range addrs {
+		covered := false
+		for _, entry := range expected {
+			if ip := net.ParseIP(entry); ip != nil {
+				covered = covered || ip.Equal(addr)
+			} else if _, network, err := net.ParseCIDR(entry); err == nil {
+				covered = covered || network.Contains(addr)
+			}
+		}
+		if !covered {
+			return fmt.Errorf("resolved to %s, outside %s", addr, strings.Join(expected, ", "))
+		}
+	}
+	return nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// verifyDependency runs the stages that apply to the dependency type in
+// order; once one fails the rest are skipped
+func verifyDependency(dep Dependency, timeout time.Duration) DependencyResult {
+	if dep.Timeout != "" {
+		timeout, _ = time.ParseDuration(dep.Timeout)
+	}
+	result := DependencyResult{Name: dep.Name, Type: dep.Type, Target: dep.target(), Optional: dep.Optional}
+	failed := false
+
+	// DNS
+	start := time.Now()
+	if ip := net.ParseIP(dep.Host); ip != nil {
+		// Nothing to resolve for a literal address, but it can still be outside resolvesTo
+		if len(dep.ResolvesTo) > 0 {
+			result.DNS = stage(start, resolvesInto([]net.IP{ip}, dep.ResolvesTo), dep.Host)
+			failed = result.DNS.Status == "fail"
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, dep.Host)
+		cancel()
+		var addrs []net.IP
+		var shown []string
+		for _, a := range resolved {
+			addrs = append(addrs, a.IP)
+			shown = append(shown, a.IP.String())
+		}
+		if err == nil && len(dep.ResolvesTo) > 0 {
+			err = resolvesInto(addrs, dep.ResolvesTo)
+		}
+		result.DNS = stage(start, err, strings.Join(shown, ", "))
+		failed = err != nil
+	}
+	if dep.Type == "dns" {
+		return finish(result)
+	}
+
+	// Connect
+	var conn net.Conn
+	if failed {
+		result.Connect = skipped()
+	} else {
+		start = time.Now()
+		var err error
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(dep.Host, strconv.Itoa(dep.Port)), timeout)
+		detail := ""
+		if err == nil {
+			detail = conn.RemoteAddr().String()
+		}
+		result.Connect = stage(start, err, detail)
+		failed = err != nil
+	}
+
+	// TLS
+	if dep.Type == "tls" || (dep.Type == "http" && strings.HasPrefix(dep.URL, "https:")) {
+		if failed {
+			result.TLS = skipped()
+		} else {
+			start = time.Now()
+			conn.SetDeadline(time.Now().Add(timeout))
+			client := tls.Client(conn, &tls.Config{ServerName: dep.Host})
+			err := client.Handshake()
+			detail := ""
+			if err == nil {
+				state := client.ConnectionState()
+				leaf := state.PeerCertificates[0]
+				detail = fmt.Sprintf("%s, certificate expires %s (%d days)", tlsVersionName(state.Version),
+					leaf.NotAfter.Format("2006-01-02"), int(time.Until(leaf.NotAfter).Hours()/24))
+			}
+			result.TLS = stage(start, err, detail)
+			failed = err != nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	// HTTP
+	if dep.Type == "http" {
+		if failed {
+			result.HTTP = skipped()
+		} else {
+			start = time.Now()
+			client := &http.Client{Timeout: timeout}
+			resp, err := client.Get(dep.URL)
+			detail := ""
+			if err == nil {
+				resp.Body.Close()
+				detail = resp.Status
+				switch {
+				case dep.ExpectStatus != 0 && resp.StatusCode != dep.ExpectStatus:
+					err = fmt.Errorf("%s, expected %d", resp.Status, dep.ExpectStatus)
+				case dep.ExpectStatus == 0 && resp.StatusCode >= 400:
+					err = fmt.Errorf("%s", resp.Status)
+				}
+			}
+			result.HTTP = stage(start, err, detail)
+		}
+	}
+	return finish(result)
+}
+
+// finish marks the result passed when no stage failed and records the first failure
+func finish(result DependencyResult) DependencyResult {
+	result.Passed = true
+	for _, s := range []struct {
+		name  string
+		stage *StageResult
+	}{{"dns", result.DNS}, {"connect", result.Connect}, {"tls", result.TLS}, {"http", result.HTTP}} {
+		if s.stage != nil && s.stage.Status == "fail" {
+			result.Passed = false
+			result.Error = s.stage.Detail
+			if !strings.HasPrefix(result.Error, s.name+": ") {
+				result.Error = s.name + ": " + result.Error
+			}
+			break
+		}
+	}
+	return result
+}
+
+// Batch mode reads one check per line on stdin and answers on stdout, so a
+// long-lived parent process can run checks without spawning a tool each time.
+// A line is either a bare dependency with an optional "id", or a JSON-RPC 2.0
+// request calling "check" (params: a dependency) or "ping". Other tools are
+// reached by name, as a "tool" field on a bare line or as the method, with
+// their command line in "args"; those run the sibling binary, so unlike
+// checks each costs a process. Checks run concurrently, so replies can
+// arrive out of order; match them on id.
+
+type batchRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Tool    string          `json:"tool"`
+	Args    []string        `json:"args"`
+}
+
+// Tools that print one JSON result and exit, so they can answer a request
+var batchTools = map[string]bool{
+	"adcheck": true, "connectivity": true, "dns": true, "http-test": true, "interfaces": true,
+	"portscan": true, "quicprobe": true, "reputation": true, "traceroute": true, "vpnprobe": true, "webrtc": true,
+}
+
+// Modes of the batch tools that print one result and exit, by the
+// positional argument that selects them; the rest (connectivity mtu-agent)
+// serve or stream and would hold a batch slot until the timeout
+var batchToolModes = map[string]struct {
+	index int
+	modes map[string]bool
+}{
+	"connectivity": {1, map[string]bool{"ping": true, "tcp": true, "udp": true, "all": true, "multicast": true, "mtu": true, "dialog": true}},
+}
+
+// batchToolArgsAllowed rejects the tool modes batch cannot run: those
+// outside batchToolModes, interfaces -watch and http-test scenarios
+// repeated on an interval
+func batchToolArgsAllowed(tool string, args []string) error {
+	if mode, ok := batchToolModes[tool]; ok {
+		if len(args) <= mode.index || !mode.modes[args[mode.index]] {
+			return fmt.Errorf("%s: only one-shot modes run in batch", tool)
+		}
+	}
+	switch {
+	case tool == "interfaces" && hasFlag(args, "watch"):
+		return fmt.Errorf("interfaces -watch streams changes and cannot run in batch")
+	case tool == "http-test" && len(args) >= 3 && args[0] == "scenario":
+		return fmt.Errorf("http-test scenario with an interval runs until stopped; send one check per run instead")
+	}
+	return nil
+}
+
+// hasFlag reports whether args set any of the named flags, in any of the
+// -name, --name or -name=value forms the flag package accepts
+func hasFlag(args []string, names ...string) bool {
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "=")
+		for _, n := range names {
+			if name == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Tools get longer than a check stage; scans and traces take a while
+const batchToolTimeout = 2 * time.Minute
+
+// runBatchTool runs a tool binary from verify's own directory and returns
+// the JSON it printed. Tools that exit non-zero to report a failed check
+// still answer with their result.
+func runBatchTool(tool string, args []string) (json.RawMessage, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(filepath.Dir(self), tool)
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), batchToolTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if output = bytes.TrimSpace(output); len(output) > 0 && json.Valid(output) {
+		return output, nil
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return nil, fmt.Errorf("%s: %v: %s", tool, err, detail)
+		}
+		return nil, fmt.Errorf("%s: %v", tool, err)
+	}
+	return nil, fmt.Errorf("%s did not print a JSON result", tool)
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"` // A DependencyResult, or a tool's own JSON
+	Error  string          `json:"error,omitempty"`
+}
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcToolFailed     = -32000 // Server-defined: the tool ran but gave no result
+)
+
+func serveBatch(in io.Reader, out io.Writer, timeout time.Duration, concurrency int) error {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(out)
+	reply := func(v interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(v)
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var req batchRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			// Without a parsable line there is no way to tell which format was meant
+			reply(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			continue
+		}
+
+		rpc := req.JSONRPC != ""
+		// Notifications carry no id and get no reply
+		notification := rpc && req.ID == nil
+		respond := func(result interface{}, code int, err error) {
+			switch {
+			case notification:
+			case rpc && err != nil:
+				reply(rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: &rpcError{code, err.Error()}})
+			case rpc:
+				reply(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+			case err != nil:
+				reply(batchResponse{ID: req.ID, Error: err.Error()})
+			default:
+				reply(batchResponse{ID: req.ID, Result: result})
+			}
+		}
+
+		params := line
+		tool, args := req.Tool, req.Args
+		if rpc {
+			if req.JSONRPC != "2.0" {
+				respond(nil, rpcInvalidRequest, fmt.Errorf("unsupported jsonrpc version %q", req.JSONRPC))
+				continue
+			}
+			switch {
+			case req.Method == "ping":
+				if !notification {
+					reply(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: "pong"})
+				}
+				continue
+			case req.Method == "check":
+				params = req.Params
+			case batchTools[req.Method]:
+				var toolParams struct {
+					Args []string `json:"args"`
+				}
+				if len(req.Params) > 0 {
+					if err := json.Unmarshal(req.Params, &toolParams); err != nil {
+						respond(nil, rpcInvalidParams, fmt.Errorf("invalid %s params: %v", req.Method, err))
+						continue
+					}
+				}
+				tool, args = req.Method, toolParams.Args
+			default:
+				respond(nil, rpcMethodNotFound, fmt.Errorf("unknown method %q (use check, ping or a tool name)", req.Method))
+				continue
+			}
+		}
+
+		if tool != "" {
+			if !batchTools[tool] {
+				respond(nil, rpcMethodNotFound, fmt.Errorf("unknown tool %q", tool))
+				continue
+			}
+			if err := batchToolArgsAllowed(tool, args); err != nil {
+				respond(nil, rpcInvalidParams, err)
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				output, err := runBatchTool(tool, args)
+				if err != nil {
+					respond(nil, rpcToolFailed, err)
+					return
+				}
+				respond(output, 0, nil)
+			}()
+			continue
+		}
+
+		var dep Dependency
+		if err := json.Unmarshal(params, &dep); err != nil {
+			respond(nil, rpcInvalidParams, fmt.Errorf("invalid check: %v", err))
+			continue
+		}
+		if err := normalizeDependency(&dep); err != nil {
+			respond(nil, rpcInvalidParams, err)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := verifyDependency(dep, timeout)
+			respond(result, 0, nil)
+		}()
+	}
+	return scanner.Err()
+}
+
+// renderTable prints the pass/fail matrix, one dependency per row
+func renderTable(report VerifyReport) {
+	nameWidth, targetWidth := len("DEPENDENCY"), len("TARGET")
+	for _, r := range report.Results {
+		if len(r.Name) > nameWidth {
+			nameWidth = len(r.Name)
+		}
+		if len(r.Target) > targetWidth {
+			targetWidth = len(r.Target)
+		}
+	}
+
+	cell := func(s *StageResult) string {
+		text, color := "-", ""
+		if s != nil {
+			text = s.Status
+			switch s.Status {
+			case "pass":
+				color = ColorGreen
+			case "fail":
+				color = ColorRed
+			}
+		}
+		padded := fmt.Sprintf("%-9s", text)
+		if color == "" {
+			return padded
+		}
+		return color + padded + ColorReset
+	}
+
+	if report.Service != "" {
+		fmt.Printf("Dependencies of %s, checked from %s\n\n", report.Service, report.Host)
+	}
+	fmt.Printf("%-*s  %-5s  %-*s  %-9s%-9s%-9s%-9s%s\n", nameWidth, "DEPENDENCY", "TYPE", targetWidth, "TARGET",
+		"DNS", "CONNECT", "TLS", "HTTP", "RESULT")
+	for _, r := range report.Results {
+		verdict := ColorGreen + "PASS" + ColorReset
+		switch {
+		case !r.Passed && r.Optional:
+			verdict = ColorYellow + "WARN" + ColorReset
+		case !r.Passed:
+			verdict = ColorRed + "FAIL" + ColorReset
+		}
+		fmt.Printf("%-*s  %-5s  %-*s  %s%s%s%s%s\n", nameWidth, r.Name, r.Type, targetWidth, r.Target,
+			cell(r.DNS), cell(r.Connect), cell(r.TLS), cell(r.HTTP), verdict)
+	}
+
+	if report.Failed+report.Warnings > 0 {
+		fmt.Println()
+		for _, r := range report.Results {
+			if !r.Passed {
+				fmt.Printf("  %s: %s\n", r.Name, r.Error)
+			}
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed, %d optional failed\n", report.Passed, report.Failed, report.Warnings)
+}
+
+func main() {
+	timeout := flag.Duration("timeout", 5*time.Second, "Default timeout per stage; a dependency's timeout overrides it")
+	concurrency := flag.Int("concurrency", 10, "Dependencies checked at once")
+	table := flag.Bool("table", false, "Render a pass/fail table instead of JSON")
+	batch := flag.Bool("batch", false, "Read checks as JSON lines (or JSON-RPC 2.0 requests) on stdin and write results as JSON lines on stdout until stdin closes")
+	flag.Parse()
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	if *batch {
+		if err := serveBatch(os.Stdin, os.Stdout, *timeout, *concurrency); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: verify [options] <manifest.yaml|manifest.json>")
+		fmt.Println("Example: verify -table manifest.yaml")
+		fmt.Println("         verify -batch   (stdin: {\"id\":1,\"host\":\"orders-db.internal\",\"port\":5432})")
+		fmt.Println("         verify -batch   (stdin: {\"id\":2,\"tool\":\"dns\",\"args\":[\"example.com\",\"a\"]})")
+		fmt.Println("\nManifest:")
+		fmt.Println("  service: orders-api")
+		fmt.Println("  dependencies:")
+		fmt.Println("    - name: orders-db")
+		fmt.Println("      host: orders-db.internal")
+		fmt.Println("      port: 5432")
+		fmt.Println("    - name: payments")
+		fmt.Println("      url: https://payments.internal/health")
+		fmt.Println("      expectStatus: 200")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	manifest, err := loadManifest(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if manifest.Timeout != "" {
+		if *timeout, err = time.ParseDuration(manifest.Timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: manifest timeout: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	report := VerifyReport{
+		Service:  manifest.Service,
+		Manifest: flag.Arg(0),
+		Host:     hostname,
+		Results:  make([]DependencyResult, len(manifest.Dependencies)),
+	}
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, dep := range manifest.Dependencies {
+		wg.Add(1)
+		go func(i int, dep Dependency) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			report.Results[i] = verifyDependency(dep, *timeout)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	for _, r := range report.Results {
+		switch {
+		case r.Passed:
+			report.Passed++
+		case r.Optional:
+			report.Warnings++
+		default:
+			report.Failed++
+		}
+	}
+	report.Healthy = report.Failed == 0
+
+	if *table {
+		renderTable(report)
+	} else {
+		json.NewEncoder(os.Stdout).Encode(report)
+	}
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
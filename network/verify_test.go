@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The manifest from the README's Dependency Manifests section
+const readmeManifest = `service: orders-api
+timeout: 5s
+dependencies:
+  - name: orders-db
+    host: orders-db.internal
+    port: 5432
+  - name: events
+    type: tls
+    host: b-1.kafka.internal
+    port: 9094
+  - name: payments-api
+    url: https://payments.internal/health
+    expectStatus: 200
+  - name: s3-endpoint
+    host: bucket.vpce-0abc.s3.us-east-1.vpce.amazonaws.com
+    resolvesTo: [10.0.0.0/8]
+  - name: metrics
+    host: metrics.internal:8125
+    optional: true
+`
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want interface{}
+	}{
+		{
+			name: "readme manifest",
+			src:  readmeManifest,
+			want: map[string]interface{}{
+				"service": "orders-api",
+				"timeout": "5s",
+				"dependencies": []interface{}{
+					map[string]interface{}{"name": "orders-db", "host": "orders-db.internal", "port": int64(5432)},
+					map[string]interface{}{"name": "events", "type": "tls", "host": "b-1.kafka.internal", "port": int64(9094)},
+					map[string]interface{}{"name": "payments-api", "url": "https://payments.internal/health", "expectStatus": int64(200)},
+					map[string]interface{}{"name": "s3-endpoint", "host": "bucket.vpce-0abc.s3.us-east-1.vpce.amazonaws.com",
+						"resolvesTo": []interface{}{"10.0.0.0/8"}},
+					map[string]interface{}{"name": "metrics", "host": "metrics.internal:8125", "optional": true},
+				},
+			},
+		},
+		{
+			name: "sequence at the key's indentation",
+			src:  "dependencies:\n- host: a.internal\n- host: b.internal\n",
+			want: map[string]interface{}{"dependencies": []interface{}{
+				map[string]interface{}{"host": "a.internal"},
+				map[string]interface{}{"host": "b.internal"},
+			}},
+		},
+		{
+			name: "block sequence of scalars",
+			src:  "resolvesTo:\n  - 10.0.0.0/8\n  - 172.16.0.0/12\n",
+			want: map[string]interface{}{"resolvesTo": []interface{}{"10.0.0.0/8", "172.16.0.0/12"}},
+		},
+		{
+			name: "dash on its own line",
+			src:  "dependencies:\n  -\n    host: a.internal\n    port: 443\n",
+			want: map[string]interface{}{"dependencies": []interface{}{
+				map[string]interface{}{"host": "a.internal", "port": int64(443)},
+			}},
+		},
+		{
+			name: "flow sequences",
+			src:  "a: []\nb: [ ]\nc: [x, 2, true]\nd: [x, y,]\n",
+			want: map[string]interface{}{
+				"a": []interface{}{},
+				"b": []interface{}{},
+				"c": []interface{}{"x", int64(2), true},
+				"d": []interface{}{"x", "y"},
+			},
+		},
+		{
+			name: "quoted commas in a flow sequence",
+			src:  `resolvesTo: ["a,b", 'c, d', e]`,
+			want: map[string]interface{}{"resolvesTo": []interface{}{"a,b", "c, d", "e"}},
+		},
+		{
+			name: "quoted scalars",
+			src:  "a: \"port: 5432\"\nb: 'it''s'\nc: \"tab\\there\"\nd: \"5432\"\ne: 'true'\n",
+			want: map[string]interface{}{"a": "port: 5432", "b": "it's", "c": "tab\there", "d": "5432", "e": "true"},
+		},
+		{
+			name: "yes no on off stay strings",
+			src:  "a: yes\nb: no\nc: on\nd: off\ne: y\nf: n\n",
+			want: map[string]interface{}{"a": "yes", "b": "no", "c": "on", "d": "off", "e": "y", "f": "n"},
+		},
+		{
+			name: "booleans and nulls",
+			src:  "a: true\nb: False\nc: TRUE\nd: null\ne: ~\nf:\n",
+			want: map[string]interface{}{"a": true, "b": false, "c": true, "d": nil, "e": nil, "f": nil},
+		},
+		{
+			name: "comments and document marker",
+			src:  "---\n# orders service\nservice: orders # trailing\nurl: https://x.internal/#frag\nname: \"a # b\"\n",
+			want: map[string]interface{}{"service": "orders", "url": "https://x.internal/#frag", "name": "a # b"},
+		},
+		{
+			name: "CRLF line endings",
+			src:  "service: orders\r\ntimeout: 5s\r\n",
+			want: map[string]interface{}{"service": "orders", "timeout": "5s"},
+		},
+		{
+			name: "nested mappings",
+			src:  "a:\n  b:\n    c: 1\n  d: 2\ne: 3\n",
+			want: map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": int64(1)}, "d": int64(2)}, "e": int64(3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("parseYAML: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"empty", "# nothing\n---\n", "empty manifest"},
+		{"tab indentation", "a:\n\tb: 1\n", "tabs"},
+		{"duplicate key", "a: 1\na: 2\n", "duplicate key"},
+		{"unterminated list", "a: [x, y\n", "unterminated list"},
+		{"unterminated string", "a: \"x\n", "unterminated string"},
+		{"unterminated string in a list", "a: [\"x, y]\n", "unterminated string"},
+		{"empty list item", "a: [x, , y]\n", "empty list item"},
+		{"nested flow list", "a: [[x], y]\n", "nested flow"},
+		{"flow mapping", "a: {b: 1}\n", "flow mappings"},
+		{"bad indentation", "a: 1\n  b: 2\n", "indentation"},
+		{"not a mapping", "a: 1\njust text\n", "expected \"key: value\""},
+		{"line number", "a: 1\nb: 2\nc: [x\n", "line 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.src))
+			if err == nil {
+				t.Fatalf("parseYAML = %#v, expected an error", got)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadManifestReadmeExample(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(path, []byte(readmeManifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Service != "orders-api" || manifest.Timeout != "5s" || len(manifest.Dependencies) != 5 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+
+	deps := manifest.Dependencies
+	wantTypes := []string{"tcp", "tls", "http", "dns", "tcp"}
+	for i, want := range wantTypes {
+		if deps[i].Type != want {
+			t.Errorf("%s: type %q, want %q", deps[i].Name, deps[i].Type, want)
+		}
+	}
+	if deps[4].Host != "metrics.internal" || deps[4].Port != 8125 || !deps[4].Optional {
+		t.Errorf("metrics = %+v, want host:port split and optional", deps[4])
+	}
+	if !reflect.DeepEqual(deps[3].ResolvesTo, []string{"10.0.0.0/8"}) {
+		t.Errorf("resolvesTo = %v", deps[3].ResolvesTo)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenVPN control channel opcodes (high five bits of the first byte)
+const (
+	ovpnHardResetClientV2 = 7
+	ovpnHardResetServerV2 = 8
+)
+
+var ovpnOpcodes = map[byte]string{
+	1:  "P_CONTROL_HARD_RESET_CLIENT_V1",
+	2:  "P_CONTROL_HARD_RESET_SERVER_V1",
+	3:  "P_CONTROL_SOFT_RESET_V1",
+	4:  "P_CONTROL_V1",
+	5:  "P_ACK_V1",
+	6:  "P_DATA_V1",
+	7:  "P_CONTROL_HARD_RESET_CLIENT_V2",
+	8:  "P_CONTROL_HARD_RESET_SERVER_V2",
+	9:  "P_DATA_V2",
+	10: "P_CONTROL_HARD_RESET_CLIENT_V3",
+}
+
+// IKEv2 payload, exchange and notify numbers from RFC 7296
+const (
+	ikeSA        = 33
+	ikeKE        = 34
+	ikeNonce     = 40
+	ikeNotify    = 41
+	ikeVendorID  = 43
+	ikeSAInit    = 34
+	ikeInitiator = 0x08
+	ikeResponse  = 0x20
+
+	notifyNoProposalChosen = 14
+	notifyInvalidKE        = 17
+	notifyCookie           = 16390
+)
+
+var ikeNotifyNames = map[uint16]string{
+	7:     "INVALID_SYNTAX",
+	14:    "NO_PROPOSAL_CHOSEN",
+	17:    "INVALID_KE_PAYLOAD",
+	24:    "AUTHENTICATION_FAILED",
+	16388: "NAT_DETECTION_SOURCE_IP",
+	16389: "NAT_DETECTION_DESTINATION_IP",
+	16390: "COOKIE",
+	16404: "MULTIPLE_AUTH_SUPPORTED",
+	16430: "IKEV2_FRAGMENTATION_SUPPORTED",
+	16431: "SIGNATURE_HASH_ALGORITHMS",
+	16435: "REDIRECT_SUPPORTED",
+	16399: "REDIRECT",
+}
+
+var ikeTransformNames = map[byte]map[uint16]string{
+	1: {3: "ENCR_3DES", 12: "ENCR_AES_CBC", 20: "ENCR_AES_GCM_16"},
+	2: {2: "PRF_HMAC_SHA1", 5: "PRF_HMAC_SHA2_256", 6: "PRF_HMAC_SHA2_384"},
+	3: {2: "AUTH_HMAC_SHA1_96", 12: "AUTH_HMAC_SHA2_256_128", 13: "AUTH_HMAC_SHA2_384_192"},
+	4: {2: "MODP_1024", 5: "MODP_1536", 14: "MODP_2048", 15: "MODP_3072", 19: "ECP_256", 20: "ECP_384", 21: "ECP_521", 31: "CURVE25519"},
+}
+
+// Key exchange data length per DH group
+var ikeKELength = map[uint16]int{2: 128, 5: 192, 14: 256, 15: 384, 19: 64, 20: 96, 21: 132, 31: 32}
+
+// Vendor IDs that are MD5 hashes rather than readable text
+var knownVendorIDs = map[string]string{
+	"4a131c81070358455c5728f20e95452f": "RFC 3947 NAT-T",
+	"afcad71368a1f1c96b8696fc77570100": "Dead Peer Detection v1.0",
+	"12f5f28c457168a9702d9fe274cc0100": "Cisco Unity",
+	"882fe56d6fd20dbc2251613b2ebe5beb": "strongSwan",
+	"4048b7d56ebce88525e7de7f00d6c2d3": "IKE Fragmentation",
+	"1e2b516905991c7d7c96fcbfb587e461": "Microsoft Windows (MS NT5 ISAKMPOAKLEY)",
+	"4865617274426561745f4e6f74696679": "Heartbeat Notify",
+}
+
+type OpenVPNResult struct {
+	Transport       string  `json:"transport"`
+	Port            int     `json:"port"`
+	Responded       bool    `json:"responded"`
+	RTTMs           float64 `json:"rttMs,omitempty"`
+	Opcode          string  `json:"opcode,omitempty"`
+	ServerSessionID string  `json:"serverSessionId,omitempty"`
+	AckedOurSession bool    `json:"ackedOurSession,omitempty"`
+	Note            string  `json:"note,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type VendorID struct {
+	Hex  string `json:"hex"`
+	Name string `json:"name,omitempty"`
+}
+
+type IKEResult struct {
+	Port           int        `json:"port"`
+	Responded      bool       `json:"responded"`
+	RTTMs          float64    `json:"rttMs,omitempty"`
+	Accepted       bool       `json:"accepted"` // Responder chose one of our proposals
+	ResponderSPI   string     `json:"responderSpi,omitempty"`
+	Proposal       []string   `json:"proposal,omitempty"`
+	DHGroup        uint16     `json:"dhGroup,omitempty"`
+	CookieRequired bool       `json:"cookieRequired,omitempty"`
+	Notifies       []string   `json:"notifies,omitempty"`
+	VendorIDs      []VendorID `json:"vendorIds,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+type VPNReport struct {
+	Target  string          `json:"target"`
+	OpenVPN []OpenVPNResult `json:"openvpn,omitempty"`
+	IKEv2   *IKEResult      `json:"ikev2,omitempty"`
+	Healthy bool            `json:"healthy"`
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// exchangeUDP sends a datagram and waits for the first reply, resending on
+// timeout since either packet may simply be lost
+func exchangeUDP(addr string, packet []byte, timeout time.Duration, attempts int, accept func([]byte) bool) ([]byte, time.Duration, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt < attempts; attempt++ {
+		start := time.Now()
+		if _, err := conn.Write(packet); err != nil {
+			return nil, 0, err
+		}
+		conn.SetReadDeadline(start.Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				// ICMP port unreachable surfaces as connection refused
+				return nil, 0, err
+			}
+			if accept(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), time.Since(start), nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("no response after %d attempts", attempts)
+}
+
+// openVPNReset builds a P_CONTROL_HARD_RESET_CLIENT_V2 with no acks and
+// packet id 0, which is what a client sends before any TLS traffic
+func openVPNReset(session []byte) []byte {
+	packet := []byte{ovpnHardResetClientV2 << 3}
+	packet = append(packet, session...)
+	packet = append(packet, 0)          // ack array length
+	packet = append(packet, 0, 0, 0, 0) // message packet id
+	return packet
+}
+
+// parseOpenVPNReply reads the opcode, server session and whether the server
+// acknowledged our session id
+func parseOpenVPNReply(reply, session []byte, result *OpenVPNResult) {
+	opcode := reply[0] >> 3
+	result.Opcode = ovpnOpcodes[opcode]
+	if result.Opcode == "" {
+		result.Opcode = fmt.Sprintf("unknown(%d)", opcode)
+	}
+	if len(reply) < 10 {
+		return
+	}
+	result.ServerSessionID = hex.EncodeToString(reply[1:9])
+
+	acks := int(reply[9])
+	remote := 10 + acks*4
+	if acks > 0 && len(reply) >= remote+8 {
+		result.AckedOurSession = bytes.Equal(reply[remote:remote+8], session)
+	}
+}
+
+func probeOpenVPN(host string, port int, transport string, timeout time.Duration, attempts int) OpenVPNResult {
+	result := OpenVPNResult{Transport: transport, Port: port}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	session := randomBytes(8)
+	packet := openVPNReset(session)
+
+	var reply []byte
+	var rtt time.Duration
+	var err error
+	if transport == "udp" {
+		reply, rtt, err = exchangeUDP(addr, packet, timeout, attempts, func(b []byte) bool { return len(b) > 0 })
+	} else {
+		reply, rtt, err = exchangeOpenVPNTCP(addr, packet, timeout)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		if strings.Contains(err.Error(), "refused") {
+			result.Note = "nothing listening on the port"
+		} else {
+			// Servers with tls-auth or tls-crypt drop unauthenticated resets silently
+			result.Note = "no reply: the port may be filtered, or the server requires tls-auth/tls-crypt"
+		}
+		return result
+	}
+
+	result.Responded = true
+	result.RTTMs = float64(rtt.Microseconds()) / 1000
+	parseOpenVPNReply(reply, session, &result)
+	if reply[0]>>3 != ovpnHardResetServerV2 {
+		result.Note = "unexpected reply opcode; endpoint may not be OpenVPN"
+	}
+	return result
+}
+
+// exchangeOpenVPNTCP frames the packet with OpenVPN's two byte length prefix
+func exchangeOpenVPNTCP(addr string, packet []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+	if _, err := conn.Write(append(framed, packet...)); err != nil {
+		return nil, 0, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, 0, fmt.Errorf("connection accepted but no reset reply: %v", err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if len(reply) == 0 {
+		return nil, 0, fmt.Errorf("empty reply frame")
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, 0, err
+	}
+	return reply, time.Since(start), nil
+}
+
+// ikePayload prepends the generic payload header
+func ikePayload(next byte, body []byte) []byte {
+	header := []byte{next, 0}
+	header = binary.BigEndian.AppendUint16(header, uint16(4+len(body)))
+	return append(header, body...)
+}
+
+func ikeTransform(last bool, kind byte, id uint16, keyLength uint16) []byte {
+	more := byte(3)
+	if last {
+		more = 0
+	}
+	body := []byte{kind, 0}
+	body = binary.BigEndian.AppendUint16(body, id)
+	if keyLength > 0 {
+		body = binary.BigEndian.AppendUint16(body, 0x800e) // Key Length attribute, TV format
+		body = binary.BigEndian.AppendUint16(body, keyLength)
+	}
+	transform := []byte{more, 0}
+	transform = binary.BigEndian.AppendUint16(transform, uint16(4+len(body)))
+	return append(transform, body...)
+}
+
+type ikeOffer struct {
+	kind      byte
+	id        uint16
+	keyLength uint16
+}
+
+func ikeProposal(number byte, last bool, offers []ikeOffer) []byte {
+	var transforms []byte
+	for i, offer := range offers {
+		transforms = append(transforms, ikeTransform(i == len(offers)-1, offer.kind, offer.id, offer.keyLength)...)
+	}
+	more := byte(2)
+	if last {
+		more = 0
+	}
+	proposal := []byte{more, 0}
+	proposal = binary.BigEndian.AppendUint16(proposal, uint16(8+len(transforms)))
+	proposal = append(proposal, number, 1, 0, byte(len(offers))) // protocol IKE, no SPI
+	return append(proposal, transforms...)
+}
+
+// ikeSAInitPacket offers the common site-to-site suites: AES-CBC with SHA2
+// or SHA1, and AES-GCM, over MODP-2048 and the NIST curves
+func ikeSAInitPacket(spi []byte, group uint16, cookie []byte) []byte {
+	dhOffers := []ikeOffer{{4, group, 0}}
+	for _, g := range []uint16{14, 19, 20, 21, 31, 15, 5, 2} {
+		if g != group {
+			dhOffers = append(dhOffers, ikeOffer{4, g, 0})
+		}
+	}
+
+	cbc := []ikeOffer{
+		{1, 12, 256}, {1, 12, 128},
+		{2, 5, 0}, {2, 6, 0}, {2, 2, 0},
+		{3, 12, 0}, {3, 13, 0}, {3, 2, 0},
+	}
+	gcm := []ikeOffer{{1, 20, 256}, {1, 20, 128}, {2, 5, 0}, {2, 6, 0}}
+	sa := append(ikeProposal(1, false, append(cbc, dhOffers...)), ikeProposal(2, true, append(gcm, dhOffers...))...)
+
+	// Random key exchange data is enough to get a reply; a leading zero
+	// byte keeps the MODP value below the prime
+	keData := randomBytes(ikeKELength[group])
+	keData[0] = 0
+	ke := binary.BigEndian.AppendUint16(nil, group)
+	ke = append(ke, 0, 0)
+	ke = append(ke, keData...)
+
+	var payloads []byte
+	first := byte(ikeSA)
+	if cookie != nil {
+		notify := []byte{0, 0} // protocol none, no SPI
+		notify = binary.BigEndian.AppendUint16(notify, notifyCookie)
+		payloads = ikePayload(ikeSA, append(notify, cookie...))
+		first = ikeNotify
+	}
+	payloads = append(payloads, ikePayload(ikeKE, sa)...)
+	payloads = append(payloads, ikePayload(ikeNonce, ke)...)
+	payloads = append(payloads, ikePayload(0, randomBytes(32))...)
+
+	header := append([]byte(nil), spi...)
+	header = append(header, make([]byte, 8)...) // responder SPI is zero
+	header = append(header, first, 0x20, ikeSAInit, ikeInitiator)
+	header = append(header, 0, 0, 0, 0) // message id
+	header = binary.BigEndian.AppendUint32(header, uint32(28+len(payloads)))
+	return append(header, payloads...)
+}
+
+// parseIKEReply walks the payload chain of an IKE_SA_INIT response. It
+// returns the cookie or suggested DH group when the responder asks for a retry.
+func parseIKEReply(reply []byte, result *IKEResult) (cookie []byte, group uint16) {
+	result.ResponderSPI = hex.EncodeToString(reply[8:16])
+	next := reply[16]
+	offset := 28
+	for next != 0 && offset+4 <= len(reply) {
+		kind := next
+		next = reply[offset]
+		length := int(binary.BigEndian.Uint16(reply[offset+2:]))
+		if length < 4 || offset+length > len(reply) {
+			break
+		}
+		body := reply[offset+4 : offset+length]
+		offset += length
+
+		switch kind {
+		case ikeSA:
+			result.Accepted = true
+			result.Proposal = parseChosenProposal(body)
+		case ikeKE:
+			if len(body) >= 2 {
+				result.DHGroup = binary.BigEndian.Uint16(body)
+			}
+		case ikeNotify:
+			// Protocol ID, SPI size and type, then the SPI before the data
+			if len(body) < 4 || 4+int(body[1]) > len(body) {
+				continue
+			}
+			notifyType := binary.BigEndian.Uint16(body[2:])
+			data := body[4+int(body[1]):]
+			name := ikeNotifyNames[notifyType]
+			if name == "" {
+				name = fmt.Sprintf("NOTIFY(%d)", notifyType)
+			}
+			result.Notifies = append(result.Notifies, name)
+			switch notifyType {
+			case notifyCookie:
+				cookie = append([]byte(nil), data...)
+			case notifyInvalidKE:
+				if len(data) >= 2 {
+					group = binary.BigEndian.Uint16(data)
+				}
+			}
+		case ikeVendorID:
+			result.VendorIDs = append(result.VendorIDs, describeVendorID(body))
+		}
+	}
+	return cookie, group
+}
+
+func parseChosenProposal(sa []byte) []string {
+	if len(sa) < 8 {
+		return nil
+	}
+	var names []string
+	offset := 8 + int(sa[6]) // skip the proposal header and SPI
+	for offset+8 <= len(sa) {
+		length := int(binary.BigEndian.Uint16(sa[offset+2:]))
+		if length < 8 || offset+length > len(sa) {
+			break
+		}
+		kind := sa[offset+4]
+		id := binary.BigEndian.Uint16(sa[offset+6:])
+		name := ikeTransformNames[kind][id]
+		if name == "" {
+			name = fmt.Sprintf("TRANSFORM(%d:%d)", kind, id)
+		}
+		if length >= 12 && binary.BigEndian.Uint16(sa[offset+8:]) == 0x800e {
+			name += fmt.Sprintf("_%d", binary.BigEndian.Uint16(sa[offset+10:]))
+		}
+		names = append(names, name)
+		offset += length
+	}
+	return names
+}
+
+// describeVendorID names a vendor ID by known hash, by known prefix, or as
+// text when the vendor sent a readable string such as "FLEXVPN-SUPPORTED"
+func describeVendorID(data []byte) VendorID {
+	vid := VendorID{Hex: hex.EncodeToString(data)}
+	for known, name := range knownVendorIDs {
+		if strings.HasPrefix(vid.Hex, known) {
+			vid.Name = name
+			return vid
+		}
+	}
+	for _, b := range data {
+		if b < 32 || b > 126 {
+			return vid
+		}
+	}
+	vid.Name = string(data)
+	return vid
+}
+
+func probeIKEv2(host string, port int, timeout time.Duration, attempts int) *IKEResult {
+	result := &IKEResult{Port: port}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	spi := randomBytes(8)
+
+	group := uint16(14)
+	var cookie []byte
+	// One retry each for a cookie challenge and a different DH group
+	for round := 0; round < 3; round++ {
+		packet := ikeSAInitPacket(spi, group, cookie)
+		if port == 4500 {
+			packet = append([]byte{0, 0, 0, 0}, packet...) // non-ESP marker
+		}
+
+		reply, rtt, err := exchangeUDP(addr, packet, timeout, attempts, func(b []byte) bool {
+			if port == 4500 && len(b) >= 4 && bytes.Equal(b[:4], []byte{0, 0, 0, 0}) {
+				b = b[4:]
+			}
+			return len(b) >= 28 && bytes.Equal(b[:8], spi) && b[18] == ikeSAInit && b[19]&ikeResponse != 0
+		})
+		if err != nil {
+			if !result.Responded {
+				result.Error = err.Error()
+			}
+			return result
+		}
+		if port == 4500 {
+			reply = reply[4:]
+		}
+
+		*result = IKEResult{Port: port, Responded: true, RTTMs: float64(rtt.Microseconds()) / 1000, CookieRequired: result.CookieRequired}
+		newCookie, newGroup := parseIKEReply(reply, result)
+		switch {
+		case newCookie != nil && cookie == nil:
+			cookie = newCookie
+			result.CookieRequired = true
+		case newGroup != 0 && newGroup != group && ikeKELength[newGroup] > 0:
+			group = newGroup
+		default:
+			if !result.Accepted && hasNotify(result.Notifies, notifyNoProposalChosen) {
+				result.Error = "responder rejected every offered proposal"
+			}
+			return result
+		}
+	}
+	return result
+}
+
+func hasNotify(notifies []string, notifyType uint16) bool {
+	for _, n := range notifies {
+		if n == ikeNotifyNames[notifyType] {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	probes := flag.String("probe", "openvpn,ikev2", "Probes to run: openvpn, ikev2 or both")
+	openvpnPort := flag.Int("openvpn-port", 1194, "OpenVPN port")
+	transport := flag.String("transport", "udp", "OpenVPN transport: udp, tcp or both")
+	ikePort := flag.Int("ike-port", 500, "IKE port (4500 adds the NAT-T non-ESP marker)")
+	timeout := flag.Duration("timeout", 3*time.Second, "Timeout per attempt")
+	attempts := flag.Int("attempts", 2, "UDP send attempts before giving up")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 1 {
+		fmt.Println("Usage: vpnprobe [options] <host>")
+		fmt.Println("Example: vpnprobe vpn.example.com")
+		fmt.Println("         vpnprobe -probe openvpn -transport both -openvpn-port 443 vpn.example.com")
+		fmt.Println("         vpnprobe -probe ikev2 -ike-port 4500 203.0.113.10")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *attempts < 1 {
+		*attempts = 1
+	}
+
+	report := VPNReport{Target: args[0]}
+	for _, probe := range strings.Split(*probes, ",") {
+		switch strings.TrimSpace(probe) {
+		case "openvpn":
+			transports := []string{*transport}
+			if *transport == "both" {
+				transports = []string{"udp", "tcp"}
+			}
+			for _, t := range transports {
+				if t != "udp" && t != "tcp" {
+					fmt.Fprintf(os.Stderr, "Error: unknown transport %q\n", t)
+					os.Exit(1)
+				}
+				report.OpenVPN = append(report.OpenVPN, probeOpenVPN(args[0], *openvpnPort, t, *timeout, *attempts))
+			}
+		case "ikev2":
+			report.IKEv2 = probeIKEv2(args[0], *ikePort, *timeout, *attempts)
+		default:
+			fmt.Fprintf(os.Stderr, "Error: unknown probe %q (use openvpn or ikev2)\n", probe)
+			os.Exit(1)
+		}
+	}
+
+	// Healthy means every endpoint probed answered its control channel
+	report.Healthy = true
+	for _, r := range report.OpenVPN {
+		report.Healthy = report.Healthy && r.Responded
+	}
+	if report.IKEv2 != nil {
+		report.Healthy = report.Healthy && report.IKEv2.Responded
+	}
+
+	json.NewEncoder(os.Stdout).Encode(report)
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,858 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ICECandidate is one candidate a WebRTC client on this network would gather
+type ICECandidate struct {
+	Type     string `json:"type"` // host, srflx or relay
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port,omitempty"`
+	Server   string `json:"server,omitempty"`
+}
+
+type TURNAllocation struct {
+	Success       bool   `json:"success"`
+	RelayAddress  string `json:"relayAddress,omitempty"`
+	LifetimeSec   int    `json:"lifetimeSec,omitempty"`
+	Realm         string `json:"realm,omitempty"`
+	AllocateMs    int64  `json:"allocateMs"`
+	RelayPings    int    `json:"relayPings"`
+	RelayReplies  int    `json:"relayReplies"`
+	RelayRTT      int64  `json:"relayRttMs"`
+	RelayRTTError string `json:"relayRttError,omitempty"`
+	ErrorCode     int    `json:"errorCode,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type ICEServerResult struct {
+	URL           string          `json:"url"`
+	Transport     string          `json:"transport"`
+	Address       string          `json:"address,omitempty"`
+	Reachable     bool            `json:"reachable"`
+	RTT           int64           `json:"rttMs"`
+	MappedAddress string          `json:"mappedAddress,omitempty"`
+	Allocation    *TURNAllocation `json:"allocation,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+type WebRTCReport struct {
+	Servers        []ICEServerResult `json:"servers"`
+	Candidates     []ICECandidate    `json:"candidates"`
+	CandidateTypes map[string]int    `json:"candidateTypes"`
+	NATMapping     string            `json:"natMapping"`
+	GatheringMs    int64             `json:"gatheringMs"`
+	Issues         []string          `json:"issues"`
+	Healthy        bool              `json:"healthy"`
+}
+
+// STUN (RFC 5389) and TURN (RFC 5766) message types and attributes. All
+// methods used here fit in the low four bits, so a message type is simply
+// method | class.
+const (
+	stunMagicCookie = 0x2112A442
+	stunHeaderLen   = 20
+
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+
+	classRequest    = 0x000
+	classIndication = 0x010
+	classSuccess    = 0x100
+	classError      = 0x110
+
+	attrMappedAddress      = 0x0001
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrLifetime           = 0x000D
+	attrXorPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXorRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrXorMappedAddress   = 0x0020
+
+	protocolUDP = 17
+)
+
+type stunAttr struct {
+	typ   uint16
+	value []byte
+}
+
+type stunMessage struct {
+	typ   uint16
+	txID  [12]byte
+	attrs []stunAttr
+}
+
+type stunError struct {
+	code   int
+	reason string
+}
+
+func (e *stunError) Error() string {
+	if e.code == 401 {
+		return fmt.Sprintf("%d %s (check -user and -credential)", e.code, e.reason)
+	}
+	return fmt.Sprintf("%d %s", e.code, e.reason)
+}
+
+func newStunMessage(typ uint16) *stunMessage {
+	m := &stunMessage{typ: typ}
+	rand.Read(m.txID[:])
+	return m
+}
+
+func (m *stunMessage) class() uint16 { return m.typ & 0x110 }
+
+func (m *stunMessage) add(typ uint16, value []byte) {
+	m.attrs = append(m.attrs, stunAttr{typ: typ, value: value})
+}
+
+func (m *stunMessage) get(typ uint16) ([]byte, bool) {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+
+// encode serializes the message, appending MESSAGE-INTEGRITY when a key is given
+func (m *stunMessage) encode(key []byte) []byte {
+	b := make([]byte, stunHeaderLen, 256)
+	binary.BigEndian.PutUint16(b[0:], m.typ)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], m.txID[:])
+	for _, a := range m.attrs {
+		b = binary.BigEndian.AppendUint16(b, a.typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.value)))
+		b = append(b, a.value...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	if key != nil {
+		// The HMAC covers the header with a length that already includes the integrity attribute
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderLen+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		b = binary.BigEndian.AppendUint16(b, attrMessageIntegrity)
+		b = binary.BigEndian.AppendUint16(b, 20)
+		b = mac.Sum(b)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderLen))
+	return b
+}
+
+func decodeStunMessage(b []byte) (*stunMessage, error) {
+	if len(b) < stunHeaderLen || b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:]) != stunMagicCookie {
+		return nil, errors.New("not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if stunHeaderLen+length > len(b) {
+		return nil, errors.New("truncated STUN message")
+	}
+	m := &stunMessage{typ: binary.BigEndian.Uint16(b)}
+	copy(m.txID[:], b[8:20])
+	body := b[stunHeaderLen : stunHeaderLen+length]
+	for len(body) >= 4 {
+		typ := binary.BigEndian.Uint16(body)
+		n := int(binary.BigEndian.Uint16(body[2:]))
+		if 4+n > len(body) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		m.add(typ, body[4:4+n])
+		padded := 4 + (n+3)&^3
+		if padded > len(body) {
+			break
+		}
+		body = body[padded:]
+	}
+	return m, nil
+}
+
+func (m *stunMessage) errorCode() (int, string) {
+	v, ok := m.get(attrErrorCode)
+	if !ok || len(v) < 4 {
+		return 0, "error response without ERROR-CODE"
+	}
+	return int(v[2]&0x07)*100 + int(v[3]), string(v[4:])
+}
+
+// address decodes an XOR-*-ADDRESS attribute, or a plain MAPPED-ADDRESS from
+// pre-RFC 5389 servers
+func (m *stunMessage) address(typ uint16) (*net.UDPAddr, bool) {
+	v, ok := m.get(typ)
+	if !ok {
+		if typ != attrXorMappedAddress {
+			return nil, false
+		}
+		if v, ok = m.get(attrMappedAddress); !ok || len(v) < 8 {
+			return nil, false
+		}
+		ip := net.IP(append([]byte(nil), v[4:]...))
+		return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(v[2:]))}, len(ip) == 4 || len(ip) == 16
+	}
+	if len(v) < 8 {
+		return nil, false
+	}
+	mask := make([]byte, 16)
+	binary.BigEndian.PutUint32(mask, stunMagicCookie)
+	copy(mask[4:], m.txID[:])
+	ip := make(net.IP, len(v)-4)
+	if len(ip) != 4 && len(ip) != 16 {
+		return nil, false
+	}
+	for i := range ip {
+		ip[i] = v[4+i] ^ mask[i]
+	}
+	port := binary.BigEndian.Uint16(v[2:]) ^ uint16(stunMagicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, true
+}
+
+func (m *stunMessage) addAddress(typ uint16, addr *net.UDPAddr) {
+	ip, family := addr.IP.To4(), byte(0x01)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 0x02
+	}
+	mask := make([]byte, 16)
+	binary.BigEndian.PutUint32(mask, stunMagicCookie)
+	copy(mask[4:], m.txID[:])
+	v := []byte{0, family}
+	v = binary.BigEndian.AppendUint16(v, uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		v = append(v, ip[i]^mask[i])
+	}
+	m.add(typ, v)
+}
+
+// stunTransport exchanges STUN messages with one server, either on a UDP
+// socket (which may be shared between servers) or over a TCP/TLS stream
+type stunTransport struct {
+	udp    *net.UDPConn
+	server *net.UDPAddr
+	stream net.Conn
+}
+
+func (t *stunTransport) send(b []byte) error {
+	if t.stream != nil {
+		_, err := t.stream.Write(b)
+		return err
+	}
+	_, err := t.udp.WriteToUDP(b, t.server)
+	return err
+}
+
+func (t *stunTransport) receive(deadline time.Time) (*stunMessage, error) {
+	if t.stream != nil {
+		t.stream.SetReadDeadline(deadline)
+		header := make([]byte, stunHeaderLen)
+		if _, err := io.ReadFull(t.stream, header); err != nil {
+			return nil, err
+		}
+		b := make([]byte, stunHeaderLen+int(binary.BigEndian.Uint16(header[2:])))
+		copy(b, header)
+		if _, err := io.ReadFull(t.stream, b[stunHeaderLen:]); err != nil {
+			return nil, err
+		}
+		return decodeStunMessage(b)
+	}
+
+	t.udp.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := t.udp.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Stray datagrams from other servers or peers are not ours to answer
+		if !from.IP.Equal(t.server.IP) || from.Port != t.server.Port {
+			continue
+		}
+		if m, err := decodeStunMessage(buf[:n]); err == nil {
+			return m, nil
+		}
+	}
+}
+
+// roundTrip sends a request and waits for its response, retransmitting on
+// UDP with a doubling interval as RFC 5389 section 7.2.1 describes
+func (t *stunTransport) roundTrip(req *stunMessage, key []byte, timeout time.Duration) (*stunMessage, time.Duration, error) {
+	b := req.encode(key)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	rto := 500 * time.Millisecond
+	for {
+		sent := time.Now()
+		if err := t.send(b); err != nil {
+			return nil, 0, err
+		}
+		wait := deadline
+		if t.stream == nil && sent.Add(rto).Before(deadline) {
+			wait = sent.Add(rto)
+		}
+		for {
+			m, err := t.receive(wait)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && wait.Before(deadline) {
+					break
+				}
+				if time.Now().After(deadline) {
+					return nil, 0, fmt.Errorf("no response within %v", timeout)
+				}
+				return nil, 0, err
+			}
+			if m.txID == req.txID {
+				// Measure from the transmission that was answered
+				return m, time.Since(sent), nil
+			}
+		}
+		rto *= 2
+	}
+}
+
+func (t *stunTransport) Close() {
+	if t.stream != nil {
+		t.stream.Close()
+	}
+}
+
+// turnClient keeps the long-term credential state (RFC 5389 section 10.2)
+// needed to sign TURN requests
+type turnClient struct {
+	t        *stunTransport
+	username string
+	password string
+	realm    string
+	nonce    string
+}
+
+func (c *turnClient) key() []byte {
+	sum := md5.Sum([]byte(c.username + ":" + c.realm + ":" + c.password))
+	return sum[:]
+}
+
+// request sends an authenticated request, learning the realm and nonce from
+// the server's 401 challenge and refreshing a stale nonce (438)
+func (c *turnClient) request(method uint16, timeout time.Duration, build func(*stunMessage)) (*stunMessage, time.Duration, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		req := newStunMessage(method | classRequest)
+		if build != nil {
+			build(req)
+		}
+		var key []byte
+		if c.nonce != "" {
+			req.add(attrUsername, []byte(c.username))
+			req.add(attrRealm, []byte(c.realm))
+			req.add(attrNonce, []byte(c.nonce))
+			key = c.key()
+		}
+		resp, rtt, err := c.t.roundTrip(req, key, timeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.class() == classSuccess {
+			return resp, rtt, nil
+		}
+		code, reason := resp.errorCode()
+		challenged := code == 401 && c.nonce == "" && c.username != ""
+		if challenged || code == 438 {
+			if realm, ok := resp.get(attrRealm); ok {
+				c.realm = string(realm)
+			}
+			if nonce, ok := resp.get(attrNonce); ok {
+				c.nonce = string(nonce)
+				continue
+			}
+		}
+		return nil, rtt, &stunError{code: code, reason: reason}
+	}
+	return nil, 0, errors.New("server kept rejecting the nonce")
+}
+
+type iceServer struct {
+	url       string
+	turn      bool
+	host      string
+	port      int
+	transport string // udp, tcp or tls
+}
+
+// parseICEServer accepts stun:, stuns:, turn: and turns: URIs (RFC 7064, RFC 7065)
+func parseICEServer(uri string) (iceServer, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return iceServer{}, fmt.Errorf("%s: expected stun:, stuns:, turn: or turns:", uri)
+	}
+	s := iceServer{url: uri}
+	rest = strings.TrimPrefix(rest, "//")
+	rest, query, _ := strings.Cut(rest, "?")
+	secure := strings.HasSuffix(scheme, "s")
+	switch scheme {
+	case "stun", "stuns":
+	case "turn", "turns":
+		s.turn = true
+	default:
+		return iceServer{}, fmt.Errorf("%s: unsupported scheme %q", uri, scheme)
+	}
+
+	s.transport = "udp"
+	if secure {
+		s.transport = "tls"
+	}
+	if query != "" {
+		transport, found := strings.CutPrefix(query, "transport=")
+		if !found || !s.turn || (transport != "udp" && transport != "tcp") {
+			return iceServer{}, fmt.Errorf("%s: only turn URIs take ?transport=udp|tcp", uri)
+		}
+		switch {
+		case transport == "tcp" && !secure:
+			s.transport = "tcp"
+		case transport == "udp" && secure:
+			return iceServer{}, fmt.Errorf("%s: TURN over DTLS is not supported", uri)
+		}
+	}
+
+	s.port = 3478
+	if secure {
+		s.port = 5349
+	}
+	s.host = rest
+	if strings.HasPrefix(rest, "[") || strings.Count(rest, ":") == 1 {
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			return iceServer{}, fmt.Errorf("%s: %v", uri, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return iceServer{}, fmt.Errorf("%s: invalid port %q", uri, port)
+		}
+		s.host, s.port = host, p
+	}
+	s.host = strings.Trim(s.host, "[]")
+	if s.host == "" {
+		return iceServer{}, fmt.Errorf("%s: missing host", uri)
+	}
+	return s, nil
+}
+
+func (s iceServer) hostPort() string { return net.JoinHostPort(s.host, strconv.Itoa(s.port)) }
+
+// connect opens a transport to the server; UDP servers share conn so that the
+// mapped addresses they report can be compared
+func (s iceServer) connect(conn *net.UDPConn, timeout time.Duration) (*stunTransport, string, error) {
+	switch s.transport {
+	case "tcp":
+		c, err := net.DialTimeout("tcp", s.hostPort(), timeout)
+		if err != nil {
+			return nil, "", err
+		}
+		return &stunTransport{stream: c}, c.RemoteAddr().String(), nil
+	case "tls":
+		dialer := &net.Dialer{Timeout: timeout}
+		c, err := tls.DialWithDialer(dialer, "tcp", s.hostPort(), &tls.Config{ServerName: s.host})
+		if err != nil {
+			return nil, "", err
+		}
+		return &stunTransport{stream: c}, c.RemoteAddr().String(), nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.hostPort())
+	if err != nil {
+		return nil, "", err
+	}
+	return &stunTransport{udp: conn, server: addr}, addr.String(), nil
+}
+
+func ms(d time.Duration) int64 { return d.Milliseconds() }
+
+func splitAddr(addr *net.UDPAddr) (string, int) { return addr.IP.String(), addr.Port }
+
+// testSTUN sends a Binding request and records the server reflexive address
+func testSTUN(s iceServer, conn *net.UDPConn, timeout time.Duration) (ICEServerResult, []ICECandidate) {
+	result := ICEServerResult{URL: s.url, Transport: s.transport}
+	t, remote, err := s.connect(conn, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer t.Close()
+	result.Address = remote
+
+	resp, rtt, err := t.roundTrip(newStunMessage(methodBinding|classRequest), nil, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Reachable = true
+	result.RTT = ms(rtt)
+	if resp.class() != classSuccess {
+		code, reason := resp.errorCode()
+		result.Error = (&stunError{code: code, reason: reason}).Error()
+		return result, nil
+	}
+	mapped, ok := resp.address(attrXorMappedAddress)
+	if !ok {
+		result.Error = "binding response without a mapped address"
+		return result, nil
+	}
+	result.MappedAddress = mapped.String()
+
+	// Browsers only gather server reflexive candidates over UDP
+	if s.transport != "udp" {
+		return result, nil
+	}
+	ip, port := splitAddr(mapped)
+	return result, []ICECandidate{{Type: "srflx", Protocol: "udp", Address: ip, Port: port, Server: s.url}}
+}
+
+// testTURN allocates a relay, measures its round trip and releases it again
+func testTURN(s iceServer, username, password string, pings int, timeout time.Duration) (ICEServerResult, []ICECandidate) {
+	result := ICEServerResult{URL: s.url, Transport: s.transport, Allocation: &TURNAllocation{}}
+	alloc := result.Allocation
+
+	var conn *net.UDPConn
+	if s.transport == "udp" {
+		var err error
+		if conn, err = net.ListenUDP("udp", nil); err != nil {
+			result.Error = err.Error()
+			return result, nil
+		}
+		defer conn.Close()
+	}
+	t, remote, err := s.connect(conn, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		alloc.Error = "server unreachable"
+		return result, nil
+	}
+	defer t.Close()
+	result.Address = remote
+
+	client := &turnClient{t: t, username: username, password: password}
+	resp, rtt, err := client.request(methodAllocate, timeout, func(m *stunMessage) {
+		m.add(attrRequestedTransport, []byte{protocolUDP, 0, 0, 0})
+	})
+	alloc.AllocateMs = ms(rtt)
+	alloc.Realm = client.realm
+	var stunErr *stunError
+	if errors.As(err, &stunErr) {
+		// The server answered, it just refused the allocation
+		result.Reachable = true
+		alloc.ErrorCode = stunErr.code
+	}
+	if err != nil {
+		alloc.Error = err.Error()
+		result.Error = "allocation failed: " + err.Error()
+		return result, nil
+	}
+	result.Reachable = true
+	result.RTT = ms(rtt)
+
+	relayed, ok := resp.address(attrXorRelayedAddress)
+	if !ok {
+		alloc.Error = "allocate response without a relayed address"
+		result.Error = "allocation failed: " + alloc.Error
+		return result, nil
+	}
+	alloc.Success = true
+	alloc.RelayAddress = relayed.String()
+	if v, ok := resp.get(attrLifetime); ok && len(v) == 4 {
+		alloc.LifetimeSec = int(binary.BigEndian.Uint32(v))
+	}
+
+	var candidates []ICECandidate
+	ip, port := splitAddr(relayed)
+	candidates = append(candidates, ICECandidate{Type: "relay", Protocol: "udp", Address: ip, Port: port, Server: s.url})
+	if mapped, ok := resp.address(attrXorMappedAddress); ok {
+		result.MappedAddress = mapped.String()
+		if s.transport == "udp" {
+			ip, port := splitAddr(mapped)
+			candidates = append(candidates, ICECandidate{Type: "srflx", Protocol: "udp", Address: ip, Port: port, Server: s.url})
+		}
+	}
+
+	if pings > 0 {
+		measureRelayRTT(client, s, alloc, pings, timeout)
+	}
+
+	// Release the allocation rather than leaving it to expire
+	client.request(methodRefresh, timeout, func(m *stunMessage) {
+		m.add(attrLifetime, []byte{0, 0, 0, 0})
+	})
+	return result, candidates
+}
+
+// measureRelayRTT sends data through the relay to a second local socket,
+// which echoes it back through the relay. The loop crosses the branch NAT
+// from outside, so a port-restricted NAT can block it even when the relay
+// itself works; that is reported but does not fail the check.
+func measureRelayRTT(client *turnClient, s iceServer, alloc *TURNAllocation, pings int, timeout time.Duration) {
+	peer, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		alloc.RelayRTTError = err.Error()
+		return
+	}
+	defer peer.Close()
+
+	// The relay must be told the peer's public address, which only the server can see
+	bindingPort := s.port
+	if s.transport == "tls" {
+		bindingPort = 3478
+	}
+	server, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.host, strconv.Itoa(bindingPort)))
+	if err != nil {
+		alloc.RelayRTTError = err.Error()
+		return
+	}
+	probe := &stunTransport{udp: peer, server: server}
+	resp, _, err := probe.roundTrip(newStunMessage(methodBinding|classRequest), nil, timeout)
+	if err != nil {
+		alloc.RelayRTTError = "could not learn the peer socket's public address over UDP: " + err.Error()
+		return
+	}
+	peerAddr, ok := resp.address(attrXorMappedAddress)
+	if !ok {
+		alloc.RelayRTTError = "binding response without a mapped address"
+		return
+	}
+
+	if _, _, err := client.request(methodCreatePermission, timeout, func(m *stunMessage) {
+		m.addAddress(attrXorPeerAddress, peerAddr)
+	}); err != nil {
+		alloc.RelayRTTError = "create permission: " + err.Error()
+		return
+	}
+
+	var total time.Duration
+	buf := make([]byte, 1500)
+	for seq := 0; seq < pings; seq++ {
+		payload := []byte(fmt.Sprintf("cloud-connect relay probe %d", seq))
+		ind := newStunMessage(methodSend | classIndication)
+		ind.addAddress(attrXorPeerAddress, peerAddr)
+		ind.add(attrData, payload)
+		alloc.RelayPings++
+
+		start := time.Now()
+		deadline := start.Add(timeout)
+		if err := client.t.send(ind.encode(nil)); err != nil {
+			alloc.RelayRTTError = err.Error()
+			return
+		}
+		peer.SetReadDeadline(deadline)
+		n, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		peer.WriteToUDP(buf[:n], from)
+
+		for {
+			m, err := client.t.receive(deadline)
+			if err != nil {
+				break
+			}
+			data, _ := m.get(attrData)
+			if m.typ == methodData|classIndication && bytes.Equal(data, payload) {
+				total += time.Since(start)
+				alloc.RelayReplies++
+				break
+			}
+		}
+	}
+
+	if alloc.RelayReplies == 0 {
+		alloc.RelayRTTError = "no data came back through the relay (NAT filtering may block the loop test)"
+		return
+	}
+	alloc.RelayRTT = ms(total / time.Duration(alloc.RelayReplies))
+}
+
+// hostCandidates lists the interface addresses ICE would offer as host candidates
+func hostCandidates(port int) []ICECandidate {
+	var candidates []ICECandidate
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return candidates
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			candidates = append(candidates, ICECandidate{Type: "host", Protocol: "udp", Address: ipNet.IP.String(), Port: port})
+		}
+	}
+	return candidates
+}
+
+// natMapping classifies how the NAT maps the shared socket, from the server
+// reflexive addresses that different STUN servers reported for it
+func natMapping(candidates []ICECandidate, sharedServers map[string]bool) string {
+	hosts := map[string]bool{}
+	mapped := map[string]bool{}
+	answered := 0
+	for _, c := range candidates {
+		switch {
+		case c.Type == "host":
+			hosts[c.Address] = true
+		case c.Type == "srflx" && sharedServers[c.Server]:
+			mapped[net.JoinHostPort(c.Address, strconv.Itoa(c.Port))] = true
+			answered++
+		}
+	}
+	if len(mapped) > 1 {
+		return "address-dependent"
+	}
+	for addr := range mapped {
+		if ip, _, _ := net.SplitHostPort(addr); hosts[ip] {
+			return "none"
+		}
+	}
+	if answered > 1 {
+		return "endpoint-independent"
+	}
+	return "unknown"
+}
+
+func main() {
+	username := flag.String("user", "", "TURN username (long-term credentials)")
+	credential := flag.String("credential", "", "TURN password")
+	pings := flag.Int("pings", 5, "Data packets sent through each TURN relay to measure its round trip (0 to skip)")
+	timeout := flag.Duration("timeout", 5*time.Second, "Timeout per STUN/TURN transaction")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Println("Usage: webrtc [options] <stun:host[:port]|turn:host[:port][?transport=udp|tcp]|turns:host[:port]>...")
+		fmt.Println("Example: webrtc stun:stun.l.google.com:19302 stun:stun.cloudflare.com:3478")
+		fmt.Println("         webrtc -user branch01 -credential s3cret stun:turn.example.com turn:turn.example.com turns:turn.example.com:443?transport=tcp")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var servers []iceServer
+	for _, arg := range flag.Args() {
+		s, err := parseICEServer(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		servers = append(servers, s)
+	}
+
+	// Like a browser, gather from one UDP socket for all STUN servers
+	shared, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer shared.Close()
+
+	start := time.Now()
+	report := WebRTCReport{
+		Servers:        make([]ICEServerResult, len(servers)),
+		Candidates:     hostCandidates(shared.LocalAddr().(*net.UDPAddr).Port),
+		CandidateTypes: map[string]int{"host": 0, "srflx": 0, "relay": 0},
+		Issues:         []string{},
+	}
+	found := make([][]ICECandidate, len(servers))
+	sharedServers := map[string]bool{}
+
+	// STUN queries on the shared socket run one after another; TURN
+	// allocations and stream transports each have their own connection
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		if !s.turn && s.transport == "udp" {
+			sharedServers[s.url] = true
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s iceServer) {
+			defer wg.Done()
+			if s.turn {
+				report.Servers[i], found[i] = testTURN(s, *username, *credential, *pings, *timeout)
+			} else {
+				report.Servers[i], found[i] = testSTUN(s, nil, *timeout)
+			}
+		}(i, s)
+	}
+	for i, s := range servers {
+		if sharedServers[s.url] {
+			report.Servers[i], found[i] = testSTUN(s, shared, *timeout)
+		}
+	}
+	wg.Wait()
+	report.GatheringMs = ms(time.Since(start))
+
+	for _, candidates := range found {
+		report.Candidates = append(report.Candidates, candidates...)
+	}
+	for _, c := range report.Candidates {
+		report.CandidateTypes[c.Type]++
+	}
+	report.NATMapping = natMapping(report.Candidates, sharedServers)
+
+	for _, result := range report.Servers {
+		if result.Error != "" {
+			report.Issues = append(report.Issues, fmt.Sprintf("%s: %s", result.URL, result.Error))
+		}
+	}
+	hasTURN, hasUDP := false, false
+	for _, s := range servers {
+		hasTURN = hasTURN || s.turn
+		hasUDP = hasUDP || s.transport == "udp"
+	}
+	switch {
+	case report.CandidateTypes["host"] == 0:
+		report.Issues = append(report.Issues, "no host candidates: no usable network interface")
+	case hasUDP && report.CandidateTypes["srflx"] == 0:
+		report.Issues = append(report.Issues, "no server reflexive candidates: UDP to the STUN/TURN servers appears blocked")
+	}
+	if hasTURN && report.CandidateTypes["relay"] == 0 {
+		report.Issues = append(report.Issues, "no relay candidates: clients behind restrictive firewalls will fail to connect")
+	}
+	if report.NATMapping == "address-dependent" && report.CandidateTypes["relay"] == 0 {
+		report.Issues = append(report.Issues, "address-dependent NAT mapping: peer-to-peer media will need a TURN relay")
+	}
+	report.Healthy = len(report.Issues) == 0
+
+	json.NewEncoder(os.Stdout).Encode(report)
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
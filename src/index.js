@@ -10,6 +10,8 @@ import { execFile } from 'child_process';
 import path from 'path';
 import { fileURLToPath } from 'url';
 import fs from 'fs';
+import { collectRunMetadata, attachRunMetadata, redactArgs } from './utils/runMetadata.js';
+import { saveSession, loadSession, listSessions, recordSessionRun, compareScanResults, displayScanDifferences } from './utils/scanSessions.js';
 
 const __filename = fileURLToPath(import.meta.url);
 const __dirname = path.dirname(__filename);
@@ -21,6 +23,13 @@ program
   .enablePositionalOptions()
   .allowExcessArguments(false);
 
+// Run metadata is attached to tool results on request
+program
+  .option('--run-metadata', 'Attach host, interface and invocation details to results (list results become { results, runMetadata })')
+  .option('--imds', 'Include the cloud instance identity (AWS/GCP/Azure metadata service) in run metadata; implies --run-metadata')
+  .option('--sink <url>', 'Also publish each tool result to nats://host:4222/subject or kafka://broker:9092/topic (through bin/ingest)')
+  .option('--sink-encoding <encoding>', 'Sink message encoding: entry, payload or cloudevents', 'entry');
+
 // Add completion support
 program
   .command('completion')
@@ -474,13 +483,49 @@ program
   });
 
 // Function to execute Go tools directly
-function executeGoTool(toolName, args) {
+async function toolRunMetadata(toolName, toolPath, args) {
+  const globalOptions = program.opts();
+  if (!globalOptions.runMetadata && !globalOptions.imds) return null;
+  return collectRunMetadata({ tool: toolName, args, binary: toolPath, imds: globalOptions.imds });
+}
+
+// Stream a tool result to the --sink broker with ingest's publisher; a
+// broker outage is reported but never fails the check itself
+function publishResult(toolName, result) {
+  const { sink, sinkEncoding } = program.opts();
+  if (!sink) return Promise.resolve();
+
+  const exeName = process.platform === 'win32' ? 'ingest.exe' : 'ingest';
+  const args = ['-publish', '-sink', sink, '-sink-encoding', sinkEncoding, '-tool', toolName];
+  return new Promise((resolve) => {
+    const child = execFile(path.join(__dirname, '../bin', exeName), args, (error, stdout, stderr) => {
+      if (error) {
+        // The URL, and execFile's message quoting the command line, may carry credentials
+        const [target, reason] = redactArgs([sink, (stderr || error.message).trim()]);
+        console.warn(chalk.yellow(`Warning: result not published to ${target}: ${reason}`));
+      }
+      resolve();
+    });
+    child.stdin.on('error', () => {}); // Reported through the exit above
+    child.stdin.end(JSON.stringify(result));
+  });
+}
+
+async function executeGoTool(toolName, args) {
+  const exeName = process.platform === 'win32' ? `${toolName}.exe` : toolName;
+  const metadata = await toolRunMetadata(toolName, path.join(__dirname, '../bin', exeName), args);
+  const withMetadata = (result) => (metadata ? attachRunMetadata(result, metadata) : result);
+  const finish = (resolve, result) => {
+    const final = withMetadata(result);
+    publishResult(toolName, final).then(() => resolve(final));
+  };
+
   return new Promise((resolve, reject) => {
-    const exeName = process.platform === 'win32' ? `${toolName}.exe` : toolName;
     const toolPath = path.join(__dirname, '../bin', exeName);
     const sourcePath = path.join(__dirname, '../network', `${toolName}.go`);
     
-    console.log(chalk.blue(`Executing: ${toolPath} ${args.join(' ')}`));
+    // Proxy and sink URLs may carry credentials
+    console.log(chalk.blue(`Executing: ${toolPath} ${redactArgs(args).join(' ')}`));
     
     if (!fs.existsSync(toolPath)) {
       console.error(chalk.red(`Error: Binary ${exeName} not found in bin directory`));
@@ -513,29 +558,62 @@ function executeGoTool(toolName, args) {
       }
       
       if (!stdout.trim()) {
-        resolve({});
+        resolve(withMetadata({}));
         return;
       }
 
+      let result;
       try {
-        const result = JSON.parse(stdout);
-        resolve(result);
+        result = JSON.parse(stdout);
       } catch (e) {
         console.log(chalk.yellow('Raw output:'), stdout);
         reject(new Error(`Failed to parse output: ${e.message}`));
+        return;
       }
+      finish(resolve, result);
     });
   });
 }
 
+// Run a Go tool attached to the terminal, for tools that stream, render
+// tables, read stdin or report through their exit code; a non-zero exit is
+// kept as the CLI's exit code
+async function spawnGoTool(toolName, args) {
+  const exeName = process.platform === 'win32' ? `${toolName}.exe` : toolName;
+  const toolPath = path.join(__dirname, '../bin', exeName);
+  if (!fs.existsSync(toolPath)) {
+    throw new Error(`Binary ${toolName} not found. Run ./build.sh first.`);
+  }
+
+  if (process.platform !== 'win32') {
+    try {
+      fs.chmodSync(toolPath, 0o755);
+    } catch (err) {
+      console.warn(chalk.yellow(`Warning: Could not set executable permissions: ${err.message}`));
+    }
+  }
+
+  const { spawn } = await import('child_process');
+  const child = spawn(toolPath, args, { stdio: 'inherit' });
+  const code = await new Promise((resolve, reject) => {
+    child.on('error', reject);
+    child.on('close', resolve);
+  });
+  if (code !== 0) process.exitCode = code;
+  return code;
+}
+
 // Connectivity testing (ping, TCP, UDP)
 program
   .command('connectivity')
   .description('Test network connectivity (ping, TCP, UDP)')
   .argument('<target>', 'Target IP or hostname')
-  .option('-m, --mode <mode>', 'Test mode: ping, tcp, udp, all', 'ping')
-  .option('-p, --port <port>', 'Port for TCP/UDP tests', '80')
-  .option('-t, --timeout <seconds>', 'Timeout in seconds', '5')
+  .option('-m, --mode <mode>', 'Test mode: ping, tcp, udp, all, multicast (target is the group), mtu, dialog', 'ping')
+  .option('-p, --port <port>', 'Port for TCP/UDP/multicast tests', '80')
+  .option('-t, --timeout <seconds>', 'Timeout in seconds (listening window for multicast)', '5')
+  .option('-I, --interface <name>', 'Interface to join the multicast group on')
+  .option('-a, --agent-port <port>', 'Port of an MTU agent on the target, to also test the reverse direction')
+  .option('-s, --script <file>', 'JSON dialog script of send/expect steps for dialog mode')
   .action(async (target, options) => {
     try {
       console.log(chalk.cyan(`Testing connectivity to ${target} using ${options.mode.toUpperCase()}...`));
@@ -545,11 +623,22 @@ program
         options.mode,
       ];
       
-      if (options.mode === 'tcp' || options.mode === 'udp') {
+      if (options.mode === 'tcp' || options.mode === 'udp' || options.mode === 'multicast') {
         args.push(options.port);
+      } else if (options.mode === 'mtu') {
+        args.push(options.agentPort || '0');
+      } else if (options.mode === 'dialog') {
+        if (!options.script) {
+          console.error(chalk.red('Error: dialog mode needs --script <file>'));
+          return;
+        }
+        args.push(options.script);
       }
       
       args.push(options.timeout);
+      if (options.mode === 'multicast' && options.interface) {
+        args.push(options.interface);
+      }
       
       const result = await executeGoTool('connectivity', args);
       console.log(result);
@@ -592,6 +681,8 @@ program
   .argument('<port-range>', 'Port range to scan (e.g., 80,443 or 1-1000)')
   .option('-t, --timeout <seconds>', 'Timeout in seconds per port', '2')
   .option('-c, --concurrent <num>', 'Maximum concurrent port scans', '100')
+  .option('-b, --banner-budget <ms>', 'Time spent identifying each open port (0 skips banners)', '1000')
+  .option('--dual-stack', 'Scan the first IPv4 and first IPv6 address of a hostname and report ports that differ', false)
   .action(async (target, portRange, options) => {
     try {
       console.log(chalk.cyan(`Scanning ports on ${target} (${portRange})...`));
@@ -600,8 +691,10 @@ program
         target,
         portRange,
         options.timeout,
-        options.concurrent
+        options.concurrent,
+        options.bannerBudget
       ];
+      if (options.dualStack) args.unshift('-dual-stack');
       
       const result = await executeGoTool('portscan', args);
       console.log(result);
@@ -615,8 +708,20 @@ program
   .command('interfaces')
   .description('Get information about network interfaces')
   .option('-i, --interface <name>', 'Specific interface to query', 'all')
+  .option('-w, --watch <interval>', 'Watch bonds and teams (Linux), printing member drops, flaps and failovers as they happen, e.g. 5s')
+  .option('--alert-file <file>', 'With --watch, also append the changes as JSON lines to this file')
   .action(async (options) => {
     try {
+      if (options.watch) {
+        const args = ['-watch', options.watch];
+        if (options.alertFile) args.push('-alert-file', options.alertFile);
+        args.push(options.interface);
+
+        console.log(chalk.cyan('Watching bonds and teams (Ctrl+C to stop)...'));
+        await spawnGoTool('interfaces', args);
+        return;
+      }
+
       console.log(chalk.cyan('Getting network interface information...'));
       
       const args = [options.interface];
@@ -636,8 +741,62 @@ program
   .option('-t, --timeout <seconds>', 'Timeout in seconds', '10')
   .option('-r, --no-redirects', 'Do not follow redirects', false)
   .option('-k, --insecure', 'Allow insecure SSL connections', false)
+  .option('-b, --backends [ips]', 'Test every DNS answer (or the given comma-separated IPs) and compare backends')
+  .option('--cert <file>', 'Client certificate (PEM) for an mTLS check: the service must reject connections without it')
+  .option('--key <file>', 'Private key (PEM) for --cert')
+  .option('--ca <file>', 'Mesh CA bundle used to verify the server certificate')
+  .option('--server-id <id>', 'Expected server SPIFFE ID, e.g. spiffe://cluster.local/ns/default/sa/api')
+  .option('--sni <name>', 'SNI to send for the mTLS check')
+  .option('--proxy <proxyUrl>', 'Check this proxy (http://, https:// or socks5://, credentials allowed) by fetching the URL through it: reachability, added latency, auth enforcement and tampering')
   .action(async (url, options) => {
     try {
+      if (options.proxy) {
+        console.log(chalk.cyan(`Testing ${url} through the proxy...`));
+
+        const result = await executeGoTool('http-test', ['proxy', options.proxy, url, options.timeout]);
+        console.log(result);
+        return;
+      }
+
+      if (options.cert) {
+        if (!options.key) {
+          console.error(chalk.red('Error:'), '--key is required with --cert');
+          return;
+        }
+        console.log(chalk.cyan(`Validating mTLS enforcement for ${url}...`));
+
+        const args = [
+          'mtls',
+          url,
+          options.cert,
+          options.key,
+          options.ca || '',
+          options.timeout,
+          options.serverId || '',
+          options.sni || ''
+        ];
+
+        const result = await executeGoTool('http-test', args);
+        console.log(result);
+        return;
+      }
+
+      if (options.backends) {
+        console.log(chalk.cyan(`Comparing backends for ${url}...`));
+
+        const args = [
+          'backends',
+          url,
+          options.backends === true ? '' : options.backends,
+          options.timeout,
+          options.insecure ? '1' : '0'
+        ];
+
+        const result = await executeGoTool('http-test', args);
+        console.log(result);
+        return;
+      }
+
       console.log(chalk.cyan(`Testing HTTP endpoint: ${url}...`));
       
       const args = [
@@ -654,6 +813,72 @@ program
     }
   });
 
+// Synthetic user journeys
+program
+  .command('http-scenario')
+  .description('Run a multi-step HTTP scenario (requests, expected status/body, extracted variables) once, or repeatedly as a synthetic monitor')
+  .argument('<scenario>', 'Scenario JSON file')
+  .option('-i, --interval <seconds>', 'Repeat the scenario at this interval, printing one JSON line per run')
+  .option('-n, --runs <count>', 'With --interval, stop after this many runs (default: until Ctrl+C)')
+  .action(async (scenario, options) => {
+    try {
+      const args = ['scenario', path.resolve(scenario)];
+      if (options.interval) {
+        args.push(options.interval);
+        if (options.runs) args.push(options.runs);
+      }
+
+      await spawnGoTool('http-test', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// PAC evaluation
+program
+  .command('pac')
+  .description('Evaluate a proxy auto-config (PAC) file for a URL and test the selected proxy')
+  .argument('<pac>', 'PAC file URL or local path')
+  .argument('<url>', 'URL to evaluate')
+  .option('-t, --timeout <seconds>', 'Timeout in seconds for the proxy test', '10')
+  .option('--no-test', 'Only evaluate the PAC file')
+  .action(async (pac, url, options) => {
+    try {
+      console.log(chalk.cyan(`Evaluating ${pac} for ${url}...`));
+
+      const { evaluatePacForUrl } = await import('./utils/pac.js');
+      const evaluation = await evaluatePacForUrl(pac, url);
+      console.log(evaluation);
+
+      if (!options.test) return;
+
+      // Try choices in order like a browser, stopping at the first that works
+      for (const choice of evaluation.proxies) {
+        if (choice.type === 'DIRECT') {
+          console.log(chalk.cyan('Testing direct connection...'));
+          const result = await executeGoTool('http-test', [url, options.timeout, '1', '0']);
+          console.log(result);
+          if (!result.error) return;
+          continue;
+        }
+
+        if (!choice.proxyUrl) {
+          console.log(chalk.yellow(`Skipping ${choice.type} ${choice.address || ''}: proxy type cannot be tested`));
+          continue;
+        }
+
+        console.log(chalk.cyan(`Testing ${choice.type} ${choice.address}...`));
+        const result = await executeGoTool('http-test', ['proxy', choice.proxyUrl, url, options.timeout]);
+        console.log(result);
+        if (result.proxied && !result.proxied.error) return;
+      }
+
+      console.log(chalk.red('No proxy choice returned by the PAC file worked for this URL'));
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
 // DNS lookup
 program
   .command('dns-lookup')
@@ -680,97 +905,775 @@ program
     }
   });
 
+// Authoritative server consistency audit
+program
+  .command('dns-audit')
+  .description('Query every authoritative name server of a zone and report lame delegations, serial drift and NS/glue mismatches')
+  .argument('<zone>', 'Zone to audit (e.g. example.com)')
+  .option('-t, --timeout <seconds>', 'Timeout per query in seconds', '5')
+  .option('-s, --servers <list>', 'Audit these servers instead of the delegation, as name=ip[:port],... (internal zones)')
+  .action(async (zone, options) => {
+    try {
+      console.log(chalk.cyan(`Auditing authoritative servers for ${zone}...`));
+
+      const args = ['audit', zone, options.timeout];
+      if (options.servers) args.push(options.servers);
+
+      const result = await executeGoTool('dns', args);
+      console.log(result);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Differential geo/latency routing probe via EDNS Client Subnet
+program
+  .command('dns-ecs')
+  .description('Ask a resolver what users in each client subnet would receive (EDNS Client Subnet) and group subnets by answer')
+  .argument('<domain>', 'Domain to query')
+  .argument('<subnets>', 'Client subnets as label=prefix,... (e.g. eu=81.2.69.0/24,us=198.51.100.0/24); bare IPs become a /24 or /56')
+  .option('-r, --resolver <ip[:port]>', 'Resolver that forwards ECS', '8.8.8.8')
+  .option('--type <type>', 'Record type: a, aaaa or cname', 'a')
+  .option('-t, --timeout <seconds>', 'Timeout per query in seconds', '5')
+  .action(async (domain, subnets, options) => {
+    try {
+      console.log(chalk.cyan(`Querying ${domain} through ${options.resolver} for each client subnet...`));
+
+      const args = ['ecs', domain, subnets, options.resolver, options.type, options.timeout];
+
+      const result = await executeGoTool('dns', args);
+      console.log(result);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Resolver failover behaviour
+program
+  .command('dns-failover')
+  .description('Measure how lookups behave when the first resolver stops answering: per-step latency, stalled lookups and the estimated outage')
+  .argument('<domain>', 'Domain to look up')
+  .option('-s, --servers <list>', 'Resolvers to test in order, comma-separated (default: this host\'s resolv.conf)')
+  .option('-t, --timeout <seconds>', 'Timeout per query in seconds (default: the resolv.conf timeout)')
+  .action(async (domain, options) => {
+    try {
+      console.log(chalk.cyan(`Testing resolver failover for ${domain}...`));
+
+      const args = ['failover', domain, options.servers || 'system'];
+      if (options.timeout) args.push(options.timeout);
+
+      const result = await executeGoTool('dns', args);
+      console.log(result);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Answers from several public or internal resolvers side by side
+program
+  .command('dns-compare')
+  .description('Ask several resolvers for the same name and report where their answers differ')
+  .argument('<domain>', 'Domain to query')
+  .option('-r, --resolvers <list>', 'Resolvers as label=ip[:port],... (default: Google, Cloudflare, Quad9 and OpenDNS)')
+  .option('--type <type>', 'Record type: a, aaaa or cname', 'a')
+  .option('-t, --timeout <seconds>', 'Timeout per query in seconds', '10')
+  .action(async (domain, options) => {
+    try {
+      console.log(chalk.cyan(`Comparing resolver answers for ${domain}...`));
+
+      const args = ['compare', domain, options.resolvers || '', options.type, options.timeout];
+
+      const result = await executeGoTool('dns', args);
+      console.log(result);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
 // Network scanning command
+const NET_GRAB_DEFAULT_PORTS = '22,80,443,3389,8080';
+
+async function runNetGrab(cidr, options, session = null) {
+  console.log(chalk.cyan(`Starting ${options.ptr ? 'reverse DNS sweep' : 'network scan'} of ${cidr}...`));
+  
+  const args = ['-v', '-progress', options.progress];
+  // Session runs and --sink always collect JSON so the results can be recorded,
+  // compared or published
+  if (options.json || session || program.opts().sink) args.push('--json');
+  if (options.targetDuration) args.push('-target-duration', options.targetDuration);
+  if (options.maxRate) args.push('-max-rate', options.maxRate);
+  for (const window of options.window || []) args.push('-window', window);
+  if (options.windowTz) args.push('-window-tz', options.windowTz);
+  if (options.checkpoint) args.push('-checkpoint', options.checkpoint);
+  if (options.daemon) args.push('-daemon');
+  if (options.every) args.push('-every', options.every);
+  if (options.ptr) args.push('-ptr');
+  if (options.resolvers) args.push('-resolvers', options.resolvers);
+  if (options.ptrRate) args.push('-ptr-rate', options.ptrRate);
+  if (options.polite) args.push('-polite');
+  if (options.politeContact) args.push('-polite-contact', options.politeContact);
+  if (options.within) args.push('-within', options.within);
+  if (options.agents) args.push('-agents', options.agents);
+  if (options.agent) args.push('-agent', options.agent);
+  if (options.plan) args.push('-plan');
+  if (options.raw === false) args.push('-no-raw');
+  if (options.syn) args.push('-syn');
+  
+  // Handle port options; the polite profile brings its own port list
+  if (options.allPorts) {
+    args.push('-p', 'all');
+  } else if (options.ports) {
+    args.push('-p', options.ports);
+  }
+  
+  args.push(cidr);
+
+  // Use spawn instead of execFile to get real-time output
+  const { spawn } = await import('child_process');
+  const readline = await import('readline');
+  const toolPath = path.join(__dirname, '../bin/net-grab');
+  
+  if (!fs.existsSync(toolPath)) {
+    console.error(chalk.red('Error: net-grab binary not found'));
+    console.log(chalk.yellow('Building net-grab binary...'));
+    
+    // Build the binary
+    const buildPath = path.join(__dirname, '../network');
+    const goBuild = spawn('go', ['build', '-o', toolPath, 'net-grab.go'], {
+      cwd: buildPath,
+    });
+    
+    await new Promise((resolve, reject) => {
+      goBuild.on('close', (code) => {
+        if (code === 0) resolve();
+        else reject(new Error(`Failed to build net-grab (exit code ${code})`));
+      });
+    });
+  }
+  
+  // Set executable permissions on Unix-like systems
+  if (process.platform !== 'win32') {
+    try {
+      fs.chmodSync(toolPath, 0o755);
+    } catch (err) {
+      console.warn(chalk.yellow(`Warning: Could not set executable permissions: ${err.message}`));
+    }
+  }
+  
+  // Run the scanner
+  const metadata = options.json ? await toolRunMetadata('net-grab', toolPath, args) : null;
+  const scanner = spawn(toolPath, args);
+  const recordings = [];
+  const publishes = [];
+  
+  // Handle output in real-time; results arrive as one JSON document per scan
+  readline.createInterface({ input: scanner.stdout }).on('line', (line) => {
+    let parsed;
+    try {
+      parsed = JSON.parse(line);
+    } catch {
+      parsed = null;
+    }
+    if (!parsed || typeof parsed !== 'object') {
+      console.log(line);
+      return;
+    }
+    const result = metadata ? attachRunMetadata(parsed, metadata) : parsed;
+    if (options.json) {
+      console.log(JSON.stringify(result, null, 2));
+    }
+    publishes.push(publishResult('net-grab', result));
+    if (session) {
+      recordings.push(recordScanSession(session, parsed));
+    }
+  });
+  
+  scanner.stderr.on('data', (data) => {
+    // Progress events are passed through untouched for consumers
+    if (options.progress === 'json') {
+      process.stderr.write(data);
+    } else {
+      console.error(chalk.red(data.toString()));
+    }
+  });
+  
+  await new Promise((resolve, reject) => {
+    scanner.on('close', (code) => {
+      if (code === 0) resolve();
+      else reject(new Error(`Scanner failed with exit code ${code}`));
+    });
+  });
+  await Promise.all(recordings);
+  await Promise.all(publishes);
+}
+
+async function recordScanSession(session, results) {
+  const { reference } = await recordSessionRun(session.name, results, session.against);
+  if (reference) {
+    displayScanDifferences(session.name, reference, compareScanResults(reference.resources, results));
+  } else {
+    console.log(chalk.green(`Baseline recorded for session ${session.name}`));
+  }
+}
+
+function reportNetGrabError(error) {
+  console.error(chalk.red('Error:'), error.message);
+  if (error.message.includes('ENOENT')) {
+    console.log(chalk.yellow('\nMake sure Go is installed and in your PATH'));
+    console.log('Install Go from: https://golang.org/dl/');
+  }
+}
+
 program
   .command('net-grab')
   .description('Scan network and collect host information')
   .argument('<cidr>', 'Network CIDR to scan (e.g., 192.168.1.0/24)')
   .option('-v, --verbose', 'Show verbose output', true)
   .option('-j, --json', 'Output as JSON', false)
-  .option('-p, --ports <spec>', 'Port specification (single, range, or comma-separated)', '22,80,443,3389,8080')
+  .option('-p, --ports <spec>', 'Port specification (single, range, comma-separated, or "roles")', NET_GRAB_DEFAULT_PORTS)
   .option('--all-ports', 'Scan all ports (1-65535)', false)
-  .action(async (cidr, options) => {
+  .option('--progress <format>', 'Progress reporting: text, json (one event per line on stderr) or none', 'text')
+  .option('--target-duration <duration>', 'Auto-tune concurrency to finish in about this long (e.g. 10m)')
+  .option('--max-rate <probes>', 'Maximum probes per second')
+  .option('--window <spec...>', 'Allowed scan windows, e.g. "01:00-05:00" or "Mon-Fri 22:00-06:00"; scanning pauses outside them')
+  .option('--window-tz <zone>', 'Time zone for --window (e.g. UTC, Europe/Berlin)')
+  .option('--checkpoint <file>', 'Record finished hosts so an interrupted or paused scan resumes where it stopped')
+  .option('--daemon', 'Keep running and repeat the scan on a schedule', false)
+  .option('--every <duration>', 'Time between scan starts in daemon mode (e.g. 24h)')
+  .option('--ptr', 'Reverse DNS sweep of the whole range instead of a port scan', false)
+  .option('--resolvers <list>', 'Comma-separated DNS resolvers for PTR lookups (default: system resolvers)')
+  .option('--ptr-rate <qps>', 'Maximum PTR queries per second per resolver')
+  .option('--polite', 'Production-safe profile: 10 probes/s with jitter, top-20 ports, no banner grabs, fixed source ports', false)
+  .option('--polite-contact <contact>', 'Contact recorded in the polite profile identity in the results (it is not sent to scanned hosts)')
+  .option('--within <duration>', 'Time box for the whole scan (e.g. 2h): shard it and pace probes to finish in time')
+  .option('--agents <n>', 'Hosts sharing a --within scan; run the same command on each with its own --agent')
+  .option('--agent <n>', 'Which of the --agents this host is (default 1)')
+  .option('--plan', 'Only print the --within plan and whether it is feasible', false)
+  .option('--no-raw', 'Use unprivileged probes (system ping, connect scans) even when raw sockets are available')
+  .option('--syn', 'Scan ports with half-open SYN probes when raw sockets are available (Linux only)', false)
+  .option('--save-session <name>', 'Save this scan\'s parameters as a named session; repeat it later with "rerun <name>"')
+  .action(async (cidr, options, command) => {
     try {
-      console.log(chalk.cyan(`Starting network scan of ${cidr}...`));
-      
-      const args = ['-v'];
-      if (options.json) args.push('--json');
-      
-      // Handle port options
-      if (options.allPorts) {
-        args.push('-p', 'all');
-      } else if (options.ports) {
-        args.push('-p', options.ports);
+      // Leave the port list to net-grab unless one was given, so the polite
+      // profile can apply its own
+      if (command.getOptionValueSource('ports') === 'default') {
+        delete options.ports;
       }
-      
-      args.push(cidr);
+      let session = null;
+      if (options.saveSession) {
+        if (options.ptr || options.plan) {
+          throw new Error('Sessions record port scans; --save-session cannot be combined with --ptr or --plan');
+        }
+        session = await saveSession(options.saveSession, { command: 'net-grab', target: cidr, options });
+        console.log(chalk.green(`Session ${session.name} saved`));
+      }
+      await runNetGrab(cidr, options, session);
+    } catch (error) {
+      reportNetGrabError(error);
+    }
+  });
 
-      // Use spawn instead of execFile to get real-time output
-      const { spawn } = await import('child_process');
-      const toolPath = path.join(__dirname, '../bin/net-grab');
-      
-      if (!fs.existsSync(toolPath)) {
-        console.error(chalk.red('Error: net-grab binary not found'));
-        console.log(chalk.yellow('Building net-grab binary...'));
-        
-        // Build the binary
-        const buildPath = path.join(__dirname, '../network');
-        const goBuild = spawn('go', ['build', '-o', toolPath, 'net-grab.go'], {
-          cwd: buildPath,
-        });
-        
-        await new Promise((resolve, reject) => {
-          goBuild.on('close', (code) => {
-            if (code === 0) resolve();
-            else reject(new Error(`Failed to build net-grab (exit code ${code})`));
-          });
-        });
+// Repeat a saved scan session and compare with its baseline
+program
+  .command('rerun')
+  .description('Repeat a saved scan session with identical parameters and show what changed')
+  .argument('<session>', 'Session name given to --save-session')
+  .option('--against <run>', 'Compare with the session "baseline" or the "previous" run', 'baseline')
+  .action(async (name, options) => {
+    try {
+      if (!['baseline', 'previous'].includes(options.against)) {
+        throw new Error(`--against must be "baseline" or "previous", got "${options.against}"`);
       }
-      
-      // Set executable permissions on Unix-like systems
-      if (process.platform !== 'win32') {
-        try {
-          fs.chmodSync(toolPath, 0o755);
-        } catch (err) {
-          console.warn(chalk.yellow(`Warning: Could not set executable permissions: ${err.message}`));
-        }
+      const session = await loadSession(name);
+      console.log(chalk.dim(`Session ${session.name}: ${session.command} ${session.target} (${session.runs} earlier runs)`));
+      await runNetGrab(session.target, session.options, { name: session.name, against: options.against });
+    } catch (error) {
+      reportNetGrabError(error);
+    }
+  });
+
+program
+  .command('list-sessions')
+  .description('List saved scan sessions')
+  .action(async () => {
+    try {
+      const sessions = await listSessions();
+      if (sessions.length === 0) {
+        console.log(chalk.yellow('No saved sessions'));
+        return;
       }
-      
-      // Run the scanner
-      const scanner = spawn(toolPath, args);
-      
-      // Handle output in real-time
-      scanner.stdout.on('data', (data) => {
-        const output = data.toString();
-        if (options.json) {
-          try {
-            const parsed = JSON.parse(output);
-            console.log(JSON.stringify(parsed, null, 2));
-          } catch {
-            process.stdout.write(output);
-          }
-        } else {
-          process.stdout.write(output);
+      for (const session of sessions) {
+        const lastRun = session.lastRun ? `last run ${session.lastRun}` : 'never run';
+        console.log(`${chalk.cyan(session.name)}  ${session.command} ${session.target}  ${chalk.dim(`${session.runs} runs, ${lastRun}`)}`);
+      }
+    } catch (error) {
+      console.error(chalk.red('Error listing sessions:'), error.message);
+    }
+  });
+
+// Support bundle for vendor or internal tickets
+program
+  .command('bundle')
+  .description('Run a curated set of diagnostics and package results and logs into a tar.gz for a support ticket')
+  .option('-o, --output <file>', 'Bundle file to write (default: cloud-connect-bundle-<host>-<time>.tar.gz)')
+  .option('--trace <hosts...>', 'Hosts to traceroute and resolve')
+  .option('--http <urls...>', 'URLs to check')
+  .option('--include <files...>', 'Extra files or globs to add, e.g. monitor.ring or alert logs')
+  .option('-t, --timeout <duration>', 'Time limit for each diagnostic (e.g. 2m)')
+  .action(async (options) => {
+    try {
+      console.log(chalk.cyan('Collecting diagnostics for a support bundle...'));
+
+      const args = [];
+      if (options.output) args.push('-o', path.resolve(options.output));
+      if (options.trace) args.push('-trace', options.trace.join(','));
+      if (options.http) args.push('-http', options.http.join(','));
+      for (const file of options.include || []) args.push('-include', file);
+      if (options.timeout) args.push('-timeout', options.timeout);
+
+      const result = await executeGoTool('bundle', args);
+      console.log(result);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Long-running availability monitor
+program
+  .command('monitor')
+  .description('Probe a target continuously and report availability, flaps and MTTR')
+  .argument('[target]', 'host:port for tcp, host for icmp, URL for http')
+  .option('-m, --mode <mode>', 'Probe type: tcp, icmp, http', 'tcp')
+  .option('-i, --interval <duration>', 'Time between probes (e.g. 1s, 500ms)', '1s')
+  .option('-f, --file <path>', 'Ring buffer file', 'monitor.ring')
+  .option('-d, --duration <duration>', 'Stop after this long (e.g. 72h); default runs until Ctrl+C')
+  .option('-r, --report', 'Print the report for an existing ring file without probing', false)
+  .option('-a, --alert-file <path>', 'Append alerts (with path analysis on packet loss) as JSON lines')
+  .option('--fire <M/N>', 'Alert when M of the last N probes fail', '3/5')
+  .option('--resolve <M/N>', 'Resolve when M of the last N probes succeed', '2/3')
+  .option('--alert-if <expr...>', 'Alert while an expression holds, e.g. "loss > 5 && p95_latency > 200"; append "; fire=M/N resolve=M/N" to override the ratios for one rule')
+  .option('-p, --persistent', 'http mode: reuse one client like a long-lived service and report connection reuse, DNS re-resolution and latency trend', false)
+  .option('--trend-window <duration>', 'Bucket size for the --persistent latency trend (e.g. 5m)')
+  .action(async (target, options) => {
+    try {
+      const args = ['-file', options.file];
+      if (options.report) {
+        args.push('-report');
+      } else {
+        if (!target) {
+          throw new Error('A target is required unless --report is given');
         }
-      });
-      
-      scanner.stderr.on('data', (data) => {
-        console.error(chalk.red(data.toString()));
-      });
-      
-      await new Promise((resolve, reject) => {
-        scanner.on('close', (code) => {
-          if (code === 0) resolve();
-          else reject(new Error(`Scanner failed with exit code ${code}`));
-        });
-      });
-      
+        args.push('-mode', options.mode, '-interval', options.interval);
+        args.push('-fire', options.fire, '-resolve', options.resolve);
+        if (options.duration) args.push('-duration', options.duration);
+        if (options.alertFile) args.push('-alert-file', options.alertFile);
+        for (const rule of options.alertIf || []) args.push('-alert-if', rule);
+        if (options.persistent) args.push('-persistent');
+        if (options.trendWindow) args.push('-trend-window', options.trendWindow);
+        args.push(target);
+      }
+
+      // Ctrl+C reaches the monitor too; it prints its report before exiting
+      const ignoreInterrupt = () => {};
+      process.on('SIGINT', ignoreInterrupt);
+      try {
+        const code = await spawnGoTool('monitor', args);
+        if (code !== 0) throw new Error(`Monitor failed with exit code ${code}`);
+      } finally {
+        process.off('SIGINT', ignoreInterrupt);
+      }
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Dependency manifest verification
+program
+  .command('verify')
+  .description('Check every dependency listed in a service manifest from this environment and print a pass/fail matrix')
+  .argument('<manifest>', 'Manifest file (YAML or JSON) listing databases, queues, APIs and DNS names')
+  .option('-t, --timeout <duration>', 'Default timeout per check (e.g. 3s); the manifest can override it')
+  .option('-c, --concurrency <n>', 'Dependencies checked at once', '10')
+  .option('--json', 'Print the results as JSON instead of a table', false)
+  .action(async (manifest, options) => {
+    try {
+      const args = ['-concurrency', options.concurrency];
+      if (options.timeout) args.push('-timeout', options.timeout);
+      if (!options.json) args.push('-table');
+      args.push(path.resolve(manifest));
+
+      // Failed dependencies are reported by the tool itself; its exit code is kept for CI
+      await spawnGoTool('verify', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Long-lived co-process: checks in as JSON lines on stdin, results out on stdout
+program
+  .command('batch')
+  .description('Read checks (dependency entries, tool calls or JSON-RPC 2.0 requests) as JSON lines on stdin and write results as JSON lines on stdout')
+  .option('-t, --timeout <duration>', 'Default timeout per check (e.g. 3s); a check\'s timeout overrides it')
+  .option('-c, --concurrency <n>', 'Checks run at once', '10')
+  .action(async (options) => {
+    try {
+      const args = ['-batch', '-concurrency', options.concurrency];
+      if (options.timeout) args.push('-timeout', options.timeout);
+
+      // stdout carries only results, so nothing else is printed here
+      await spawnGoTool('verify', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+program
+  .command('ad-check')
+  .description('Check Active Directory readiness from this subnet: DC SRV records, Kerberos, LDAP, SMB and RPC reachability, and clock skew')
+  .argument('<domain>', 'AD DNS domain, e.g. corp.example.com')
+  .option('--site <site>', 'AD site of this subnet; test its site-specific domain controllers')
+  .option('--realm <realm>', 'Kerberos realm (default: the domain in upper case)')
+  .option('--dns <server>', 'DNS server for the SRV lookups')
+  .option('--max-skew <duration>', 'Largest clock difference Kerberos tolerates', '5m')
+  .option('--max-dcs <n>', 'Most domain controllers to test', '10')
+  .option('-t, --timeout <duration>', 'Timeout per lookup and probe', '3s')
+  .option('--json', 'Print the results as JSON instead of a table', false)
+  .action(async (domain, options) => {
+    try {
+      const args = ['-max-skew', options.maxSkew, '-max-dcs', options.maxDcs, '-timeout', options.timeout];
+      if (options.site) args.push('-site', options.site);
+      if (options.realm) args.push('-realm', options.realm);
+      if (options.dns) args.push('-dns', options.dns);
+      if (!options.json) args.push('-table');
+      args.push(domain);
+
+      // A not-ready verdict exits non-zero; it is kept for CI
+      await spawnGoTool('adcheck', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Central result collector
+program
+  .command('ingest')
+  .description('Receive results pushed by remote instances or CI jobs and store them in a history file, PostgreSQL or DynamoDB')
+  .option('-l, --listen <addr>', 'Address to listen on', ':8787')
+  .option('--history <store>', 'JSON lines file, postgres://user@host:5432/db[?table=name&sslmode=require] or dynamodb://table[?region=name]', 'history.jsonl')
+  .option('--token-file <file>', 'File with one accepted bearer token per line (default: CLOUD_CONNECT_INGEST_TOKEN)')
+  .option('--read-token-file <file>', 'File with bearer tokens that may only query /grafana')
+  .option('--tls-cert <file>', 'TLS certificate file (serves HTTPS with --tls-key)')
+  .option('--tls-key <file>', 'TLS private key file')
+  .option('--max-body <bytes>', 'Largest accepted payload in bytes')
+  .action(async (options) => {
+    try {
+      const args = ['-listen', options.listen, '-history', options.history];
+      if (options.tokenFile) args.push('-token-file', options.tokenFile);
+      if (options.readTokenFile) args.push('-read-token-file', options.readTokenFile);
+      if (options.tlsCert) args.push('-tls-cert', options.tlsCert);
+      if (options.tlsKey) args.push('-tls-key', options.tlsKey);
+      if (options.maxBody) args.push('-max-body', options.maxBody);
+      // The global --sink forwards every received result to the broker
+      const { sink, sinkEncoding } = program.opts();
+      if (sink) args.push('-sink', sink, '-sink-encoding', sinkEncoding);
+
+      await spawnGoTool('ingest', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Failure injection for testing monitoring
+program
+  .command('chaos')
+  .description('Temporarily blackhole a target, add latency/loss or drop DNS to check that monitoring fires; prints the plan unless --yes')
+  .argument('<action>', 'blackhole, netem, dns-drop or cleanup')
+  .argument('[target]', 'Address the fault applies to')
+  .option('-y, --yes', 'Actually apply the fault (otherwise only print the plan)', false)
+  .option('-d, --duration <duration>', 'How long the fault stays in place before automatic cleanup', '1m')
+  .option('-p, --port <port>', 'Blackhole only this TCP/UDP port')
+  .option('--delay <duration>', 'Added latency for netem, e.g. 200ms')
+  .option('--jitter <duration>', 'Latency variation for netem')
+  .option('--loss <percent>', 'Packet loss percentage for netem')
+  .option('--iface <name>', 'Interface for netem (default: the route to the target)')
+  .action(async (action, target, options) => {
+    try {
+      const args = ['-duration', options.duration];
+      if (options.yes) args.push('-yes');
+      if (options.port) args.push('-port', options.port);
+      if (options.delay) args.push('-delay', options.delay);
+      if (options.jitter) args.push('-jitter', options.jitter);
+      if (options.loss) args.push('-loss', options.loss);
+      if (options.iface) args.push('-iface', options.iface);
+      args.push(action);
+      if (target) args.push(target);
+
+      // Ctrl+C reaches the tool too; it removes the fault before exiting
+      const ignoreInterrupt = () => {};
+      process.on('SIGINT', ignoreInterrupt);
+      try {
+        await spawnGoTool('chaos', args);
+      } finally {
+        process.off('SIGINT', ignoreInterrupt);
+      }
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Latency matrix across hosts
+program
+  .command('matrix')
+  .description('Measure latency from this host to many targets, or merge rows saved on several hosts into an N×N matrix')
+  .argument('<targets...>', 'label=host[:port],... to measure, or row files with --merge')
+  .option('-n, --name <name>', 'Name of this host as a matrix row (default: hostname)')
+  .option('-m, --mode <mode>', 'Measurement: tcp (connect time) or icmp', 'tcp')
+  .option('-p, --port <port>', 'Default TCP port for targets without one', '443')
+  .option('--count <n>', 'Samples per target', '5')
+  .option('-t, --timeout <duration>', 'Timeout per sample', '2s')
+  .option('--merge', 'Combine row files saved on several hosts into one matrix', false)
+  .option('--table', 'Render a table instead of JSON', false)
+  .action(async (targets, options) => {
+    try {
+      const args = ['-mode', options.mode, '-port', options.port, '-count', options.count, '-timeout', options.timeout];
+      if (options.name) args.push('-name', options.name);
+      if (options.merge) args.push('-merge');
+      if (options.table) args.push('-table');
+      args.push(...(options.merge ? targets.map((file) => path.resolve(file)) : targets));
+
+      await spawnGoTool('matrix', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// SSH port-forward health
+program
+  .command('tunnel')
+  .description('Check that an SSH port-forward reaches the far-side service, optionally restarting the forward to check it recovers')
+  .argument('<addr>', 'Forward listener to probe: the local side of -L, or the bastion side of -R (host:port)')
+  .option('--send <payload>', 'Payload to send through the tunnel (\\r and \\n are unescaped)')
+  .option('--expect <regex>', 'Regular expression the far-side response must match')
+  .option('--grace <duration>', 'How long a silent service must hold the connection open to count as healthy', '1s')
+  .option('--ssh <command>', 'Command that establishes the forward; started and managed by the tool')
+  .option('--reestablish', 'Kill and restart the --ssh command, checking the outage is detected and the forward recovers', false)
+  .option('--rounds <n>', 'Kill/restart rounds for --reestablish', '1')
+  .option('--ready-timeout <duration>', 'How long the forward may take to carry traffic after the command starts', '20s')
+  .option('-w, --watch <interval>', 'Probe continuously, printing state changes as JSON lines')
+  .option('--fail <n>', 'Consecutive failures before --watch restarts the --ssh command', '2')
+  .option('-t, --timeout <duration>', 'Connect and response timeout', '5s')
+  .action(async (addr, options) => {
+    try {
+      const args = ['-addr', addr, '-grace', options.grace, '-timeout', options.timeout, '-ready-timeout', options.readyTimeout];
+      if (options.send) args.push('-send', options.send);
+      if (options.expect) args.push('-expect', options.expect);
+      if (options.ssh) args.push('-ssh', options.ssh);
+      if (options.reestablish) args.push('-reestablish', '-rounds', options.rounds);
+      if (options.watch) args.push('-watch', options.watch, '-fail', options.fail);
+
+      await spawnGoTool('tunnel', args);
     } catch (error) {
       console.error(chalk.red('Error:'), error.message);
-      if (error.message.includes('ENOENT')) {
-        console.log(chalk.yellow('\nMake sure Go is installed and in your PATH'));
-        console.log('Install Go from: https://golang.org/dl/');
+    }
+  });
+
+// VPN control channel probe
+program
+  .command('vpn-probe')
+  .description('Check that OpenVPN and IKEv2 endpoints answer, with the negotiated proposal and vendor IDs')
+  .argument('<host>', 'VPN endpoint')
+  .option('--probe <list>', 'Probes to run: openvpn, ikev2 or both', 'openvpn,ikev2')
+  .option('--openvpn-port <port>', 'OpenVPN port', '1194')
+  .option('--transport <transport>', 'OpenVPN transport: udp, tcp or both', 'udp')
+  .option('--ike-port <port>', 'IKE port (4500 adds the NAT-T non-ESP marker)', '500')
+  .option('--attempts <n>', 'UDP send attempts before giving up', '2')
+  .option('-t, --timeout <duration>', 'Timeout per attempt', '3s')
+  .action(async (host, options) => {
+    try {
+      const args = [
+        '-probe', options.probe,
+        '-openvpn-port', options.openvpnPort,
+        '-transport', options.transport,
+        '-ike-port', options.ikePort,
+        '-attempts', options.attempts,
+        '-timeout', options.timeout,
+        host
+      ];
+
+      await spawnGoTool('vpnprobe', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// QUIC/HTTP3 reachability
+program
+  .command('quic-probe')
+  .description('Report UDP/443 reachability next to TCP/443, the QUIC versions offered, 0-RTT acceptance and connection migration support')
+  .argument('<target>', 'host[:port] or https:// URL')
+  .option('--sni <name>', 'Server name to send (default: the target host)')
+  .option('--alpn <protocol>', 'ALPN protocol to offer', 'h3')
+  .option('--no-early-data', 'Skip the 0-RTT resumption check')
+  .option('--no-migration', 'Skip the connection migration check')
+  .option('-t, --timeout <duration>', 'Timeout for each stage', '5s')
+  .action(async (target, options) => {
+    try {
+      const args = ['-alpn', options.alpn, '-timeout', options.timeout];
+      if (options.sni) args.push('-sni', options.sni);
+      if (!options.earlyData) args.push('-0rtt=false');
+      if (!options.migration) args.push('-migration=false');
+      args.push(target);
+
+      await spawnGoTool('quicprobe', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Declared ingress vs. what is actually open
+program
+  .command('tf-drift')
+  .description('Compare ingress rules declared in Terraform state or plan with a scan of the addresses they protect')
+  .argument('<state>', 'terraform.tfstate, `terraform show -json` output, plan JSON, or - for stdin')
+  .option('-p, --ports <ports>', 'Ports always scanned in addition to declared ones')
+  .option('--address <kind>', 'Addresses to scan: public, private or all', 'public')
+  .option('--source <ip>', 'Address the scan comes from; rules are matched against it (default: only rules open to the internet)')
+  .option('--target <mappings...>', 'Addresses for rule sets the state cannot link, as <group id, name or address>=<ip>[,<ip>]')
+  .option('--max-range <n>', 'Declared ranges wider than this are not enumerated for declared-but-not-open checks', '1024')
+  .option('-c, --concurrency <n>', 'Concurrent connection attempts', '200')
+  .option('-t, --timeout <duration>', 'Connect timeout per port', '2s')
+  .action(async (state, options) => {
+    try {
+      const args = [
+        '-address', options.address,
+        '-max-range', options.maxRange,
+        '-concurrency', options.concurrency,
+        '-timeout', options.timeout
+      ];
+      if (options.ports) args.push('-ports', options.ports);
+      if (options.source) args.push('-source', options.source);
+      for (const target of options.target || []) args.push('-target', target);
+      args.push(state === '-' ? state : path.resolve(state));
+
+      await spawnGoTool('tfdrift', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Listening socket exposure audit
+program
+  .command('self-check')
+  .description('List this host\'s listening sockets, flag those bound beyond loopback, and report which an outside agent can reach')
+  .option('--agent <host:port>', 'Selfcheck agent outside this host that probes the listeners back')
+  .option('--serve <addr>', 'Run as an agent on this address (e.g. :7790) for other hosts to audit against')
+  .option('--intended <ports>', 'Ports meant to be reachable from the agent, e.g. 22,443')
+  .option('--no-udp', 'Leave UDP sockets out of the inventory')
+  .option('-t, --timeout <duration>', 'Connect timeout per probe', '3s')
+  .action(async (options) => {
+    try {
+      const args = ['-timeout', options.timeout];
+      if (options.serve) args.push('-serve', options.serve);
+      if (options.agent) args.push('-agent', options.agent);
+      if (options.intended) args.push('-intended', options.intended);
+      if (!options.udp) args.push('-udp=false');
+
+      await spawnGoTool('selfcheck', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Shared agent and check scheduling controller
+program
+  .command('agent')
+  .description('Serve check, MTU and selfcheck requests from other hosts, or schedule checks across agents by label with failover')
+  .option('--listen <addr>', 'Address the agent listens on', ':7790')
+  .option('--name <name>', 'Agent name reported to the controller (default: hostname)')
+  .option('--labels <labels>', 'Agent labels for check selection, e.g. zone=us-east-1a,role=edge')
+  .option('--max-ops <n>', 'Requests the agent runs at once', '8')
+  .option('--token-file <file>', 'File with the shared token (default: CLOUD_CONNECT_AGENT_TOKEN)')
+  .option('--controller <config>', 'Run as the controller with this JSON config of agents and checks')
+  .option('--once', 'With --controller, run every check once and exit')
+  .action(async (options) => {
+    try {
+      const args = ['-max-ops', options.maxOps];
+      if (options.controller) {
+        args.push('-controller', options.controller);
+        if (options.once) args.push('-once');
+      } else {
+        args.push('-listen', options.listen);
+        if (options.name) args.push('-name', options.name);
+        if (options.labels) args.push('-labels', options.labels);
+      }
+      if (options.tokenFile) args.push('-token-file', options.tokenFile);
+
+      await spawnGoTool('agent', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// Blocklist and reputation feed lookups
+program
+  .command('reputation')
+  .description('Check addresses, mail hosts or this host\'s egress IP against DNS blocklists and reputation feeds, exiting non-zero when any is listed')
+  .argument('[targets...]', 'IPs, CIDRs or hostnames')
+  .option('--dnsbl <zones...>', 'DNS blocklist zones to query (default: zen.spamhaus.org)')
+  .option('--feed <feeds...>', 'Reputation feeds as name=url or a local file (default: abuse.ch Feodo Tracker and SSLBL)')
+  .option('--no-feeds', 'Skip reputation feeds, query DNSBLs only')
+  .option('--resolver <ip[:port]>', 'DNS server for blocklist queries (default: system resolver)')
+  .option('--egress', 'Also check this host\'s public egress address', false)
+  .option('--egress-url <url>', 'Service that echoes the caller\'s address, used by --egress')
+  .option('--feed-max-age <duration>', 'Re-download feeds older than this', '1h')
+  .option('--max-hosts <n>', 'Largest prefix (in addresses) that is expanded', '256')
+  .option('-c, --concurrency <n>', 'Concurrent blocklist queries', '20')
+  .option('-t, --timeout <duration>', 'Timeout per DNS query or feed download', '5s')
+  .action(async (targets, options) => {
+    try {
+      if (targets.length === 0 && !options.egress) {
+        throw new Error('Give at least one target or --egress');
       }
+
+      const args = [
+        '-feed-max-age', options.feedMaxAge,
+        '-max-hosts', options.maxHosts,
+        '-concurrency', options.concurrency,
+        '-timeout', options.timeout
+      ];
+      for (const zone of options.dnsbl || []) args.push('-dnsbl', zone);
+      for (const feed of options.feed || []) args.push('-feed', feed);
+      if (!options.feeds) args.push('-no-feeds');
+      if (options.resolver) args.push('-resolver', options.resolver);
+      if (options.egress) args.push('-egress');
+      if (options.egressUrl) args.push('-egress-url', options.egressUrl);
+      args.push(...targets);
+
+      await spawnGoTool('reputation', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
+    }
+  });
+
+// WebRTC ICE gathering against STUN/TURN servers
+program
+  .command('webrtc')
+  .description('Gather ICE candidates against STUN/TURN servers and report candidate types, NAT mapping, TURN allocation and relay round trip')
+  .argument('<servers...>', 'Server URIs: stun:host[:port], turn:host[:port][?transport=udp|tcp] or turns:host[:port]')
+  .option('-u, --user <name>', 'TURN username (long-term credentials)')
+  .option('--credential <password>', 'TURN password')
+  .option('--pings <n>', 'Data packets sent through each TURN relay (0 to skip)', '5')
+  .option('-t, --timeout <duration>', 'Timeout per STUN/TURN transaction', '5s')
+  .action(async (servers, options) => {
+    try {
+      const args = ['-pings', options.pings, '-timeout', options.timeout];
+      if (options.user) args.push('-user', options.user);
+      if (options.credential) args.push('-credential', options.credential);
+      args.push(...servers);
+
+      await spawnGoTool('webrtc', args);
+    } catch (error) {
+      console.error(chalk.red('Error:'), error.message);
     }
   });
 
@@ -843,9 +1746,37 @@ Examples:
     $ cloud-connect traceroute cloudflare.com       Trace network path
     $ cloud-connect port-scan example.com 80,443    Scan ports
     $ cloud-connect interfaces                      List network interfaces
+    $ cloud-connect interfaces --watch 5s           Alert on bond member drops
     $ cloud-connect http-test https://example.com   Test HTTP endpoints
+    $ cloud-connect pac http://wpad/wpad.dat https://example.com  Evaluate PAC file
     $ cloud-connect dns-lookup google.com all       DNS lookup
+    $ cloud-connect dns-audit example.com           Authoritative NS/SOA audit
+    $ cloud-connect dns-ecs cdn.example.com \\
+        eu=81.2.69.0/24,us=198.51.100.0/24         Answers per client subnet
+    $ cloud-connect bundle --trace example.com      Support bundle (tar.gz)
+    $ cloud-connect verify manifest.yaml            Check a service's dependencies
+    $ cloud-connect batch < checks.jsonl            Checks as JSON lines (co-process)
+    $ cloud-connect ad-check corp.example.com --site HQ  AD/Kerberos readiness
     $ cloud-connect net-grab 192.168.1.0/24        Network discovery scan
+    $ cloud-connect net-grab 10.0.0.0/22 --all-ports --within 2h --plan  Time-boxed scan plan
+    $ cloud-connect monitor 203.0.113.10:443 -f isp.ring  Availability monitor
+    $ cloud-connect monitor --report -f isp.ring    Availability report
+    $ cloud-connect monitor -m http -p -i 30s https://api.internal/health  Connection reuse over time
+    $ cloud-connect dns-failover example.com        Lookup behaviour on resolver failure
+    $ cloud-connect dns-compare example.com         Answers from several resolvers
+    $ cloud-connect http-scenario journey.json -i 60  Synthetic user journey
+    $ cloud-connect http-test https://example.com --proxy socks5://proxy:1080  Proxy check
+    $ cloud-connect ingest --history hub.jsonl      Central result collector
+    $ cloud-connect chaos blackhole 203.0.113.10    Failure injection plan (--yes applies)
+    $ cloud-connect matrix use1=10.0.0.10,usw2=10.1.0.10  Latency matrix row
+    $ cloud-connect tunnel 127.0.0.1:15432          SSH port-forward health
+    $ cloud-connect vpn-probe vpn.example.com       OpenVPN/IKEv2 endpoint probe
+    $ cloud-connect quic-probe www.example.com      QUIC/HTTP3 reachability
+    $ cloud-connect tf-drift terraform.tfstate      Declared vs. open ingress
+    $ cloud-connect self-check --intended 22,443    Listening socket exposure
+    $ cloud-connect agent --labels zone=us-east-1a  Agent for scheduled checks
+    $ cloud-connect reputation 203.0.113.25 --egress  Blocklist lookups
+    $ cloud-connect webrtc stun:stun.l.google.com:19302  ICE/STUN/TURN check
 
   AWS Connectivity Testing:
     $ cloud-connect netcon-aws                      Test AWS connectivity
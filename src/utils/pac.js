@@ -0,0 +1,299 @@
+import vm from 'vm';
+import os from 'os';
+import fs from 'fs/promises';
+import http from 'http';
+import https from 'https';
+import { fork } from 'child_process';
+import { fileURLToPath } from 'url';
+import { lookup } from 'dns/promises';
+
+/**
+ * Proxy auto-config (PAC) evaluation
+ *
+ * PAC scripts call DNS helpers synchronously, so every hostname the script
+ * can ask about is resolved up front and served from a cache.
+ */
+
+const MONTHS = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+const WEEKDAYS = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+
+// Wall-clock limit for the isolated evaluation, including process startup
+const PAC_WORKER_TIMEOUT = 5000;
+const MAX_REDIRECTS = 5;
+
+// Scheme used by the Go proxy check for each PAC directive
+const PROXY_SCHEMES = {
+  PROXY: 'http',
+  HTTP: 'http',
+  HTTPS: 'https',
+  SOCKS: 'socks5',
+  SOCKS5: 'socks5'
+};
+
+const isIPv4 = (value) => /^\d{1,3}(\.\d{1,3}){3}$/.test(value);
+
+const ipToInt = (ip) => ip.split('.').reduce((acc, octet) => ((acc << 8) | parseInt(octet, 10)) >>> 0, 0);
+
+// Pick the first non-internal IPv4 address, as browsers do for myIpAddress()
+function localIpAddress() {
+  for (const addresses of Object.values(os.networkInterfaces())) {
+    for (const address of addresses || []) {
+      if (address.family === 'IPv4' && !address.internal) {
+        return address.address;
+      }
+    }
+  }
+  return '127.0.0.1';
+}
+
+// Compare "now" against a start/end pair built from the same fields
+function inRange(now, start, end) {
+  if (!end) {
+    return start.every((value, i) => value === now[i]);
+  }
+  const key = (parts) => parts.reduce((acc, value) => acc * 100 + value, 0);
+  const [n, s, e] = [key(now), key(start), key(end)];
+  return s <= e ? n >= s && n <= e : n >= s || n <= e;
+}
+
+function splitGmt(args) {
+  const gmt = args[args.length - 1] === 'GMT';
+  return { gmt, values: gmt ? args.slice(0, -1) : args };
+}
+
+/**
+ * Build the global functions a PAC script expects
+ * @param {Object} resolved - hostname to IPv4 address cache
+ */
+export function createPacSandbox(resolved = {}) {
+  const dnsResolve = (host) => (isIPv4(host) ? host : resolved[host.toLowerCase()] || null);
+  const isPlainHostName = (host) => !host.includes('.');
+
+  return {
+    isPlainHostName,
+    dnsDomainIs: (host, domain) => host.toLowerCase().endsWith(domain.toLowerCase()),
+    localHostOrDomainIs: (host, hostdom) =>
+      host === hostdom || (isPlainHostName(host) && hostdom.startsWith(`${host}.`)),
+    isResolvable: (host) => dnsResolve(host) !== null,
+    isInNet: (host, pattern, mask) => {
+      const ip = dnsResolve(host);
+      if (!ip) return false;
+      return (ipToInt(ip) & ipToInt(mask)) >>> 0 === (ipToInt(pattern) & ipToInt(mask)) >>> 0;
+    },
+    dnsResolve,
+    convert_addr: ipToInt,
+    myIpAddress: localIpAddress,
+    dnsDomainLevels: (host) => host.split('.').length - 1,
+    shExpMatch: (str, shexp) => {
+      const pattern = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+      return new RegExp(`^${pattern}$`).test(str);
+    },
+    weekdayRange: (...args) => {
+      const { gmt, values } = splitGmt(args);
+      const today = gmt ? new Date().getUTCDay() : new Date().getDay();
+      const start = WEEKDAYS.indexOf(values[0]);
+      const end = values.length > 1 ? WEEKDAYS.indexOf(values[1]) : start;
+      return start <= end ? today >= start && today <= end : today >= start || today <= end;
+    },
+    dateRange: (...args) => {
+      const { gmt, values } = splitGmt(args);
+      const date = new Date();
+      const fields = {
+        year: gmt ? date.getUTCFullYear() : date.getFullYear(),
+        month: gmt ? date.getUTCMonth() : date.getMonth(),
+        day: gmt ? date.getUTCDate() : date.getDate()
+      };
+
+      // Each argument is a day (1-31), a month name or a year
+      const parse = (value) => {
+        if (typeof value === 'string') return ['month', MONTHS.indexOf(value.toUpperCase())];
+        return value > 31 ? ['year', value] : ['day', value];
+      };
+      const half = values.length > 1 ? values.length / 2 : values.length;
+      const build = (parts) => {
+        const parsed = Object.fromEntries(parts.map(parse));
+        return ['year', 'month', 'day'].filter((f) => f in parsed).map((f) => [f, parsed[f]]);
+      };
+
+      const start = build(values.slice(0, half));
+      const end = values.length > 1 ? build(values.slice(half)) : null;
+      const now = start.map(([field]) => fields[field]);
+      return inRange(now, start.map(([, v]) => v), end && end.map(([, v]) => v));
+    },
+    timeRange: (...args) => {
+      const { gmt, values } = splitGmt(args);
+      const date = new Date();
+      const now = gmt
+        ? [date.getUTCHours(), date.getUTCMinutes(), date.getUTCSeconds()]
+        : [date.getHours(), date.getMinutes(), date.getSeconds()];
+
+      if (values.length === 1) {
+        return now[0] === values[0];
+      }
+      // timeRange(9, 17) covers 9:00 up to but not including 17:00
+      if (values.length === 2) {
+        return inRange([now[0]], [values[0]], [values[1] - 1]);
+      }
+      const half = values.length / 2;
+      return inRange(now.slice(0, half), values.slice(0, half), values.slice(half));
+    }
+  };
+}
+
+/**
+ * Run FindProxyForURL from a PAC script
+ * @returns {string} - raw result such as "PROXY proxy:8080; DIRECT"
+ */
+export function evaluatePac(script, url, resolved = {}) {
+  const host = new URL(url).hostname;
+  const context = vm.createContext(createPacSandbox(resolved), {
+    codeGeneration: { strings: false, wasm: false }
+  });
+
+  vm.runInContext(script, context, { timeout: 1000 });
+  if (typeof context.FindProxyForURL !== 'function') {
+    throw new Error('PAC file does not define FindProxyForURL');
+  }
+
+  context.__url = url;
+  context.__host = host;
+  return String(vm.runInContext('FindProxyForURL(__url, __host)', context, { timeout: 1000 }));
+}
+
+/**
+ * Split a PAC result into ordered proxy choices
+ */
+export function parsePacResult(result) {
+  return result
+    .split(';')
+    .map((entry) => entry.trim())
+    .filter(Boolean)
+    .map((entry) => {
+      const [type, address] = entry.split(/\s+/);
+      const directive = type.toUpperCase();
+      if (directive === 'DIRECT') {
+        return { type: directive };
+      }
+      const scheme = PROXY_SCHEMES[directive];
+      return {
+        type: directive,
+        address,
+        proxyUrl: scheme && address ? `${scheme}://${address}` : null
+      };
+    });
+}
+
+/**
+ * Run evaluatePac in a separate process
+ *
+ * vm contexts share the host realm's objects, so a hostile PAC file could
+ * otherwise reach process and the filesystem. The child has an empty
+ * environment, cannot compile code from strings and is killed on timeout.
+ */
+export function evaluatePacIsolated(script, url, resolved = {}) {
+  return new Promise((resolve, reject) => {
+    const child = fork(fileURLToPath(new URL('./pacWorker.js', import.meta.url)), [], {
+      env: {},
+      execArgv: ['--disallow-code-generation-from-strings'],
+      stdio: ['ignore', 'ignore', 'ignore', 'ipc']
+    });
+
+    const timer = setTimeout(() => {
+      child.kill('SIGKILL');
+      reject(new Error('PAC evaluation timed out'));
+    }, PAC_WORKER_TIMEOUT);
+
+    child.once('message', (reply) => {
+      clearTimeout(timer);
+      if (reply.error) {
+        reject(new Error(reply.error));
+      } else {
+        resolve(reply.result);
+      }
+    });
+    child.once('error', (error) => {
+      clearTimeout(timer);
+      reject(error);
+    });
+    child.once('exit', (code) => {
+      clearTimeout(timer);
+      reject(new Error(`PAC evaluation exited with code ${code}`));
+    });
+
+    child.send({ script, url, resolved });
+  });
+}
+
+function fetchText(source, redirects = MAX_REDIRECTS) {
+  const client = source.startsWith('https:') ? https : http;
+  return new Promise((resolve, reject) => {
+    const req = client.get(source, (res) => {
+      if (res.statusCode >= 300 && res.statusCode < 400 && res.headers.location) {
+        res.resume();
+        if (redirects === 0) {
+          reject(new Error('Failed to fetch PAC file: too many redirects'));
+          return;
+        }
+        resolve(fetchText(new URL(res.headers.location, source).href, redirects - 1));
+        return;
+      }
+
+      let body = '';
+      res.setEncoding('utf8');
+      res.on('data', (chunk) => { body += chunk; });
+      res.on('end', () => {
+        if (res.statusCode !== 200) {
+          reject(new Error(`Failed to fetch PAC file: HTTP ${res.statusCode}`));
+          return;
+        }
+        resolve(body);
+      });
+    });
+    req.setTimeout(10000, () => req.destroy(new Error('Failed to fetch PAC file: timed out')));
+    req.on('error', reject);
+  });
+}
+
+async function loadPacScript(source) {
+  if (/^https?:\/\//i.test(source)) {
+    return fetchText(source);
+  }
+  return fs.readFile(source, 'utf8');
+}
+
+// Resolve the target host plus any literal hostnames the script looks up
+async function resolveHosts(script, host) {
+  const hosts = new Set([host.toLowerCase()]);
+  for (const match of script.matchAll(/(?:dnsResolve|isResolvable|isInNet)\(\s*["']([^"']+)["']/g)) {
+    hosts.add(match[1].toLowerCase());
+  }
+
+  const resolved = {};
+  await Promise.all([...hosts].filter((h) => !isIPv4(h)).map(async (h) => {
+    try {
+      resolved[h] = (await lookup(h, { family: 4 })).address;
+    } catch {
+      // Unresolvable hosts stay out of the cache, so dnsResolve returns null
+    }
+  }));
+  return resolved;
+}
+
+/**
+ * Fetch a PAC file and report which proxies it selects for a URL
+ */
+export async function evaluatePacForUrl(pacSource, url) {
+  const script = await loadPacScript(pacSource);
+  const host = new URL(url).hostname;
+  const resolved = await resolveHosts(script, host);
+  const result = await evaluatePacIsolated(script, url, resolved);
+
+  return {
+    pac: pacSource,
+    url,
+    host,
+    resolvedAddress: isIPv4(host) ? host : resolved[host.toLowerCase()] || null,
+    result,
+    proxies: parsePacResult(result)
+  };
+}
@@ -0,0 +1,20 @@
+import { evaluatePac } from './pac.js';
+
+/**
+ * PAC evaluation child process
+ *
+ * Runs with string code generation disabled, so a script that reaches a host
+ * object (this.constructor.constructor) still cannot compile code outside the
+ * vm context. The parent sends one { script, url, resolved } message and kills
+ * the process if it does not answer in time.
+ */
+
+process.once('message', ({ script, url, resolved }) => {
+  let reply;
+  try {
+    reply = { result: evaluatePac(script, url, resolved) };
+  } catch (error) {
+    reply = { error: error.message };
+  }
+  process.send(reply, () => process.exit(0));
+});
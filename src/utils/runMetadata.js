@@ -0,0 +1,280 @@
+import os from 'os';
+import fs from 'fs';
+import net from 'net';
+import path from 'path';
+import http from 'http';
+import dgram from 'dgram';
+import crypto from 'crypto';
+import { lookup } from 'dns/promises';
+import { fileURLToPath } from 'url';
+
+/**
+ * Run metadata attached to tool results
+ *
+ * Results from many machines end up side by side in one history, so each
+ * result records where it ran, which address and interface it left from,
+ * and exactly how the tool was invoked.
+ */
+
+const __dirname = path.dirname(fileURLToPath(import.meta.url));
+
+const IMDS_ADDRESS = '169.254.169.254';
+const IMDS_TIMEOUT_MS = 1000;
+
+// Connecting a UDP socket only consults the routing table, nothing is sent
+const ROUTE_PROBE_V4 = '192.0.2.1';
+
+let packageVersion;
+// Keyed by whether the instance identity was asked for
+const hostMetadata = new Map();
+
+function toolVersion() {
+  if (packageVersion === undefined) {
+    try {
+      const pkg = JSON.parse(fs.readFileSync(path.join(__dirname, '../../package.json'), 'utf8'));
+      packageVersion = pkg.version || null;
+    } catch {
+      packageVersion = null;
+    }
+  }
+  return packageVersion;
+}
+
+// Source address the kernel would pick for traffic towards target
+export function routeSource(target = ROUTE_PROBE_V4) {
+  return new Promise((resolve) => {
+    const socket = dgram.createSocket(target.includes(':') ? 'udp6' : 'udp4');
+    socket.on('error', () => {
+      socket.close();
+      resolve(null);
+    });
+    socket.connect(53, target, () => {
+      const { address } = socket.address();
+      socket.close();
+      resolve(address);
+    });
+  });
+}
+
+/**
+ * First argument that names a host the tool will contact: a URL, an IP,
+ * host:port, a CIDR or a dotted hostname. Existing files are skipped so
+ * manifest paths are not mistaken for names.
+ */
+export function targetFromArgs(args) {
+  for (const arg of args.map(String)) {
+    if (arg.startsWith('-') || fs.existsSync(arg)) continue;
+
+    let host = arg.split(',')[0];
+    if (/^[a-z][a-z0-9+.-]*:\/\//i.test(host)) {
+      try {
+        host = new URL(host).hostname.replace(/^\[|\]$/g, '');
+      } catch {
+        continue;
+      }
+    }
+    host = host.split('/')[0];
+    if (!net.isIP(host)) {
+      const hostPort = host.match(/^\[([^\]]+)\]:\d+$/) || host.match(/^([^:]+):\d+$/);
+      if (hostPort) host = hostPort[1];
+    }
+
+    if (net.isIP(host)) return host;
+    if (/^[a-z0-9-]+(\.[a-z0-9-]+)+\.?$/i.test(host) && /[a-z]/i.test(host)) return host;
+  }
+  return null;
+}
+
+// Interface the kernel routes target through, or the default route's
+async function routeInterface(target) {
+  let address = target;
+  if (address && !net.isIP(address)) {
+    try {
+      ({ address } = await lookup(address));
+    } catch {
+      address = null;
+    }
+  }
+  const source = await routeSource(address || ROUTE_PROBE_V4);
+  return interfaceForAddress(source) || (source ? { name: null, address: source } : null);
+}
+
+export function interfaceForAddress(address, interfaces = os.networkInterfaces()) {
+  if (!address) return null;
+  for (const [name, addresses] of Object.entries(interfaces)) {
+    const match = (addresses || []).find((entry) => entry.address === address);
+    if (match) {
+      return { name, address, cidr: match.cidr || null, mac: match.mac || null };
+    }
+  }
+  return null;
+}
+
+// Routable addresses of this host, skipping loopback and link-local
+export function sourceAddresses(interfaces = os.networkInterfaces()) {
+  const addresses = [];
+  for (const [name, entries] of Object.entries(interfaces)) {
+    for (const entry of entries || []) {
+      if (entry.internal || entry.address.toLowerCase().startsWith('fe80:')) continue;
+      addresses.push({ interface: name, address: entry.address, family: String(entry.family).replace(/^(\d)$/, 'IPv$1') });
+    }
+  }
+  return addresses;
+}
+
+// Mask credentials embedded in URLs (proxy URLs, basic auth) before they are stored
+export function redactArgs(args) {
+  return args.map((arg) => String(arg).replace(/(\/\/[^/:@\s]+):[^/@\s]+@/g, '$1:***@'));
+}
+
+function imdsRequest({ host, port, method = 'GET', path: requestPath, headers = {}, timeout }) {
+  return new Promise((resolve, reject) => {
+    const req = http.request({ host, port, method, path: requestPath, headers }, (res) => {
+      let body = '';
+      res.setEncoding('utf8');
+      res.on('data', (chunk) => { body += chunk; });
+      res.on('end', () => {
+        if (res.statusCode !== 200) {
+          reject(new Error(`HTTP ${res.statusCode} from ${requestPath}`));
+          return;
+        }
+        resolve(body);
+      });
+    });
+    req.setTimeout(timeout, () => req.destroy(new Error('metadata service timed out')));
+    req.on('error', reject);
+    req.end();
+  });
+}
+
+async function awsIdentity(endpoint) {
+  const token = await imdsRequest({
+    ...endpoint,
+    method: 'PUT',
+    path: '/latest/api/token',
+    headers: { 'X-aws-ec2-metadata-token-ttl-seconds': '60' }
+  });
+  const doc = JSON.parse(await imdsRequest({
+    ...endpoint,
+    path: '/latest/dynamic/instance-identity/document',
+    headers: { 'X-aws-ec2-metadata-token': token }
+  }));
+  return {
+    provider: 'aws',
+    instanceId: doc.instanceId,
+    account: doc.accountId,
+    region: doc.region,
+    zone: doc.availabilityZone,
+    instanceType: doc.instanceType,
+    imageId: doc.imageId
+  };
+}
+
+async function gcpIdentity(endpoint) {
+  const headers = { 'Metadata-Flavor': 'Google' };
+  const instance = JSON.parse(await imdsRequest({ ...endpoint, path: '/computeMetadata/v1/instance/?recursive=true', headers }));
+  const project = await imdsRequest({ ...endpoint, path: '/computeMetadata/v1/project/project-id', headers });
+  const last = (value) => (value ? String(value).split('/').pop() : undefined);
+  return {
+    provider: 'gcp',
+    instanceId: String(instance.id),
+    name: instance.name,
+    account: project,
+    zone: last(instance.zone),
+    instanceType: last(instance.machineType)
+  };
+}
+
+async function azureIdentity(endpoint) {
+  const compute = JSON.parse(await imdsRequest({
+    ...endpoint,
+    path: '/metadata/instance/compute?api-version=2021-02-01',
+    headers: { Metadata: 'true' }
+  }));
+  return {
+    provider: 'azure',
+    instanceId: compute.vmId,
+    name: compute.name,
+    account: compute.subscriptionId,
+    region: compute.location,
+    zone: compute.zone || undefined,
+    instanceType: compute.vmSize
+  };
+}
+
+/**
+ * Ask the instance metadata service who we are. All three providers share
+ * the link-local address, so they are tried together and the first valid
+ * answer wins; off-cloud this resolves to null after the timeout.
+ */
+export function fetchInstanceIdentity({ host = IMDS_ADDRESS, port = 80, timeout = IMDS_TIMEOUT_MS } = {}) {
+  const endpoint = { host, port, timeout };
+  const attempts = [awsIdentity, gcpIdentity, azureIdentity].map((lookup) => lookup(endpoint));
+  return new Promise((resolve) => {
+    let pending = attempts.length;
+    for (const attempt of attempts) {
+      attempt.then(resolve, () => {
+        pending -= 1;
+        if (pending === 0) resolve(null);
+      });
+    }
+  });
+}
+
+function sha256File(file) {
+  try {
+    return crypto.createHash('sha256').update(fs.readFileSync(file)).digest('hex');
+  } catch {
+    return null;
+  }
+}
+
+// Host facts do not change during a run, so they are gathered once
+async function collectHostMetadata(imds) {
+  const metadata = {
+    hostname: os.hostname(),
+    user: os.userInfo().username,
+    os: { platform: os.platform(), release: os.release(), arch: os.arch() },
+    node: process.version,
+    sourceIps: sourceAddresses()
+  };
+  if (imds) {
+    metadata.cloud = await fetchInstanceIdentity();
+  }
+  return metadata;
+}
+
+export async function collectRunMetadata({ tool, args = [], binary, imds = false } = {}) {
+  if (!hostMetadata.has(imds)) {
+    hostMetadata.set(imds, collectHostMetadata(imds));
+  }
+  const target = targetFromArgs(args);
+  return {
+    runId: crypto.randomBytes(8).toString('hex'),
+    startedAt: new Date().toISOString(),
+    ...(await hostMetadata.get(imds)),
+    target,
+    interface: await routeInterface(target),
+    toolVersion: toolVersion(),
+    tool,
+    binarySha256: binary ? sha256File(binary) : undefined,
+    options: redactArgs(args),
+    invocation: redactArgs(process.argv.slice(2))
+  };
+}
+
+/**
+ * Attach metadata without disturbing fields callers already read; list
+ * results are wrapped since an array has nowhere to carry it, which is why
+ * metadata is only collected when asked for with --run-metadata
+ */
+export function attachRunMetadata(result, metadata) {
+  const runMetadata = { ...metadata, durationMs: Date.now() - Date.parse(metadata.startedAt) };
+  if (Array.isArray(result)) {
+    return { results: result, runMetadata };
+  }
+  if (result && typeof result === 'object') {
+    return { ...result, runMetadata };
+  }
+  return result;
+}
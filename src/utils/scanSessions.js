@@ -0,0 +1,178 @@
+import fs from 'fs/promises';
+import path from 'path';
+import chalk from 'chalk';
+import { saveSnapshot, loadSnapshot, generateSnapshotName } from './snapshot.js';
+
+/**
+ * Named scan sessions
+ *
+ * A session keeps the full parameter set of a scan so it can be repeated
+ * identically later. Every run of a session is stored as a 'scan' snapshot;
+ * the first run becomes the baseline that later runs are compared against.
+ */
+
+export const SESSIONS_DIR = path.join(process.cwd(), 'sessions');
+
+// Options that describe how a run is displayed or recorded, not what it scans
+const RUN_ONLY_OPTIONS = ['saveSession'];
+
+const SESSION_NAME = /^[A-Za-z0-9][A-Za-z0-9._-]*$/;
+
+export const validateSessionName = (name) => {
+  if (!SESSION_NAME.test(name || '')) {
+    throw new Error(`Invalid session name "${name}": use letters, digits, '.', '_' and '-'`);
+  }
+  return name;
+};
+
+const sessionPath = (name, dir) => path.join(dir, `${validateSessionName(name)}.json`);
+
+const writeSession = async (session, dir) => {
+  await fs.mkdir(dir, { recursive: true });
+  await fs.writeFile(sessionPath(session.name, dir), JSON.stringify(session, null, 2));
+};
+
+// Save the parameters of a scan; replacing a session starts a new baseline
+export const saveSession = async (name, { command, target, options }, dir = SESSIONS_DIR) => {
+  const stored = Object.fromEntries(
+    Object.entries(options).filter(([key, value]) => !RUN_ONLY_OPTIONS.includes(key) && value !== undefined)
+  );
+  const session = {
+    name: validateSessionName(name),
+    command,
+    target,
+    options: stored,
+    createdAt: new Date().toISOString(),
+    baseline: null,
+    lastRun: null,
+    runs: 0
+  };
+  await writeSession(session, dir);
+  return session;
+};
+
+export const loadSession = async (name, dir = SESSIONS_DIR) => {
+  try {
+    return JSON.parse(await fs.readFile(sessionPath(name, dir), 'utf8'));
+  } catch (error) {
+    if (error.code === 'ENOENT') {
+      throw new Error(`Session ${name} not found`);
+    }
+    throw error;
+  }
+};
+
+export const listSessions = async (dir = SESSIONS_DIR) => {
+  let files;
+  try {
+    files = await fs.readdir(dir);
+  } catch (error) {
+    if (error.code === 'ENOENT') return [];
+    throw error;
+  }
+
+  const sessions = [];
+  for (const file of files) {
+    if (!file.endsWith('.json')) continue;
+    try {
+      sessions.push(JSON.parse(await fs.readFile(path.join(dir, file), 'utf8')));
+    } catch (error) {
+      console.error(`Error reading session ${file}:`, error.message);
+    }
+  }
+  return sessions.sort((a, b) => a.name.localeCompare(b.name));
+};
+
+/**
+ * Store the results of a session run as a scan snapshot and return the
+ * snapshot to compare against ('baseline' or 'previous'), if there is one
+ */
+export const recordSessionRun = async (name, results, against = 'baseline', dir = SESSIONS_DIR) => {
+  const session = await loadSession(name, dir);
+  const snapshot = generateSnapshotName(session.name);
+  await saveSnapshot(results, snapshot, 'scan');
+
+  const reference = against === 'previous' ? session.lastRun : session.baseline;
+  session.baseline = session.baseline || snapshot;
+  session.lastRun = snapshot;
+  session.runs += 1;
+  await writeSession(session, dir);
+
+  return { snapshot, reference: reference ? await loadSnapshot(reference) : null };
+};
+
+const hostKey = (host) => host.ip_address;
+
+// Profiled scans (e.g. --polite) wrap their hosts together with the profile
+const scanHosts = (results) => (Array.isArray(results) ? results : (results && results.hosts) || []);
+
+// Compare two sets of net-grab host results
+export const compareScanResults = (older = [], newer = []) => {
+  const respondingHosts = (results) =>
+    new Map(scanHosts(results).filter((host) => host.is_reachable).map((host) => [hostKey(host), host]));
+  const oldHosts = respondingHosts(older);
+  const newHosts = respondingHosts(newer);
+
+  const changes = {
+    hostsAdded: [],
+    hostsRemoved: [],
+    portsOpened: [],
+    portsClosed: [],
+    renamed: []
+  };
+
+  for (const [ip, host] of newHosts) {
+    const previous = oldHosts.get(ip);
+    if (!previous) {
+      changes.hostsAdded.push({ ip, hostname: host.hostname, ports: host.open_ports || [] });
+      continue;
+    }
+    const oldPorts = new Set(previous.open_ports || []);
+    const newPorts = new Set(host.open_ports || []);
+    const opened = [...newPorts].filter((port) => !oldPorts.has(port)).sort((a, b) => a - b);
+    const closed = [...oldPorts].filter((port) => !newPorts.has(port)).sort((a, b) => a - b);
+    if (opened.length > 0) changes.portsOpened.push({ ip, ports: opened });
+    if (closed.length > 0) changes.portsClosed.push({ ip, ports: closed });
+    if ((previous.hostname || '') !== (host.hostname || '')) {
+      changes.renamed.push({ ip, old: previous.hostname || null, new: host.hostname || null });
+    }
+  }
+
+  for (const [ip, host] of oldHosts) {
+    if (!newHosts.has(ip)) {
+      changes.hostsRemoved.push({ ip, hostname: host.hostname, ports: host.open_ports || [] });
+    }
+  }
+
+  return changes;
+};
+
+export const countScanChanges = (changes) =>
+  Object.values(changes).reduce((total, list) => total + list.length, 0);
+
+export const displayScanDifferences = (sessionName, reference, changes) => {
+  console.log(chalk.yellow.bold(`\nChanges in session ${sessionName} since ${reference.name}`));
+  console.log(chalk.dim(`  (${new Date(reference.timestamp).toLocaleString()})`));
+
+  if (countScanChanges(changes) === 0) {
+    console.log(chalk.green('  ✓ No changes detected'));
+    return;
+  }
+
+  const label = (entry) => (entry.hostname ? `${entry.ip} (${entry.hostname})` : entry.ip);
+  for (const entry of changes.hostsAdded) {
+    console.log(chalk.green(`  ✚ ${label(entry)} now responding${entry.ports.length ? `, open: ${entry.ports.join(', ')}` : ''}`));
+  }
+  for (const entry of changes.hostsRemoved) {
+    console.log(chalk.red(`  ✖ ${label(entry)} no longer responding`));
+  }
+  for (const entry of changes.portsOpened) {
+    console.log(chalk.green(`  ↑ ${entry.ip} opened: ${entry.ports.join(', ')}`));
+  }
+  for (const entry of changes.portsClosed) {
+    console.log(chalk.red(`  ↓ ${entry.ip} closed: ${entry.ports.join(', ')}`));
+  }
+  for (const entry of changes.renamed) {
+    console.log(chalk.blue(`  ↻ ${entry.ip} hostname ${entry.old || '-'} → ${entry.new || '-'}`));
+  }
+};
@@ -0,0 +1,54 @@
+import { describe, it, expect } from 'vitest';
+import { evaluatePac, parsePacResult, createPacSandbox } from '../src/utils/pac.js';
+
+const PAC_SCRIPT = `
+function FindProxyForURL(url, host) {
+  if (isPlainHostName(host) || dnsDomainIs(host, ".corp.example.com")) {
+    return "DIRECT";
+  }
+  if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+    return "PROXY internal-proxy:3128";
+  }
+  if (shExpMatch(url, "https://*.video.example.com/*")) {
+    return "SOCKS5 socks.example.com:1080; DIRECT";
+  }
+  return "PROXY proxy1.example.com:8080; PROXY proxy2.example.com:8080";
+}
+`;
+
+describe('PAC evaluation', () => {
+  it('returns DIRECT for plain and internal hostnames', () => {
+    expect(evaluatePac(PAC_SCRIPT, 'http://intranet/')).toBe('DIRECT');
+    expect(evaluatePac(PAC_SCRIPT, 'https://wiki.corp.example.com/page')).toBe('DIRECT');
+  });
+
+  it('uses pre-resolved addresses for isInNet', () => {
+    const result = evaluatePac(PAC_SCRIPT, 'https://db.example.net/', { 'db.example.net': '10.1.2.3' });
+    expect(result).toBe('PROXY internal-proxy:3128');
+  });
+
+  it('matches shell expressions against the URL', () => {
+    expect(evaluatePac(PAC_SCRIPT, 'https://cdn.video.example.com/stream'))
+      .toBe('SOCKS5 socks.example.com:1080; DIRECT');
+  });
+
+  it('rejects scripts without FindProxyForURL', () => {
+    expect(() => evaluatePac('var x = 1;', 'http://example.com/')).toThrow('FindProxyForURL');
+  });
+
+  it('parses results into testable proxy URLs', () => {
+    expect(parsePacResult('PROXY proxy1:8080; SOCKS5 socks:1080; SOCKS4 old:1080; DIRECT')).toEqual([
+      { type: 'PROXY', address: 'proxy1:8080', proxyUrl: 'http://proxy1:8080' },
+      { type: 'SOCKS5', address: 'socks:1080', proxyUrl: 'socks5://socks:1080' },
+      { type: 'SOCKS4', address: 'old:1080', proxyUrl: null },
+      { type: 'DIRECT' }
+    ]);
+  });
+
+  it('treats unresolved hosts as not resolvable', () => {
+    const sandbox = createPacSandbox({ 'known.example.com': '192.0.2.10' });
+    expect(sandbox.isResolvable('known.example.com')).toBe(true);
+    expect(sandbox.isResolvable('unknown.example.com')).toBe(false);
+    expect(sandbox.dnsDomainLevels('a.b.example.com')).toBe(3);
+  });
+});
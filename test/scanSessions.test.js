@@ -0,0 +1,67 @@
+import { describe, it, expect, afterEach } from 'vitest';
+import fs from 'fs';
+import os from 'os';
+import path from 'path';
+import {
+  validateSessionName,
+  saveSession,
+  loadSession,
+  listSessions,
+  compareScanResults,
+  countScanChanges
+} from '../src/utils/scanSessions.js';
+
+const host = (ip, ports = [], extra = {}) => ({ ip_address: ip, is_reachable: true, open_ports: ports, ...extra });
+
+describe('scan sessions', () => {
+  let dir;
+
+  afterEach(() => {
+    if (dir) fs.rmSync(dir, { recursive: true, force: true });
+    dir = undefined;
+  });
+
+  it('rejects names that are not safe file names', () => {
+    expect(validateSessionName('prod-dmz')).toBe('prod-dmz');
+    expect(() => validateSessionName('../etc/passwd')).toThrow('Invalid session name');
+    expect(() => validateSessionName('')).toThrow('Invalid session name');
+  });
+
+  it('stores scan parameters without run-only options', async () => {
+    dir = fs.mkdtempSync(path.join(os.tmpdir(), 'sessions-'));
+    await saveSession('prod-dmz', {
+      command: 'net-grab',
+      target: '10.20.0.0/24',
+      options: { ports: 'roles', window: ['Mon-Fri 22:00-06:00'], maxRate: undefined, saveSession: 'prod-dmz' }
+    }, dir);
+
+    const session = await loadSession('prod-dmz', dir);
+    expect(session.target).toBe('10.20.0.0/24');
+    expect(session.options).toEqual({ ports: 'roles', window: ['Mon-Fri 22:00-06:00'] });
+    expect(session.baseline).toBe(null);
+    expect((await listSessions(dir)).map((s) => s.name)).toEqual(['prod-dmz']);
+  });
+
+  it('reports a missing session by name', async () => {
+    dir = fs.mkdtempSync(path.join(os.tmpdir(), 'sessions-'));
+    await expect(loadSession('nope', dir)).rejects.toThrow('Session nope not found');
+  });
+
+  it('diffs hosts and ports between runs', () => {
+    const before = [host('10.0.0.1', [22, 443], { hostname: 'bastion' }), host('10.0.0.2', [80]), host('10.0.0.9', [], { is_reachable: false })];
+    const after = [host('10.0.0.1', [443, 8443], { hostname: 'bastion' }), host('10.0.0.3', [22])];
+
+    const changes = compareScanResults(before, after);
+    expect(changes.hostsAdded).toEqual([{ ip: '10.0.0.3', hostname: undefined, ports: [22] }]);
+    expect(changes.hostsRemoved.map((h) => h.ip)).toEqual(['10.0.0.2']);
+    expect(changes.portsOpened).toEqual([{ ip: '10.0.0.1', ports: [8443] }]);
+    expect(changes.portsClosed).toEqual([{ ip: '10.0.0.1', ports: [22] }]);
+    expect(countScanChanges(changes)).toBe(4);
+    expect(countScanChanges(compareScanResults(after, after))).toBe(0);
+  });
+
+  it('reads hosts from profiled scan results', () => {
+    const polite = { scan_profile: { name: 'polite' }, hosts: [host('10.0.0.1', [22])] };
+    expect(compareScanResults([host('10.0.0.1', [22, 80])], polite).portsClosed).toEqual([{ ip: '10.0.0.1', ports: [80] }]);
+  });
+});